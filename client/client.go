@@ -1,28 +1,57 @@
+//Package chclient is the penguin client, which Go programs
+//can embed as well. A Client is configured with plain values
+//(no flags are parsed), runs until its context is cancelled,
+//and logs and dials as set in its Config:
+//
+//	c, err := chclient.NewClient(&chclient.Config{
+//		Server:      "https://penguin.example.com",
+//		Fingerprint: "...",
+//		Remotes:     []string{"3000:intranet.internal:80"},
+//		Logger:      cio.NewLogger("myapp"),
+//	})
+//	if err != nil {
+//		...
+//	}
+//	if err := c.Start(ctx); err != nil {
+//		...
+//	}
+//	err = c.Wait()
+//
+//The exported API of chclient, chserver and tunnel follows
+//semantic versioning: within a major version it only grows,
+//e.g. with new Config fields whose zero values keep the
+//previous behaviour. See tunnelkit for dialing and listening
+//through a server without any remotes.
 package chclient
 
 import (
 	"context"
 	"crypto/md5"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	chshare "github.com/myzhang1029/penguin/share"
 	"github.com/myzhang1029/penguin/share/ccrypto"
 	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/cmetrics"
 	"github.com/myzhang1029/penguin/share/cnet"
 	"github.com/myzhang1029/penguin/share/settings"
 	"github.com/myzhang1029/penguin/share/tunnel"
+	"github.com/quic-go/quic-go/http3"
+	utls "github.com/refraction-networking/utls"
+	"github.com/yosida95/uritemplate/v3"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/proxy"
@@ -33,16 +62,174 @@ import (
 type Config struct {
 	Fingerprint      string
 	Auth             string
+	Psk              string
+	PskTransport     string
 	KeepAlive        time.Duration
 	MaxRetryCount    int
 	MaxRetryInterval time.Duration
+	//MinRetryInterval, RetryFactor and RetryJitter tune the
+	//backoff between reconnects, see backoff.Backoff
+	MinRetryInterval time.Duration
+	RetryFactor      float64
+	RetryJitter      bool
 	Server           string
+	WsPath           string
 	Proxy            string
 	Remotes          []string
 	Headers          http.Header
 	TLS              TLSConfig
 	DialContext      func(ctx context.Context, network, addr string) (net.Conn, error)
 	Verbose          bool
+	//RetryOn is "network-only" to give up right away when
+	//the server rejects the client or its key, or "all"
+	RetryOn string
+	//ProxyNTLM authenticates to the HTTP proxy with NTLM,
+	//using the "domain\user:pass" of the proxy URL
+	ProxyNTLM bool
+	//ProxyNegotiate authenticates to the HTTP proxy with
+	//Kerberos (SPNEGO), using the system credential cache
+	//or the keytab in $KRB5_CLIENT_KTNAME
+	ProxyNegotiate bool
+	//PAC is the URL or path of a proxy auto-config file,
+	//which chooses the proxy for each connection attempt
+	PAC string
+	//AuthPrompt answers questions asked by the server during
+	//keyboard-interactive authentication, other than the
+	//password (e.g. a verification code)
+	AuthPrompt func(question string, echo bool) (string, error)
+	//Token returns a bearer token (e.g. from an OIDC login),
+	//which is sent in the Authorization header of every
+	//connection attempt
+	Token func(ctx context.Context) (string, error)
+	//Failover are further servers which are tried in
+	//order when the connection to Server fails
+	Failover []string
+	//Failback, if set, is how often to check whether Server
+	//has recovered while connected to a failover server
+	Failback time.Duration
+	//Pool are further servers which the client stays
+	//connected to alongside Server, spreading new streams
+	//over all of the connections
+	Pool []string
+	//Control is the address of the control API, through which
+	//remotes are listed, added and removed while the client is
+	//running. Either a TCP address or a unix socket "unix:<path>".
+	Control string
+	//Logger, if set, is forked for the client's logs,
+	//which otherwise go to stderr
+	Logger *cio.Logger
+	//Dial, if set, connects to the server or the proxy
+	//instead of net.Dialer
+	Dial cnet.DialFunc
+	//OnConnect, if set, is called in the background whenever
+	//a connection to a server is established. OnDisconnect is
+	//called when the connection ends, after OnConnect has
+	//returned, and holds up reconnecting until it returns.
+	OnConnect    func(Session)
+	OnDisconnect func(sess Session, err error)
+	//Metrics receives the client's instrumentation. When it
+	//is a *cmetrics.Prometheus, it is also served on the
+	//control API at /metrics.
+	Metrics cmetrics.Sink
+	//KeepAliveTimeout closes the connection when a ping is
+	//not replied to within it. It is negotiated with the
+	//server, like KeepAlive, taking the shorter of both.
+	KeepAliveTimeout time.Duration
+	//PskPath derives a fresh websocket upgrade path from
+	//Psk for each connection, see ccrypto.PSKPath
+	PskPath bool
+	//Subprotocol is the websocket subprotocol, which the
+	//server must accept, defaulting to the protocol version
+	Subprotocol string
+	//HeadersFile is a file of request headers, one
+	//"Name: value" per line, whose values are text/template
+	//templates rendered for each connection. Headers also
+	//set in Headers are left out.
+	HeadersFile string
+	//UDP limits the UDP flows of the remotes, the client
+	//listens for forward ones and relays reverse ones
+	UDP tunnel.UDPConfig
+	//StdioFramed multiplexes the stdio remotes over stdin and
+	//stdout with cio.Framer, indexing them in their order.
+	//It is implied by more than one stdio remote.
+	StdioFramed bool
+	//ListenerAllow restricts the clients of the local
+	//listeners to a comma separated list of networks
+	//(CIDR notation) or IP addresses
+	ListenerAllow string
+	//ListenerSocksAuth, as <user>:<pass>, requires SOCKS5
+	//username/password authentication on the local socks
+	//listeners
+	ListenerSocksAuth string
+	//Compress offers the server to compress the payloads of
+	//the channels with these algorithms, in order of
+	//preference, see cnet.Compressions
+	Compress []string
+	//Transport carries the SSH connection to the server,
+	//either "websocket", "quic" or "webtransport", which
+	//connect to the server's QUIC port instead, "http2", a
+	//long-lived HTTP/2 request without websockets, "grpc",
+	//the same framed as a gRPC bidirectional stream, "poll",
+	//pairs of plain upload and download requests, "dns",
+	//queries of the zone given by the host of the server URL,
+	//delegated to the server's DNSZone, "icmp", pings of
+	//the server's host (requires CAP_NET_RAW), "tls", SSH
+	//directly over TLS to the server's RawTLSPort, or "kcp", a
+	//reliable stream over UDP to the server's KCPPort, for
+	//lossy or high-latency links. By default,
+	//websockets are used, falling back to "poll" when the
+	//upgrade is refused.
+	Transport string
+	//DNSResolver is the resolver, as <host>[:<port>], which
+	//the DNS transport queries, by default the first one of
+	///etc/resolv.conf
+	DNSResolver string
+	//Bond is the number of parallel connections to the server,
+	//over which new streams are spread as with Pool, when the
+	//throughput of each is capped. Only the first one carries
+	//the reverse remotes.
+	Bond int
+	//Resume reconnects for up to this long when the connection
+	//drops, resuming the session on the server so that the
+	//forwarded connections survive. The server must resume
+	//sessions for at least as long, and the keepalive timeout
+	//also bounds it. Sessions are not resumed by default.
+	Resume time.Duration
+	//SSH restricts the ciphers, key exchanges and MACs of the
+	//SSH connection, which the server must also allow
+	SSH settings.SSHAlgorithms
+	//Padding pads the websocket messages of both sides to
+	//bucketed sizes, and has them send dummy messages at random
+	//intervals averaging this duration, to hide the sizes and
+	//timing of the tunnelled traffic. Off by default.
+	Padding time.Duration
+	//MASQUE is the URI template of a MASQUE relay (RFC 9298),
+	//e.g. https://relay.example/.well-known/masque/udp/{target_host}/{target_port}/,
+	//which relays the UDP of the quic, webtransport and kcp
+	//transports to the server. The relay's certificate is
+	//verified with the CA of the TLS options, unless they skip
+	//verification. Relays which require authentication are
+	//not supported.
+	MASQUE string
+	//KeepAliveMisses is the number of keepalive timeouts in a
+	//row after which the server is declared dead, one by
+	//default. It is negotiated like KeepAlive.
+	KeepAliveMisses int
+	//WsCompress negotiates permessage-deflate (RFC 7692) on
+	//the websocket, if the server allows it. Since the SSH
+	//layer encrypts the data beforehand, little of it
+	//compresses, unlike with Compress.
+	WsCompress bool
+	//TCPKeepAlive is the TCP keepalive period of the
+	//connections accepted by remotes and dialed to the
+	//targets of reverse remotes. 0 keeps the default of
+	//Go (15s), a negative period disables keepalives.
+	TCPKeepAlive time.Duration
+	//PskLegacy also sends Psk in plain text in the
+	//X-Penguin-Psk header, for servers which predate
+	//the authenticator. Anyone who observes the
+	//header can replay it.
+	PskLegacy bool
 }
 
 //TLSConfig for a Client
@@ -52,6 +239,21 @@ type TLSConfig struct {
 	Cert       string
 	Key        string
 	ServerName string
+	//Pins are SPKI SHA256 hashes in base64, of which a
+	//certificate of the server's chain must have one
+	Pins []string
+	//PKCS12 is a .p12 bundle of the client certificate and
+	//key, used instead of Cert and Key, and PKCS12Password
+	//its password
+	PKCS12         string
+	PKCS12Password string
+	//Mimic is the browser whose TLS ClientHello is imitated:
+	//chrome, firefox, ios or randomized
+	Mimic string
+	//Keystore is the common name or SHA1 thumbprint of the
+	//client certificate in the OS keystore, whose key signs
+	//in place. Only the Windows certificate store is supported.
+	Keystore string
 }
 
 //Client represents a client instance
@@ -62,25 +264,72 @@ type Client struct {
 	sshConfig *ssh.ClientConfig
 	tlsConfig *tls.Config
 	proxyURL  *url.URL
-	server    string
+	pac       *pacFile
+	headers   *headersFile
+	mimic     *utls.ClientHelloID
+	servers   []endpoint
+	pool      []endpoint
 	connCount cnet.ConnCount
+	faults    *cnet.Faults
+	ctx       context.Context
 	stop      func()
 	eg        *errgroup.Group
 	tunnel    *tunnel.Tunnel
+	metrics   cmetrics.Sink
+	//connected counts the live connections,
+	//and connections all of the connections
+	connected   int32
+	connections int32
+	//remotesMut guards the remotes and the
+	//connection they were negotiated on
+	remotesMut sync.Mutex
+	sshConn    ssh.Conn
+	//remoteOptions is set when the server of
+	//sshConn honours the options of remotes
+	remoteOptions bool
+	//noResume is set once the server
+	//refused to resume sessions
+	noResume int32
+	//tlsSessions are shared by the
+	//TLS configurations of all transports
+	tlsSessions tls.ClientSessionCache
+	//verifiedKey is the marshalled host key
+	//which matched the fingerprint
+	verifiedKey atomic.Value
+	//masque is the template of the relay, and
+	//masqueTLS its TLS configuration
+	masque    *uritemplate.Template
+	masqueTLS *tls.Config
+	//subprotocols are offered to
+	//the server, newest first
+	subprotocols []string
+
+	//listenerCount numbers in-process listeners
+	listenerCount int32
 }
 
-//NewClient creates a new client instance
-func NewClient(c *Config) (*Client, error) {
+//endpoint is a server the client can connect to
+type endpoint struct {
+	//url is the websocket URL and path its upgrade
+	//path, which is covered by the PSK authenticator
+	url  string
+	path string
+	host string
+}
+
+//parseServer converts a server URL into an endpoint
+func parseServer(server, wsPath string) (endpoint, error) {
 	//apply default scheme
-	if !strings.HasPrefix(c.Server, "http") {
-		c.Server = "http://" + c.Server
+	if !strings.HasPrefix(server, "http") {
+		server = "http://" + server
 	}
-	if c.MaxRetryInterval < time.Second {
-		c.MaxRetryInterval = 5 * time.Minute
-	}
-	u, err := url.Parse(c.Server)
+	u, err := url.Parse(server)
 	if err != nil {
-		return nil, err
+		return endpoint{}, err
+	}
+	//override the websocket upgrade path
+	if wsPath != "" {
+		u.Path = "/" + strings.TrimPrefix(wsPath, "/")
 	}
 	//swap to websockets scheme
 	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
@@ -92,43 +341,174 @@ func NewClient(c *Config) (*Client, error) {
 			u.Host = u.Host + ":80"
 		}
 	}
+	e := endpoint{url: u.String(), path: u.Path, host: u.Host}
+	if e.path == "" {
+		e.path = "/"
+	}
+	return e, nil
+}
+
+//NewClient creates a new client instance
+func NewClient(c *Config) (*Client, error) {
+	//apply default scheme
+	if !strings.HasPrefix(c.Server, "http") {
+		c.Server = "http://" + c.Server
+	}
+	if c.MaxRetryInterval < time.Second {
+		c.MaxRetryInterval = 5 * time.Minute
+	}
+	switch c.RetryOn {
+	case "", "all", "network-only":
+	default:
+		return nil, fmt.Errorf("invalid retry policy '%s'", c.RetryOn)
+	}
+	if c.RetryFactor != 0 && c.RetryFactor < 1 {
+		return nil, errors.New("retry factor must be at least 1")
+	}
+	if c.MinRetryInterval > c.MaxRetryInterval {
+		return nil, errors.New("minimum retry interval exceeds the maximum")
+	}
+	if c.Bond < 0 {
+		return nil, errors.New("the number of bonded connections cannot be negative")
+	}
+	if len(c.Pool) > 0 && len(c.Failover) > 0 {
+		return nil, errors.New("a server pool cannot be combined with failover servers")
+	}
+	var servers, pool []endpoint
+	useTLS := false
+	for i, server := range append(append([]string{c.Server}, c.Failover...), c.Pool...) {
+		e, err := parseServer(server, c.WsPath)
+		if err != nil {
+			return nil, err
+		}
+		if i > len(c.Failover) {
+			pool = append(pool, e)
+		} else {
+			servers = append(servers, e)
+		}
+		useTLS = useTLS || strings.HasPrefix(e.url, "wss:")
+	}
+	switch c.PskTransport {
+	case "", "header", "cookie", "query":
+	default:
+		return nil, fmt.Errorf("invalid PSK transport '%s'", c.PskTransport)
+	}
+	if c.ProxyNTLM && c.ProxyNegotiate {
+		return nil, errors.New("cannot authenticate to the proxy with both NTLM and Negotiate")
+	}
+	if c.PskPath {
+		if c.Psk == "" {
+			return nil, errors.New("PSK derived paths require a PSK")
+		}
+		if c.WsPath != "" {
+			return nil, errors.New("cannot use both a websocket path and PSK derived paths")
+		}
+	}
+	//the default offers all of the supported protocol versions
+	subprotocols := []string{c.Subprotocol}
+	if c.Subprotocol == "" {
+		c.Subprotocol = chshare.ProtocolVersion
+		subprotocols = chshare.ProtocolVersions()
+	}
+	for _, algorithm := range c.Compress {
+		if settings.NegotiateCompression([]string{algorithm}, cnet.Compressions) == "" {
+			return nil, fmt.Errorf("unsupported compression '%s'", algorithm)
+		}
+	}
 	hasReverse := false
 	hasSocks := false
-	hasStdio := false
+	hasUnix := false
+	hasSerial := false
+	var tlsCAs []string
+	stdioCount := 0
 	client := &Client{
-		Logger: cio.NewLogger("client"),
-		config: c,
+		config:       c,
+		subprotocols: subprotocols,
 		computed: settings.Config{
-			Version: chshare.BuildVersion,
+			Version:     chshare.BuildVersion,
+			Protocol:    chshare.ProtocolVersion,
+			MinProtocol: chshare.MinProtocolVersion,
+			Reply:       true,
+			KeepAlive: &settings.KeepAlive{
+				Interval: c.KeepAlive,
+				Timeout:  c.KeepAliveTimeout,
+				Misses:   c.KeepAliveMisses,
+			},
+			Compress: c.Compress,
 		},
-		server:    u.String(),
-		tlsConfig: nil,
+		servers:     servers,
+		pool:        pool,
+		tlsConfig:   nil,
+		tlsSessions: tls.NewLRUClientSessionCache(0),
+		metrics:     cmetrics.OrNop(c.Metrics),
 	}
 	//set default log level
-	client.Logger.Info = c.Verbose
+	if c.Logger != nil {
+		client.Logger = c.Logger.Fork("client")
+	} else {
+		client.Logger = cio.NewLogger("client")
+	}
+	if c.Verbose {
+		client.Logger.Info = true
+	}
+	//debug: misbehave like a broken middlebox
+	if spec := settings.Env("FAULTS"); spec != "" {
+		f, err := cnet.ParseFaults(spec)
+		if err != nil {
+			return nil, err
+		}
+		client.Infof("WARNING: injecting faults into connections (%s)", spec)
+		client.faults = f
+	}
 	//configure tls
-	if u.Scheme == "wss" {
+	if useTLS {
 		tc := &tls.Config{}
 		if c.TLS.ServerName != "" {
 			tc.ServerName = c.TLS.ServerName
 		}
 		//certificate verification config
+		if c.TLS.SkipVerify && c.TLS.CA != "" {
+			return nil, errors.New("cannot use both TLS CA and skip verification")
+		}
 		if c.TLS.SkipVerify {
 			client.Infof("TLS verification disabled")
 			tc.InsecureSkipVerify = true
 		} else if c.TLS.CA != "" {
-			rootCAs := x509.NewCertPool()
-			if b, err := ioutil.ReadFile(c.TLS.CA); err != nil {
-				return nil, fmt.Errorf("failed to load file: %s", c.TLS.CA)
-			} else if ok := rootCAs.AppendCertsFromPEM(b); !ok {
-				return nil, fmt.Errorf("failed to decode PEM: %s", c.TLS.CA)
-			} else {
-				client.Infof("TLS verification using CA %s", c.TLS.CA)
-				tc.RootCAs = rootCAs
+			rootCAs, err := ccrypto.LoadCertPool(c.TLS.CA)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS CA: %s", err)
 			}
+			client.Infof("TLS verification using CA %s", c.TLS.CA)
+			tc.RootCAs = rootCAs
+		}
+		if len(c.TLS.Pins) > 0 {
+			verify, err := verifyPins(c.TLS.Pins)
+			if err != nil {
+				return nil, err
+			}
+			tc.VerifyPeerCertificate = verify
+			client.Infof("TLS server pinned to %d key(s)", len(c.TLS.Pins))
 		}
 		//provide client cert and key pair for mtls
-		if c.TLS.Cert != "" && c.TLS.Key != "" {
+		if c.TLS.Keystore != "" {
+			if c.TLS.PKCS12 != "" || c.TLS.Cert != "" || c.TLS.Key != "" {
+				return nil, errors.New("cannot use both the OS keystore and a PKCS#12 bundle or cert and key")
+			}
+			c, err := loadKeystore(c.TLS.Keystore)
+			if err != nil {
+				return nil, fmt.Errorf("error loading client certificate from the OS keystore: %v", err)
+			}
+			tc.Certificates = []tls.Certificate{c}
+		} else if c.TLS.PKCS12 != "" {
+			if c.TLS.Cert != "" || c.TLS.Key != "" {
+				return nil, errors.New("cannot use both a PKCS#12 bundle and cert and key")
+			}
+			c, err := loadPKCS12(c.TLS.PKCS12, c.TLS.PKCS12Password)
+			if err != nil {
+				return nil, fmt.Errorf("error loading client PKCS#12 bundle: %v", err)
+			}
+			tc.Certificates = []tls.Certificate{c}
+		} else if c.TLS.Cert != "" && c.TLS.Key != "" {
 			c, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
 			if err != nil {
 				return nil, fmt.Errorf("error loading client cert and key pair: %v", err)
@@ -137,59 +517,205 @@ func NewClient(c *Config) (*Client, error) {
 		} else if c.TLS.Cert != "" || c.TLS.Key != "" {
 			return nil, fmt.Errorf("please specify client BOTH cert and key")
 		}
+		if c.TLS.Mimic != "" {
+			id, ok := tlsMimics[c.TLS.Mimic]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLS ClientHello to mimic: %s", c.TLS.Mimic)
+			}
+			client.mimic = &id
+			client.Infof("TLS ClientHello mimics %s", c.TLS.Mimic)
+		}
+		//reconnections resume the TLS session
+		tc.ClientSessionCache = client.tlsSessions
 		client.tlsConfig = tc
 	}
 	//validate remotes
 	for _, s := range c.Remotes {
-		r, err := settings.DecodeRemote(s)
+		rs, err := settings.DecodeRemotes(s)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode remote '%s': %s", s, err)
 		}
-		if r.Socks {
-			hasSocks = true
-		}
-		if r.Reverse {
-			hasReverse = true
-		}
-		if r.Stdio {
-			if hasStdio {
-				return nil, errors.New("only one stdio is allowed")
+		for _, r := range rs {
+			//http and transparent proxies dial through socks too
+			if r.Socks || r.HTTPProxy || r.Transparent {
+				hasSocks = true
+			}
+			if r.Reverse {
+				hasReverse = true
+			}
+			if r.Stdio {
+				stdioCount++
+			}
+			if r.Reverse && settings.IsSocket(r.RemoteProto) {
+				hasUnix = true
+			}
+			if r.Reverse && r.RemoteProto == "serial" {
+				hasSerial = true
+			}
+			if r.TLSCA != "" {
+				tlsCAs = append(tlsCAs, r.TLSCA)
+			}
+			//confirm non-reverse tunnel is available
+			if !r.Reverse && !r.Stdio && !r.Tun && !r.CanListen() {
+				return nil, fmt.Errorf("client cannot listen on %s", r.String())
 			}
-			hasStdio = true
-		}
-		//confirm non-reverse tunnel is available
-		if !r.Reverse && !r.Stdio && !r.CanListen() {
-			return nil, fmt.Errorf("client cannot listen on %s", r.String())
 		}
-		client.computed.Remotes = append(client.computed.Remotes, r)
+		client.computed.Remotes = append(client.computed.Remotes, rs...)
 	}
 	//outbound proxy
 	if p := c.Proxy; p != "" {
-		client.proxyURL, err = url.Parse(p)
+		var err error
+		//allow "domain\user" without escaping
+		client.proxyURL, err = url.Parse(strings.Replace(p, `\`, "%5C", -1))
 		if err != nil {
 			return nil, fmt.Errorf("invalid proxy URL (%s)", err)
 		}
 	}
+	if c.PAC != "" {
+		if c.Proxy != "" {
+			return nil, errors.New("cannot use both a proxy and a PAC file")
+		}
+		client.pac = &pacFile{location: c.PAC}
+	}
+	if c.Padding < 0 {
+		return nil, errors.New("the padding interval cannot be negative")
+	}
+	if c.Padding > 0 && c.Transport != "" && c.Transport != "websocket" {
+		return nil, fmt.Errorf("cannot pad the messages of the %s transport", c.Transport)
+	}
+	if c.WsCompress && c.Transport != "" && c.Transport != "websocket" {
+		return nil, fmt.Errorf("cannot deflate the messages of the %s transport", c.Transport)
+	}
+	if c.WsCompress && c.Padding > 0 {
+		//the compressed sizes would reveal those of the data
+		return nil, errors.New("cannot deflate padded messages")
+	}
+	switch c.Transport {
+	case "", "websocket":
+	case "poll":
+		if c.PAC != "" {
+			return nil, errors.New("cannot use a PAC file with the poll transport")
+		}
+	case "quic", "http2", "grpc", "webtransport", "dns", "icmp", "tls", "kcp":
+		if c.Proxy != "" || c.PAC != "" {
+			return nil, fmt.Errorf("cannot use a proxy with the %s transport", c.Transport)
+		}
+		if c.TLS.Mimic != "" {
+			return nil, fmt.Errorf("cannot mimic a ClientHello with the %s transport", c.Transport)
+		}
+	default:
+		return nil, fmt.Errorf("invalid transport '%s'", c.Transport)
+	}
+	if c.MASQUE != "" {
+		if c.Transport != "quic" && c.Transport != "webtransport" && c.Transport != "kcp" {
+			return nil, errors.New("MASQUE relays only carry the quic, webtransport and kcp transports")
+		}
+		template, err := uritemplate.New(c.MASQUE)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MASQUE template: %s", err)
+		}
+		client.masque = template
+		//the CA or skipping verification apply to the relay
+		//too, but the pins and client certificates do not
+		tc := &tls.Config{NextProtos: []string{http3.NextProtoH3}}
+		if c.TLS.SkipVerify {
+			tc.InsecureSkipVerify = true
+		} else if c.TLS.CA != "" {
+			if tc.RootCAs, err = ccrypto.LoadCertPool(c.TLS.CA); err != nil {
+				return nil, fmt.Errorf("failed to load TLS CA: %s", err)
+			}
+		}
+		client.masqueTLS = tc
+		client.Infof("relaying through MASQUE %s", c.MASQUE)
+	}
+	//slow transports tell the server, so that keepalives adapt
+	switch c.Transport {
+	case "dns":
+		client.computed.Throughput = cnet.DNSThroughput
+	case "icmp":
+		client.computed.Throughput = cnet.ICMPThroughput
+	}
+	if c.HeadersFile != "" {
+		h, err := loadHeadersFile(c.HeadersFile)
+		if err != nil {
+			return nil, err
+		}
+		client.headers = h
+	}
 	//ssh auth and config
 	user, pass := settings.ParseAuth(c.Auth)
 	client.sshConfig = &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(pass),
+			ssh.KeyboardInteractive(client.answerChallenge(pass)),
+		},
 		ClientVersion:   "SSH-" + chshare.ProtocolVersion + "-client",
 		HostKeyCallback: client.verifyServer,
 		Timeout:         settings.EnvDuration("SSH_TIMEOUT", 30*time.Second),
 	}
+	if err := c.SSH.Apply(&client.sshConfig.Config); err != nil {
+		return nil, err
+	}
 	//prepare client tunnel
+	allow, err := settings.ParseNetworks(c.ListenerAllow)
+	if err != nil {
+		return nil, err
+	}
+	listeners := tunnel.ListenerConfig{Allow: allow}
+	if c.ListenerSocksAuth != "" {
+		listeners.SocksUser, listeners.SocksPass = settings.ParseAuth(c.ListenerSocksAuth)
+		if listeners.SocksUser == "" {
+			return nil, errors.New("listener socks auth must be <user>:<pass>")
+		}
+	}
+	var framer *cio.Framer
+	if stdioCount > 1 || (stdioCount == 1 && c.StdioFramed) {
+		framer = cio.NewFramer(os.Stdin, os.Stdout)
+	}
 	client.tunnel = tunnel.New(tunnel.Config{
 		Logger:    client.Logger,
 		Inbound:   true, //client always accepts inbound
 		Outbound:  hasReverse,
 		Socks:     hasReverse && hasSocks,
 		KeepAlive: client.config.KeepAlive,
+		Metrics:   client.metrics,
+		//the remotes of a client are few enough to label
+		RemoteMetrics: true,
+		UDP:           client.config.UDP,
+		Framer:        framer,
+		Listeners:     listeners,
+		TCPKeepAlive:  client.config.TCPKeepAlive,
+		Unix:          hasUnix,
+		Serial:        hasSerial,
+		TLSCAs:        tlsCAs,
 	})
 	return client, nil
 }
 
+//answerChallenge answers keyboard-interactive questions
+//with the password, prompting for anything else
+func (c *Client) answerChallenge(pass string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			if strings.HasPrefix(strings.ToLower(q), "password") {
+				answers[i] = pass
+				continue
+			}
+			if c.config.AuthPrompt == nil {
+				return nil, fmt.Errorf("server asked '%s', try --auth <user>:<pass>:<code>", strings.TrimSpace(q))
+			}
+			a, err := c.config.AuthPrompt(q, echos[i])
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = a
+		}
+		return answers, nil
+	}
+}
+
 //Run starts client and blocks while connected
 func (c *Client) Run() error {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -205,11 +731,20 @@ func (c *Client) verifyServer(hostname string, remote net.Addr, key ssh.PublicKe
 	if expect == "" {
 		return nil
 	}
+	//the same key was already verified by an earlier connection
+	marshalled := string(key.Marshal())
+	if c.verifiedKey.Load() == marshalled {
+		return nil
+	}
 	got := ccrypto.FingerprintKey(key)
 	_, err := base64.StdEncoding.DecodeString(expect)
 	if _, ok := err.(base64.CorruptInputError); ok {
 		c.Logger.Infof("specified deprecated MD5 fingerprint (%s), please update to the new SHA256 fingerprint: %s", expect, got)
-		return c.verifyLegacyFingerprint(key)
+		if err := c.verifyLegacyFingerprint(key); err != nil {
+			return err
+		}
+		c.verifiedKey.Store(marshalled)
+		return nil
 	} else if err != nil {
 		return fmt.Errorf("error decoding fingerprint: %w", err)
 	}
@@ -218,6 +753,7 @@ func (c *Client) verifyServer(hostname string, remote net.Addr, key ssh.PublicKe
 	}
 	//overwrite with complete fingerprint
 	c.Infof("fingerprint %s", got)
+	c.verifiedKey.Store(marshalled)
 	return nil
 }
 
@@ -242,15 +778,41 @@ func (c *Client) Start(ctx context.Context) error {
 	c.stop = cancel
 	eg, ctx := errgroup.WithContext(ctx)
 	c.eg = eg
+	c.ctx = ctx
 	via := ""
 	if c.proxyURL != nil {
 		via = " via " + c.proxyURL.String()
+	} else if c.pac != nil {
+		via = " via PAC " + c.pac.location
+	}
+	if c.config.Control != "" {
+		if err := c.listenControl(ctx); err != nil {
+			cancel()
+			return err
+		}
+	}
+	c.Infof("connecting to %s%s\n", c.servers[0].url, via)
+	for _, e := range c.servers[1:] {
+		c.Infof("failover server %s", e.url)
 	}
-	c.Infof("connecting to %s%s\n", c.server, via)
 	//connect to penguin server
 	eg.Go(func() error {
-		return c.connectionLoop(ctx)
+		return c.connectionLoop(ctx, c.servers, false)
 	})
+	//with its bonded connections
+	for i := 1; i < c.config.Bond; i++ {
+		eg.Go(func() error {
+			return c.connectionLoop(ctx, c.servers, true)
+		})
+	}
+	//and to the rest of the pool
+	for _, e := range c.pool {
+		servers := []endpoint{e}
+		c.Infof("connecting to %s%s\n", e.url, via)
+		eg.Go(func() error {
+			return c.connectionLoop(ctx, servers, false)
+		})
+	}
 	//listen sockets
 	eg.Go(func() error {
 		clientInbound := c.computed.Remotes.Reversed(false)
@@ -265,6 +827,20 @@ func (c *Client) Start(ctx context.Context) error {
 func (c *Client) setProxy(u *url.URL, d *websocket.Dialer) error {
 	// CONNECT proxy
 	if !strings.HasPrefix(u.Scheme, "socks") {
+		var newAuth func(*url.URL) (proxyAuth, error)
+		if c.config.ProxyNTLM {
+			newAuth = newNTLMAuth
+		} else if c.config.ProxyNegotiate {
+			newAuth = newNegotiateAuth
+		}
+		if newAuth != nil {
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return fmt.Errorf("unsupported proxy type for authentication: %s://", u.Scheme)
+			}
+			cd := &connectDialer{proxy: u, newAuth: newAuth, forward: c.config.Dial}
+			d.NetDialContext = cd.DialContext
+			return nil
+		}
 		d.Proxy = func(*http.Request) (*url.URL, error) {
 			return u, nil
 		}
@@ -285,14 +861,223 @@ func (c *Client) setProxy(u *url.URL, d *websocket.Dialer) error {
 			Password: pass,
 		}
 	}
-	socksDialer, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+	var forward proxy.Dialer = proxy.Direct
+	if c.config.Dial != nil {
+		forward = c.config.Dial
+	}
+	socksDialer, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
 	if err != nil {
 		return err
 	}
-	d.NetDial = socksDialer.Dial
+	d.NetDialContext = socksDialer.(proxy.ContextDialer).DialContext
 	return nil
 }
 
+//AddRemotes adds remotes to the running client. The remotes
+//are applied as a single transaction: if any of them cannot
+//be bound, either locally or on the server, the ones already
+//bound are rolled back and the client is left unchanged.
+func (c *Client) AddRemotes(remotes ...string) error {
+	if c.ctx == nil {
+		return errors.New("client not started")
+	}
+	rs := settings.Remotes{}
+	for _, s := range remotes {
+		decoded, err := settings.DecodeRemotes(s)
+		if err != nil {
+			return fmt.Errorf("failed to decode remote '%s': %s", s, err)
+		}
+		for _, r := range decoded {
+			if r.Stdio {
+				return errors.New("stdio remotes cannot be added at runtime")
+			}
+			if r.Reverse && len(c.pool) > 0 {
+				return errors.New("reverse remotes cannot be changed at runtime with a server pool")
+			}
+			if r.Reverse && !c.tunnel.Outbound {
+				return errors.New("reverse remotes can only be added at runtime " +
+					"when the client was started with a reverse remote")
+			}
+			if (r.Socks || r.HTTPProxy) && r.Reverse && !c.tunnel.Socks {
+				return errors.New("reverse SOCKS remotes can only be added at runtime " +
+					"when the client was started with a reverse SOCKS remote")
+			}
+			if r.Reverse && settings.IsSocket(r.RemoteProto) && !c.tunnel.Unix {
+				return errors.New("reverse remotes to unix sockets or named pipes can only be " +
+					"added at runtime when the client was started with one")
+			}
+			if r.Reverse && r.RemoteProto == "serial" && !c.tunnel.Serial {
+				return errors.New("reverse remotes to serial devices can only be " +
+					"added at runtime when the client was started with one")
+			}
+			if r.TLSCA != "" {
+				known := false
+				for _, ca := range c.tunnel.TLSCAs {
+					known = known || ca == r.TLSCA
+				}
+				if !known {
+					return errors.New("reverse remotes with a CA bundle can only be " +
+						"added at runtime when the client was started with one using it")
+				}
+			}
+		}
+		rs = append(rs, decoded...)
+	}
+	return c.addRemotes(rs)
+}
+
+func (c *Client) addRemotes(rs settings.Remotes) error {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	reversed := rs.Reversed(true)
+	if len(reversed) > 0 && c.sshConn != nil {
+		if !c.remoteOptions && hasOptions(reversed) {
+			return errors.New("server ignores the options of reverse remotes")
+		}
+		if err := tunnel.RequestRemotes(c.sshConn, "add-remotes", reversed); err != nil {
+			return fmt.Errorf("server rejected remotes: %s", err)
+		}
+	}
+	if forward := rs.Reversed(false); len(forward) > 0 {
+		if err := c.tunnel.AddRemotes(c.ctx, forward); err != nil {
+			//roll back the server side too
+			if len(reversed) > 0 && c.sshConn != nil {
+				if err := tunnel.RequestRemotes(c.sshConn, "del-remotes", reversed); err != nil {
+					c.Infof("failed to roll back remotes on server: %s", err)
+				}
+			}
+			return err
+		}
+	}
+	c.computed.Remotes = append(c.computed.Remotes, rs...)
+	c.Infof("added remotes %v", rs)
+	return nil
+}
+
+//RemoveRemotes removes remotes from the running client.
+//Nothing is removed unless all of the remotes are present.
+func (c *Client) RemoveRemotes(remotes ...string) error {
+	if c.ctx == nil {
+		return errors.New("client not started")
+	}
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	index := map[string]int{}
+	for i, r := range c.computed.Remotes {
+		index[r.Encode()] = i
+	}
+	remove := map[int]bool{}
+	rs := settings.Remotes{}
+	for _, s := range remotes {
+		decoded, err := settings.DecodeRemotes(s)
+		if err != nil {
+			return fmt.Errorf("failed to decode remote '%s': %s", s, err)
+		}
+		for _, r := range decoded {
+			i, ok := index[r.Encode()]
+			if !ok {
+				return fmt.Errorf("remote %s not found", r)
+			}
+			if r.Reverse && len(c.pool) > 0 {
+				return errors.New("reverse remotes cannot be changed at runtime with a server pool")
+			}
+			remove[i] = true
+			rs = append(rs, c.computed.Remotes[i])
+		}
+	}
+	if reversed := rs.Reversed(true); len(reversed) > 0 && c.sshConn != nil {
+		if err := tunnel.RequestRemotes(c.sshConn, "del-remotes", reversed); err != nil {
+			return fmt.Errorf("server failed to remove remotes: %s", err)
+		}
+	}
+	if forward := rs.Reversed(false); len(forward) > 0 {
+		if err := c.tunnel.RemoveRemotes(forward); err != nil {
+			return err
+		}
+	}
+	kept := settings.Remotes{}
+	for i, r := range c.computed.Remotes {
+		if !remove[i] {
+			kept = append(kept, r)
+		}
+	}
+	c.computed.Remotes = kept
+	c.Infof("removed remotes %v", rs)
+	return nil
+}
+
+//Remotes returns the remotes currently configured on the client
+func (c *Client) Remotes() []string {
+	c.remotesMut.Lock()
+	defer c.remotesMut.Unlock()
+	return c.computed.Remotes.Encode()
+}
+
+//DialContext connects to addr through the server, as if dialed
+//by the server, without listening on a local port. Only TCP is
+//supported. It blocks while the client is (re)connecting.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	return c.tunnel.Dial(ctx, addr)
+}
+
+//Listen asks the server to listen on addr and returns a listener
+//for the connections it receives, like a reverse remote served
+//in-process. Only TCP is supported, and the server must allow
+//reverse remotes.
+func (c *Client) Listen(network, addr string) (net.Listener, error) {
+	if c.ctx == nil {
+		return nil, errors.New("client not started")
+	}
+	if network != "tcp" {
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	//connections are addressed to a name which never resolves
+	target := fmt.Sprintf("listener-%d.invalid:1", atomic.AddInt32(&c.listenerCount, 1))
+	r, err := settings.DecodeRemote("R:" + addr + ":" + target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address '%s': %s", addr, err)
+	}
+	ln, err := c.tunnel.Listen(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addRemotes(settings.Remotes{r}); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &listener{Listener: ln, client: c, remote: r}, nil
+}
+
+//listener releases its reverse remote when closed
+type listener struct {
+	*tunnel.Listener
+	client *Client
+	remote *settings.Remote
+	once   sync.Once
+}
+
+func (l *listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		err = l.client.RemoveRemotes(l.remote.Encode())
+		l.Listener.Close()
+	})
+	return err
+}
+
+func (l *listener) Addr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", l.remote.Local())
+	if err != nil {
+		return l.Listener.Addr()
+	}
+	return addr
+}
+
 //Wait blocks while the client is running.
 func (c *Client) Wait() error {
 	return c.eg.Wait()
@@ -305,3 +1090,13 @@ func (c *Client) Close() error {
 	}
 	return nil
 }
+
+//hasOptions reports whether any of the remotes has options
+func hasOptions(rs settings.Remotes) bool {
+	for _, r := range rs {
+		if r.HasOptions() {
+			return true
+		}
+	}
+	return false
+}
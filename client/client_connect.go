@@ -5,30 +5,95 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jpillora/backoff"
-	chshare "github.com/myzhang1029/penguin/share"
+	"github.com/myzhang1029/penguin/share/ccrypto"
 	"github.com/myzhang1029/penguin/share/cnet"
 	"github.com/myzhang1029/penguin/share/cos"
 	"github.com/myzhang1029/penguin/share/settings"
+	"github.com/myzhang1029/penguin/share/tunnel"
+	"github.com/quic-go/quic-go"
 	"golang.org/x/crypto/ssh"
 )
 
-func (c *Client) connectionLoop(ctx context.Context) error {
+//ErrAuth is wrapped by the errors of connections which the
+//server rejected, due to the credentials or access to remotes
+var ErrAuth = errors.New("rejected by server")
+
+//ErrFingerprint is wrapped by the errors of connections to
+//a server whose key does not match the expected fingerprint
+var ErrFingerprint = errors.New("fingerprint mismatch")
+
+//ErrGaveUp is wrapped by the error returned when the client
+//stops reconnecting after network errors
+var ErrGaveUp = errors.New("gave up reconnecting")
+
+//connectionLoop keeps a connection to the first of servers,
+//failing over to the others in order. Bonded connections
+//only carry streams alongside the main one, see Config.Bond.
+func (c *Client) connectionLoop(ctx context.Context, servers []endpoint, bonded bool) error {
 	//connection loop!
-	b := &backoff.Backoff{Max: c.config.MaxRetryInterval}
+	b := &backoff.Backoff{
+		Min:    c.config.MinRetryInterval,
+		Max:    c.config.MaxRetryInterval,
+		Factor: c.config.RetryFactor,
+		Jitter: c.config.RetryJitter,
+	}
+	current := 0
+	rejected := false
 	for {
-		connected, err := c.connectionOnce(ctx)
+		connected, err := c.connectionOnce(ctx, servers, current, bonded)
+		if err != nil && ctx.Err() == nil {
+			c.metrics.Counter("penguin_client_connection_errors_total", 1)
+		}
+		//a restarted server cannot resume the TLS session
+		//of a 0-RTT attempt, so retry with a full handshake
+		if errors.Is(err, quic.Err0RTTRejected) && !rejected {
+			rejected = true
+			c.Debugf("0-RTT data rejected, reconnecting")
+			continue
+		}
+		rejected = false
 		//reset backoff after successful connections
 		if connected {
 			b.Reset()
 		}
+		//retrying does not help with bad credentials or keys
+		if c.config.RetryOn == "network-only" && (errors.Is(err, ErrAuth) || errors.Is(err, ErrFingerprint)) {
+			c.Infof("connection error: %s", err)
+			c.Infof("Give up")
+			c.Close()
+			return err
+		}
+		if err == errFailback {
+			current = 0
+			b.Reset()
+			c.Infof("failing back to %s", servers[0].url)
+			continue
+		}
+		//try the next server straight away, and only
+		//back off once all of them have failed
+		if !connected && len(servers) > 1 && ctx.Err() == nil {
+			current = (current + 1) % len(servers)
+			if current != 0 {
+				if err != nil {
+					c.Infof("connection error: %s", err)
+				}
+				c.Infof("failing over to %s", servers[current].url)
+				continue
+			}
+		}
 		//connection error
 		attempt := int(b.Attempt())
 		maxAttempt := c.config.MaxRetryCount
+		lastErr := err
 		//dont print closed-connection errors
 		if strings.HasSuffix(err.Error(), "use of closed network connection") {
 			err = io.EOF
@@ -48,7 +113,11 @@ func (c *Client) connectionLoop(ctx context.Context) error {
 		//give up?
 		if maxAttempt >= 0 && attempt >= maxAttempt {
 			c.Infof("Give up")
-			break
+			c.Close()
+			if errors.Is(lastErr, ErrAuth) || errors.Is(lastErr, ErrFingerprint) {
+				return lastErr
+			}
+			return fmt.Errorf("%w: %s", ErrGaveUp, lastErr)
 		}
 		d := b.Duration()
 		c.Infof("retrying in %s...", d)
@@ -60,12 +129,10 @@ func (c *Client) connectionLoop(ctx context.Context) error {
 			return nil
 		}
 	}
-	c.Close()
-	return nil
 }
 
-//connectionOnce connects to the penguin server and blocks
-func (c *Client) connectionOnce(ctx context.Context) (connected bool, err error) {
+//connectionOnce connects to the current penguin server and blocks
+func (c *Client) connectionOnce(ctx context.Context, servers []endpoint, current int, bonded bool) (connected bool, err error) {
 	//already closed?
 	select {
 	case <-ctx.Done():
@@ -75,25 +142,30 @@ func (c *Client) connectionOnce(ctx context.Context) (connected bool, err error)
 	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	//prepare dialer
-	d := websocket.Dialer{
-		HandshakeTimeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second),
-		Subprotocols:     []string{chshare.ProtocolVersion},
-		TLSClientConfig:  c.tlsConfig,
-		ReadBufferSize:   settings.EnvInt("WS_BUFF_SIZE", 0),
-		WriteBufferSize:  settings.EnvInt("WS_BUFF_SIZE", 0),
-	}
-	//optional proxy
-	if p := c.proxyURL; p != nil {
-		if err := c.setProxy(p, &d); err != nil {
-			return false, err
-		}
-	}
-	wsConn, _, err := d.DialContext(ctx, c.server, c.config.Headers)
+	conn, err := c.dial(ctx, servers[current])
 	if err != nil {
 		return false, err
 	}
-	conn := cnet.NewWebSocketConn(wsConn)
+	if c.config.Resume > 0 && atomic.LoadInt32(&c.noResume) == 0 {
+		rc := cnet.NewResumableConn(cnet.NewResumeToken(), c.config.Resume)
+		lost, err := rc.Connect(conn)
+		if err == nil {
+			defer rc.Close()
+			go c.keepResuming(ctx, rc, servers[current], lost)
+			conn = rc
+		} else {
+			conn.Close()
+			if !errors.Is(err, cnet.ErrResumeDisabled) {
+				return false, err
+			}
+			//reconnect straight away, without resuming
+			c.Infof("%s, reconnecting without resuming", err)
+			atomic.StoreInt32(&c.noResume, 1)
+			if conn, err = c.dial(ctx, servers[current]); err != nil {
+				return false, err
+			}
+		}
+	}
 	// perform SSH handshake on net.Conn
 	c.Debugf("handshaking...")
 	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", c.sshConfig)
@@ -102,8 +174,11 @@ func (c *Client) connectionOnce(ctx context.Context) (connected bool, err error)
 		if strings.Contains(e, "unable to authenticate") {
 			c.Infof("authentication failed")
 			c.Debugf(e)
-		} else {
-			c.Infof(e)
+			return false, fmt.Errorf("%w: %s", ErrAuth, e)
+		}
+		c.Infof(e)
+		if strings.Contains(e, "invalid fingerprint") {
+			return false, fmt.Errorf("%w: %s", ErrFingerprint, e)
 		}
 		return false, err
 	}
@@ -112,22 +187,372 @@ func (c *Client) connectionOnce(ctx context.Context) (connected bool, err error)
 	// send configuration
 	c.Debugf("sending config")
 	t0 := time.Now()
-	_, configerr, err := sshConn.SendRequest(
+	//hold the remotes while they are negotiated,
+	//so runtime changes are not lost in between
+	c.remotesMut.Lock()
+	config := c.computed
+	if bonded {
+		//the reverse remotes are bound by the main connection
+		config.Remotes = config.Remotes.Reversed(false)
+	}
+	ok, reply, err := sshConn.SendRequest(
 		"config",
 		true,
-		settings.EncodeConfig(c.computed),
+		settings.EncodeConfig(config),
 	)
 	if err != nil {
+		c.remotesMut.Unlock()
 		c.Infof("Config verification failed")
 		return false, err
 	}
-	if len(configerr) > 0 {
-		return false, errors.New(string(configerr))
+	if !ok {
+		c.remotesMut.Unlock()
+		return false, configError(string(reply))
+	}
+	//older servers acknowledge with an empty reply
+	requestID := "<unknown>"
+	var keepAlive *settings.KeepAlive
+	compress := ""
+	remoteOptions := false
+	if len(reply) > 0 {
+		r, err := settings.DecodeConfigReply(reply)
+		if err != nil {
+			c.remotesMut.Unlock()
+			return false, err
+		}
+		requestID = r.RequestID
+		keepAlive = r.KeepAlive
+		compress = r.Compress
+		remoteOptions = r.RemoteOptions
+		if r.Protocol != "" {
+			c.Debugf("negotiated protocol %s", r.Protocol)
+		}
+	}
+	if !remoteOptions && hasOptions(config.Remotes.Reversed(true)) {
+		c.remotesMut.Unlock()
+		return false, errors.New("server ignores the options of reverse remotes")
+	}
+	if compress != "" {
+		c.Debugf("compressing channels with %s", compress)
+		sshConn, chans = tunnel.Compress(sshConn, chans, compress)
+	} else if len(c.config.Compress) > 0 {
+		c.Debugf("server does not support the offered compressions")
+	}
+	//remotes changed at runtime are negotiated
+	//on this connection, unless there is a pool
+	if len(c.pool) == 0 && !bonded {
+		c.sshConn = sshConn
+		c.remoteOptions = remoteOptions
+	}
+	sess := c.newSession(servers[current].url, requestID)
+	c.remotesMut.Unlock()
+	c.Infof("connected (Latency %s, Request ID %s)", time.Since(t0), requestID)
+	c.metrics.Histogram("penguin_client_handshake_seconds", time.Since(t0).Seconds())
+	c.metrics.Counter("penguin_client_connections_total", 1)
+	if atomic.AddInt32(&c.connections, 1) > 1 {
+		c.metrics.Counter("penguin_client_reconnects_total", 1)
+	}
+	c.metrics.Gauge("penguin_client_connected", float64(atomic.AddInt32(&c.connected, 1)))
+	hooked := c.connectHook(sess)
+	//return to the primary server once it recovers
+	var failback int32
+	if current != 0 && c.config.Failback > 0 {
+		go func() {
+			if c.awaitPrimary(ctx, servers[0]) {
+				atomic.StoreInt32(&failback, 1)
+				cancel()
+			}
+		}()
 	}
-	c.Infof("connected (Latency %s)", time.Since(t0))
 	//connected, handover ssh connection for tunnel to use, and block
-	err = c.tunnel.BindSSH(ctx, sshConn, reqs, chans)
-	c.Infof("Disconnected")
+	if keepAlive != nil {
+		c.Debugf("negotiated keepalive every %s, timeout %s, dead after %s", keepAlive.Interval, keepAlive.Timeout, keepAlive.Deadline())
+		err = c.tunnel.BindSSHKeepAlive(ctx, sshConn, reqs, chans, *keepAlive, true)
+	} else {
+		err = c.tunnel.BindSSH(ctx, sshConn, reqs, chans)
+	}
+	c.remotesMut.Lock()
+	if c.sshConn == sshConn {
+		c.sshConn = nil
+	}
+	c.remotesMut.Unlock()
+	c.Infof("Disconnected (Request ID %s)", requestID)
+	c.metrics.Gauge("penguin_client_connected", float64(atomic.AddInt32(&c.connected, -1)))
+	c.disconnectHook(sess, hooked, err)
+	if atomic.LoadInt32(&failback) == 1 {
+		return true, errFailback
+	}
 	connected = time.Since(t0) > 5*time.Second
 	return connected, err
 }
+
+//dial connects to the server e with the configured transport
+func (c *Client) dial(ctx context.Context, e endpoint) (conn net.Conn, err error) {
+	switch c.config.Transport {
+	case "quic":
+		conn, err = c.dialQUIC(ctx, e)
+	case "http2":
+		conn, err = c.dialStream(ctx, e, false)
+	case "grpc":
+		conn, err = c.dialStream(ctx, e, true)
+	case "webtransport":
+		conn, err = c.dialWebTransport(ctx, e)
+	case "dns":
+		conn, err = c.dialDNS(ctx, e)
+	case "icmp":
+		conn, err = c.dialICMP(ctx, e)
+	case "tls":
+		conn, err = c.dialRawTLS(ctx, e)
+	case "kcp":
+		conn, err = c.dialKCP(ctx, e)
+	case "poll":
+		conn, err = c.dialPoll(ctx, e, c.proxyURL)
+	default:
+		conn, err = c.dialWebSocket(ctx, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.faults != nil {
+		conn = cnet.NewFaultConn(conn, *c.faults)
+	}
+	return conn, nil
+}
+
+//keepResuming reconnects to the server e whenever the conn
+//carrying rc is lost, until the session is resumed, the server
+//has dropped it, or rc expires
+func (c *Client) keepResuming(ctx context.Context, rc *cnet.ResumableConn, e endpoint, lost <-chan struct{}) {
+	for {
+		select {
+		case <-lost:
+		case <-rc.Done():
+			return
+		}
+		select {
+		case <-rc.Done():
+			return
+		default:
+		}
+		c.Infof("connection lost, resuming session...")
+		b := &backoff.Backoff{
+			Min:    c.config.MinRetryInterval,
+			Max:    c.config.MaxRetryInterval,
+			Factor: c.config.RetryFactor,
+			Jitter: c.config.RetryJitter,
+		}
+		for {
+			conn, err := c.dial(ctx, e)
+			if err == nil {
+				if lost, err = rc.Connect(conn); err == nil {
+					break
+				}
+				conn.Close()
+			}
+			if errors.Is(err, cnet.ErrResumeUnknown) || errors.Is(err, cnet.ErrResumeDisabled) {
+				c.Infof("failed to resume session: %s", err)
+				rc.Close()
+				return
+			}
+			c.Debugf("failed to resume session: %s", err)
+			select {
+			case <-time.After(b.Duration()):
+			case <-rc.Done():
+				return
+			}
+		}
+		c.Infof("resumed session")
+		c.metrics.Counter("penguin_client_resumes_total", 1)
+	}
+}
+
+//errFailback ends a connection to a failover server
+//when the primary server has recovered
+var errFailback = errors.New("primary server recovered")
+
+//awaitPrimary blocks until a TCP connection to the primary
+//server succeeds, returning false if ctx is done first
+func (c *Client) awaitPrimary(ctx context.Context, primary endpoint) bool {
+	ticker := time.NewTicker(c.config.Failback)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+		d := net.Dialer{Timeout: 10 * time.Second}
+		conn, err := d.DialContext(ctx, "tcp", primary.host)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+		c.Debugf("primary server still unreachable: %s", err)
+	}
+}
+
+//dialWebSocket connects to the server e with a websocket,
+//through the proxy or the proxies chosen by the PAC file
+func (c *Client) dialWebSocket(ctx context.Context, e endpoint) (net.Conn, error) {
+	var err error
+	//prepare dialer
+	d := websocket.Dialer{
+		HandshakeTimeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second),
+		Subprotocols:     c.subprotocols,
+		TLSClientConfig:  c.tlsConfig,
+		ReadBufferSize:   settings.EnvInt("WS_BUFF_SIZE", 0),
+		WriteBufferSize:  settings.EnvInt("WS_BUFF_SIZE", 0),
+		NetDialContext:   c.config.Dial,
+		//in effect only if the server agrees
+		EnableCompression: c.config.WsCompress,
+	}
+	//optional proxy, or the proxies chosen by the PAC file
+	proxies := []*url.URL{c.proxyURL}
+	if c.pac != nil {
+		if proxies, err = c.pac.find(ctx, e.url); err != nil {
+			return nil, err
+		}
+	}
+	var wsConn *websocket.Conn
+	var resp *http.Response
+	for i, p := range proxies {
+		//each attempt may reach the server, so it
+		//needs a fresh, single-use authenticator
+		server, headers, err := c.prepareRequest(ctx, e)
+		if err != nil {
+			return nil, err
+		}
+		if c.config.Padding > 0 {
+			headers.Set(cnet.PaddingHeader, c.config.Padding.String())
+		}
+		pd := d
+		if p != nil {
+			if err := c.setProxy(p, &pd); err != nil {
+				return nil, err
+			}
+		}
+		target := server
+		if c.mimic != nil && strings.HasPrefix(server, "wss:") {
+			target = c.mimicDialer(&pd, p, server)
+		}
+		wsConn, resp, err = pd.DialContext(ctx, target, headers)
+		if err == nil {
+			break
+		}
+		if perr := c.protocolError(resp); perr != nil {
+			return nil, perr
+		}
+		//a middlebox may refuse the upgrade, but let requests
+		//through, which cannot be padded
+		if errors.Is(err, websocket.ErrBadHandshake) && c.config.Transport == "" && c.config.Padding == 0 {
+			conn, perr := c.dialPoll(ctx, e, p)
+			if perr == nil {
+				c.Infof("websocket upgrade refused, falling back to long-polling")
+				return conn, nil
+			}
+			c.Debugf("long-polling fallback failed: %s", perr)
+		}
+		if i == len(proxies)-1 {
+			return nil, err
+		}
+		via := "directly"
+		if p != nil {
+			via = "via " + p.String()
+		}
+		c.Infof("failed to connect %s (%s), trying the next PAC entry", via, err)
+	}
+	if c.config.WsCompress && !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		c.Debugf("server does not support permessage-deflate")
+	}
+	if c.config.Padding > 0 {
+		//older servers ignore the header, others
+		//echo the interval which they settled on
+		interval, err := time.ParseDuration(resp.Header.Get(cnet.PaddingHeader))
+		if err != nil {
+			wsConn.Close()
+			return nil, errors.New("server does not support padding")
+		}
+		return cnet.NewPaddedWebSocketConn(wsConn, interval), nil
+	}
+	return cnet.NewWebSocketConn(wsConn), nil
+}
+
+//protocolError explains the refusal of the offered
+//protocol versions by a server which supports others
+func (c *Client) protocolError(resp *http.Response) error {
+	if resp == nil || resp.StatusCode != http.StatusUpgradeRequired {
+		return nil
+	}
+	supported := resp.Header.Get(cnet.ProtocolsHeader)
+	if supported == "" {
+		return nil
+	}
+	return fmt.Errorf("server supports protocols %s, none of the offered %s",
+		supported, strings.Join(c.subprotocols, ", "))
+}
+
+//configError is the error of a refused config request, which
+//is ErrAuth when the user may not have the remotes. Others, such
+//as a reverse port which is briefly in use, may be retried.
+func configError(reply string) error {
+	if strings.HasSuffix(reply, "' denied") || strings.HasSuffix(reply, " needs credentials") {
+		return fmt.Errorf("%w: %s", ErrAuth, reply)
+	}
+	return fmt.Errorf("server refused the config: %s", reply)
+}
+
+//prepareRequest renders the URL and the headers of a request
+//to the server e, which are signed with the PSK if any
+func (c *Client) prepareRequest(ctx context.Context, e endpoint) (string, http.Header, error) {
+	headers := c.config.Headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if c.headers != nil {
+		if err := c.headers.render(headers); err != nil {
+			return "", nil, err
+		}
+	}
+	server := e.url
+	path := e.path
+	if c.config.PskPath {
+		//derive a fresh path for each attempt
+		path = ccrypto.PSKPath(c.config.Psk, time.Now())
+		u, err := url.Parse(server)
+		if err != nil {
+			return "", nil, err
+		}
+		u.Path = path
+		server = u.String()
+	}
+	if c.config.Psk != "" {
+		//sign a fresh authenticator for each attempt
+		auth := ccrypto.SignPSK(c.config.Psk, path, time.Now())
+		switch c.config.PskTransport {
+		case "cookie":
+			headers.Add("Cookie", (&http.Cookie{Name: ccrypto.PSKParam, Value: auth}).String())
+		case "query":
+			u, err := url.Parse(server)
+			if err != nil {
+				return "", nil, err
+			}
+			q := u.Query()
+			q.Set(ccrypto.PSKParam, auth)
+			u.RawQuery = q.Encode()
+			server = u.String()
+		default:
+			headers.Set("X-Penguin-Auth", auth)
+		}
+		if c.config.PskLegacy {
+			headers.Set("X-Penguin-Psk", c.config.Psk)
+		}
+	}
+	if c.config.Token != nil {
+		token, err := c.config.Token(ctx)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to obtain token: %s", err)
+		}
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	return server, headers, nil
+}
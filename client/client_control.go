@@ -0,0 +1,71 @@
+package chclient
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/myzhang1029/penguin/share/cmetrics"
+	"github.com/myzhang1029/penguin/share/cnet"
+)
+
+//listenControl starts the control API on the configured address,
+//which is either a TCP address or a unix socket "unix:<path>"
+func (c *Client) listenControl(ctx context.Context) error {
+	network, addr := "tcp", c.config.Control
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		//remove the socket left by a client which was killed
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial(network, addr); err == nil {
+				conn.Close()
+			} else {
+				os.Remove(addr)
+			}
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return c.Errorf("control: %s", err)
+	}
+	c.Infof("control API listening on %s", c.config.Control)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/remotes", c.handleControlRemotes)
+	if p, ok := c.config.Metrics.(*cmetrics.Prometheus); ok {
+		mux.Handle("/metrics", p)
+	}
+	return cnet.NewHTTPServer().GoServe(ctx, l, mux)
+}
+
+//handleControlRemotes lists the remotes (GET), or adds (POST)
+//or removes (DELETE) the JSON array of remotes in the body
+func (c *Client) handleControlRemotes(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Remotes())
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var remotes []string
+	if err := json.NewDecoder(r.Body).Decode(&remotes); err != nil || len(remotes) == 0 {
+		http.Error(w, "expected a JSON array of remotes", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if r.Method == http.MethodPost {
+		err = c.AddRemotes(remotes...)
+	} else {
+		err = c.RemoveRemotes(remotes...)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
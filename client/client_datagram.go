@@ -0,0 +1,196 @@
+package chclient
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+//errNoSession is answered once the server has closed
+//the session of a connection of a datagram transport
+var errNoSession = errors.New("no such session")
+
+//datagramSocket sends and receives the
+//datagrams of a single peer
+type datagramSocket interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+//roundTrip sends msg on s until an answer is accepted, at
+//most retries times. answer returns the data of the answers
+//to msg, and false for other datagrams.
+func roundTrip(s datagramSocket, msg []byte, retries int, answer func([]byte) ([]byte, bool, error)) ([]byte, error) {
+	timeout := settings.EnvDuration("DATAGRAM_TIMEOUT", 2*time.Second)
+	buf := make([]byte, 1500)
+	for i := 0; i < retries; i++ {
+		if _, err := s.Write(msg); err != nil {
+			return nil, err
+		}
+		s.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if data, ok, err := answer(buf[:n]); ok || err != nil {
+				return data, err
+			}
+		}
+	}
+	return nil, errors.New("query timed out")
+}
+
+//datagramConn is a connection of a datagram transport, which
+//uploads what was written with each query, and downloads the
+//answers, polling while there is nothing to send
+type datagramConn struct {
+	socket     datagramSocket
+	exchange   func(q cnet.Query, retries int) ([]byte, error)
+	key        string
+	upload     int
+	seq        uint32
+	down       *io.PipeReader
+	downWriter *io.PipeWriter
+	mut        sync.Mutex
+	pending    *sync.Cond
+	up         []byte
+	err        error
+	wake       chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+//dialDatagram opens a session with key, running its queries
+//with exchange, which upload at most upload bytes each
+func dialDatagram(socket datagramSocket, exchange func(cnet.Query, int) ([]byte, error), key, protocol string, upload int) (net.Conn, error) {
+	q := cnet.Query{Op: cnet.QueryOpen, Key: key, Protocol: protocol}
+	if _, err := exchange(q, settings.EnvInt("DATAGRAM_RETRIES", 10)); err != nil {
+		socket.Close()
+		if err == errNoSession {
+			err = errors.New("refused by the server")
+		}
+		return nil, err
+	}
+	d := &datagramConn{
+		socket:   socket,
+		exchange: exchange,
+		key:      key,
+		upload:   upload,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	d.pending = sync.NewCond(&d.mut)
+	d.down, d.downWriter = io.Pipe()
+	go d.run()
+	return cnet.NewRWCConn(d), nil
+}
+
+func (d *datagramConn) run() {
+	defer d.socket.Close()
+	retries := settings.EnvInt("DATAGRAM_RETRIES", 10)
+	var idle time.Duration
+	for {
+		d.mut.Lock()
+		empty := len(d.up) == 0
+		d.mut.Unlock()
+		if empty && idle > 0 {
+			select {
+			case <-d.wake:
+			case <-time.After(idle):
+			case <-d.done:
+			}
+		}
+		select {
+		case <-d.done:
+			//tell the server, once
+			d.exchange(cnet.Query{Op: cnet.QueryClose, Key: d.key}, 1)
+			return
+		default:
+		}
+		d.mut.Lock()
+		b := d.up
+		if len(b) > d.upload {
+			b = b[:d.upload]
+		}
+		d.up = d.up[len(b):]
+		more := len(d.up) > 0
+		d.pending.Broadcast()
+		d.mut.Unlock()
+		b, err := d.exchange(cnet.Query{Op: cnet.QueryData, Key: d.key, Seq: d.seq, Data: b}, retries)
+		if err != nil {
+			if err == errNoSession {
+				err = io.EOF
+			}
+			d.fail(err)
+			return
+		}
+		d.seq++
+		if len(b) > 0 {
+			//fails once closed
+			d.downWriter.Write(b)
+			idle = 0
+		} else if !more {
+			//back off while there is nothing to send
+			idle = idle*2 + 10*time.Millisecond
+			if max := settings.EnvDuration("DATAGRAM_POLL", 500*time.Millisecond); idle > max {
+				idle = max
+			}
+		}
+	}
+}
+
+//fail ends the connection with err
+func (d *datagramConn) fail(err error) {
+	if err == io.EOF {
+		d.downWriter.Close()
+	} else {
+		d.downWriter.CloseWithError(err)
+	}
+	d.mut.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.pending.Broadcast()
+	d.mut.Unlock()
+}
+
+func (d *datagramConn) Read(b []byte) (int, error) {
+	return d.down.Read(b)
+}
+
+//Write queues b for the next queries
+func (d *datagramConn) Write(b []byte) (int, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	for len(d.up) >= pollWindow && d.err == nil {
+		d.pending.Wait()
+	}
+	if d.err != nil {
+		return 0, io.ErrClosedPipe
+	}
+	d.up = append(d.up, b...)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+//Close ends the connection, telling the
+//server so on a best-effort basis
+func (d *datagramConn) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		d.fail(io.ErrClosedPipe)
+	})
+	return nil
+}
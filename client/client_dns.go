@@ -0,0 +1,125 @@
+package chclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//dialDNS connects to the server e with the DNS transport,
+//whose zone is the host of the server URL, by querying the
+//resolver of the DNS transport
+func (c *Client) dialDNS(ctx context.Context, e endpoint) (net.Conn, error) {
+	u, err := url.Parse(e.url)
+	if err != nil {
+		return nil, err
+	}
+	resolver := c.config.DNSResolver
+	if resolver == "" {
+		if resolver, err = systemResolver(); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(resolver, "53")
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	zone := u.Hostname()
+	exchange := func(q cnet.Query, retries int) ([]byte, error) {
+		return dnsExchange(conn, zone, q, retries)
+	}
+	dc, err := dialDatagram(conn, exchange, cnet.NewQueryKey(), c.config.Subprotocol, cnet.DNSUploadSize(zone))
+	if err != nil {
+		return nil, fmt.Errorf("dns: %s", err)
+	}
+	return dc, nil
+}
+
+//systemResolver is the first nameserver of resolv.conf
+func systemResolver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", errors.New("no DNS resolver, set one for the DNS transport")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1], nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+//dnsExchange sends q, in zone, to the resolver of conn
+//until it is answered, with the data of the answer
+func dnsExchange(conn net.Conn, zone string, q cnet.Query, retries int) ([]byte, error) {
+	name, err := dnsmessage.NewName(q.DNSName(zone) + ".")
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var h dnsmessage.ResourceHeader
+	h.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(h, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(conn, msg, retries, func(answer []byte) ([]byte, bool, error) {
+		var p dnsmessage.Parser
+		header, err := p.Start(answer)
+		if err != nil || header.ID != id || !header.Response {
+			//late answers to previous queries
+			return nil, false, nil
+		}
+		switch header.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, true, errNoSession
+		default:
+			return nil, true, fmt.Errorf("query failed (%s)", header.RCode)
+		}
+		if err := p.SkipAllQuestions(); err != nil {
+			return nil, true, err
+		}
+		txt := []string{}
+		for {
+			h, err := p.AnswerHeader()
+			if err == dnsmessage.ErrSectionDone {
+				break
+			}
+			if err != nil {
+				return nil, true, err
+			}
+			if h.Type != dnsmessage.TypeTXT {
+				p.SkipAnswer()
+				continue
+			}
+			r, err := p.TXTResource()
+			if err != nil {
+				return nil, true, err
+			}
+			txt = append(txt, r.TXT...)
+		}
+		data, err := cnet.DNSTXTData(txt)
+		return data, true, err
+	})
+}
@@ -0,0 +1,119 @@
+package chclient
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+//headersFile holds request headers whose values are templates,
+//rendered afresh for each connection attempt
+type headersFile struct {
+	names  []string
+	values []*template.Template
+}
+
+//headerFuncs are the functions available to header templates
+var headerFuncs = template.FuncMap{
+	//env is the value of an environment variable
+	"env": os.Getenv,
+	//randomHex is n random bytes in hex
+	"randomHex": func(n int) (string, error) {
+		b := make([]byte, n)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(b), nil
+	},
+	//randomInt is a random integer in [min, max]
+	"randomInt": func(min, max int64) (int64, error) {
+		if max < min {
+			return 0, errors.New("randomInt: max is less than min")
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(max-min+1))
+		if err != nil {
+			return 0, err
+		}
+		return min + n.Int64(), nil
+	},
+	//pick is one of its arguments, at random
+	"pick": func(choices ...string) (string, error) {
+		if len(choices) == 0 {
+			return "", errors.New("pick: no choices")
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(choices))))
+		if err != nil {
+			return "", err
+		}
+		return choices[n.Int64()], nil
+	},
+	//uuid is a random (version 4) UUID
+	"uuid": func() (string, error) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	},
+}
+
+//loadHeadersFile parses a file of "Name: value" lines,
+//skipping blank lines and those starting with #
+func loadHeadersFile(path string) (*headersFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := &headersFile{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		index := strings.Index(line, ":")
+		if index <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"HeaderName: HeaderContent\"", path, n)
+		}
+		name := http.CanonicalHeaderKey(strings.TrimSpace(line[:index]))
+		value, err := template.New(name).Funcs(headerFuncs).Parse(strings.TrimSpace(line[index+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		h.names = append(h.names, name)
+		h.values = append(h.values, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+//render adds the headers to dst, except those
+//which are already set there, such as by flags
+func (h *headersFile) render(dst http.Header) error {
+	rendered := http.Header{}
+	for i, name := range h.names {
+		var b strings.Builder
+		if err := h.values[i].Execute(&b, nil); err != nil {
+			return fmt.Errorf("headers file: %s", err)
+		}
+		rendered.Add(name, b.String())
+	}
+	for name, values := range rendered {
+		if _, ok := dst[name]; !ok {
+			dst[name] = values
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package chclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestHeadersFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "penguin-headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# browser headers
+user-agent: {{pick "Mozilla/5.0 (A)" "Mozilla/5.0 (B)"}}
+X-Env: {{env "PENGUIN_TEST_HEADER"}}
+X-Nonce: {{randomHex 4}}-{{randomInt 1 9}}
+X-Id: {{uuid}}
+
+Accept: text/html
+`)
+	f.Close()
+	os.Setenv("PENGUIN_TEST_HEADER", "foo")
+	defer os.Unsetenv("PENGUIN_TEST_HEADER")
+	h, err := loadHeadersFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := http.Header{}
+	headers.Set("Accept", "*/*")
+	if err := h.render(headers); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"User-Agent": `^Mozilla/5\.0 \([AB]\)$`,
+		"X-Env":      `^foo$`,
+		"X-Nonce":    `^[0-9a-f]{8}-[1-9]$`,
+		"X-Id":       `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		"Accept":     `^\*/\*$`,
+	}
+	for name, re := range expect {
+		if v := headers.Get(name); !regexp.MustCompile(re).MatchString(v) {
+			t.Errorf("header %s: %q does not match %s", name, v, re)
+		}
+	}
+	//values are rendered afresh each time
+	again := http.Header{}
+	h.render(again)
+	if again.Get("X-Id") == headers.Get("X-Id") {
+		t.Error("expected a new uuid")
+	}
+}
+
+func TestHeadersFileInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "penguin-headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("X-Foo: {{randomHex\n")
+	f.Close()
+	if _, err := loadHeadersFile(f.Name()); err == nil {
+		t.Fatal("expected invalid template to fail")
+	}
+}
@@ -0,0 +1,66 @@
+package chclient
+
+//Session describes a connection to a server,
+//for the OnConnect and OnDisconnect hooks
+type Session struct {
+	//Server is the URL of the server
+	Server string
+	//RequestID is the server's id of the connection
+	RequestID string
+	//Remotes are the remotes of the client
+	Remotes []string
+	//Ports are the addresses which the remotes listen on,
+	//as <host>:<port>/<proto>, and ReversePorts those
+	//of the reverse remotes, on the server
+	Ports        []string
+	ReversePorts []string
+}
+
+//newSession describes the current connection,
+//and must be called with remotesMut held
+func (c *Client) newSession(server, requestID string) *Session {
+	sess := &Session{
+		Server:    server,
+		RequestID: requestID,
+		Remotes:   c.computed.Remotes.Encode(),
+	}
+	for _, r := range c.computed.Remotes {
+		if r.Stdio || r.Tun {
+			continue
+		}
+		port := r.Local() + "/" + r.LocalProto
+		if r.Reverse {
+			sess.ReversePorts = append(sess.ReversePorts, port)
+		} else {
+			sess.Ports = append(sess.Ports, port)
+		}
+	}
+	return sess
+}
+
+//connectHook calls OnConnect in the background, so that the
+//tunnel is not held up, returning a channel which is closed
+//once it has returned
+func (c *Client) connectHook(sess *Session) <-chan struct{} {
+	hooked := make(chan struct{})
+	if c.config.OnConnect == nil {
+		close(hooked)
+		return hooked
+	}
+	go func() {
+		defer close(hooked)
+		c.config.OnConnect(*sess)
+	}()
+	return hooked
+}
+
+//disconnectHook calls OnDisconnect once OnConnect has returned,
+//and blocks, so that it completes before the client reconnects
+//or exits
+func (c *Client) disconnectHook(sess *Session, hooked <-chan struct{}, err error) {
+	if c.config.OnDisconnect == nil {
+		return
+	}
+	<-hooked
+	c.config.OnDisconnect(*sess, err)
+}
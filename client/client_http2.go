@@ -0,0 +1,125 @@
+package chclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+	"golang.org/x/net/http2"
+)
+
+//dialStream connects to the server e with the body of a
+//long-lived HTTP/2 POST request and of its response, over
+//TLS for https servers and cleartext (h2c) otherwise. With
+//grpc, the body is framed as a bidirectional gRPC stream.
+func (c *Client) dialStream(ctx context.Context, e endpoint, grpc bool) (net.Conn, error) {
+	server, headers, err := c.prepareRequest(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	//back from the websocket scheme
+	server = "http" + strings.TrimPrefix(server, "ws")
+	if grpc {
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = cnet.GRPCPath
+			server = u.String()
+		}
+	}
+	dial := c.config.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t := &http2.Transport{
+		//detect dead connections, as websockets would
+		ReadIdleTimeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second),
+	}
+	if c.tlsConfig != nil {
+		t.TLSClientConfig = c.tlsConfig
+		t.DialTLSContext = func(ctx context.Context, network, addr string, tc *tls.Config) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tconn := tls.Client(conn, tc)
+			if err := tconn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tconn, nil
+		}
+	} else {
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+	}
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header = headers
+	if grpc {
+		req.Header.Set("Content-Type", cnet.GRPCContentType)
+		req.Header.Set("Te", "trailers")
+	} else {
+		req.Header.Set("Content-Type", cnet.StreamContentType)
+	}
+	req.Header.Set(cnet.StreamProtocolHeader, strings.Join(c.subprotocols, ", "))
+	//only the response headers are bounded by the timeout
+	timer := time.AfterFunc(settings.EnvDuration("WS_TIMEOUT", 45*time.Second), cancel)
+	res, err := t.RoundTrip(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		pw.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		cancel()
+		res.Body.Close()
+		pw.Close()
+		if err := c.protocolError(res); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unexpected HTTP response (%s)", res.Status)
+	}
+	stream := cnet.NewHTTPStream(res.Body, pw)
+	if grpc {
+		stream = cnet.NewGRPCStream(res.Body, pw)
+	}
+	return &streamConn{
+		Conn: cnet.NewRWCConn(stream),
+		done: func() {
+			cancel()
+			t.CloseIdleConnections()
+		},
+	}, nil
+}
+
+//streamConn also releases the HTTP/2
+//connection of its stream once closed
+type streamConn struct {
+	net.Conn
+	done func()
+}
+
+func (c *streamConn) Close() error {
+	err := c.Conn.Close()
+	c.done()
+	return err
+}
@@ -0,0 +1,106 @@
+package chclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+//dialICMP connects to the server e with the ICMP transport,
+//whose queries and answers are the payloads of echo requests
+//and replies, sent with a raw socket (requires CAP_NET_RAW)
+func (c *Client) dialICMP(ctx context.Context, e endpoint) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(e.host)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			dst = &net.IPAddr{IP: a.IP}
+			break
+		}
+	}
+	if dst == nil {
+		return nil, fmt.Errorf("icmp: no IPv4 address for %s", host)
+	}
+	pc, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("icmp: %s", err)
+	}
+	socket := &icmpSocket{PacketConn: pc, dst: dst}
+	id := rand.Intn(1 << 16)
+	exchange := func(q cnet.Query, retries int) ([]byte, error) {
+		return icmpExchange(socket, id, q, retries)
+	}
+	conn, err := dialDatagram(socket, exchange, cnet.NewQueryKey(), c.config.Subprotocol, cnet.ICMPDataSize)
+	if err != nil {
+		return nil, fmt.Errorf("icmp: %s", err)
+	}
+	return conn, nil
+}
+
+//icmpSocket is a raw ICMP socket, which
+//only exchanges packets with dst
+type icmpSocket struct {
+	*icmp.PacketConn
+	dst net.Addr
+}
+
+func (s *icmpSocket) Read(b []byte) (int, error) {
+	for {
+		n, from, err := s.ReadFrom(b)
+		if err != nil || from.String() == s.dst.String() {
+			return n, err
+		}
+	}
+}
+
+func (s *icmpSocket) Write(b []byte) (int, error) {
+	return s.WriteTo(b, s.dst)
+}
+
+//icmpExchange sends q with an echo request of id until
+//the server replies, with the data of the answer
+func icmpExchange(s *icmpSocket, id int, q cnet.Query, retries int) ([]byte, error) {
+	m := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: int(uint16(q.Seq)), Data: q.ICMPPayload(false)},
+	}
+	msg, err := m.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+	return roundTrip(s, msg, retries, func(b []byte) ([]byte, bool, error) {
+		m, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), b)
+		if err != nil || m.Type != ipv4.ICMPTypeEchoReply {
+			return nil, false, nil
+		}
+		echo, ok := m.Body.(*icmp.Echo)
+		if !ok {
+			return nil, false, nil
+		}
+		//the kernel of the server may reply with the query
+		a, answer, err := cnet.ParseICMPPayload(echo.Data)
+		if err != nil || !answer || a.Key != q.Key || a.Seq != q.Seq {
+			return nil, false, nil
+		}
+		switch a.Op {
+		case q.Op:
+			return a.Data, true, nil
+		case cnet.QueryClosed:
+			return nil, true, errNoSession
+		}
+		return nil, true, errors.New("unexpected answer")
+	})
+}
@@ -0,0 +1,51 @@
+package chclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+//dialKCP connects to the server e with the KCP transport,
+//a reliable stream over UDP, which avoids the meltdown of
+//TCP over TCP on lossy or high-latency links. It has no
+//handshake of its own, the SSH one follows.
+func (c *Client) dialKCP(ctx context.Context, e endpoint) (net.Conn, error) {
+	if c.masque != nil {
+		return c.dialKCPMASQUE(ctx, e)
+	}
+	conn, err := kcp.DialWithOptions(e.host, nil, cnet.KCPDataShards, cnet.KCPParityShards)
+	if err != nil {
+		return nil, err
+	}
+	cnet.ConfigureKCP(conn)
+	return conn, nil
+}
+
+//dialKCPMASQUE connects with the KCP transport through
+//the MASQUE relay, in packets which fit its datagrams
+func (c *Client) dialKCPMASQUE(ctx context.Context, e endpoint) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, settings.EnvDuration("WS_TIMEOUT", 45*time.Second))
+	defer cancel()
+	pc, raddr, done, err := c.dialMASQUE(ctx, e.host)
+	if err != nil {
+		return nil, err
+	}
+	var convid uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &convid)
+	conn, err := kcp.NewConn4(convid, raddr, nil, cnet.KCPDataShards, cnet.KCPParityShards, true, pc)
+	if err != nil {
+		pc.Close()
+		done()
+		return nil, err
+	}
+	cnet.ConfigureKCP(conn)
+	conn.SetMtu(masqueMTU)
+	return &streamConn{Conn: conn, done: done}, nil
+}
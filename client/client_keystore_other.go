@@ -0,0 +1,14 @@
+//+build !windows
+
+package chclient
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+//loadKeystore loads the client certificate named by name from
+//the OS keystore, which is only supported on Windows
+func loadKeystore(name string) (tls.Certificate, error) {
+	return tls.Certificate{}, errors.New("OS keystores are only supported on Windows")
+}
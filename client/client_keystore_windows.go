@@ -0,0 +1,170 @@
+package chclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	ncrypt             = windows.NewLazySystemDLL("ncrypt.dll")
+	procNCryptSignHash = ncrypt.NewProc("NCryptSignHash")
+)
+
+//padding flags of NCryptSignHash
+const (
+	bcryptPadPKCS1 = 0x2
+	bcryptPadPSS   = 0x8
+)
+
+type bcryptPKCS1PaddingInfo struct {
+	algID *uint16
+}
+
+type bcryptPSSPaddingInfo struct {
+	algID *uint16
+	salt  uint32
+}
+
+//keystoreSigner signs with a CNG key, which
+//never leaves the Windows certificate store
+type keystoreSigner struct {
+	key    windows.Handle
+	public crypto.PublicKey
+}
+
+func (s *keystoreSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *keystoreSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var alg *uint16
+	switch opts.HashFunc() {
+	case crypto.SHA1:
+		alg, _ = windows.UTF16PtrFromString("SHA1")
+	case crypto.SHA256:
+		alg, _ = windows.UTF16PtrFromString("SHA256")
+	case crypto.SHA384:
+		alg, _ = windows.UTF16PtrFromString("SHA384")
+	case crypto.SHA512:
+		alg, _ = windows.UTF16PtrFromString("SHA512")
+	case crypto.MD5SHA1:
+		//TLS 1.0 and 1.1 sign the bare digest
+	default:
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+	var padding unsafe.Pointer
+	var flags uintptr
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			salt := pss.SaltLength
+			if salt == rsa.PSSSaltLengthEqualsHash || salt == rsa.PSSSaltLengthAuto {
+				salt = len(digest)
+			}
+			padding = unsafe.Pointer(&bcryptPSSPaddingInfo{alg, uint32(salt)})
+			flags = bcryptPadPSS
+		} else {
+			padding = unsafe.Pointer(&bcryptPKCS1PaddingInfo{alg})
+			flags = bcryptPadPKCS1
+		}
+	case *ecdsa.PublicKey:
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	var size uint32
+	if err := s.signHash(padding, digest, nil, &size, flags); err != nil {
+		return nil, err
+	}
+	sig := make([]byte, size)
+	if err := s.signHash(padding, digest, sig, &size, flags); err != nil {
+		return nil, err
+	}
+	sig = sig[:size]
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		//CNG returns r and s back to back, but TLS expects ASN.1
+		half := size / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+func (s *keystoreSigner) signHash(padding unsafe.Pointer, digest, sig []byte, size *uint32, flags uintptr) error {
+	var out *byte
+	if len(sig) > 0 {
+		out = &sig[0]
+	}
+	r, _, _ := procNCryptSignHash.Call(uintptr(s.key), uintptr(padding),
+		uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		uintptr(unsafe.Pointer(out)), uintptr(len(sig)), uintptr(unsafe.Pointer(size)), flags)
+	if r != 0 {
+		return fmt.Errorf("NCryptSignHash failed: %v", windows.Errno(r))
+	}
+	return nil
+}
+
+//loadKeystore loads the client certificate of the current user's
+//personal store (certmgr's Personal) whose subject's common name
+//or SHA1 thumbprint is name. Its private key is not exported, so
+//it may be held by a smart card or a TPM.
+func loadKeystore(name string) (tls.Certificate, error) {
+	store, err := windows.CertOpenSystemStore(0, windows.StringToUTF16Ptr("MY"))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to open the certificate store: %v", err)
+	}
+	defer windows.CertCloseStore(store, 0)
+	thumbprint := strings.ToLower(strings.Replace(name, " ", "", -1))
+	var ctx *windows.CertContext
+	var leaf *x509.Certificate
+	for {
+		ctx, err = windows.CertFindCertificateInStore(store,
+			windows.X509_ASN_ENCODING|windows.PKCS_7_ASN_ENCODING, 0, windows.CERT_FIND_ANY, nil, ctx)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("no certificate '%s' in the certificate store", name)
+		}
+		raw := unsafe.Slice(ctx.EncodedCert, ctx.Length)
+		sum := sha1.Sum(raw)
+		if hex.EncodeToString(sum[:]) != thumbprint {
+			if c, err := x509.ParseCertificate(raw); err != nil || c.Subject.CommonName != name {
+				continue
+			}
+		}
+		//the context is freed by the store, so copy the certificate
+		if leaf, err = x509.ParseCertificate(append([]byte(nil), raw...)); err != nil {
+			windows.CertFreeCertificateContext(ctx)
+			return tls.Certificate{}, err
+		}
+		break
+	}
+	defer windows.CertFreeCertificateContext(ctx)
+	var key windows.Handle
+	var spec uint32
+	var mustFree bool
+	err = windows.CryptAcquireCertificatePrivateKey(ctx,
+		windows.CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG|windows.CRYPT_ACQUIRE_SILENT_FLAG, nil, &key, &spec, &mustFree)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to acquire the key of '%s': %v", name, err)
+	}
+	//the key is kept for the life of the client
+	return tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  &keystoreSigner{key: key, public: leaf.PublicKey},
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package chclient
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/settings"
+	"github.com/quic-go/masque-go"
+	"github.com/quic-go/quic-go"
+)
+
+//dialMASQUE relays a UDP flow to addr through the MASQUE
+//relay, returning it as a net.PacketConn whose packets are
+//all to and from raddr. done closes the connection to the
+//relay, once pc is no longer used.
+func (c *Client) dialMASQUE(ctx context.Context, addr string) (pc net.PacketConn, raddr net.Addr, done func(), err error) {
+	mc := &masque.Client{
+		TLSClientConfig: c.masqueTLS.Clone(),
+		QUICConfig: &quic.Config{
+			MaxIdleTimeout:    settings.EnvDuration("QUIC_IDLE_TIMEOUT", 45*time.Second),
+			KeepAlivePeriod:   15 * time.Second,
+			EnableDatagrams:   true,
+			InitialPacketSize: masquePacketSize,
+		},
+	}
+	conn, _, err := mc.DialAddr(ctx, c.masque, addr)
+	if err != nil {
+		mc.Close()
+		return nil, nil, nil, err
+	}
+	raddr = masqueAddr(addr)
+	return &masqueConn{PacketConn: conn, raddr: raddr}, raddr, func() { mc.Close() }, nil
+}
+
+//masquePacketSize is that of the packets to the relay, whose
+//datagrams can then carry packets of 1200 bytes, the minimum
+//size of QUIC
+const masquePacketSize = 1350
+
+//masqueMTU is the largest packet which is relayed
+const masqueMTU = 1200
+
+//masqueAddr is the address of a target of the relay,
+//which resolves it
+type masqueAddr string
+
+func (a masqueAddr) Network() string { return "connect-udp" }
+func (a masqueAddr) String() string  { return string(a) }
+
+//masqueConn reports the address of the
+//target as the source of its packets
+type masqueConn struct {
+	net.PacketConn
+	raddr net.Addr
+}
+
+func (c *masqueConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := c.PacketConn.ReadFrom(b)
+	return n, c.raddr, err
+}
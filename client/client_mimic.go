@@ -0,0 +1,109 @@
+package chclient
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	utls "github.com/refraction-networking/utls"
+)
+
+//tlsMimics are the ClientHellos which the outer
+//TLS connection can imitate, by name
+var tlsMimics = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"randomized": utls.HelloRandomizedALPN,
+}
+
+//mimicDialer makes d connect to a wss:// server using uTLS, and
+//returns the server URL to dial instead. As the websocket dialer
+//cannot use another TLS implementation, it dials ws:// and the
+//TLS handshake happens in its NetDialContext, which must then
+//also connect through a plain HTTP proxy itself.
+func (c *Client) mimicDialer(d *websocket.Dialer, proxyURL *url.URL, server string) string {
+	dial := d.NetDialContext
+	if d.Proxy != nil {
+		cd := &connectDialer{proxy: proxyURL, newAuth: newBasicAuth, forward: c.config.Dial}
+		dial = cd.DialContext
+		d.Proxy = nil
+	}
+	if dial == nil {
+		var nd net.Dialer
+		dial = nd.DialContext
+	}
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tconn, err := c.mimicHandshake(ctx, conn, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tconn, nil
+	}
+	return "ws:" + strings.TrimPrefix(server, "wss:")
+}
+
+//mimicHandshake performs the TLS handshake with the configured
+//ClientHello, and otherwise the settings of the TLS config
+func (c *Client) mimicHandshake(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	tc := c.tlsConfig
+	config := &utls.Config{
+		ServerName:            tc.ServerName,
+		InsecureSkipVerify:    tc.InsecureSkipVerify,
+		RootCAs:               tc.RootCAs,
+		VerifyPeerCertificate: tc.VerifyPeerCertificate,
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	for _, cert := range tc.Certificates {
+		config.Certificates = append(config.Certificates, utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			Leaf:        cert.Leaf,
+		})
+	}
+	uconn := utls.UClient(conn, config, *c.mimic)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	//the tunnel is a websocket over HTTP/1.1, so
+	//the server must not pick h2 from the browser's list
+	for _, ext := range uconn.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	//give up with the context
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if err := uconn.Handshake(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return uconn, nil
+}
@@ -0,0 +1,60 @@
+package chclient
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMimic(t *testing.T) {
+	type hello struct {
+		grease bool
+		protos []string
+	}
+	hellos := make(chan hello, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			//chrome sends GREASE values, Go never does
+			grease := len(h.CipherSuites) > 0 && h.CipherSuites[0]&0x0f0f == 0x0a0a
+			select {
+			case hellos <- hello{grease, h.SupportedProtos}:
+			default:
+			}
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+	c, err := NewClient(&Config{
+		KeepAlive:        time.Second,
+		MaxRetryInterval: time.Second,
+		Server:           server.URL,
+		Remotes:          []string{"9001"},
+		TLS: TLSConfig{
+			SkipVerify: true,
+			Mimic:      "chrome",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Run()
+	defer c.Close()
+	select {
+	case h := <-hellos:
+		if !h.grease {
+			t.Fatal("expected a chrome ClientHello")
+		}
+		if len(h.protos) != 1 || h.protos[0] != "http/1.1" {
+			t.Fatalf("expected only http/1.1 to be offered, got %v", h.protos)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ClientHello received")
+	}
+	if _, err := NewClient(&Config{Server: server.URL, TLS: TLSConfig{Mimic: "netscape"}}); err == nil {
+		t.Fatal("expected unknown ClientHello to be rejected")
+	}
+}
@@ -0,0 +1,293 @@
+package chclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+//pacFile chooses proxies with a proxy auto-config
+//script, loaded from a URL or a local path
+type pacFile struct {
+	location string
+	mut      sync.Mutex
+	script   string
+}
+
+//load fetches the script again, keeping the
+//last good one when it is unavailable
+func (p *pacFile) load(ctx context.Context) (string, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(p.location, "http://") || strings.HasPrefix(p.location, "https://") {
+		b, err = fetchPAC(ctx, p.location)
+	} else {
+		b, err = ioutil.ReadFile(strings.TrimPrefix(p.location, "file://"))
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if err != nil {
+		if p.script != "" {
+			return p.script, nil
+		}
+		return "", fmt.Errorf("failed to load PAC file: %s", err)
+	}
+	p.script = string(b)
+	return p.script, nil
+}
+
+func fetchPAC(ctx context.Context, location string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	//never through a proxy, the script decides that
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", location, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+//errPACTimeout stops scripts which do not finish in pacTimeout
+var errPACTimeout = errors.New("PAC script timed out")
+
+var pacTimeout = 10 * time.Second
+
+//find evaluates FindProxyForURL for server, returning the
+//proxies to try in order, where nil is a direct connection
+func (p *pacFile) find(ctx context.Context, server string) (proxies []*url.URL, err error) {
+	script, err := p.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	//scripts are written for the http(s) urls of browsers
+	target := *u
+	target.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	if port := u.Port(); (target.Scheme == "http" && port == "80") ||
+		(target.Scheme == "https" && port == "443") {
+		target.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	//a fresh vm per evaluation, since vms are not goroutine safe
+	vm := otto.New()
+	vm.Set("dnsResolve", func(call otto.FunctionCall) otto.Value {
+		return pacValue(vm, dnsResolve(ctx, call.Argument(0).String()))
+	})
+	vm.Set("myIpAddress", func(call otto.FunctionCall) otto.Value {
+		return pacValue(vm, myIPAddress(u.Host))
+	})
+	if _, err := vm.Run(pacUtils); err != nil {
+		return nil, err
+	}
+	vm.Interrupt = make(chan func(), 1)
+	timer := time.AfterFunc(pacTimeout, func() {
+		vm.Interrupt <- func() {
+			panic(errPACTimeout)
+		}
+	})
+	defer timer.Stop()
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errPACTimeout {
+				panic(r)
+			}
+			err = errPACTimeout
+		}
+	}()
+	if _, err := vm.Run(script); err != nil {
+		return nil, fmt.Errorf("invalid PAC file: %s", err)
+	}
+	result, err := vm.Call("FindProxyForURL", nil, target.String(), target.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("PAC file failed: %s", err)
+	}
+	return parsePACResult(result.String())
+}
+
+//parsePACResult parses results like "PROXY a:8080; SOCKS b:1080; DIRECT"
+func parsePACResult(result string) ([]*url.URL, error) {
+	var proxies []*url.URL
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		scheme := ""
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			proxies = append(proxies, nil)
+			continue
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5h"
+		default:
+			//e.g. SOCKS4, which is not supported
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid PAC result '%s'", entry)
+		}
+		proxies = append(proxies, &url.URL{Scheme: scheme, Host: fields[1]})
+	}
+	if len(proxies) == 0 {
+		//an empty result means DIRECT
+		proxies = append(proxies, nil)
+	}
+	return proxies, nil
+}
+
+func pacValue(vm *otto.Otto, s string) otto.Value {
+	if s == "" {
+		return otto.NullValue()
+	}
+	v, _ := vm.ToValue(s)
+	return v
+}
+
+func dnsResolve(ctx context.Context, host string) string {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		if ip := a.IP.To4(); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+//myIPAddress is the local address of the route to the server,
+//found without sending anything by "connecting" over UDP
+func myIPAddress(serverHost string) string {
+	host := serverHost
+	if h, _, err := net.SplitHostPort(serverHost); err == nil {
+		host = h
+	}
+	conn, err := net.Dial("udp4", net.JoinHostPort(host, "80"))
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+//pacUtils are the functions which PAC scripts expect,
+//besides dnsResolve and myIpAddress
+const pacUtils = `
+function isPlainHostName(host) {
+	return host.indexOf('.') < 0;
+}
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) == domain;
+}
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+function isResolvable(host) {
+	return dnsResolve(host) != null;
+}
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+function convert_addr(ip) {
+	var p = ip.split('.');
+	return ((p[0] << 24) | (p[1] << 16) | (p[2] << 8) | p[3]) >>> 0;
+}
+function isInNet(host, pattern, mask) {
+	var ip = /^\d+\.\d+\.\d+\.\d+$/.test(host) ? host : dnsResolve(host);
+	if (ip == null) {
+		return false;
+	}
+	var m = convert_addr(mask);
+	return (convert_addr(ip) & m) == (convert_addr(pattern) & m);
+}
+function shExpMatch(str, shexp) {
+	var re = shexp.replace(/[.+^${}()|[\]\\]/g, '\\$&')
+		.replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(str);
+}
+function pacArgs(args) {
+	var a = Array.prototype.slice.call(args), now = new Date();
+	if (a[a.length - 1] == 'GMT') {
+		a.pop();
+		now = new Date(now.getTime() + now.getTimezoneOffset() * 60000);
+	}
+	return {args: a, now: now};
+}
+function pacInRange(start, end, value) {
+	if (start <= end) {
+		return start <= value && value <= end;
+	}
+	return start <= value || value <= end;
+}
+function weekdayRange() {
+	var p = pacArgs(arguments), days = 'SUNMONTUEWEDTHUFRISAT';
+	var start = days.indexOf(p.args[0]) / 3;
+	var end = p.args.length > 1 ? days.indexOf(p.args[1]) / 3 : start;
+	return pacInRange(start, end, p.now.getDay());
+}
+function dateRange() {
+	var p = pacArgs(arguments), months = 'JANFEBMARAPRMAYJUNJULAUGSEPOCTNOVDEC';
+	var n = p.args.length > 1 ? p.args.length / 2 : 1;
+	var start = p.args.slice(0, n), end = p.args.length > 1 ? p.args.slice(n) : start;
+	// compare only the fields given, as yyyymmdd
+	var key = function(fields, date) {
+		var k = 0;
+		for (var i = 0; i < fields.length; i++) {
+			var f = fields[i];
+			if (typeof f == 'string') {
+				k += 100 * (date ? date.getMonth() : months.indexOf(f) / 3);
+			} else if (f > 31) {
+				k += 10000 * (date ? date.getFullYear() : f);
+			} else {
+				k += date ? date.getDate() : f;
+			}
+		}
+		return k;
+	};
+	var now = key(start, p.now);
+	var wraps = !start.some(function(f) { return typeof f != 'string' && f > 31; });
+	var s = key(start), e = key(end);
+	return wraps ? pacInRange(s, e, now) : s <= now && now <= e;
+}
+function timeRange() {
+	var p = pacArgs(arguments), a = p.args, now = p.now;
+	var secs = now.getHours() * 3600 + now.getMinutes() * 60 + now.getSeconds();
+	switch (a.length) {
+	case 1:
+		return now.getHours() == a[0];
+	case 2:
+		return pacInRange(a[0] * 3600, a[1] * 3600 - 1, secs);
+	case 4:
+		return pacInRange(a[0] * 3600 + a[1] * 60, a[2] * 3600 + a[3] * 60 - 1, secs);
+	case 6:
+		return pacInRange(a[0] * 3600 + a[1] * 60 + a[2], a[3] * 3600 + a[4] * 60 + a[5], secs);
+	}
+	return false;
+}
+`
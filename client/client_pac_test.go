@@ -0,0 +1,75 @@
+package chclient
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPACFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "penguin-pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || isInNet(host, "10.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (shExpMatch(url, "https://*.example.com/*") && dnsDomainIs(host, ".example.com"))
+		return "PROXY proxy.corp:8080; SOCKS socks.corp:1080; DIRECT";
+	return "";
+}`)
+	f.Close()
+	p := &pacFile{location: f.Name()}
+	for server, expected := range map[string][]string{
+		"ws://intranet:8080/":            {"DIRECT"},
+		"ws://10.1.2.3:8080/":            {"DIRECT"},
+		"wss://penguin.example.com:443/": {"http://proxy.corp:8080", "socks5h://socks.corp:1080", "DIRECT"},
+		"ws://penguin.example.com:80/":   {"DIRECT"},
+		"wss://penguin.example.org:443/": {"DIRECT"},
+	} {
+		proxies, err := p.find(context.Background(), server)
+		if err != nil {
+			t.Fatalf("%s: %s", server, err)
+		}
+		var got []string
+		for _, u := range proxies {
+			if u == nil {
+				got = append(got, "DIRECT")
+			} else {
+				got = append(got, u.String())
+			}
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("%s: expected %v, got %v", server, expected, got)
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("%s: expected %v, got %v", server, expected, got)
+			}
+		}
+	}
+	//the last good script is kept when it goes missing
+	os.Remove(f.Name())
+	if _, err := p.find(context.Background(), "ws://intranet/"); err != nil {
+		t.Fatalf("expected the cached script, got %s", err)
+	}
+}
+
+func TestPACTimeout(t *testing.T) {
+	f, err := ioutil.TempFile("", "penguin-pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`function FindProxyForURL(url, host) { while (true) {} }`)
+	f.Close()
+	defer func(d time.Duration) { pacTimeout = d }(pacTimeout)
+	pacTimeout = 100 * time.Millisecond
+	p := &pacFile{location: f.Name()}
+	if _, err := p.find(context.Background(), "ws://server/"); err != errPACTimeout {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
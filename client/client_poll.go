@@ -0,0 +1,218 @@
+package chclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+//pollWindow is how much data a long-polling connection
+//buffers for the server before writes block
+const pollWindow = 1 << 20
+
+//dialPoll connects to the server e with the long-polling
+//transport, optionally via proxy p, with plain requests
+//which upload and download the data of the connection
+func (c *Client) dialPoll(ctx context.Context, e endpoint, p *url.URL) (net.Conn, error) {
+	server, headers, err := c.prepareRequest(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	//back from the websocket scheme
+	server = "http" + strings.TrimPrefix(server, "ws")
+	//the proxy is set up as it is for websockets
+	d := websocket.Dialer{NetDialContext: c.config.Dial}
+	if p != nil {
+		if err := c.setProxy(p, &d); err != nil {
+			return nil, err
+		}
+	}
+	t := &http.Transport{
+		Proxy:               d.Proxy,
+		DialContext:         d.NetDialContext,
+		TLSClientConfig:     c.tlsConfig,
+		TLSHandshakeTimeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second),
+		MaxIdleConnsPerHost: 2,
+	}
+	if t.DialContext == nil {
+		t.DialContext = (&net.Dialer{}).DialContext
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = headers.Clone()
+	req.Header.Set(cnet.PollHeader, "open")
+	req.Header.Set(cnet.StreamProtocolHeader, strings.Join(c.subprotocols, ", "))
+	hc := &http.Client{Transport: t, Timeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second)}
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	key, err := io.ReadAll(io.LimitReader(res.Body, 64))
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.protocolError(res); err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK || len(key) == 0 {
+		return nil, fmt.Errorf("unexpected HTTP response (%s)", res.Status)
+	}
+	pc := &pollConn{
+		client:  &http.Client{Transport: t},
+		server:  server,
+		headers: headers,
+		key:     string(key),
+	}
+	pc.ctx, pc.cancel = context.WithCancel(context.Background())
+	pc.pending = sync.NewCond(&pc.mut)
+	pc.down, pc.downWriter = io.Pipe()
+	go pc.download()
+	go pc.upload()
+	return cnet.NewRWCConn(pc), nil
+}
+
+//pollConn is a connection of the long-polling transport,
+//downloading with long-polled GET requests, and uploading
+//what was written since the previous POST request
+type pollConn struct {
+	client     *http.Client
+	server     string
+	headers    http.Header
+	key        string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	down       *io.PipeReader
+	downWriter *io.PipeWriter
+	mut        sync.Mutex
+	pending    *sync.Cond
+	up         []byte
+	err        error
+	closeOnce  sync.Once
+}
+
+func (p *pollConn) request(method string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(p.ctx, method, p.server, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = p.headers.Clone()
+	req.Header.Set(cnet.PollHeader, p.key)
+	return p.client.Do(req)
+}
+
+func (p *pollConn) download() {
+	for {
+		res, err := p.request(http.MethodGet, nil)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		switch res.StatusCode {
+		case http.StatusOK:
+			_, err = io.Copy(p.downWriter, res.Body)
+		case http.StatusGone:
+			err = io.EOF
+		default:
+			err = fmt.Errorf("unexpected HTTP response (%s)", res.Status)
+		}
+		res.Body.Close()
+		if err != nil {
+			p.fail(err)
+			return
+		}
+	}
+}
+
+func (p *pollConn) upload() {
+	for {
+		p.mut.Lock()
+		for len(p.up) == 0 && p.err == nil {
+			p.pending.Wait()
+		}
+		b, err := p.up, p.err
+		p.up = nil
+		p.pending.Broadcast()
+		p.mut.Unlock()
+		if err != nil {
+			return
+		}
+		res, err := p.request(http.MethodPost, bytes.NewReader(b))
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			p.fail(fmt.Errorf("unexpected HTTP response (%s)", res.Status))
+			return
+		}
+	}
+}
+
+//fail ends the connection with err
+func (p *pollConn) fail(err error) {
+	if err == io.EOF {
+		p.downWriter.Close()
+	} else {
+		p.downWriter.CloseWithError(err)
+	}
+	p.mut.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.pending.Broadcast()
+	p.mut.Unlock()
+}
+
+func (p *pollConn) Read(b []byte) (int, error) {
+	return p.down.Read(b)
+}
+
+//Write queues b for the next upload
+func (p *pollConn) Write(b []byte) (int, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for len(p.up) >= pollWindow && p.err == nil {
+		p.pending.Wait()
+	}
+	if p.err != nil {
+		return 0, io.ErrClosedPipe
+	}
+	p.up = append(p.up, b...)
+	p.pending.Broadcast()
+	return len(b), nil
+}
+
+//Close ends the connection, telling the
+//server so on a best-effort basis
+func (p *pollConn) Close() error {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		p.fail(io.ErrClosedPipe)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, p.server, nil); err == nil {
+			req.Header = p.headers.Clone()
+			req.Header.Set(cnet.PollHeader, p.key)
+			if res, err := p.client.Do(req); err == nil {
+				res.Body.Close()
+			}
+		}
+		p.client.CloseIdleConnections()
+	})
+	return nil
+}
@@ -0,0 +1,273 @@
+package chclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-ntlmssp"
+	krbclient "github.com/jcmturner/gokrb5/v8/client"
+	krbconfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/myzhang1029/penguin/share/cnet"
+)
+
+//proxyAuth authenticates CONNECT requests with a
+//challenge/response scheme, one round at a time
+type proxyAuth interface {
+	//scheme is the name of the scheme in the headers
+	scheme() string
+	//token returns the next token to send, given the
+	//proxy's challenge (which is nil in the first round)
+	token(challenge []byte) ([]byte, error)
+}
+
+//basicAuth sends the credentials of the proxy URL, if any,
+//in a single round. It is used where the client connects to
+//a plain HTTP proxy itself, rather than the websocket dialer.
+type basicAuth struct {
+	user *url.Userinfo
+}
+
+func newBasicAuth(u *url.URL) (proxyAuth, error) {
+	return &basicAuth{user: u.User}, nil
+}
+
+func (a *basicAuth) scheme() string {
+	return "Basic"
+}
+
+func (a *basicAuth) token(challenge []byte) ([]byte, error) {
+	if a.user == nil {
+		return nil, nil
+	}
+	pass, _ := a.user.Password()
+	return []byte(a.user.Username() + ":" + pass), nil
+}
+
+//ntlmAuth is NTLMv2 with credentials in the form of
+//"domain\user:pass", taken from the proxy URL
+type ntlmAuth struct {
+	user, domain, pass string
+}
+
+func newNTLMAuth(u *url.URL) (proxyAuth, error) {
+	if u.User == nil {
+		return nil, errors.New("NTLM requires credentials in the proxy URL")
+	}
+	pass, _ := u.User.Password()
+	user, domain := ntlmssp.GetDomain(u.User.Username())
+	return &ntlmAuth{user: user, domain: domain, pass: pass}, nil
+}
+
+func (a *ntlmAuth) scheme() string {
+	return "NTLM"
+}
+
+func (a *ntlmAuth) token(challenge []byte) ([]byte, error) {
+	if challenge == nil {
+		return ntlmssp.NewNegotiateMessage(a.domain, "")
+	}
+	return ntlmssp.ProcessChallenge(challenge, a.user, a.pass)
+}
+
+//negotiateAuth is Kerberos wrapped in SPNEGO, for a
+//ticket to the proxy's HTTP service principal
+type negotiateAuth struct {
+	client *krbclient.Client
+	spn    string
+}
+
+//newNegotiateAuth logs in with the keytab in $KRB5_CLIENT_KTNAME
+//as the user of the proxy URL ("user" or "user@REALM"), or
+//otherwise uses the tickets in the system credential cache
+func newNegotiateAuth(u *url.URL) (proxyAuth, error) {
+	confPath := os.Getenv("KRB5_CONFIG")
+	if confPath == "" {
+		confPath = "/etc/krb5.conf"
+	}
+	conf, err := krbconfig.Load(confPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %s", confPath, err)
+	}
+	opts := krbclient.DisablePAFXFAST(true)
+	var cl *krbclient.Client
+	if ktPath := strings.TrimPrefix(os.Getenv("KRB5_CLIENT_KTNAME"), "FILE:"); ktPath != "" {
+		if u.User == nil {
+			return nil, errors.New("Negotiate with a keytab requires a user in the proxy URL")
+		}
+		kt, err := keytab.Load(ktPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load keytab: %s", err)
+		}
+		user, realm := u.User.Username(), conf.LibDefaults.DefaultRealm
+		if i := strings.LastIndex(user, "@"); i >= 0 {
+			user, realm = user[:i], user[i+1:]
+		}
+		cl = krbclient.NewWithKeytab(user, realm, kt, conf, opts)
+		if err := cl.Login(); err != nil {
+			return nil, fmt.Errorf("kerberos login failed: %s", err)
+		}
+	} else {
+		ccPath := strings.TrimPrefix(os.Getenv("KRB5CCNAME"), "FILE:")
+		if ccPath == "" {
+			ccPath = fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+		}
+		cc, err := credentials.LoadCCache(ccPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load credential cache (kinit?): %s", err)
+		}
+		if cl, err = krbclient.NewFromCCache(cc, conf, opts); err != nil {
+			return nil, fmt.Errorf("failed to use credential cache: %s", err)
+		}
+	}
+	return &negotiateAuth{client: cl, spn: "HTTP/" + u.Hostname()}, nil
+}
+
+func (a *negotiateAuth) scheme() string {
+	return "Negotiate"
+}
+
+func (a *negotiateAuth) token(challenge []byte) ([]byte, error) {
+	//kerberos completes in one round,
+	//so any challenge is a rejection
+	if challenge != nil {
+		return nil, errors.New("proxy rejected the kerberos ticket")
+	}
+	s := spnego.SPNEGOClient(a.client, a.spn)
+	if err := s.AcquireCred(); err != nil {
+		return nil, err
+	}
+	st, err := s.InitSecContext()
+	if err != nil {
+		return nil, err
+	}
+	return st.Marshal()
+}
+
+//connectDialer tunnels connections through an HTTP CONNECT
+//proxy, which requires more than basic authentication
+type connectDialer struct {
+	proxy   *url.URL
+	newAuth func(*url.URL) (proxyAuth, error)
+	//forward connects to the proxy, nil uses net.Dialer
+	forward cnet.DialFunc
+}
+
+//DialContext connects to addr through the proxy. All rounds
+//of the authentication happen on the same connection, since
+//schemes like NTLM authenticate the connection rather than
+//the request.
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	auth, err := d.newAuth(d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+	forward := d.forward
+	if forward == nil {
+		var nd net.Dialer
+		forward = nd.DialContext
+	}
+	conn, err := forward(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+	}
+	//give up with the context
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if err := d.connect(conn, addr, auth); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *connectDialer) connect(conn net.Conn, addr string, auth proxyAuth) error {
+	br := bufio.NewReader(conn)
+	var challenge []byte
+	//a handful of rounds is plenty for any scheme
+	for round := 0; round < 4; round++ {
+		token, err := auth.token(challenge)
+		if err != nil {
+			return fmt.Errorf("proxy authentication failed: %s", err)
+		}
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: http.Header{},
+		}
+		if token != nil {
+			req.Header.Set("Proxy-Authorization", auth.scheme()+" "+base64.StdEncoding.EncodeToString(token))
+		}
+		req.Header.Set("Proxy-Connection", "Keep-Alive")
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusOK {
+			if br.Buffered() > 0 {
+				return errors.New("proxy sent data before the tunnel was used")
+			}
+			return nil
+		}
+		//keep the connection for the next round
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			return fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+		}
+		if _, ok := auth.(*basicAuth); ok {
+			return errors.New("proxy rejected Basic authentication")
+		}
+		challenge = nil
+		prefix := auth.scheme() + " "
+		for _, h := range resp.Header["Proxy-Authenticate"] {
+			if strings.HasPrefix(h, prefix) {
+				if challenge, err = base64.StdEncoding.DecodeString(strings.TrimSpace(h[len(prefix):])); err != nil {
+					return fmt.Errorf("invalid proxy challenge: %s", err)
+				}
+			}
+		}
+		if challenge == nil {
+			return fmt.Errorf("proxy rejected %s authentication", auth.scheme())
+		}
+	}
+	return errors.New("proxy authentication did not complete")
+}
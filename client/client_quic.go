@@ -0,0 +1,134 @@
+package chclient
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+//dialQUIC connects to the server e with the QUIC transport,
+//carrying the SSH connection on a single stream. Certificates
+//are only verified for https servers, otherwise the SSH
+//handshake alone authenticates the server, as it does
+//over plain websockets. Reconnections send the start of the
+//SSH handshake as 0-RTT data, which is safe to replay since
+//the server's half of the handshake is fresh each time.
+func (c *Client) dialQUIC(ctx context.Context, e endpoint) (net.Conn, error) {
+	tc := c.quicTLSConfig()
+	tc.NextProtos = []string{cnet.QUICProtocol}
+	ctx, cancel := context.WithTimeout(ctx, settings.EnvDuration("WS_TIMEOUT", 45*time.Second))
+	defer cancel()
+	conn, done, err := c.dialQUICConn(ctx, e.host, tc, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		done()
+		return nil, err
+	}
+	return &streamConn{Conn: cnet.NewQUICConn(conn, stream), done: done}, nil
+}
+
+//dialWebTransport connects to the server e with the first
+//stream of a WebTransport session over HTTP/3, verifying
+//certificates as the QUIC transport does
+func (c *Client) dialWebTransport(ctx context.Context, e endpoint) (net.Conn, error) {
+	server, headers, err := c.prepareRequest(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	//HTTP/3 is always encrypted
+	server = "https" + strings.TrimPrefix(strings.TrimPrefix(server, "wss"), "ws")
+	headers.Set(cnet.StreamProtocolHeader, strings.Join(c.subprotocols, ", "))
+	var conn *quic.Conn
+	done := func() {}
+	d := &webtransport.Dialer{
+		TLSClientConfig: c.quicTLSConfig(),
+		QUICConfig:      quicConfig(),
+		DialAddr: func(ctx context.Context, addr string, tc *tls.Config, qc *quic.Config) (*quic.Conn, error) {
+			var err error
+			conn, done, err = c.dialQUICConn(ctx, addr, tc, qc)
+			return conn, err
+		},
+	}
+	closeAll := func() {
+		if conn != nil {
+			conn.CloseWithError(0, "")
+			done()
+		}
+		d.Close()
+	}
+	ctx, cancel := context.WithTimeout(ctx, settings.EnvDuration("WS_TIMEOUT", 45*time.Second))
+	defer cancel()
+	resp, sess, err := d.Dial(ctx, server, headers)
+	if err != nil {
+		closeAll()
+		if perr := c.protocolError(resp); perr != nil {
+			return nil, perr
+		}
+		return nil, err
+	}
+	stream, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return &streamConn{Conn: cnet.NewWebTransportConn(sess, stream), done: closeAll}, nil
+}
+
+//dialQUICConn makes the QUIC connection to addr, through the
+//MASQUE relay if any, whose datagrams then carry its packets.
+//done releases the relay once the connection is closed.
+func (c *Client) dialQUICConn(ctx context.Context, addr string, tc *tls.Config, qc *quic.Config) (*quic.Conn, func(), error) {
+	if c.masque == nil {
+		conn, err := quic.DialAddrEarly(ctx, addr, tc, qc)
+		return conn, func() {}, err
+	}
+	pc, raddr, closeRelay, err := c.dialMASQUE(ctx, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := &quic.Transport{Conn: pc}
+	done := func() {
+		tr.Close()
+		pc.Close()
+		closeRelay()
+	}
+	if tc.ServerName == "" {
+		tc.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	qc.InitialPacketSize = masqueMTU
+	qc.DisablePathMTUDiscovery = true
+	conn, err := tr.DialEarly(ctx, raddr, tc, qc)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return conn, done, nil
+}
+
+//quicTLSConfig is the TLS configuration of the QUIC
+//transports, which only verify https servers
+func (c *Client) quicTLSConfig() *tls.Config {
+	if c.tlsConfig != nil {
+		return c.tlsConfig.Clone()
+	}
+	return &tls.Config{InsecureSkipVerify: true, ClientSessionCache: c.tlsSessions}
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  settings.EnvDuration("QUIC_IDLE_TIMEOUT", 45*time.Second),
+		KeepAlivePeriod: 15 * time.Second,
+		EnableDatagrams: true, //required by WebTransport
+	}
+}
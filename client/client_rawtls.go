@@ -0,0 +1,38 @@
+package chclient
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+//dialRawTLS connects to the server e with the raw TLS
+//transport, speaking SSH directly over TLS, verifying
+//certificates as the QUIC transport does
+func (c *Client) dialRawTLS(ctx context.Context, e endpoint) (net.Conn, error) {
+	dial := c.config.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(ctx, settings.EnvDuration("WS_TIMEOUT", 45*time.Second))
+	defer cancel()
+	conn, err := dial(ctx, "tcp", e.host)
+	if err != nil {
+		return nil, err
+	}
+	tc := c.quicTLSConfig()
+	tc.NextProtos = []string{cnet.TLSProtocol}
+	if tc.ServerName == "" {
+		tc.ServerName, _, _ = net.SplitHostPort(e.host)
+	}
+	tconn := tls.Client(conn, tc)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
@@ -45,6 +45,39 @@ func TestCustomHeaders(t *testing.T) {
 	c.Close()
 }
 
+func TestLegacyPsk(t *testing.T) {
+	//fake server predating the authenticator
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Penguin-Psk") != "secret" {
+			t.Fatal("expected header X-Penguin-Psk to be 'secret'")
+		}
+		if req.Header.Get("X-Penguin-Auth") == "" {
+			t.Fatal("expected header X-Penguin-Auth to be set")
+		}
+		wg.Done()
+	}))
+	defer server.Close()
+	//client
+	config := Config{
+		KeepAlive:        time.Second,
+		MaxRetryInterval: time.Second,
+		Server:           server.URL,
+		Remotes:          []string{"9003"},
+		Psk:              "secret",
+		PskLegacy:        true,
+	}
+	c, err := NewClient(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go c.Run()
+	//wait for test to complete
+	wg.Wait()
+	c.Close()
+}
+
 func TestFallbackLegacyFingerprint(t *testing.T) {
 	config := Config{
 		Fingerprint: "a5:32:92:c6:56:7a:9e:61:26:74:1b:81:a6:f5:1b:44",
@@ -0,0 +1,90 @@
+package chclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/myzhang1029/penguin/share/ccrypto"
+	"golang.org/x/crypto/pkcs12"
+)
+
+var errNoPinnedKey = errors.New("tls: server certificate does not match any pinned key")
+
+//verifyPins returns a VerifyPeerCertificate function which
+//requires a certificate of the server's chain to have one of the
+//given SPKI SHA256 hashes. When certificate verification is skipped,
+//only the server's own certificate can match.
+func verifyPins(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	want := map[string]bool{}
+	for _, p := range pins {
+		p = strings.TrimPrefix(p, "sha256/")
+		if b, err := base64.StdEncoding.DecodeString(p); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("invalid TLS pin '%s', expected a base64 SHA256 hash", p)
+		}
+		want[p] = true
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 {
+			if len(rawCerts) == 0 {
+				return errNoPinnedKey
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			verifiedChains = [][]*x509.Certificate{{leaf}}
+		}
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if want[ccrypto.FingerprintSPKI(cert)] {
+					return nil
+				}
+			}
+		}
+		return errNoPinnedKey
+	}, nil
+}
+
+//loadPKCS12 loads a client certificate, its chain
+//and its key from a PKCS#12 (.p12 or .pfx) bundle
+func loadPKCS12(path, password string) (tls.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	blocks, err := pkcs12.ToPEM(b, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var key []byte
+	var certs [][]byte
+	for _, b := range blocks {
+		if b.Type == "CERTIFICATE" {
+			certs = append(certs, pem.EncodeToMemory(b))
+		} else {
+			key = pem.EncodeToMemory(b)
+		}
+	}
+	if key == nil || len(certs) == 0 {
+		return tls.Certificate{}, errors.New("expected a certificate and a key")
+	}
+	//the bundle may hold the chain in any order,
+	//but the certificate of the key must come first
+	err = errors.New("no certificate matches the key")
+	for i, leaf := range certs {
+		chain := append([][]byte{leaf}, certs[:i]...)
+		chain = append(chain, certs[i+1:]...)
+		var cert tls.Certificate
+		if cert, err = tls.X509KeyPair(bytes.Join(chain, nil), key); err == nil {
+			return cert, nil
+		}
+	}
+	return tls.Certificate{}, err
+}
@@ -0,0 +1,119 @@
+package chclient
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/ccrypto"
+)
+
+func TestVerifyPins(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	cert := server.Certificate()
+	pin := ccrypto.FingerprintSPKI(cert)
+	raw := [][]byte{cert.Raw}
+	chains := [][]*x509.Certificate{{cert}}
+	verify, err := verifyPins([]string{"sha256/" + pin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(raw, nil); err != nil {
+		t.Fatalf("expected unverified leaf to match: %s", err)
+	}
+	if err := verify(raw, chains); err != nil {
+		t.Fatalf("expected verified chain to match: %s", err)
+	}
+	other := ccrypto.FingerprintSPKI(&x509.Certificate{RawSubjectPublicKeyInfo: []byte("other")})
+	verify, err = verifyPins([]string{other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(raw, chains); err != errNoPinnedKey {
+		t.Fatalf("expected pin mismatch, got %v", err)
+	}
+	if err := verify(nil, nil); err != errNoPinnedKey {
+		t.Fatalf("expected pin mismatch without certificates, got %v", err)
+	}
+	if _, err := verifyPins([]string{"abc"}); err == nil {
+		t.Fatal("expected invalid pin to be rejected")
+	}
+}
+
+func TestLoadPKCS12(t *testing.T) {
+	path := filepath.Join("testdata", "client.p12")
+	cert, err := loadPKCS12(path, "penguin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Fatalf("expected certificate and CA, got %d certificates", len(cert.Certificate))
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "client" {
+		t.Fatalf("expected the client certificate first, got %s", leaf.Subject.CommonName)
+	}
+	if _, err := loadPKCS12(path, "wrong"); err == nil {
+		t.Fatal("expected wrong password to fail")
+	}
+}
+
+func TestSNIOverride(t *testing.T) {
+	type request struct{ host, sni string }
+	requests := make(chan request, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- request{r.Host, r.TLS.ServerName}:
+		default:
+		}
+	}))
+	defer server.Close()
+	headers := http.Header{}
+	headers.Set("Host", "tunnel.example.com")
+	c, err := NewClient(&Config{
+		KeepAlive:        time.Second,
+		MaxRetryInterval: time.Second,
+		Server:           server.URL,
+		Remotes:          []string{"9002"},
+		Headers:          headers,
+		TLS: TLSConfig{
+			SkipVerify: true,
+			ServerName: "cdn.example.net",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Run()
+	defer c.Close()
+	select {
+	case r := <-requests:
+		if r.host != "tunnel.example.com" || r.sni != "cdn.example.net" {
+			t.Fatalf("expected fronted request, got host %s and SNI %s", r.host, r.sni)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+	}
+}
+
+func TestKeystoreExclusive(t *testing.T) {
+	_, err := NewClient(&Config{
+		Server:  "https://localhost:1",
+		Remotes: []string{"9002"},
+		TLS: TLSConfig{
+			Keystore: "client",
+			PKCS12:   "testdata/client.p12",
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "OS keystore") {
+		t.Fatalf("expected the keystore and the bundle to conflict, got %v", err)
+	}
+}
@@ -1,13 +1,35 @@
+// Package chserver is the penguin server, which Go programs
+// can embed as well. A Server is configured with plain values
+// (no flags are parsed), runs until the context given to
+// StartContext is cancelled, and logs and dials remotes as set
+// in its Config:
+//
+//	s, err := chserver.NewServer(&chserver.Config{
+//		Reverse: true,
+//		Logger:  cio.NewLogger("myapp"),
+//	})
+//	if err != nil {
+//		...
+//	}
+//	if err := s.StartContext(ctx, "0.0.0.0", "8080"); err != nil {
+//		...
+//	}
+//	err = s.Wait()
+//
+// The exported API follows semantic versioning, like that of
+// chclient.
 package chserver
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,37 +37,204 @@ import (
 	chshare "github.com/myzhang1029/penguin/share"
 	"github.com/myzhang1029/penguin/share/ccrypto"
 	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/cmetrics"
 	"github.com/myzhang1029/penguin/share/cnet"
 	"github.com/myzhang1029/penguin/share/settings"
+	"github.com/myzhang1029/penguin/share/tunnel"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+	kcp "github.com/xtaci/kcp-go/v5"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/icmp"
 )
 
 // Config is the configuration for the penguin service
 type Config struct {
 	KeySeed   string
 	AuthFile  string
+	AuthDB    string
+	Redis     string
+	QuotaFile string
 	Auth      string
 	Psk       string
+	Psks      []string
+	PskFile   string
+	PskLegacy bool
+	WsPath    string
 	Proxy     string
 	Resp404   string
 	Socks5    bool
 	Reverse   bool
 	Obfs      bool
+	Admin     string
 	KeepAlive time.Duration
 	TLS       TLSConfig
+	JWT       JWTConfig
+	LDAP      LDAPConfig
+	PAM       PAMConfig
+	// Quota is the default number of bytes each
+	// user may transfer, 0 for no limit
+	Quota int64
+	// DNS controls how the hostnames of remotes are
+	// resolved, see cnet.NewResolver
+	DNS string
+	// DNSCache, if set, caches the resolutions of those
+	// hostnames for their TTL, up to DNSCache
+	DNSCache time.Duration
+	// EgressBind is the local IP address or interface that
+	// remotes are dialed from. Entries in the form of
+	// <addr-pattern>=<ip-or-interface> override it for
+	// the matching remotes.
+	EgressBind []string
+	// Upstream is a SOCKS5 or HTTP proxy which remotes and
+	// SOCKS requests are dialed through, see cnet.ParseUpstream
+	Upstream string
+	// HandshakeLimit limits how often each source IP may
+	// connect, e.g. "10/1m", see newHandshakeLimiter
+	HandshakeLimit string
+	// HealthToken, if set, is required to read the
+	// JSON state of the server from /health
+	HealthToken string
+	// Metrics receives the server's instrumentation. When it
+	// is a *cmetrics.Prometheus, it is also served on the
+	// admin API at /metrics.
+	Metrics cmetrics.Sink
+	// Logger, if set, is forked for the server's logs,
+	// which otherwise go to stderr
+	Logger *cio.Logger
+	// Dial, if set, makes the connections to remotes
+	// instead of net.Dialer, see cnet.Dialer
+	Dial cnet.DialFunc
+	// Subprotocols are the websocket subprotocols accepted
+	// from clients, defaulting to the supported protocol
+	// versions
+	Subprotocols []string
+	// KeepAliveTimeout closes connections of newer clients
+	// whose pings stop for this long after the negotiated
+	// interval, defaulting to the interval
+	KeepAliveTimeout time.Duration
+	// PskPath only accepts websocket upgrades to the
+	// per-connection paths which clients derive from
+	// the PSK, see ccrypto.PSKPath
+	PskPath bool
+	// UDP limits the UDP flows of the remotes, the
+	// server relays forward ones and listens for reverse ones
+	UDP tunnel.UDPConfig
+	// ListenerAllow restricts the clients of the listeners of
+	// reverse remotes to a comma separated list of networks
+	// (CIDR notation) or IP addresses
+	ListenerAllow string
+	// ListenerSocksAuth, as <user>:<pass>, requires SOCKS5
+	// username/password authentication on reverse socks
+	// listeners
+	ListenerSocksAuth string
+	// Tun allows clients to bridge their tun remotes with
+	// TUN devices of the server (Linux only, requires
+	// CAP_NET_ADMIN)
+	Tun bool
+	// Compress are the compression algorithms which clients
+	// may choose for the payloads of their channels, none by
+	// default, see cnet.Compressions
+	Compress []string
+	// QUICPort is the UDP port on which clients may also connect
+	// with the QUIC transport, on the same host as the websocket
+	// listener, none by default
+	QUICPort string
+	// DNSZone is the zone delegated to the server, whose
+	// queries carry the connections of clients with the DNS
+	// transport, answered on DNSPort (UDP, 53 by default)
+	DNSZone string
+	DNSPort string
+	// ICMP also accepts clients with the ICMP transport, whose
+	// echo requests are replied to with a raw socket (requires
+	// CAP_NET_RAW), on the host of the websocket listener
+	ICMP bool
+	// RawTLSPort is the TCP port on which clients may also
+	// connect with the raw TLS transport, SSH directly over TLS
+	// without HTTP, on the same host as the websocket listener,
+	// none by default
+	RawTLSPort string
+	// KCPPort is the UDP port on which clients may also connect
+	// with the KCP transport, on the same host as the websocket
+	// listener, none by default
+	KCPPort string
+	// Resume keeps the sessions of clients which resume them
+	// for this long after their connection drops, so that their
+	// forwarded connections survive reconnecting. Sessions are
+	// not resumed by default.
+	Resume time.Duration
+	// SSH restricts the ciphers, key exchanges and MACs of the
+	// SSH connections, e.g. for compliance with a policy
+	SSH settings.SSHAlgorithms
+	// MASQUE relays UDP for standard CONNECT-UDP (RFC 9298)
+	// clients over HTTP/3 on the QUIC port, to the targets
+	// which their users may access when authentication is
+	// enabled, see handleMASQUE
+	MASQUE bool
+	// KeepAliveMisses is the number of keepalive timeouts in
+	// a row after which clients are declared dead, one by
+	// default. It is negotiated like KeepAlive.
+	KeepAliveMisses int
+	// WsCompress lets websocket clients negotiate
+	// permessage-deflate (RFC 7692)
+	WsCompress bool
+	// TCPKeepAlive is the TCP keepalive period of the
+	// connections accepted by reverse remotes and dialed
+	// to the targets of remotes. 0 keeps the default of
+	// Go (15s), a negative period disables keepalives.
+	TCPKeepAlive time.Duration
+	// Unix allows clients to reach unix sockets and named
+	// pipes on the server, and to listen on them with
+	// reverse remotes
+	Unix bool
+	// Serial allows clients to bridge serial devices
+	// of the server (Linux only)
+	Serial bool
+	// RemoteTLS has the certificates with which reverse
+	// remotes may terminate TLS (?terminate=true)
+	RemoteTLS RemoteTLSConfig
 }
 
 // Server respresent a penguin service
 type Server struct {
 	*cio.Logger
 	config       *Config
+	metrics      cmetrics.Sink
 	fingerprint  string
 	httpServer   *cnet.HTTPServer
+	faults       *cnet.Faults
+	jwks         *jwks
+	ldap         *ldapAuth
+	redis        *redisState
+	quotas       *quotas
+	dialer       *cnet.Dialer
+	pam          *pamAuth
+	adminServer  *cnet.HTTPServer
 	reverseProxy *httputil.ReverseProxy
 	sessCount    int32
+	subprotocols map[string]bool
+	started      time.Time
+	psks         pskSet
+	pskReplays   replayCache
+	totpSteps    totpSteps
+	handshakes   *handshakeLimiter
+	listeners    tunnel.ListenerConfig
+	registry     sessionRegistry
 	sessions     *settings.Users
 	sshConfig    *ssh.ServerConfig
 	users        *settings.UserIndex
+	quic         *quic.Transport
+	webTransport *webtransport.Server
+	polls        pollSessions
+	dns          net.PacketConn
+	icmp         *icmp.PacketConn
+	rawTLS       net.Listener
+	kcp          *kcp.Listener
+	datagrams    datagramSessions
+	resumables   resumableSessions
+	remoteTLS    *tls.Config
 }
 
 var upgrader = websocket.Upgrader{
@@ -57,20 +246,160 @@ var upgrader = websocket.Upgrader{
 // NewServer creates and returns a new penguin server
 func NewServer(c *Config) (*Server, error) {
 	server := &Server{
-		config:     c,
-		httpServer: cnet.NewHTTPServer(),
-		Logger:     cio.NewLogger("server"),
-		sessions:   settings.NewUsers(),
+		config:      c,
+		httpServer:  cnet.NewHTTPServer(),
+		adminServer: cnet.NewHTTPServer(),
+		metrics:     cmetrics.OrNop(c.Metrics),
+		sessions:    settings.NewUsers(),
+	}
+	if c.Logger != nil {
+		server.Logger = c.Logger.Fork("server")
+	} else {
+		server.Logger = cio.NewLogger("server")
+		server.Info = true
+	}
+	if c.WsPath != "" && !strings.HasPrefix(c.WsPath, "/") {
+		c.WsPath = "/" + c.WsPath
+	}
+	if len(c.Subprotocols) == 0 {
+		c.Subprotocols = chshare.ProtocolVersions()
+	}
+	server.subprotocols = map[string]bool{}
+	for _, p := range c.Subprotocols {
+		server.subprotocols[p] = true
+	}
+	if spec := settings.Env("FAULTS"); spec != "" {
+		f, err := cnet.ParseFaults(spec)
+		if err != nil {
+			return nil, err
+		}
+		server.Infof("WARNING: injecting faults into connections (%s)", spec)
+		server.faults = f
 	}
-	server.Info = true
 	server.users = settings.NewUserIndex(server.Logger)
+	if c.AuthFile != "" && c.AuthDB != "" {
+		return nil, errors.New("authfile and authdb are mutually exclusive")
+	}
 	if c.AuthFile != "" {
 		if err := server.users.LoadUsers(c.AuthFile); err != nil {
 			return nil, err
 		}
 	}
+	if c.Psk != "" {
+		server.psks.static = append(server.psks.static, c.Psk)
+	}
+	server.psks.static = append(server.psks.static, c.Psks...)
+	if c.PskFile != "" {
+		server.psks.file = c.PskFile
+		if err := server.psks.load(); err != nil {
+			return nil, err
+		}
+		if err := server.psks.watch(server.Logger); err != nil {
+			return nil, err
+		}
+	}
+	if c.PskPath {
+		if c.Psk == "" && len(c.Psks) == 0 && c.PskFile == "" {
+			return nil, errors.New("PSK derived paths require a PSK")
+		}
+		if c.WsPath != "" {
+			return nil, errors.New("cannot use both a websocket path and PSK derived paths")
+		}
+	}
+	for _, algorithm := range c.Compress {
+		if settings.NegotiateCompression([]string{algorithm}, cnet.Compressions) == "" {
+			return nil, fmt.Errorf("unsupported compression '%s'", algorithm)
+		}
+	}
+	if c.MASQUE && c.QUICPort == "" {
+		return nil, errors.New("MASQUE requires a QUIC port")
+	}
+	if c.DNSZone != "" && c.DNSPort == "" {
+		c.DNSPort = "53"
+	}
+	allow, err := settings.ParseNetworks(c.ListenerAllow)
+	if err != nil {
+		return nil, err
+	}
+	server.listeners.Allow = allow
+	if c.ListenerSocksAuth != "" {
+		server.listeners.SocksUser, server.listeners.SocksPass = settings.ParseAuth(c.ListenerSocksAuth)
+		if server.listeners.SocksUser == "" {
+			return nil, errors.New("listener socks auth must be <user>:<pass>")
+		}
+	}
+	if server.remoteTLS, err = server.remoteTLSConfig(); err != nil {
+		return nil, err
+	}
+	handshakes, err := newHandshakeLimiter(c.HandshakeLimit)
+	if err != nil {
+		return nil, err
+	}
+	server.handshakes = handshakes
+	dialer, err := newDialer(c)
+	if err != nil {
+		return nil, err
+	}
+	server.dialer = dialer
+	quotas, err := loadQuotas(c.QuotaFile)
+	if err != nil {
+		return nil, err
+	}
+	server.quotas = quotas
+	if c.Redis != "" {
+		r, err := newRedisState(c.Redis)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to redis: %s", err)
+		}
+		server.redis = r
+	}
+	if c.AuthDB != "" && isRedisURL(c.AuthDB) {
+		r := server.redis
+		if c.AuthDB != c.Redis {
+			var err error
+			if r, err = newRedisState(c.AuthDB); err != nil {
+				return nil, fmt.Errorf("failed to connect to redis: %s", err)
+			}
+		}
+		if err := r.watchUsers(server.users.Logger, server.users); err != nil {
+			return nil, fmt.Errorf("failed to load users from redis: %s", err)
+		}
+	} else if c.AuthDB != "" {
+		if err := server.users.LoadUsersDB(c.AuthDB); err != nil {
+			return nil, err
+		}
+	}
+	if c.JWT.OIDCIssuer != "" {
+		// the provider issues ID tokens to all of its clients
+		if c.JWT.Audience == "" {
+			return nil, errors.New("--oidc-issuer requires --jwt-audience")
+		}
+		if err := c.JWT.discover(); err != nil {
+			return nil, err
+		}
+	}
+	if c.JWT.JWKS != "" {
+		server.jwks = newJWKS(c.JWT.JWKS)
+	}
+	if c.JWT.Claim == "" {
+		c.JWT.Claim = "remotes"
+	}
+	if c.LDAP.URL != "" {
+		a, err := newLDAPAuth(&c.LDAP)
+		if err != nil {
+			return nil, err
+		}
+		server.ldap = a
+	}
+	if c.PAM.Service != "" {
+		a, err := newPAMAuth(&c.PAM)
+		if err != nil {
+			return nil, err
+		}
+		server.pam = a
+	}
 	if c.Auth != "" {
-		u := &settings.User{Addrs: []*regexp.Regexp{settings.UserAllowAll}}
+		u := &settings.User{Addrs: []settings.AddrMatcher{settings.UserAllowAll}}
 		u.Name, u.Pass = settings.ParseAuth(c.Auth)
 		if u.Name != "" {
 			server.users.AddUser(u)
@@ -79,19 +408,23 @@ func NewServer(c *Config) (*Server, error) {
 	//generate private key (optionally using seed)
 	key, err := ccrypto.GenerateKey(c.KeySeed)
 	if err != nil {
-		log.Fatal("failed to generate key")
+		return nil, fmt.Errorf("failed to generate key: %s", err)
 	}
 	//convert into ssh.PrivateKey
 	private, err := ssh.ParsePrivateKey(key)
 	if err != nil {
-		log.Fatal("failed to parse key")
+		return nil, fmt.Errorf("failed to parse key: %s", err)
 	}
 	//fingerprint this key
 	server.fingerprint = ccrypto.FingerprintKey(private.PublicKey())
 	//create ssh config
 	server.sshConfig = &ssh.ServerConfig{
-		ServerVersion:    "SSH-" + chshare.ProtocolVersion + "-server",
-		PasswordCallback: server.authUser,
+		ServerVersion:               "SSH-" + chshare.ProtocolVersion + "-server",
+		PasswordCallback:            server.authUser,
+		KeyboardInteractiveCallback: server.authUserInteractive,
+	}
+	if err := c.SSH.Apply(&server.sshConfig.Config); err != nil {
+		return nil, err
 	}
 	server.sshConfig.AddHostKey(private)
 	//setup reverse proxy
@@ -136,23 +469,95 @@ func (s *Server) Start(host, port string) error {
 // StartContext is responsible for kicking off the http server,
 // and can be closed by cancelling the provided context
 func (s *Server) StartContext(ctx context.Context, host, port string) error {
+	s.started = time.Now()
 	s.Infof("fingerprint %s", s.fingerprint)
 	if s.users.Len() > 0 {
 		s.Infof("user authentication enabled")
 	}
+	if s.config.JWT.enabled() {
+		s.Infof("bearer token authentication enabled")
+	}
+	if s.ldap != nil {
+		s.Infof("LDAP authentication enabled")
+	}
+	if s.redis != nil {
+		s.Infof("sharing state through redis")
+	}
+	if s.pam != nil {
+		s.Infof("PAM authentication enabled (service %s)", s.config.PAM.Service)
+	}
 	if s.reverseProxy != nil {
 		s.Infof("reverse proxy enabled")
 	}
-	l, err := s.listener(host, port)
+	if s.dialer != nil && s.dialer.Resolver != nil {
+		s.Infof("resolving remotes with %s", s.dialer.Resolver)
+	}
+	if s.dialer != nil && s.dialer.Egress != nil {
+		s.Infof("dialing remotes from %s", s.dialer.Egress)
+	}
+	if s.dialer != nil && s.dialer.Upstream != nil {
+		s.Infof("dialing remotes through %s", s.dialer.Upstream)
+	}
+	if s.handshakes != nil {
+		s.Infof("limiting handshakes to %s per IP", s.handshakes)
+	}
+	if s.config.QuotaFile != "" {
+		go s.saveQuotasLoop(ctx)
+	}
+	tlsConf, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	l, err := s.listener(host, port, tlsConf)
 	if err != nil {
 		return err
 	}
+	if s.config.QUICPort != "" {
+		if err := s.listenQUIC(ctx, host, tlsConf); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	if s.config.DNSZone != "" {
+		if err := s.listenDNS(ctx, host); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	if s.config.RawTLSPort != "" {
+		if err := s.listenRawTLS(ctx, host, tlsConf); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	if s.config.KCPPort != "" {
+		if err := s.listenKCP(ctx, host); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	if s.config.ICMP {
+		if err := s.listenICMP(ctx, host); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	if s.config.Admin != "" {
+		if err := s.listenAdmin(ctx); err != nil {
+			l.Close()
+			return err
+		}
+	}
 	h := http.Handler(http.HandlerFunc(s.handleClientHandler))
 	if s.Debug {
 		o := requestlog.DefaultOptions
 		o.TrustProxy = true
 		h = requestlog.WrapWith(h, o)
 	}
+	if tlsConf == nil {
+		//cleartext HTTP/2 for the stream transport
+		h = h2c.NewHandler(h, &http2.Server{})
+	}
 	return s.httpServer.GoServe(ctx, l, h)
 }
 
@@ -163,6 +568,27 @@ func (s *Server) Wait() error {
 
 // Close forcibly closes the http server
 func (s *Server) Close() error {
+	if s.config.Admin != "" {
+		s.adminServer.Close()
+	}
+	if s.quic != nil {
+		s.closeQUIC()
+	}
+	s.polls.closeAll()
+	if s.dns != nil {
+		s.dns.Close()
+	}
+	if s.icmp != nil {
+		s.icmp.Close()
+	}
+	if s.rawTLS != nil {
+		s.rawTLS.Close()
+	}
+	if s.kcp != nil {
+		s.kcp.Close()
+	}
+	s.datagrams.closeAll()
+	s.resumables.closeAll()
 	return s.httpServer.Close()
 }
 
@@ -171,30 +597,179 @@ func (s *Server) GetFingerprint() string {
 	return s.fingerprint
 }
 
-// authUser is responsible for validating the ssh user / password combination
+// authUser is responsible for validating the ssh user / password combination.
+// Users with a second factor append the current code to their password,
+// separated by a colon.
 func (s *Server) authUser(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 	// check if user authentication is enabled and if not, allow all
-	if s.users.Len() == 0 {
+	if !s.authEnabled() {
+		return nil, nil
+	}
+	pass, code := string(password), ""
+	if user, found := s.users.Get(c.User()); found && user.TOTP != nil {
+		if i := strings.LastIndex(pass, ":"); i >= 0 {
+			pass, code = pass[:i], pass[i+1:]
+		}
+	}
+	return s.checkUser(c, pass, code)
+}
+
+// authUserInteractive is responsible for validating the ssh user through
+// a keyboard-interactive exchange, asking for the password and, if the
+// user has one, the current code of their second factor
+func (s *Server) authUserInteractive(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	// check if user authentication is enabled and if not, allow all
+	if !s.authEnabled() {
+		return nil, nil
+	}
+	questions := []string{"Password: "}
+	echos := []bool{false}
+	// every user is asked the same, so that the questions
+	// do not reveal which users exist or have a second factor
+	if s.users.HasTOTP() {
+		questions = append(questions, "Verification code: ")
+		echos = append(echos, true)
+	}
+	answers, err := client(c.User(), "", questions, echos)
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != len(questions) {
+		return nil, errors.New("unexpected number of answers")
+	}
+	code := ""
+	if len(answers) > 1 {
+		code = strings.TrimSpace(answers[1])
+	}
+	return s.checkUser(c, answers[0], code)
+}
+
+// checkUser validates the credentials of a user and records the user
+// for the session
+func (s *Server) checkUser(c ssh.ConnMetadata, pass, code string) (*ssh.Permissions, error) {
+	// bearer tokens can be presented in place of the password
+	if s.config.JWT.enabled() && ccrypto.IsJWT(pass) {
+		user, err := s.authJWT(pass)
+		if err != nil {
+			s.Debugf("login failed for token (%s)", err)
+			s.metrics.Counter("penguin_auth_failures_total", 1)
+			return nil, errors.New("invalid bearer token")
+		}
+		s.sessions.Set(string(c.SessionID()), user)
 		return nil, nil
 	}
 	// check the user exists and has matching password
 	n := c.User()
 	user, found := s.users.Get(n)
-	if !found || user.Pass != string(password) {
+	// users not in the authfile may be in the directory
+	if !found && s.ldap != nil {
+		user, err := s.ldap.authenticate(n, pass)
+		if err != nil {
+			s.Debugf("login failed for user: %s (%s)", n, err)
+			s.metrics.Counter("penguin_auth_failures_total", 1)
+			return nil, errors.New("invalid authentication for username: %s")
+		}
+		s.sessions.Set(string(c.SessionID()), user)
+		return nil, nil
+	}
+	// or be system accounts
+	if !found && s.pam != nil {
+		host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		user, err := s.pam.authenticate(n, pass, host)
+		if err != nil {
+			s.Debugf("login failed for user: %s (%s)", n, err)
+			s.metrics.Counter("penguin_auth_failures_total", 1)
+			return nil, errors.New("invalid authentication for username: %s")
+		}
+		s.sessions.Set(string(c.SessionID()), user)
+		return nil, nil
+	}
+	if !found || user.Pass != pass {
 		s.Debugf("login failed for user: %s", n)
+		s.metrics.Counter("penguin_auth_failures_total", 1)
 		return nil, errors.New("invalid authentication for username: %s")
 	}
+	// check the second factor, whose codes are only valid once
+	if user.TOTP != nil {
+		step, ok := ccrypto.MatchTOTP(user.TOTP, code, time.Now())
+		if !ok || !s.totpSteps.advance(n, step) {
+			s.Debugf("login failed for user: %s (invalid verification code)", n)
+			s.metrics.Counter("penguin_auth_failures_total", 1)
+			return nil, errors.New("invalid verification code for username: %s")
+		}
+	}
+	// check the user's time windows
+	if !user.AllowedAt(time.Now()) {
+		s.Debugf("login failed for user: %s (outside of allowed hours)", n)
+		s.metrics.Counter("penguin_auth_failures_total", 1)
+		return nil, errors.New("access outside of allowed hours for username: %s")
+	}
 	// insert the user session map
 	// TODO this should probably have a lock on it given the map isn't thread-safe
 	s.sessions.Set(string(c.SessionID()), user)
 	return nil, nil
 }
 
+// newDialer creates the dialer of the remotes, or
+// nil if the defaults of the host are used
+func newDialer(c *Config) (*cnet.Dialer, error) {
+	if c.DNS == "" && c.DNSCache <= 0 && len(c.EgressBind) == 0 && c.Upstream == "" && c.Dial == nil {
+		return nil, nil
+	}
+	resolver, err := cnet.NewResolver(c.DNS)
+	if err != nil {
+		return nil, err
+	}
+	// hostnames left to the upstream proxy or
+	// to Dial are not resolved, nor cached
+	if c.DNSCache > 0 && (resolver != nil || (c.Upstream == "" && c.Dial == nil)) {
+		resolver = resolver.Cached(c.DNSCache)
+	}
+	d := &cnet.Dialer{Resolver: resolver, Dial: c.Dial}
+	if c.Upstream != "" {
+		if len(c.EgressBind) > 0 {
+			return nil, errors.New("egress-bind cannot be used with an upstream proxy")
+		}
+		if d.Upstream, err = cnet.ParseUpstream(c.Upstream); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range c.EgressBind {
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			if d.Egress != nil {
+				return nil, errors.New("only one default egress-bind can be set")
+			}
+			if d.Egress, err = cnet.ParseEgress(spec); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		match, err := settings.ParseAddr(spec[:i])
+		if err != nil {
+			return nil, err
+		}
+		egress, err := cnet.ParseEgress(spec[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		d.EgressRules = append(d.EgressRules, cnet.EgressRule{Match: match, Egress: egress})
+	}
+	return d, nil
+}
+
+// authEnabled reports whether clients need to authenticate
+func (s *Server) authEnabled() bool {
+	// an empty auth database still requires authentication
+	return s.users.Len() > 0 || s.config.AuthDB != "" || s.config.JWT.enabled() ||
+		s.ldap != nil || s.pam != nil
+}
+
 // AddUser adds a new user into the server user index
 func (s *Server) AddUser(user, pass string, addrs ...string) error {
-	authorizedAddrs := []*regexp.Regexp{}
+	authorizedAddrs := []settings.AddrMatcher{}
 	for _, addr := range addrs {
-		authorizedAddr, err := regexp.Compile(addr)
+		authorizedAddr, err := settings.ParseAddr(addr)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,77 @@
+package chserver
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/myzhang1029/penguin/share/cmetrics"
+)
+
+// listenAdmin starts the admin API on the configured address,
+// which is either a TCP address or a unix socket "unix:<path>"
+func (s *Server) listenAdmin(ctx context.Context) error {
+	network, addr := "tcp", s.config.Admin
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return s.Errorf("admin: %s", err)
+	}
+	s.Infof("admin API listening on %s", s.config.Admin)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", s.handleAdminSessions)
+	mux.HandleFunc("/sessions/", s.handleAdminSession)
+	if p, ok := s.config.Metrics.(*cmetrics.Prometheus); ok {
+		mux.Handle("/metrics", p)
+	}
+	return s.adminServer.GoServe(ctx, l, mux)
+}
+
+// handleAdminSessions lists snapshots of all sessions
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.Sessions())
+}
+
+// handleAdminSession snapshots or disconnects a single session
+func (s *Server) handleAdminSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if !s.KillSession(int32(id)) {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		s.Infof("admin: disconnected session#%d", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snap, ok := s.Session(int32(id))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, snap)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
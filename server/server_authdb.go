@@ -0,0 +1,8 @@
+package chserver
+
+import (
+	// database/sql drivers for Config.AuthDB, the
+	// sqlite driver requires a cgo enabled build
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
@@ -0,0 +1,129 @@
+package chserver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// datagramSession is a connection of the datagram transports
+// (DNS and ICMP). Clients send one query at a time, and resend
+// it until answered, so the answer to the last query is kept
+// for those which were lost, or which resolvers retry.
+type datagramSession struct {
+	*pollSession
+	mut  sync.Mutex
+	seq  uint32
+	last []byte
+}
+
+// datagramSessions are the datagram sessions by their key
+type datagramSessions struct {
+	sync.Mutex
+	inner map[string]*datagramSession
+}
+
+func (r *datagramSessions) get(key string) (*datagramSession, bool) {
+	r.Lock()
+	sess, ok := r.inner[key]
+	r.Unlock()
+	return sess, ok
+}
+
+func (r *datagramSessions) closeAll() {
+	r.Lock()
+	for _, sess := range r.inner {
+		sess.Close()
+	}
+	r.Unlock()
+}
+
+// handleQuery runs a query of a datagram transport from addr,
+// returning the data of its answer of at most max bytes, false
+// when there is no such session
+func (s *Server) handleQuery(q cnet.Query, max int, addr net.Addr, transport string) ([]byte, bool) {
+	switch q.Op {
+	case cnet.QueryOpen:
+		return nil, s.openQuerySession(q, addr, transport)
+	case cnet.QueryClose:
+		if sess, ok := s.datagrams.get(q.Key); ok {
+			sess.Close()
+		}
+		return nil, true
+	}
+	sess, ok := s.datagrams.get(q.Key)
+	if !ok {
+		return nil, false
+	}
+	atomic.StoreInt64(&sess.active, time.Now().UnixNano())
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	switch q.Seq {
+	case sess.seq - 1:
+		return sess.last, true
+	case sess.seq:
+	default:
+		return nil, false
+	}
+	wait := settings.EnvDuration("DATAGRAM_WAIT", 200*time.Millisecond)
+	if len(q.Data) > 0 {
+		if _, err := sess.upWriter.Write(q.Data); err != nil {
+			return nil, false
+		}
+		// the client has more to send
+		wait = 0
+	}
+	b, open := sess.take(context.Background(), wait, max)
+	if !open {
+		return nil, false
+	}
+	sess.seq++
+	sess.last = b
+	return b, true
+}
+
+// openQuerySession starts the session of q, unless
+// this is a retry of the query which started it
+func (s *Server) openQuerySession(q cnet.Query, addr net.Addr, transport string) bool {
+	if !s.subprotocols[q.Protocol] {
+		s.Infof("ignoring client connection using protocol '%s', expected '%s'",
+			q.Protocol, strings.Join(s.config.Subprotocols, "', '"))
+		return false
+	}
+	s.datagrams.Lock()
+	defer s.datagrams.Unlock()
+	if _, ok := s.datagrams.inner[q.Key]; ok {
+		return true
+	}
+	if s.datagrams.inner == nil {
+		s.datagrams.inner = map[string]*datagramSession{}
+	}
+	sess := &datagramSession{pollSession: newPollSession()}
+	s.datagrams.inner[q.Key] = sess
+	go sess.expire(settings.EnvDuration("DATAGRAM_IDLE_TIMEOUT", time.Minute))
+	go s.runQuerySession(q.Key, sess, q.Protocol, addr.String(), transport)
+	return true
+}
+
+// runQuerySession runs the SSH connection of a datagram
+// session, whose remote address is the one which opened it
+func (s *Server) runQuerySession(key string, sess *datagramSession, protocol, remoteAddr, transport string) {
+	defer func() {
+		s.datagrams.Lock()
+		delete(s.datagrams.inner, key)
+		s.datagrams.Unlock()
+	}()
+	defer sess.Close()
+	id := atomic.AddInt32(&s.sessCount, 1)
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	l.Debugf("%s", transport)
+	ssess := &session{id: id, requestID: requestID, remoteAddr: remoteAddr}
+	s.handleSSH(context.Background(), l, ssess, protocol, cnet.NewRWCConn(sess.pollSession), s.sshConfig)
+}
@@ -0,0 +1,123 @@
+package chserver
+
+import (
+	"context"
+	"net"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// listenDNS accepts clients of the DNS transport, answering
+// the queries of the delegated zone on the DNS port. Like QUIC
+// connections, the websocket checks do not apply to them.
+func (s *Server) listenDNS(ctx context.Context, host string) error {
+	addr := net.JoinHostPort(host, s.config.DNSPort)
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return s.Errorf("dns: %s", err)
+	}
+	s.dns = pc
+	s.Infof("listening on dns://%s for %s", addr, s.config.DNSZone)
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		s.datagrams.closeAll()
+	}()
+	go func() {
+		for {
+			b := make([]byte, 1500)
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			go func() {
+				if reply := s.handleDNS(b[:n], from); reply != nil {
+					pc.WriteTo(reply, from)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// handleDNS answers a query from a resolver, nil to drop it
+func (s *Server) handleDNS(msg []byte, from net.Addr) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	// the response size of resolvers supporting EDNS
+	size := 512
+	edns := false
+	if p.SkipAllQuestions() == nil && p.SkipAllAnswers() == nil && p.SkipAllAuthorities() == nil {
+		for {
+			h, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if h.Type == dnsmessage.TypeOPT {
+				edns = true
+				if int(h.Class) > size {
+					size = int(h.Class)
+				}
+			}
+			if p.SkipAdditional() != nil {
+				break
+			}
+		}
+	}
+	if size > 1232 {
+		size = 1232
+	}
+	rcode := dnsmessage.RCodeSuccess
+	var txt []string
+	q, err := cnet.ParseDNSQuery(question.Name.String(), s.config.DNSZone)
+	switch {
+	case err != nil && question.Type == dnsmessage.TypeTXT:
+		rcode = dnsmessage.RCodeNameError
+	case err != nil || question.Type != dnsmessage.TypeTXT:
+		// no data, but the zone is still ours
+	default:
+		b, ok := s.handleQuery(q, cnet.DNSDownloadSize(question.Name.String(), size), from, "dns")
+		if ok {
+			txt = cnet.DNSTXT(b)
+		} else {
+			rcode = dnsmessage.RCodeNameError
+		}
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, size), dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+		RCode:            rcode,
+	})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	if txt != nil {
+		b.TXTResource(dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}, dnsmessage.TXTResource{TXT: txt})
+	}
+	b.StartAdditionals()
+	if edns {
+		var h dnsmessage.ResourceHeader
+		h.SetEDNS0(size, dnsmessage.RCodeSuccess, false)
+		b.OPTResource(h, dnsmessage.OPTResource{})
+	}
+	reply, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return reply
+}
@@ -0,0 +1,49 @@
+package chserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// groupACL maps the groups of externally authenticated
+// users to the addresses their members may access
+type groupACL map[string][]settings.AddrMatcher
+
+// loadGroupACL reads a JSON file in the authfile format, with
+// groups instead of users: {"<group>": ["<addr-regex>"]}.
+// Group names are case-insensitive and "*" applies to everyone.
+func loadGroupACL(file string) (groupACL, error) {
+	acl := groupACL{}
+	if file == "" {
+		return acl, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups file: %s", err)
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, errors.New("invalid JSON: " + err.Error())
+	}
+	for group, addrs := range raw {
+		key := strings.ToLower(group)
+		for _, r := range addrs {
+			addr, err := settings.ParseAddr(r)
+			if err != nil {
+				return nil, err
+			}
+			acl[key] = append(acl[key], addr)
+		}
+	}
+	return acl, nil
+}
+
+// group returns the addresses of a single group
+func (acl groupACL) group(name string) []settings.AddrMatcher {
+	return acl[strings.ToLower(name)]
+}
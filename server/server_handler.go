@@ -1,12 +1,16 @@
 package chserver
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	chshare "github.com/myzhang1029/penguin/share"
+	"github.com/myzhang1029/penguin/share/cio"
 	"github.com/myzhang1029/penguin/share/cnet"
 	"github.com/myzhang1029/penguin/share/settings"
 	"github.com/myzhang1029/penguin/share/tunnel"
@@ -16,22 +20,70 @@ import (
 
 // handleClientHandler is the main http websocket handler for the penguin server
 func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
-	//websockets upgrade AND has penguin prefix
+	//data of a long-polling session
+	poll := r.Header.Get(cnet.PollHeader)
+	if poll != "" && poll != "open" && s.handlePollData(w, r, poll) {
+		return
+	}
+	//UDP of standard MASQUE clients
+	if s.config.MASQUE && r.Method == http.MethodConnect && r.Proto == "connect-udp" {
+		s.handleMASQUE(w, r)
+		return
+	}
+	//websockets upgrade, HTTP/2 stream, gRPC stream, WebTransport session
+	//or long-polling, AND has penguin prefix or an accepted subprotocol
 	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
-	protocol := r.Header.Get("Sec-WebSocket-Protocol")
-	wsPsk := r.Header.Get("X-Penguin-Psk")
-	if upgrade == "websocket" && strings.HasPrefix(protocol, "penguin-") {
-		if s.config.Psk == "" || wsPsk == s.config.Psk {
-			if protocol == chshare.ProtocolVersion {
-				s.handleWebsocket(w, r)
+	protocol := strings.Join(r.Header.Values("Sec-WebSocket-Protocol"), ",")
+	stream := r.ProtoMajor == 2 && r.Method == http.MethodPost && r.Header.Get("Content-Type") == cnet.StreamContentType
+	grpc := r.ProtoMajor == 2 && r.Method == http.MethodPost && cnet.IsGRPC(r.Header.Get("Content-Type"))
+	webTransport := r.Method == http.MethodConnect && r.Proto == "webtransport"
+	pollOpen := poll == "open" && r.Method == http.MethodPost
+	if stream || grpc || webTransport || pollOpen {
+		protocol = r.Header.Get(cnet.StreamProtocolHeader)
+	}
+	//clients may offer several protocols, newest first
+	protocol = s.chooseSubprotocol(protocol)
+	if (upgrade == "websocket" || stream || grpc || webTransport || pollOpen) && (strings.HasPrefix(protocol, "penguin-") || s.subprotocols[protocol]) {
+		if s.config.WsPath != "" && r.URL.Path != s.config.WsPath {
+			s.Infof("ignoring client connection to path '%s'", r.URL.Path)
+		} else if s.config.PskPath && !s.checkPskPath(r.URL.Path) {
+			s.Infof("ignoring client connection to path '%s', not derived from a PSK", r.URL.Path)
+		} else if !s.handshakes.allow(r.RemoteAddr, time.Now()) {
+			s.Debugf("ignoring client connection from %s, too many handshakes", r.RemoteAddr)
+			s.metrics.Counter("penguin_handshakes_limited_total", 1)
+			if !s.config.Obfs {
+				w.Header().Set("Retry-After", strconv.Itoa(s.handshakes.retryAfter()))
+				http.Error(w, "too many connections", http.StatusTooManyRequests)
+				return
+			}
+		} else if s.checkPsk(r) {
+			if s.subprotocols[protocol] {
+				switch {
+				case webTransport:
+					s.handleWebTransport(w, r, protocol)
+				case stream:
+					s.handleStream(w, r, protocol)
+				case grpc:
+					s.handleGRPC(w, r, protocol)
+				case pollOpen:
+					s.handlePollOpen(w, r, protocol)
+				default:
+					s.handleWebsocket(w, r, protocol)
+				}
+				return
+			}
+			//tell clients of other protocol versions which are supported,
+			//for their logs, unless the server should not be recognized
+			if strings.HasPrefix(protocol, "penguin-") && !s.config.Obfs {
+				s.Infof("refusing client connection using protocol '%s', expected '%s'",
+					protocol, strings.Join(s.config.Subprotocols, "', '"))
+				w.Header().Set(cnet.ProtocolsHeader, strings.Join(s.config.Subprotocols, ", "))
+				http.Error(w, "unsupported protocol", http.StatusUpgradeRequired)
 				return
 			}
 			//print into server logs and silently fall-through
 			s.Infof("ignoring client connection using protocol '%s', expected '%s'",
-				protocol, chshare.ProtocolVersion)
-		} else {
-			s.Infof("ignoring client connection with incorrect or missing PSK '%s'",
-				wsPsk)
+				protocol, strings.Join(s.config.Subprotocols, "', '"))
 		}
 	}
 	//proxy target was provided
@@ -43,7 +95,7 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 		//no proxy defined, provide access to health/version checks
 		switch r.URL.Path {
 		case "/health":
-			w.Write([]byte("OK\n"))
+			s.handleHealth(w, r)
 			return
 		case "/version":
 			w.Write([]byte(chshare.BuildVersion))
@@ -55,26 +107,162 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(s.config.Resp404))
 }
 
+// chooseSubprotocol picks the first of the comma separated offered
+// protocols which is accepted, or else the first offered
+func (s *Server) chooseSubprotocol(offered string) string {
+	protocols := strings.Split(offered, ",")
+	for _, p := range protocols {
+		if p = strings.TrimSpace(p); s.subprotocols[p] {
+			return p
+		}
+	}
+	return strings.TrimSpace(protocols[0])
+}
+
 // handleWebsocket is responsible for handling the websocket connection
-func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
+func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request, protocol string) {
 	id := atomic.AddInt32(&s.sessCount, 1)
-	l := s.Fork("session#%d", id)
-	wsConn, err := upgrader.Upgrade(w, req, nil)
+	// the request id correlates this session's logs with the client's
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	sshConfig, ok := s.requestSSHConfig(w, req, l)
+	if !ok {
+		return
+	}
+	// echo the subprotocol, as any websocket server would
+	header := http.Header{"Sec-Websocket-Protocol": {protocol}}
+	// the client may ask for padded messages and dummy traffic
+	padding, padded := time.Duration(0), false
+	if p := req.Header.Get(cnet.PaddingHeader); p != "" {
+		d, err := time.ParseDuration(p)
+		if err != nil || d < 0 {
+			l.Debugf("invalid padding interval '%s'", p)
+			http.Error(w, "invalid padding", http.StatusBadRequest)
+			return
+		}
+		if d > 0 && d < cnet.MinPaddingInterval {
+			d = cnet.MinPaddingInterval
+		}
+		padding, padded = d, true
+		header.Set(cnet.PaddingHeader, d.String())
+	}
+	u := upgrader
+	u.EnableCompression = s.config.WsCompress && !padded
+	wsConn, err := u.Upgrade(w, req, header)
 	if err != nil {
 		l.Debugf("failed to upgrade (%s)", err)
 		return
 	}
 	conn := cnet.NewWebSocketConn(wsConn)
+	if padded {
+		conn = cnet.NewPaddedWebSocketConn(wsConn, padding)
+	}
+	sess := &session{id: id, requestID: requestID, remoteAddr: req.RemoteAddr}
+	s.handleSSH(req.Context(), l, sess, protocol, conn, sshConfig)
+}
+
+// handleStream is responsible for handling the connection
+// carried by the body of an HTTP/2 request and its response
+func (s *Server) handleStream(w http.ResponseWriter, req *http.Request, protocol string) {
+	id := atomic.AddInt32(&s.sessCount, 1)
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	sshConfig, ok := s.requestSSHConfig(w, req, l)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", cnet.StreamContentType)
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	// the response must not be written once the handler returns
+	stream := cnet.NewHTTPStream(req.Body, w)
+	defer stream.Close()
+	sess := &session{id: id, requestID: requestID, remoteAddr: req.RemoteAddr}
+	s.handleSSH(req.Context(), l, sess, protocol, cnet.NewRWCConn(stream), sshConfig)
+}
+
+// handleGRPC is responsible for handling the connection
+// carried by the messages of a bidirectional gRPC stream
+func (s *Server) handleGRPC(w http.ResponseWriter, req *http.Request, protocol string) {
+	id := atomic.AddInt32(&s.sessCount, 1)
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	sshConfig, ok := s.requestSSHConfig(w, req, l)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", cnet.GRPCContentType)
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	stream := cnet.NewGRPCStream(req.Body, w)
+	sess := &session{id: id, requestID: requestID, remoteAddr: req.RemoteAddr}
+	s.handleSSH(req.Context(), l, sess, protocol, cnet.NewRWCConn(stream), sshConfig)
+	stream.Close()
+	// end the RPC as gRPC servers do
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// requestSSHConfig is the SSH configuration of a session
+// requested with req, which replaces the authentication when
+// it has a bearer token, or false once an error is sent
+func (s *Server) requestSSHConfig(w http.ResponseWriter, req *http.Request, l *cio.Logger) (*ssh.ServerConfig, bool) {
+	token := bearerToken(req)
+	if token == "" || !s.config.JWT.enabled() {
+		return s.sshConfig, true
+	}
+	user, err := s.authJWT(token)
+	if err != nil {
+		l.Infof("rejecting bearer token (%s)", err)
+		s.metrics.Counter("penguin_auth_failures_total", 1)
+		http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+		return nil, false
+	}
+	// the token already authenticates this connection, so
+	// accept whatever credentials the ssh client presents
+	c := *s.sshConfig
+	c.PasswordCallback = func(c ssh.ConnMetadata, _ []byte) (*ssh.Permissions, error) {
+		s.sessions.Set(string(c.SessionID()), user)
+		return nil, nil
+	}
+	c.KeyboardInteractiveCallback = nil
+	return &c, true
+}
+
+// handleSSH runs the session of a client connected through
+// either transport, until it disconnects. The session only
+// has its id, request id and remote address set, and protocol
+// is the websocket subprotocol, if any.
+func (s *Server) handleSSH(ctx context.Context, l *cio.Logger, sess *session, protocol string, conn net.Conn, sshConfig *ssh.ServerConfig) {
+	if s.faults != nil {
+		conn = cnet.NewFaultConn(conn, *s.faults)
+	}
+	// clients which resume sessions say so before the SSH handshake
+	conn, hello, err := cnet.ReadResumeHello(conn)
+	if err != nil {
+		l.Debugf("failed to read from %s (%s)", sess.remoteAddr, err)
+		return
+	}
+	if hello != nil {
+		s.handleResume(l, sess, protocol, conn, hello, sshConfig)
+		return
+	}
+	s.serveSSH(ctx, l, sess, protocol, conn, sshConfig)
+}
+
+// serveSSH runs the session of a client over conn
+func (s *Server) serveSSH(ctx context.Context, l *cio.Logger, sess *session, protocol string, conn net.Conn, sshConfig *ssh.ServerConfig) {
 	// perform SSH handshake on net.Conn
-	l.Debugf("handshaking with %s...", req.RemoteAddr)
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	l.Debugf("handshaking with %s...", sess.remoteAddr)
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
 	if err != nil {
-		s.Debugf("failed to handshake (%s)", err)
+		l.Debugf("failed to handshake (%s)", err)
+		s.metrics.Counter("penguin_handshake_failures_total", 1)
 		return
 	}
 	// pull the users from the session map
 	var user *settings.User
-	if s.users.Len() > 0 {
+	if s.authEnabled() {
 		sid := string(sshConn.SessionID())
 		u, ok := s.sessions.Get(sid)
 		if !ok {
@@ -108,6 +296,24 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		failed(s.Errorf("invalid config"))
 		return
 	}
+	//negotiate the protocol version, which older clients
+	//only sent as the websocket subprotocol, without a range
+	max := c.Protocol
+	if max == "" {
+		max = protocol
+	}
+	min := c.MinProtocol
+	if min == "" {
+		min = max
+	}
+	version, err := settings.NegotiateProtocol(min, max, chshare.MinProtocolVersion, chshare.ProtocolVersion)
+	if err != nil {
+		failed(s.Errorf("client %s", err))
+		return
+	}
+	if version != chshare.ProtocolVersion {
+		l.Infof("using protocol %s, the newest which the client supports", version)
+	}
 	//print if client and server versions dont match
 	if c.Version != chshare.BuildVersion {
 		v := c.Version
@@ -118,30 +324,48 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 			v, chshare.BuildVersion)
 	}
 	//validate remotes
-	for _, r := range c.Remotes {
-		//if user is provided, ensure they have
-		//access to the desired remotes
-		if user != nil {
-			addr := r.UserAddr()
-			if !user.HasAccess(addr) {
-				failed(s.Errorf("access to '%s' denied", addr))
-				return
-			}
-		}
-		//confirm reverse tunnels are allowed
-		if r.Reverse && !s.config.Reverse {
-			l.Debugf("denied reverse port forwarding request, please enable --reverse")
-			failed(s.Errorf("reverse port forwarding not enabled on server"))
-			return
-		}
-		//confirm reverse tunnel is available
-		if r.Reverse && !r.CanListen() {
-			failed(s.Errorf("server cannot listen on %s", r.String()))
-			return
-		}
+	if err := s.validateRemotes(l, user, c.Remotes); err != nil {
+		failed(err)
+		return
+	}
+	//take the reverse ports across the cluster
+	leases := s.newReverseLeases(l, user, sess.requestID)
+	if err := leases.claim(c.Remotes); err != nil {
+		failed(err)
+		return
+	}
+	//newer clients negotiate the keepalive and send all
+	//the pings, older ones get the server's own pings
+	var keepAlive *settings.KeepAlive
+	if c.KeepAlive != nil {
+		k := settings.KeepAlive{
+			Interval: s.config.KeepAlive,
+			Timeout:  s.config.KeepAliveTimeout,
+			Misses:   s.config.KeepAliveMisses,
+		}.Negotiate(*c.KeepAlive).Adapt(c.Throughput)
+		keepAlive = &k
+		l.Debugf("negotiated keepalive every %s, timeout %s, dead after %s", k.Interval, k.Timeout, k.Deadline())
 	}
 	//successfully validated config!
-	r.Reply(true, nil)
+	compress := ""
+	if c.Reply {
+		//only clients which read the reply learn the compression
+		compress = settings.NegotiateCompression(c.Compress, s.config.Compress)
+		r.Reply(true, settings.EncodeConfigReply(settings.ConfigReply{
+			RequestID:     sess.requestID,
+			KeepAlive:     keepAlive,
+			Compress:      compress,
+			Protocol:      version,
+			RemoteOptions: true,
+		}))
+	} else {
+		r.Reply(true, nil)
+	}
+	var bound ssh.Conn = sshConn
+	if compress != "" {
+		l.Debugf("compressing channels with %s", compress)
+		bound, chans = tunnel.Compress(sshConn, chans, compress)
+	}
 	//tunnel per ssh connection
 	tunnel := tunnel.New(tunnel.Config{
 		Logger:    l,
@@ -149,12 +373,82 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		Outbound:  true, //server always accepts outbound
 		Socks:     s.config.Socks5,
 		KeepAlive: s.config.KeepAlive,
+		Metrics:   s.metrics,
+		Dialer:    s.dialer,
+		UDP:       s.config.UDP,
+		Listeners: s.listeners,
+		Tun:       s.config.Tun,
+		Unix:      s.config.Unix,
+		Serial:    s.config.Serial,
+		ValidateRemotes: func(remotes settings.Remotes) error {
+			for _, r := range remotes {
+				if !r.Reverse {
+					return s.Errorf("only reverse remotes can be added at runtime")
+				}
+			}
+			if err := s.validateRemotes(l, user, remotes); err != nil {
+				return err
+			}
+			return leases.claim(remotes)
+		},
+		AdmitStream: func() error {
+			if user == nil {
+				return nil
+			}
+			return s.checkQuota(user)
+		},
+		TCPKeepAlive: s.config.TCPKeepAlive,
+		TerminateTLS: s.remoteTLS,
+		AdmitBind: func(addr string) error {
+			//a socks BIND listens here as a reverse remote would
+			if user == nil {
+				return nil
+			}
+			_, port, _ := net.SplitHostPort(addr)
+			if bind := "R:0.0.0.0:" + port; !user.HasAccess(bind) {
+				return s.Errorf("access to '%s' denied", bind)
+			}
+			return nil
+		},
 	})
 	//bind
-	eg, ctx := errgroup.WithContext(req.Context())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go leases.hold(ctx)
+	if user != nil && user.Disconnect && len(user.Windows) > 0 {
+		go s.enforceWindows(ctx, l, user, sshConn)
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	//register the session while it is connected
+	sess.version = c.Version
+	sess.started = time.Now()
+	sess.protocol = version
+	sess.keepAlive = s.config.KeepAlive
+	if keepAlive != nil {
+		sess.keepAlive = keepAlive.Interval
+	}
+	sess.compress = compress
+	sess.remotes = c.Remotes
+	sess.tunnel = tunnel
+	sess.cancel = cancel
+	if user != nil {
+		sess.user = user.Name
+	}
+	s.registry.add(sess)
+	s.metrics.Counter("penguin_sessions_total", 1)
+	s.metrics.Gauge("penguin_sessions", float64(s.registry.len()))
+	defer func() {
+		stats := tunnel.Stats()
+		s.quotas.add(sess.user, stats.Sent+stats.Received)
+		s.registry.remove(sess.id)
+		s.metrics.Gauge("penguin_sessions", float64(s.registry.len()))
+	}()
 	eg.Go(func() error {
 		//connected, handover ssh connection for tunnel to use, and block
-		return tunnel.BindSSH(ctx, sshConn, reqs, chans)
+		if keepAlive != nil {
+			return tunnel.BindSSHKeepAlive(ctx, bound, reqs, chans, *keepAlive, false)
+		}
+		return tunnel.BindSSH(ctx, bound, reqs, chans)
 	})
 	eg.Go(func() error {
 		//connected, setup reversed-remotes?
@@ -172,3 +466,76 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		l.Debugf("closed connection")
 	}
 }
+
+// validateRemotes checks the remotes requested by a client
+// against the server configuration and the user's permissions
+func (s *Server) validateRemotes(l *cio.Logger, user *settings.User, remotes settings.Remotes) error {
+	for _, r := range remotes {
+		//if user is provided, ensure they have
+		//access to the desired remotes
+		if user != nil {
+			addr := r.UserAddr()
+			if !user.HasAccess(addr) {
+				return s.Errorf("access to '%s' denied", addr)
+			}
+			//each of the targets is dialed here
+			for _, target := range r.Targets {
+				if !r.Reverse && !user.HasAccess(target) {
+					return s.Errorf("access to '%s' denied", target)
+				}
+			}
+		}
+		//the user's reverse socks listeners may need credentials
+		if user != nil && user.SocksAuth && r.Reverse && r.Socks &&
+			r.SocksAuth == "" && s.listeners.SocksUser == "" {
+			return s.Errorf("reverse socks remote '%s' needs credentials", r.String())
+		}
+		//confirm reverse tunnels are allowed
+		if r.Reverse && !s.config.Reverse {
+			l.Debugf("denied reverse port forwarding request, please enable --reverse")
+			return s.Errorf("reverse port forwarding not enabled on server")
+		}
+		if r.Tun && !s.config.Tun {
+			l.Debugf("denied tun request, please enable --tun")
+			return s.Errorf("tun not enabled on server")
+		}
+		//the unix sockets and named pipes on the server are
+		//the listeners of reverse remotes and the targets of others
+		if (r.Reverse && settings.IsSocket(r.LocalProto) || !r.Reverse && settings.IsSocket(r.RemoteProto)) && !s.config.Unix {
+			l.Debugf("denied unix socket or named pipe request, please enable --unix")
+			return s.Errorf("unix sockets not enabled on server")
+		}
+		if !r.Reverse && r.RemoteProto == "serial" && !s.config.Serial {
+			l.Debugf("denied serial device request, please enable --serial")
+			return s.Errorf("serial devices not enabled on server")
+		}
+		if r.TerminateTLS && s.remoteTLS == nil {
+			l.Debugf("denied TLS termination request, please set --remote-tls-cert or --remote-tls-domain")
+			return s.Errorf("TLS termination not enabled on server")
+		}
+		//confirm reverse tunnel is available
+		if r.Reverse && !r.CanListen() {
+			return s.Errorf("server cannot listen on %s", r.String())
+		}
+	}
+	return nil
+}
+
+// enforceWindows closes the session once the
+// user is outside of their allowed time windows
+func (s *Server) enforceWindows(ctx context.Context, l *cio.Logger, user *settings.User, conn ssh.Conn) {
+	ticker := time.NewTicker(settings.EnvDuration("WINDOW_CHECK", 30*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if !user.AllowedAt(now) {
+				l.Infof("closing session of %s outside of allowed hours", user.Name)
+				conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
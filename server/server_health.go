@@ -0,0 +1,68 @@
+package chserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Health is the state of the server reported by /health
+type Health struct {
+	Started       time.Time
+	UptimeSeconds int64
+	// Sessions is the number of connected sessions, and
+	// UserSessions the number of them per user, which
+	// /health only reveals to holders of the health token
+	Sessions     int
+	UserSessions map[string]int `json:",omitempty"`
+	// BytesProxied is transferred by all sessions,
+	// in both directions, since the start
+	BytesProxied int64
+}
+
+// Health returns the current state of the server
+func (s *Server) Health() *Health {
+	h := &Health{
+		Started:       s.started,
+		UptimeSeconds: int64(time.Since(s.started) / time.Second),
+		UserSessions:  map[string]int{},
+	}
+	s.quotas.mut.Lock()
+	h.BytesProxied = s.quotas.total
+	s.quotas.mut.Unlock()
+	for _, sess := range s.registry.list() {
+		h.Sessions++
+		if sess.user != "" {
+			h.UserSessions[sess.user]++
+		}
+		stats := sess.tunnel.Stats()
+		h.BytesProxied += stats.Sent + stats.Received
+	}
+	return h
+}
+
+// handleHealth answers health checks with "OK", or with
+// the JSON state of the server when it is asked for
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") &&
+		r.URL.Query().Get("format") != "json" {
+		w.Write([]byte("OK\n"))
+		return
+	}
+	h := s.Health()
+	if token := s.config.HealthToken; token != "" {
+		given := bearerToken(r)
+		if given == "" {
+			given = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "invalid health token", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		// the usernames are not for anyone to see
+		h.UserSessions = nil
+	}
+	writeJSON(w, h)
+}
@@ -0,0 +1,64 @@
+package chserver
+
+import (
+	"context"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// listenICMP accepts clients of the ICMP transport, replying
+// to their echo requests with a raw socket (which requires
+// CAP_NET_RAW). The kernel still replies to them as well,
+// unless told to ignore echo requests.
+func (s *Server) listenICMP(ctx context.Context, host string) error {
+	pc, err := icmp.ListenPacket("ip4:icmp", host)
+	if err != nil {
+		return s.Errorf("icmp: %s", err)
+	}
+	s.icmp = pc
+	s.Infof("listening on icmp://%s", host)
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		s.datagrams.closeAll()
+	}()
+	go func() {
+		for {
+			b := make([]byte, 1500)
+			n, from, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			m, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), b[:n])
+			if err != nil || m.Type != ipv4.ICMPTypeEcho {
+				continue
+			}
+			echo, ok := m.Body.(*icmp.Echo)
+			if !ok {
+				continue
+			}
+			q, answer, err := cnet.ParseICMPPayload(echo.Data)
+			if err != nil || answer {
+				// other pings
+				continue
+			}
+			go func() {
+				data, ok := s.handleQuery(q, cnet.ICMPDataSize, from, "icmp")
+				q.Data = data
+				if !ok {
+					q.Op = cnet.QueryClosed
+				}
+				reply := icmp.Message{
+					Type: ipv4.ICMPTypeEchoReply,
+					Body: &icmp.Echo{ID: echo.ID, Seq: echo.Seq, Data: q.ICMPPayload(true)},
+				}
+				if b, err := reply.Marshal(nil); err == nil {
+					pc.WriteTo(b, from)
+				}
+			}()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,180 @@
+package chserver
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/ccrypto"
+	"github.com/myzhang1029/penguin/share/oidc"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// JWTConfig enables bearer-token authentication
+type JWTConfig struct {
+	// Secret verifies HMAC (HS256/384/512) signed tokens
+	Secret string
+	// JWKS is the URL of a JSON Web Key Set used to
+	// verify RSA and ECDSA signed tokens
+	JWKS string
+	// OIDCIssuer is an OpenID Connect issuer whose discovery
+	// document provides the JWKS URL. It also sets Issuer.
+	OIDCIssuer string
+	Issuer     string
+	Audience   string
+	// Claim lists the address regexes the token grants,
+	// using the same format as the authfile
+	Claim string
+}
+
+func (c *JWTConfig) enabled() bool {
+	return c.Secret != "" || c.JWKS != ""
+}
+
+// discover fills in the JWKS URL and issuer from the OIDC provider
+func (c *JWTConfig) discover() error {
+	p, err := oidc.Discover(context.Background(), c.OIDCIssuer)
+	if err != nil {
+		return fmt.Errorf("OIDC discovery failed: %s", err)
+	}
+	if p.JWKSURI == "" {
+		return errors.New("OIDC provider does not publish a JWKS URL")
+	}
+	c.JWKS = p.JWKSURI
+	if c.Issuer == "" {
+		c.Issuer = p.Issuer
+	}
+	return nil
+}
+
+// authJWT verifies a bearer token and maps it to a user
+// whose allowed addresses are taken from the configured claim
+func (s *Server) authJWT(token string) (*settings.User, error) {
+	c := &s.config.JWT
+	t, err := ccrypto.ParseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(t.Alg, "HS") {
+		if c.Secret == "" {
+			return nil, errors.New("HMAC tokens are not accepted")
+		}
+		err = t.VerifyHMAC([]byte(c.Secret))
+	} else {
+		if s.jwks == nil {
+			return nil, errors.New("signed tokens are not accepted")
+		}
+		var key crypto.PublicKey
+		if key, err = s.jwks.key(t.Kid); err == nil {
+			err = t.VerifyKey(key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Validate(time.Now(), c.Issuer, c.Audience); err != nil {
+		return nil, err
+	}
+	user := &settings.User{Name: t.Subject()}
+	if user.Name == "" {
+		return nil, errors.New("missing subject")
+	}
+	for _, r := range t.Strings(c.Claim) {
+		addr, err := settings.ParseAddr(r)
+		if err != nil {
+			return nil, err
+		}
+		user.Addrs = append(user.Addrs, addr)
+	}
+	return user, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// jwks is a cached JSON Web Key Set
+type jwks struct {
+	url     string
+	client  *http.Client
+	mut     sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newJWKS(url string) *jwks {
+	return &jwks{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// key returns the key with the given id, refreshing the set
+// when it is stale or does not contain the key (for rotation)
+func (j *jwks) key(kid string) (crypto.PublicKey, error) {
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	key, ok := j.keys[kid]
+	age := time.Since(j.fetched)
+	refresh := age > settings.EnvDuration("JWKS_TTL", time.Hour)
+	//rate limit refreshes caused by unknown keys
+	if !ok && age > time.Minute {
+		refresh = true
+	}
+	if refresh {
+		if err := j.fetch(); err != nil {
+			//keep using the previous set if there is one
+			if j.keys == nil {
+				return nil, err
+			}
+		}
+		key, ok = j.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id '%s'", kid)
+	}
+	return key, nil
+}
+
+func (j *jwks) fetch() error {
+	j.fetched = time.Now()
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch key set: %s", resp.Status)
+	}
+	var set struct {
+		Keys []ccrypto.JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("invalid key set: %s", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.PublicKey()
+		if err != nil {
+			//skip key types we do not support
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	j.keys = keys
+	return nil
+}
@@ -0,0 +1,56 @@
+package chserver
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// listenKCP accepts clients of the KCP transport, a reliable
+// stream over UDP for lossy or high-latency links, on the KCP
+// port. Like QUIC connections, the websocket checks do not
+// apply to them.
+func (s *Server) listenKCP(ctx context.Context, host string) error {
+	addr := net.JoinHostPort(host, s.config.KCPPort)
+	l, err := kcp.ListenWithOptions(addr, nil, cnet.KCPDataShards, cnet.KCPParityShards)
+	if err != nil {
+		return s.Errorf("kcp: %s", err)
+	}
+	s.kcp = l
+	s.Infof("listening on kcp://%s", addr)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go s.handleKCP(ctx, conn)
+		}
+	}()
+	return nil
+}
+
+// handleKCP runs the session of a KCP connection
+func (s *Server) handleKCP(ctx context.Context, conn *kcp.UDPSession) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	if !s.handshakes.allow(remoteAddr, time.Now()) {
+		s.Debugf("ignoring client connection from %s, too many handshakes", remoteAddr)
+		s.metrics.Counter("penguin_handshakes_limited_total", 1)
+		return
+	}
+	cnet.ConfigureKCP(conn)
+	id := atomic.AddInt32(&s.sessCount, 1)
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	sess := &session{id: id, requestID: requestID, remoteAddr: remoteAddr}
+	s.handleSSH(ctx, l, sess, "", conn, s.sshConfig)
+}
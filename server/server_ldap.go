@@ -0,0 +1,111 @@
+package chserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// LDAPConfig enables verifying passwords by binding against LDAP
+type LDAPConfig struct {
+	// URL of the directory, e.g. ldaps://ldap.example.com
+	URL string
+	// BindDN and BindPassword are used to search for users,
+	// leave empty to search anonymously
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched for
+	BaseDN string
+	// Filter finds a user, %s is replaced by the escaped
+	// username. Defaults to (uid=%s).
+	Filter string
+	// GroupsFile is a JSON file mapping groups to the address
+	// regexes their members may use, in the authfile format:
+	//   {"<group-dn-or-cn>": ["<addr-regex>"]}
+	// The group "*" applies to all users.
+	GroupsFile string
+}
+
+// ldapAuth verifies users against a directory
+type ldapAuth struct {
+	config *LDAPConfig
+	groups groupACL
+}
+
+func newLDAPAuth(c *LDAPConfig) (*ldapAuth, error) {
+	if c.Filter == "" {
+		c.Filter = "(uid=%s)"
+	}
+	if !strings.Contains(c.Filter, "%s") {
+		return nil, errors.New("LDAP filter must contain %s")
+	}
+	groups, err := loadGroupACL(c.GroupsFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ldapAuth{config: c, groups: groups}, nil
+}
+
+// authenticate finds the user's entry, verifies the password
+// by binding as the user and maps their groups to addresses
+func (a *ldapAuth) authenticate(name, pass string) (*settings.User, error) {
+	// an empty password would be an unauthenticated bind,
+	// which most servers accept for any dn
+	if name == "" || pass == "" {
+		return nil, errors.New("missing credentials")
+	}
+	conn, err := ldap.DialURL(a.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("search bind failed: %s", err)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.config.Filter, ldap.EscapeFilter(name)),
+		[]string{"memberOf"},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %s", err)
+	}
+	if len(res.Entries) != 1 {
+		return nil, errors.New("user not found")
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, pass); err != nil {
+		return nil, errors.New("invalid password")
+	}
+	user := &settings.User{Name: name}
+	user.Addrs = append(user.Addrs, a.groups.group("*")...)
+	for _, group := range entry.GetAttributeValues("memberOf") {
+		user.Addrs = append(user.Addrs, a.groupAddrs(group)...)
+	}
+	return user, nil
+}
+
+// groupAddrs returns the addresses of a group, which
+// may be configured by its full DN or just its CN
+func (a *ldapAuth) groupAddrs(dn string) []settings.AddrMatcher {
+	if addrs := a.groups.group(dn); addrs != nil {
+		return addrs
+	}
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return nil
+	}
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return a.groups.group(attr.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package chserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLDAPGroups(t *testing.T) {
+	f, err := ioutil.TempFile("", "groups*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{
+		"*": ["^localhost:80$"],
+		"cn=admins,ou=groups,dc=example,dc=com": [""],
+		"Developers": ["^10\\.0\\."]
+	}`)
+	f.Close()
+	a, err := newLDAPAuth(&LDAPConfig{GroupsFile: f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.config.Filter != "(uid=%s)" {
+		t.Fatalf("expected default filter, got %s", a.config.Filter)
+	}
+	for _, test := range []struct {
+		dn    string
+		addrs int
+	}{
+		{"CN=Admins,OU=Groups,DC=example,DC=com", 1},
+		{"cn=developers,ou=groups,dc=example,dc=com", 1},
+		{"cn=other,ou=groups,dc=example,dc=com", 0},
+	} {
+		if n := len(a.groupAddrs(test.dn)); n != test.addrs {
+			t.Fatalf("expected %d addresses for %s, got %d", test.addrs, test.dn, n)
+		}
+	}
+	if _, err := newLDAPAuth(&LDAPConfig{Filter: "(uid=foo)"}); err == nil {
+		t.Fatal("expected filter without a placeholder to be rejected")
+	}
+}
@@ -4,12 +4,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
-	"io/ioutil"
 	"net"
 	"os"
 	"os/user"
 	"path/filepath"
 
+	"github.com/myzhang1029/penguin/share/ccrypto"
 	"github.com/myzhang1029/penguin/share/settings"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -22,26 +22,10 @@ type TLSConfig struct {
 	CA      string
 }
 
-func (s *Server) listener(host, port string) (net.Listener, error) {
-	hasDomains := len(s.config.TLS.Domains) > 0
-	hasKeyCert := s.config.TLS.Key != "" && s.config.TLS.Cert != ""
-	if hasDomains && hasKeyCert {
-		return nil, errors.New("cannot use key/cert and domains")
-	}
-	var tlsConf *tls.Config
-	if hasDomains {
-		tlsConf = s.tlsLetsEncrypt(s.config.TLS.Domains)
-	}
+func (s *Server) listener(host, port string, tlsConf *tls.Config) (net.Listener, error) {
 	extra := ""
-	if hasKeyCert {
-		c, err := s.tlsKeyCert(s.config.TLS.Key, s.config.TLS.Cert, s.config.TLS.CA)
-		if err != nil {
-			return nil, err
-		}
-		tlsConf = c
-		if port != "443" && hasDomains {
-			extra = " (WARNING: LetsEncrypt will attempt to connect to your domain on port 443)"
-		}
+	if port != "443" && len(s.config.TLS.Domains) > 0 {
+		extra = " (WARNING: LetsEncrypt will attempt to connect to your domain on port 443)"
 	}
 	//tcp listen
 	l, err := net.Listen("tcp", host+":"+port)
@@ -53,6 +37,10 @@ func (s *Server) listener(host, port string) (net.Listener, error) {
 	if tlsConf != nil {
 		proto += "s"
 		tlsConf.MinVersion = 0x0301 + (12 - 10) // Force TLSv1.2 minimum
+		//offer HTTP/2 for the stream transport
+		if len(tlsConf.NextProtos) == 0 {
+			tlsConf.NextProtos = []string{"h2", "http/1.1"}
+		}
 		l = tls.NewListener(l, tlsConf)
 	}
 	if err == nil {
@@ -61,7 +49,30 @@ func (s *Server) listener(host, port string) (net.Listener, error) {
 	return l, nil
 }
 
+//tlsConfig is the TLS configuration of the listeners,
+//nil when neither key/cert nor domains are set
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	hasDomains := len(s.config.TLS.Domains) > 0
+	hasKeyCert := s.config.TLS.Key != "" && s.config.TLS.Cert != ""
+	if hasDomains && hasKeyCert {
+		return nil, errors.New("cannot use key/cert and domains")
+	}
+	if hasDomains {
+		return s.tlsLetsEncrypt(s.config.TLS.Domains), nil
+	}
+	if hasKeyCert {
+		return s.tlsKeyCert(s.config.TLS.Key, s.config.TLS.Cert, s.config.TLS.CA)
+	}
+	return nil, nil
+}
+
 func (s *Server) tlsLetsEncrypt(domains []string) *tls.Config {
+	//return lets-encrypt tls config
+	return s.letsEncryptManager(domains).TLSConfig()
+}
+
+//letsEncryptManager fetches and renews the certificates of domains
+func (s *Server) letsEncryptManager(domains []string) *autocert.Manager {
 	//prepare cert manager
 	m := &autocert.Manager{
 		Prompt: func(tosURL string) bool {
@@ -86,8 +97,7 @@ func (s *Server) tlsLetsEncrypt(domains []string) *tls.Config {
 		s.Infof("Let's Encrypt cache directory %s", c)
 		m.Cache = autocert.DirCache(c)
 	}
-	//return lets-encrypt tls config
-	return m.TLSConfig()
+	return m
 }
 
 func (s *Server) tlsKeyCert(key, cert string, ca string) (*tls.Config, error) {
@@ -95,6 +105,10 @@ func (s *Server) tlsKeyCert(key, cert string, ca string) (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	//log the key's pin for clients' --tls-pin
+	if leaf, err := x509.ParseCertificate(keypair.Certificate[0]); err == nil {
+		s.Infof("TLS pin sha256/%s", ccrypto.FingerprintSPKI(leaf))
+	}
 	//file based tls config using tls defaults
 	c := &tls.Config{
 		Certificates: []tls.Certificate{keypair},
@@ -110,43 +124,12 @@ func (s *Server) tlsKeyCert(key, cert string, ca string) (*tls.Config, error) {
 }
 
 func addCA(ca string, c *tls.Config) error {
-	fileInfo, err := os.Stat(ca)
+	clientCAPool, err := ccrypto.LoadCertPool(ca)
 	if err != nil {
 		return err
 	}
-	clientCAPool := x509.NewCertPool()
-	if fileInfo.IsDir() {
-		//this is a directory holding CA bundle files
-		files, err := ioutil.ReadDir(ca)
-		if err != nil {
-			return err
-		}
-		//add all cert files from path
-		for _, file := range files {
-			f := file.Name()
-			if err := addPEMFile(filepath.Join(ca, f), clientCAPool); err != nil {
-				return err
-			}
-		}
-	} else {
-		//this is a CA bundle file
-		if err := addPEMFile(ca, clientCAPool); err != nil {
-			return err
-		}
-	}
 	//set client CAs and enable cert verification
 	c.ClientCAs = clientCAPool
 	c.ClientAuth = tls.RequireAndVerifyClientCert
 	return nil
 }
-
-func addPEMFile(path string, pool *x509.CertPool) error {
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
-	}
-	if !pool.AppendCertsFromPEM(content) {
-		return errors.New("fail to load certificates from : " + path)
-	}
-	return nil
-}
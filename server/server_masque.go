@@ -0,0 +1,121 @@
+package chserver
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/masque-go"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/yosida95/uritemplate/v3"
+	"golang.org/x/sync/errgroup"
+)
+
+// handleMASQUE relays the UDP of a CONNECT-UDP request, made to
+// https://<host>/.well-known/masque/udp/{target_host}/{target_port}/
+// by any standard MASQUE client. When authentication is enabled,
+// users of the authfile present their credentials with basic
+// Proxy-Authorization, and may only reach the addresses which
+// their remotes could.
+func (s *Server) handleMASQUE(w http.ResponseWriter, r *http.Request) {
+	l := s.Fork("masque[%s]", newRequestID())
+	if !s.handshakes.allow(r.RemoteAddr, time.Now()) {
+		l.Debugf("ignoring request from %s, too many handshakes", r.RemoteAddr)
+		s.metrics.Counter("penguin_handshakes_limited_total", 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	template, err := uritemplate.New("https://" + r.Host + "/.well-known/masque/udp/{target_host}/{target_port}/")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req, err := masque.ParseRequest(r, template)
+	if err != nil {
+		l.Debugf("invalid request from %s (%s)", r.RemoteAddr, err)
+		var perr *masque.RequestParseError
+		if errors.As(err, &perr) {
+			w.WriteHeader(perr.HTTPStatus)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+	if s.authEnabled() {
+		// the credentials are those of basic authentication
+		name, pass, _ := (&http.Request{Header: http.Header{
+			"Authorization": {r.Header.Get("Proxy-Authorization")},
+		}}).BasicAuth()
+		user, found := s.users.Get(name)
+		if !found || user.Pass != pass || user.TOTP != nil || !user.AllowedAt(time.Now()) {
+			l.Debugf("login failed for user: %s", name)
+			s.metrics.Counter("penguin_auth_failures_total", 1)
+			w.Header().Set("Proxy-Authenticate", `Basic realm="penguin"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if !user.HasAccess(req.Target) {
+			l.Infof("access to '%s' denied for user: %s", req.Target, name)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	conn, err := s.dialer.DialContext(r.Context(), "udp", req.Target)
+	if err != nil {
+		l.Debugf("failed to dial %s (%s)", req.Target, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	w.Header().Set(http3.CapsuleProtocolHeader, "?1")
+	w.WriteHeader(http.StatusOK)
+	l.Debugf("relaying %s to %s", r.RemoteAddr, req.Target)
+	s.metrics.Counter("penguin_masque_flows_total", 1)
+	str := w.(http3.HTTPStreamer).HTTPStream()
+	var eg errgroup.Group
+	eg.Go(func() error {
+		defer conn.Close()
+		// capsules are not used, the stream ends the flow
+		io.Copy(ioutil.Discard, str)
+		return nil
+	})
+	eg.Go(func() error {
+		defer conn.Close()
+		for {
+			data, err := str.ReceiveDatagram(r.Context())
+			if err != nil {
+				return err
+			}
+			// only UDP payloads have context ID zero
+			id, n, err := quicvarint.Parse(data)
+			if err != nil || id != 0 {
+				continue
+			}
+			if _, err := conn.Write(data[n:]); err != nil {
+				return err
+			}
+		}
+	})
+	eg.Go(func() error {
+		defer str.Close()
+		// the payloads follow context ID zero
+		b := make([]byte, 1500)
+		for {
+			n, err := conn.Read(b[1:])
+			if err != nil {
+				return err
+			}
+			// packets too large for a datagram are dropped,
+			// as a link of a lower MTU would
+			if err := str.SendDatagram(b[:1+n]); err != nil && !errors.As(err, new(*quic.DatagramTooLargeError)) {
+				return err
+			}
+		}
+	})
+	err = eg.Wait()
+	l.Debugf("relay closed (%s)", err)
+}
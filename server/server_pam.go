@@ -0,0 +1,75 @@
+package chserver
+
+import (
+	"errors"
+	"os/user"
+
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// PAMConfig enables verifying passwords through PAM, which is only
+// available on Linux builds with the pam tag (go build -tags pam)
+type PAMConfig struct {
+	// Service is the PAM service name, i.e. the file
+	// in /etc/pam.d with the policy to apply
+	Service string
+	// GroupsFile is a JSON file mapping the Unix groups of
+	// users to the address regexes their members may use:
+	//   {"<group>": ["<addr-regex>"]}
+	// The group "*" applies to all users.
+	GroupsFile string
+}
+
+// pamAuth verifies users against the system accounts
+type pamAuth struct {
+	config *PAMConfig
+	groups groupACL
+}
+
+func newPAMAuth(c *PAMConfig) (*pamAuth, error) {
+	if !pamSupported {
+		return nil, errors.New("PAM authentication is not supported by this build")
+	}
+	groups, err := loadGroupACL(c.GroupsFile)
+	if err != nil {
+		return nil, err
+	}
+	return &pamAuth{config: c, groups: groups}, nil
+}
+
+// authenticate runs the auth and account stacks of the service,
+// so lockouts and password aging apply, and maps the user's
+// groups to addresses
+func (a *pamAuth) authenticate(name, pass, rhost string) (*settings.User, error) {
+	if name == "" || pass == "" {
+		return nil, errors.New("missing credentials")
+	}
+	if err := pamVerify(a.config.Service, name, pass, rhost); err != nil {
+		return nil, err
+	}
+	user := &settings.User{Name: name}
+	user.Addrs = append(user.Addrs, a.groups.group("*")...)
+	for _, group := range unixGroups(name) {
+		user.Addrs = append(user.Addrs, a.groups.group(group)...)
+	}
+	return user, nil
+}
+
+// unixGroups returns the names of the groups name is a member of
+func unixGroups(name string) []string {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, id := range ids {
+		if g, err := user.LookupGroupId(id); err == nil {
+			names = append(names, g.Name)
+		}
+	}
+	return names
+}
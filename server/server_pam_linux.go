@@ -0,0 +1,40 @@
+//+build pam,linux
+
+package chserver
+
+import (
+	"errors"
+
+	"github.com/msteinert/pam"
+)
+
+const pamSupported = true
+
+// pamVerify runs a PAM transaction for user, answering
+// password prompts with pass
+func pamVerify(service, user, pass, rhost string) error {
+	t, err := pam.StartFunc(service, user, func(s pam.Style, msg string) (string, error) {
+		switch s {
+		case pam.PromptEchoOff:
+			return pass, nil
+		case pam.PromptEchoOn:
+			return user, nil
+		case pam.ErrorMsg, pam.TextInfo:
+			return "", nil
+		}
+		return "", errors.New("unrecognized PAM message style")
+	})
+	if err != nil {
+		return err
+	}
+	if rhost != "" {
+		if err := t.SetItem(pam.Rhost, rhost); err != nil {
+			return err
+		}
+	}
+	if err := t.Authenticate(pam.DisallowNullAuthtok); err != nil {
+		return err
+	}
+	// the account stack checks expiry, aging and access rules
+	return t.AcctMgmt(pam.DisallowNullAuthtok)
+}
@@ -0,0 +1,11 @@
+//+build !pam !linux
+
+package chserver
+
+import "errors"
+
+const pamSupported = false
+
+func pamVerify(service, user, pass, rhost string) error {
+	return errors.New("PAM authentication is not supported by this build")
+}
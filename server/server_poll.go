@@ -0,0 +1,228 @@
+package chserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// pollWindow is how much data a long-polling session
+// buffers for the client before writes block
+const pollWindow = 1 << 20
+
+// pollSession is a connection of the long-polling transport,
+// whose data the client uploads and downloads with requests
+type pollSession struct {
+	up        *io.PipeReader
+	upWriter  *io.PipeWriter
+	mut       sync.Mutex
+	drained   *sync.Cond
+	down      []byte
+	ready     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	active    int64
+}
+
+func newPollSession() *pollSession {
+	p := &pollSession{
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		active: time.Now().UnixNano(),
+	}
+	p.up, p.upWriter = io.Pipe()
+	p.drained = sync.NewCond(&p.mut)
+	return p
+}
+
+func (p *pollSession) Read(b []byte) (int, error) {
+	return p.up.Read(b)
+}
+
+// Write buffers b until the client downloads it
+func (p *pollSession) Write(b []byte) (int, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for len(p.down) >= pollWindow && !p.isClosed() {
+		p.drained.Wait()
+	}
+	if p.isClosed() {
+		return 0, io.ErrClosedPipe
+	}
+	p.down = append(p.down, b...)
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (p *pollSession) Close() error {
+	p.closeOnce.Do(func() {
+		p.mut.Lock()
+		close(p.closed)
+		p.drained.Broadcast()
+		p.mut.Unlock()
+		p.upWriter.Close()
+	})
+	return nil
+}
+
+func (p *pollSession) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// take waits up to wait for at most max bytes of data to
+// download, which is false once the session is closed
+func (p *pollSession) take(ctx context.Context, wait time.Duration, max int) ([]byte, bool) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		p.mut.Lock()
+		b := p.down
+		p.down = nil
+		if len(b) > max {
+			b, p.down = b[:max], b[max:]
+		}
+		p.drained.Broadcast()
+		p.mut.Unlock()
+		if len(b) > 0 {
+			return b, true
+		}
+		select {
+		case <-p.ready:
+		case <-p.closed:
+			return nil, false
+		case <-timer.C:
+			return nil, true
+		case <-ctx.Done():
+			return nil, true
+		}
+	}
+}
+
+// expire closes the session once the client has
+// not made any request for the idle duration
+func (p *pollSession) expire(idle time.Duration) {
+	ticker := time.NewTicker(idle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&p.active))) > idle {
+				p.Close()
+				return
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// pollSessions are the long-polling sessions by their key
+type pollSessions struct {
+	sync.Mutex
+	inner map[string]*pollSession
+}
+
+func (r *pollSessions) add(key string, p *pollSession) {
+	r.Lock()
+	if r.inner == nil {
+		r.inner = map[string]*pollSession{}
+	}
+	r.inner[key] = p
+	r.Unlock()
+}
+
+func (r *pollSessions) get(key string) (*pollSession, bool) {
+	r.Lock()
+	p, ok := r.inner[key]
+	r.Unlock()
+	return p, ok
+}
+
+func (r *pollSessions) remove(key string) {
+	r.Lock()
+	delete(r.inner, key)
+	r.Unlock()
+}
+
+func (r *pollSessions) closeAll() {
+	r.Lock()
+	for _, p := range r.inner {
+		p.Close()
+	}
+	r.Unlock()
+}
+
+// handlePollOpen starts a session of the long-polling transport,
+// replying with the key which its data requests carry
+func (s *Server) handlePollOpen(w http.ResponseWriter, req *http.Request, protocol string) {
+	id := atomic.AddInt32(&s.sessCount, 1)
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	sshConfig, ok := s.requestSSHConfig(w, req, l)
+	if !ok {
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	key := hex.EncodeToString(b)
+	p := newPollSession()
+	s.polls.add(key, p)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(key))
+	l.Debugf("long-polling")
+	go p.expire(settings.EnvDuration("POLL_IDLE_TIMEOUT", time.Minute))
+	go func() {
+		defer s.polls.remove(key)
+		defer p.Close()
+		sess := &session{id: id, requestID: requestID, remoteAddr: req.RemoteAddr}
+		s.handleSSH(context.Background(), l, sess, protocol, cnet.NewRWCConn(p), sshConfig)
+	}()
+}
+
+// handlePollData serves the uploads, downloads and closing of
+// a long-polling session, false when there is no such session
+func (s *Server) handlePollData(w http.ResponseWriter, req *http.Request, key string) bool {
+	p, ok := s.polls.get(key)
+	if !ok {
+		return false
+	}
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	switch req.Method {
+	case http.MethodPost:
+		if _, err := io.Copy(p.upWriter, req.Body); err != nil {
+			http.Error(w, "closed", http.StatusGone)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		b, open := p.take(req.Context(), settings.EnvDuration("POLL_WAIT", 25*time.Second), pollWindow)
+		if !open {
+			http.Error(w, "closed", http.StatusGone)
+			return true
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	case http.MethodDelete:
+		p.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+	return true
+}
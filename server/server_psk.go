@@ -0,0 +1,184 @@
+package chserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/myzhang1029/penguin/share/ccrypto"
+	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// checkPsk verifies the pre-shared key presented by a websocket
+// upgrade request, either as an HMAC authenticator or, when
+// allowed, as the legacy plain-text key
+func (s *Server) checkPsk(r *http.Request) bool {
+	keys, enabled := s.psks.get()
+	if !enabled {
+		return true
+	}
+	if auth := pskAuthenticator(r); auth != "" {
+		window := settings.EnvDuration("PSK_WINDOW", 2*time.Minute)
+		var err error
+		for i, key := range keys {
+			if err = ccrypto.VerifyPSK(key, r.URL.Path, auth, time.Now(), window); err == nil {
+				s.Debugf("accepted PSK #%d", i+1)
+				break
+			}
+		}
+		if len(keys) == 0 {
+			err = errors.New("no keys configured")
+		}
+		if err != nil {
+			s.Infof("ignoring client connection with invalid PSK authenticator (%s)", err)
+			return false
+		}
+		fresh := true
+		if s.redis != nil {
+			//replays may be attempted against any server of the cluster
+			if fresh, err = s.redis.addReplay(auth, 2*window); err != nil {
+				s.Infof("ignoring client connection, failed to check PSK replay (%s)", err)
+				return false
+			}
+		} else {
+			fresh = s.pskReplays.add(auth, time.Now().Add(2*window))
+		}
+		if !fresh {
+			s.Infof("ignoring client connection with replayed PSK authenticator")
+			return false
+		}
+		return true
+	}
+	if wsPsk := r.Header.Get("X-Penguin-Psk"); s.config.PskLegacy && wsPsk != "" {
+		for _, key := range keys {
+			if wsPsk == key {
+				return true
+			}
+		}
+	}
+	s.Infof("ignoring client connection with incorrect or missing PSK")
+	return false
+}
+
+// checkPskPath verifies that a websocket upgrade is
+// to a path derived from one of the pre-shared keys
+func (s *Server) checkPskPath(path string) bool {
+	keys, _ := s.psks.get()
+	window := settings.EnvDuration("PSK_WINDOW", 2*time.Minute)
+	for _, key := range keys {
+		if ccrypto.VerifyPSKPath(key, path, time.Now(), window) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// pskAuthenticator finds the authenticator of a request, which
+// is usually sent in a header but may instead be a cookie or URL
+// parameter when proxies strip unknown headers
+func pskAuthenticator(r *http.Request) string {
+	if auth := r.Header.Get("X-Penguin-Auth"); auth != "" {
+		return auth
+	}
+	if c, err := r.Cookie(ccrypto.PSKParam); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return r.URL.Query().Get(ccrypto.PSKParam)
+}
+
+// pskSet holds the accepted pre-shared keys. Several keys
+// can be accepted at once so that they can be rotated
+// without disconnecting clients which use the old one.
+type pskSet struct {
+	sync.RWMutex
+	static []string
+	file   string
+	loaded []string
+}
+
+// get returns the keys, and whether a key is required
+// at all (an empty key file rejects every client)
+func (p *pskSet) get() ([]string, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	keys := append(append([]string{}, p.static...), p.loaded...)
+	return keys, len(keys) > 0 || p.file != ""
+}
+
+// load reads the key file, which has one key per line
+// and may contain comments starting with #
+func (p *pskSet) load() error {
+	b, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return fmt.Errorf("failed to read PSK file: %s", err)
+	}
+	var keys []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	p.Lock()
+	p.loaded = keys
+	p.Unlock()
+	return nil
+}
+
+// watch reloads the key file whenever it is written
+func (p *pskSet) watch(l *cio.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(p.file); err != nil {
+		return err
+	}
+	go func() {
+		for e := range watcher.Events {
+			if e.Op&fsnotify.Write != fsnotify.Write {
+				continue
+			}
+			if err := p.load(); err != nil {
+				l.Infof("failed to reload the PSK file: %s", err)
+			} else {
+				l.Debugf("PSK file successfully reloaded from: %s", p.file)
+			}
+		}
+	}()
+	return nil
+}
+
+// replayCache remembers authenticators until they expire
+type replayCache struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+// add records the authenticator, returning false
+// if it has already been seen
+func (c *replayCache) add(auth string, expiry time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if c.seen == nil {
+		c.seen = map[string]time.Time{}
+	}
+	for a, e := range c.seen {
+		if now.After(e) {
+			delete(c.seen, a)
+		}
+	}
+	if _, ok := c.seen[auth]; ok {
+		return false
+	}
+	c.seen[auth] = expiry
+	return true
+}
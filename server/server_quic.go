@@ -0,0 +1,136 @@
+package chserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/ccrypto"
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// listenQUIC accepts clients of the QUIC and WebTransport
+// transports on the QUIC port, with the TLS configuration of the
+// websocket listener, or a self-signed certificate since the SSH
+// handshake authenticates the server either way
+func (s *Server) listenQUIC(ctx context.Context, host string, tlsConf *tls.Config) error {
+	if tlsConf != nil {
+		tlsConf = tlsConf.Clone()
+	} else {
+		cert, err := ccrypto.SelfSignedCert(host)
+		if err != nil {
+			return err
+		}
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tlsConf.NextProtos = []string{cnet.QUICProtocol, http3.NextProtoH3}
+	addr := net.JoinHostPort(host, s.config.QUICPort)
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return s.Errorf("quic: %s", err)
+	}
+	s.quic = &quic.Transport{Conn: pc}
+	// reconnecting clients may start their SSH handshake in 0-RTT,
+	// which is safe to replay since the server's half is fresh
+	l, err := s.quic.ListenEarly(tlsConf, &quic.Config{
+		MaxIdleTimeout:  settings.EnvDuration("QUIC_IDLE_TIMEOUT", 45*time.Second),
+		EnableDatagrams: true, //required by WebTransport
+		Allow0RTT:       true,
+	})
+	if err != nil {
+		pc.Close()
+		return s.Errorf("quic: %s", err)
+	}
+	// HTTP/3 requests are handled as any other, the
+	// websocket checks apply to WebTransport sessions
+	s.webTransport = &webtransport.Server{
+		H3: http3.Server{Handler: http.HandlerFunc(s.handleClientHandler)},
+		// clients are not browsers
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	s.Infof("listening on quic://%s", addr)
+	go func() {
+		<-ctx.Done()
+		s.closeQUIC()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept(ctx)
+			if err != nil {
+				return
+			}
+			if conn.ConnectionState().TLS.NegotiatedProtocol == http3.NextProtoH3 {
+				go s.webTransport.ServeQUICConn(conn)
+			} else {
+				go s.handleQUIC(conn)
+			}
+		}
+	}()
+	return nil
+}
+
+// handleQUIC runs the session on the first stream of a
+// QUIC connection. The websocket checks (path, PSK and
+// bearer tokens) do not apply to this transport.
+func (s *Server) handleQUIC(conn *quic.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	if !s.handshakes.allow(remoteAddr, time.Now()) {
+		s.Debugf("ignoring client connection from %s, too many handshakes", remoteAddr)
+		s.metrics.Counter("penguin_handshakes_limited_total", 1)
+		conn.CloseWithError(0, "")
+		return
+	}
+	defer conn.CloseWithError(0, "")
+	ctx := conn.Context()
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		s.Debugf("quic: no stream from %s (%s)", remoteAddr, err)
+		return
+	}
+	id := atomic.AddInt32(&s.sessCount, 1)
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	sess := &session{id: id, requestID: requestID, remoteAddr: remoteAddr}
+	s.handleSSH(ctx, l, sess, "", cnet.NewQUICConn(conn, stream), s.sshConfig)
+}
+
+// handleWebTransport is responsible for handling the connection
+// carried by the first stream of a WebTransport session
+func (s *Server) handleWebTransport(w http.ResponseWriter, req *http.Request, protocol string) {
+	id := atomic.AddInt32(&s.sessCount, 1)
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	sshConfig, ok := s.requestSSHConfig(w, req, l)
+	if !ok {
+		return
+	}
+	wt, err := s.webTransport.Upgrade(w, req)
+	if err != nil {
+		l.Debugf("failed to upgrade (%s)", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	ctx := wt.Context()
+	stream, err := wt.AcceptStream(ctx)
+	if err != nil {
+		l.Debugf("no stream from %s (%s)", req.RemoteAddr, err)
+		wt.CloseWithError(0, "")
+		return
+	}
+	sess := &session{id: id, requestID: requestID, remoteAddr: req.RemoteAddr}
+	s.handleSSH(ctx, l, sess, protocol, cnet.NewWebTransportConn(wt, stream), sshConfig)
+}
+
+// closeQUIC closes the QUIC port and its connections
+func (s *Server) closeQUIC() {
+	s.quic.Close()
+	s.quic.Conn.Close()
+	s.webTransport.Close()
+}
@@ -0,0 +1,128 @@
+package chserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jpillora/sizestr"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// quotas tracks the bytes transferred by each user
+// in the sessions which have ended
+type quotas struct {
+	mut  sync.Mutex
+	used map[string]int64
+	//total is transferred by all ended sessions,
+	//including anonymous ones, since the start
+	total int64
+}
+
+// loadQuotas reads the usage saved by saveQuotas, a
+// missing file starts counting from zero
+func loadQuotas(file string) (*quotas, error) {
+	q := &quotas{used: map[string]int64{}}
+	if file == "" {
+		return q, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota file: %s", err)
+	}
+	if err := json.Unmarshal(b, &q.used); err != nil {
+		return nil, fmt.Errorf("invalid quota file: %s", err)
+	}
+	return q, nil
+}
+
+func (q *quotas) add(user string, n int64) {
+	q.mut.Lock()
+	if user != "" {
+		q.used[user] += n
+	}
+	q.total += n
+	q.mut.Unlock()
+}
+
+// usage returns the bytes transferred by the user,
+// including their running sessions
+func (s *Server) usage(user string) int64 {
+	s.quotas.mut.Lock()
+	n := s.quotas.used[user]
+	s.quotas.mut.Unlock()
+	for _, sess := range s.registry.list() {
+		if sess.user == user {
+			stats := sess.tunnel.Stats()
+			n += stats.Sent + stats.Received
+		}
+	}
+	return n
+}
+
+// checkQuota refuses new streams of users who are over their quota
+func (s *Server) checkQuota(user *settings.User) error {
+	limit := user.Quota
+	if limit == 0 {
+		limit = s.config.Quota
+	}
+	if limit <= 0 {
+		return nil
+	}
+	if used := s.usage(user.Name); used >= limit {
+		return fmt.Errorf("quota of %s exceeded", sizestr.ToString(limit))
+	}
+	return nil
+}
+
+// saveQuotas writes the usage of all users, including
+// running sessions, so that it survives restarts
+func (s *Server) saveQuotas() error {
+	usage := map[string]int64{}
+	s.quotas.mut.Lock()
+	for user, n := range s.quotas.used {
+		usage[user] = n
+	}
+	s.quotas.mut.Unlock()
+	for _, sess := range s.registry.list() {
+		if sess.user != "" {
+			stats := sess.tunnel.Stats()
+			usage[sess.user] += stats.Sent + stats.Received
+		}
+	}
+	b, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	//replace atomically, a partial file would reset everyone
+	tmp := s.config.QuotaFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.config.QuotaFile)
+}
+
+// saveQuotasLoop periodically saves the usage until ctx is done
+func (s *Server) saveQuotasLoop(ctx context.Context) {
+	ticker := time.NewTicker(settings.EnvDuration("QUOTA_SAVE", time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+		if err := s.saveQuotas(); err != nil {
+			s.Infof("failed to save quota usage: %s", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
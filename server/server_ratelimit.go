@@ -0,0 +1,117 @@
+package chserver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handshakeLimiter is a token bucket per source IP, limiting
+// how often each IP may start a websocket upgrade and the
+// (expensive) SSH handshake which follows it
+type handshakeLimiter struct {
+	mut     sync.Mutex
+	burst   float64
+	every   time.Duration
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newHandshakeLimiter parses a limit such as "10/1m", which allows
+// bursts of 10 handshakes and refills 10 tokens per minute. An
+// empty limit returns nil, which allows everything.
+func newHandshakeLimiter(limit string) (*handshakeLimiter, error) {
+	if limit == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(limit, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid handshake limit '%s', expected <count>/<duration>", limit)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid handshake limit '%s', expected a positive count", limit)
+	}
+	period := parts[1]
+	// allow "10/m" for "10/1m"
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid handshake limit '%s', expected a positive duration", limit)
+	}
+	return &handshakeLimiter{
+		burst:   float64(n),
+		every:   d / time.Duration(n),
+		buckets: map[string]*bucket{},
+	}, nil
+}
+
+func (h *handshakeLimiter) String() string {
+	return fmt.Sprintf("%d/%s", int(h.burst), h.every*time.Duration(h.burst))
+}
+
+// retryAfter is the number of seconds until an
+// exhausted bucket has a token again
+func (h *handshakeLimiter) retryAfter() int {
+	return int((h.every + time.Second - 1) / time.Second)
+}
+
+// allow takes a token from the bucket of remoteAddr's IP
+func (h *handshakeLimiter) allow(remoteAddr string, now time.Time) bool {
+	if h == nil {
+		return true
+	}
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.sweep(now)
+	b, ok := h.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: h.burst, last: now}
+		h.buckets[ip] = b
+	}
+	b.refill(now, h.every, h.burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) refill(now time.Time, every time.Duration, burst float64) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(every)
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// sweep forgets the IPs whose buckets have refilled, which
+// behave just like a new bucket, at most once a minute
+func (h *handshakeLimiter) sweep(now time.Time) {
+	if now.Sub(h.swept) < time.Minute {
+		return
+	}
+	h.swept = now
+	for ip, b := range h.buckets {
+		b.refill(now, h.every, h.burst)
+		if b.tokens >= h.burst {
+			delete(h.buckets, ip)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package chserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	h, err := newHandshakeLimiter("3/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !h.allow("192.0.2.1:1000", now) {
+			t.Fatalf("expected handshake %d to be allowed", i+1)
+		}
+	}
+	if h.allow("192.0.2.1:1001", now) {
+		t.Fatal("expected the burst to be used up")
+	}
+	if !h.allow("192.0.2.2:1000", now) {
+		t.Fatal("expected other IPs to be unaffected")
+	}
+	if !h.allow("192.0.2.1:1002", now.Add(20*time.Second)) {
+		t.Fatal("expected a token to be refilled")
+	}
+	if h.allow("192.0.2.1:1003", now.Add(21*time.Second)) {
+		t.Fatal("expected only one token to be refilled")
+	}
+	//idle buckets are forgotten
+	h.allow("192.0.2.3:1000", now.Add(time.Hour))
+	if _, ok := h.buckets["192.0.2.1"]; ok {
+		t.Fatal("expected the refilled bucket to be swept")
+	}
+	if h.retryAfter() != 20 {
+		t.Fatalf("expected to retry after 20s, got %d", h.retryAfter())
+	}
+}
+
+func TestHandshakeLimiterInvalid(t *testing.T) {
+	for _, limit := range []string{"10", "0/m", "x/m", "10/", "10/-1s"} {
+		if _, err := newHandshakeLimiter(limit); err == nil {
+			t.Fatalf("expected '%s' to be invalid", limit)
+		}
+	}
+}
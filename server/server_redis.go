@@ -0,0 +1,233 @@
+package chserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// redisPrefix namespaces the keys penguin uses:
+//   penguin:users                   hash of "<user:pass>" to authfile entries
+//   penguin:psk:<auth>              PSK authenticators already used
+//   penguin:reverse:<port>/<proto>  owner of a reverse port
+const redisPrefix = "penguin:"
+
+// reverseLeaseTTL is how long a reverse port stays claimed
+// after the server holding it stops renewing it
+const reverseLeaseTTL = 30 * time.Second
+
+// redisState is state shared by the servers of a cluster
+type redisState struct {
+	pool *redis.Pool
+}
+
+func isRedisURL(url string) bool {
+	return strings.HasPrefix(url, "redis://") || strings.HasPrefix(url, "rediss://")
+}
+
+func newRedisState(url string) (*redisState, error) {
+	if !isRedisURL(url) {
+		return nil, errors.New("redis URL must start with redis:// or rediss://")
+	}
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url,
+				redis.DialConnectTimeout(10*time.Second),
+				redis.DialReadTimeout(10*time.Second),
+				redis.DialWriteTimeout(10*time.Second),
+			)
+		},
+	}
+	//fail early on a bad URL or unreachable server
+	c := pool.Get()
+	defer c.Close()
+	if _, err := c.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &redisState{pool: pool}, nil
+}
+
+func (r *redisState) do(cmd string, args ...interface{}) (interface{}, error) {
+	c := r.pool.Get()
+	defer c.Close()
+	return c.Do(cmd, args...)
+}
+
+// users reads the shared users, which are stored
+// like the entries of an authfile
+func (r *redisState) users() ([]*settings.User, error) {
+	m, err := redis.StringMap(r.do("HGETALL", redisPrefix+"users"))
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	for auth, value := range m {
+		raw[auth] = json.RawMessage(value)
+	}
+	return settings.ParseUsers(raw)
+}
+
+// watchUsers loads the shared users into the index
+// and polls for changes
+func (r *redisState) watchUsers(l *cio.Logger, index *settings.UserIndex) error {
+	users, err := r.users()
+	if err != nil {
+		return err
+	}
+	index.Reset(users)
+	go func() {
+		for range time.Tick(settings.EnvDuration("AUTHDB_POLL", 10*time.Second)) {
+			users, err := r.users()
+			if err != nil {
+				l.Infof("failed to reload users from redis: %s", err)
+				continue
+			}
+			index.Reset(users)
+		}
+	}()
+	return nil
+}
+
+// addReplay records a PSK authenticator, returning false
+// if any server of the cluster has already seen it
+func (r *redisState) addReplay(auth string, ttl time.Duration) (bool, error) {
+	reply, err := r.do("SET", redisPrefix+"psk:"+auth, 1, "NX", "PX", int64(ttl/time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// claimScript takes a reverse port when it is free or held by
+// another session of the same owner (i.e. a reconnecting client)
+var claimScript = redis.NewScript(1, `
+local v = redis.call("GET", KEYS[1])
+if v and v ~= ARGV[1] and string.sub(v, 1, #ARGV[2]) ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return 1`)
+
+// renewScript extends a claim only if it has not been taken over
+var renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])`)
+
+// releaseScript deletes a claim only if it is still ours
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])`)
+
+// reverseLeases are the reverse ports claimed by a session, so
+// that no two sessions in the cluster listen on the same port
+type reverseLeases struct {
+	state *redisState
+	l     *cio.Logger
+	//owner identifies the client across reconnects and
+	//value identifies this session of the owner
+	owner string
+	value string
+	mut   sync.Mutex
+	keys  []string
+}
+
+// newReverseLeases returns nil when there is no shared state,
+// in which case claims always succeed
+func (s *Server) newReverseLeases(l *cio.Logger, user *settings.User, requestID string) *reverseLeases {
+	if s.redis == nil {
+		return nil
+	}
+	//anonymous clients cannot be told apart
+	owner := "session " + requestID + "\n"
+	if user != nil {
+		owner = "user " + user.Name + "\n"
+	}
+	return &reverseLeases{
+		state: s.redis,
+		l:     l,
+		owner: owner,
+		value: owner + requestID,
+	}
+}
+
+// claim takes the ports of the reverse remotes
+func (rl *reverseLeases) claim(remotes settings.Remotes) error {
+	if rl == nil {
+		return nil
+	}
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	c := rl.state.pool.Get()
+	defer c.Close()
+	var claimed []string
+	for _, r := range remotes {
+		if !r.Reverse || r.Stdio {
+			continue
+		}
+		key := redisPrefix + "reverse:" + r.LocalPort + "/" + r.LocalProto
+		ok, err := redis.Bool(claimScript.Do(c, key, rl.value, rl.owner, int64(reverseLeaseTTL/time.Millisecond)))
+		if err == nil && !ok {
+			err = errors.New("in use by another session")
+		}
+		if err != nil {
+			//all or nothing
+			rl.run(c, releaseScript, claimed)
+			return rl.l.Errorf("failed to claim reverse port %s: %s", r.LocalPort, err)
+		}
+		claimed = append(claimed, key)
+	}
+	rl.keys = append(rl.keys, claimed...)
+	return nil
+}
+
+// hold renews the claims until ctx is done and then releases them
+func (rl *reverseLeases) hold(ctx context.Context) {
+	if rl == nil {
+		return
+	}
+	ticker := time.NewTicker(reverseLeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rl.each(renewScript, int64(reverseLeaseTTL/time.Millisecond))
+		case <-ctx.Done():
+			rl.each(releaseScript)
+			return
+		}
+	}
+}
+
+func (rl *reverseLeases) each(script *redis.Script, args ...interface{}) {
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	c := rl.state.pool.Get()
+	defer c.Close()
+	rl.run(c, script, rl.keys, args...)
+}
+
+// run applies one of the claim scripts to keys
+func (rl *reverseLeases) run(c redis.Conn, script *redis.Script, keys []string, args ...interface{}) {
+	for _, key := range keys {
+		ok, err := redis.Bool(script.Do(c, append([]interface{}{key, rl.value}, args...)...))
+		if err != nil {
+			rl.l.Infof("failed to update claim %s: %s", key, err)
+		} else if !ok && script == renewScript {
+			rl.l.Infof("claim %s was taken over by another session", key)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package chserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+func TestRedisState(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	state, err := newRedisState("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	//users
+	mr.HSet("penguin:users", "alice:secret", `["^example\\.com:443$"]`)
+	users, err := state.users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "alice" || !users[0].HasAccess("example.com:443") {
+		t.Fatalf("unexpected users %v", users)
+	}
+	//psk replays
+	if fresh, err := state.addReplay("auth", time.Minute); err != nil || !fresh {
+		t.Fatalf("expected a fresh authenticator (%v)", err)
+	}
+	if fresh, _ := state.addReplay("auth", time.Minute); fresh {
+		t.Fatal("expected a replayed authenticator")
+	}
+	mr.FastForward(2 * time.Minute)
+	if fresh, _ := state.addReplay("auth", time.Minute); !fresh {
+		t.Fatal("expected the authenticator to expire")
+	}
+}
+
+func TestReverseLeases(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	state, err := newRedisState("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{redis: state}
+	l := cio.NewLogger("test")
+	remotes := func(specs ...string) settings.Remotes {
+		var rs settings.Remotes
+		for _, spec := range specs {
+			r, err := settings.DecodeRemote(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs = append(rs, r)
+		}
+		return rs
+	}
+	alice := &settings.User{Name: "alice"}
+	a1 := s.newReverseLeases(l, alice, "a1")
+	if err := a1.claim(remotes("R:8000:localhost:80", "R:8001:localhost:81")); err != nil {
+		t.Fatal(err)
+	}
+	//other users cannot take the ports, and claims are all or nothing
+	bob := s.newReverseLeases(l, &settings.User{Name: "bob"}, "b1")
+	if err := bob.claim(remotes("R:9000:localhost:80", "R:8000:localhost:80")); err == nil {
+		t.Fatal("expected port 8000 to be in use")
+	}
+	if mr.Exists("penguin:reverse:9000/tcp") {
+		t.Fatal("expected port 9000 to be released")
+	}
+	//the same protocol and port only
+	if err := bob.claim(remotes("R:8000:localhost:80/udp")); err != nil {
+		t.Fatal(err)
+	}
+	//a reconnecting user takes over their ports
+	a2 := s.newReverseLeases(l, alice, "a2")
+	if err := a2.claim(remotes("R:8000:localhost:80")); err != nil {
+		t.Fatal(err)
+	}
+	//and the old session does not release them
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a1.hold(ctx)
+	if !mr.Exists("penguin:reverse:8000/tcp") {
+		t.Fatal("expected port 8000 to be kept by the new session")
+	}
+	if mr.Exists("penguin:reverse:8001/tcp") {
+		t.Fatal("expected port 8001 to be released")
+	}
+	a2.hold(ctx)
+	if mr.Exists("penguin:reverse:8000/tcp") {
+		t.Fatal("expected port 8000 to be released")
+	}
+	//without shared state claims always succeed
+	var none *reverseLeases
+	if err := none.claim(remotes("R:8000:localhost:80")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,57 @@
+package chserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+
+	"golang.org/x/crypto/acme"
+)
+
+// RemoteTLSConfig has the certificates with which reverse
+// remotes terminate TLS, each chosen by the server name of
+// the connection
+type RemoteTLSConfig struct {
+	// Certs and Keys are the paths of PEM encoded
+	// certificates and their keys, in pairs
+	Certs []string
+	Keys  []string
+	// Domains have their certificates acquired
+	// with LetsEncrypt
+	Domains []string
+}
+
+// remoteTLSConfig is the TLS configuration of the reverse
+// remotes which terminate TLS, nil when there are no
+// certificates for them
+func (s *Server) remoteTLSConfig() (*tls.Config, error) {
+	rc := s.config.RemoteTLS
+	if len(rc.Certs) != len(rc.Keys) {
+		return nil, errors.New("each remote TLS certificate needs a key")
+	}
+	if len(rc.Certs) == 0 && len(rc.Domains) == 0 {
+		return nil, nil
+	}
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	for i := range rc.Certs {
+		keypair, err := tls.LoadX509KeyPair(rc.Certs[i], rc.Keys[i])
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = append(c.Certificates, keypair)
+	}
+	if len(rc.Domains) > 0 {
+		m := s.letsEncryptManager(rc.Domains)
+		//the remotes answer the TLS-ALPN challenges of their
+		//domains, so that they can listen on port 443 alone
+		c.NextProtos = []string{acme.ALPNProto}
+		c.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if m.HostPolicy(context.Background(), hello.ServerName) != nil && len(c.Certificates) > 0 {
+				//one of the certificates
+				return nil, nil
+			}
+			return m.GetCertificate(hello)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,104 @@
+package chserver
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/cnet"
+	"golang.org/x/crypto/ssh"
+)
+
+// resumable is a session which its client may resume
+type resumable struct {
+	*cnet.ResumableConn
+	l *cio.Logger
+}
+
+// resumableSessions are the resumable sessions by their token
+type resumableSessions struct {
+	sync.Mutex
+	inner map[string]resumable
+}
+
+func (r *resumableSessions) add(token string, s resumable) {
+	r.Lock()
+	if r.inner == nil {
+		r.inner = map[string]resumable{}
+	}
+	r.inner[token] = s
+	r.Unlock()
+}
+
+func (r *resumableSessions) get(token string) (resumable, bool) {
+	r.Lock()
+	s, ok := r.inner[token]
+	r.Unlock()
+	return s, ok
+}
+
+func (r *resumableSessions) remove(token string) {
+	r.Lock()
+	delete(r.inner, token)
+	r.Unlock()
+}
+
+func (r *resumableSessions) closeAll() {
+	r.Lock()
+	for _, s := range r.inner {
+		s.Close()
+	}
+	r.Unlock()
+}
+
+// handleResume carries a resumable session over conn, starting
+// the session unless the client resumes one, and returns once
+// conn is lost. The session itself runs until the client closes
+// it, or does not resume it within the configured duration.
+func (s *Server) handleResume(l *cio.Logger, sess *session, protocol string, conn net.Conn, hello *cnet.ResumeHello, sshConfig *ssh.ServerConfig) {
+	if s.config.Resume <= 0 {
+		l.Debugf("refusing to resume sessions")
+		cnet.RejectResume(conn, cnet.ResumeDisabled)
+		return
+	}
+	if r, ok := s.resumables.get(hello.Token); ok {
+		lost, err := r.Accept(conn, hello)
+		if err != nil {
+			l.Debugf("failed to resume (%s)", err)
+			return
+		}
+		r.l.Infof("resumed by %s", sess.remoteAddr)
+		s.metrics.Counter("penguin_sessions_resumed_total", 1)
+		awaitLost(r.l, r.ResumableConn, lost)
+		return
+	}
+	if hello.Received > 0 {
+		l.Debugf("cannot resume an unknown session")
+		cnet.RejectResume(conn, cnet.ResumeUnknown)
+		return
+	}
+	rc := cnet.NewResumableConn(hello.Token, s.config.Resume)
+	lost, err := rc.Accept(conn, hello)
+	if err != nil {
+		l.Debugf("failed to start a resumable session (%s)", err)
+		return
+	}
+	s.resumables.add(hello.Token, resumable{rc, l})
+	go func() {
+		defer s.resumables.remove(hello.Token)
+		defer rc.Close()
+		s.serveSSH(context.Background(), l, sess, protocol, rc, sshConfig)
+	}()
+	awaitLost(l, rc, lost)
+}
+
+// awaitLost blocks until the conn carrying rc is lost
+func awaitLost(l *cio.Logger, rc *cnet.ResumableConn, lost <-chan struct{}) {
+	<-lost
+	select {
+	case <-rc.Done():
+	default:
+		l.Debugf("connection lost, waiting for the client to resume")
+	}
+}
@@ -0,0 +1,231 @@
+package chserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/settings"
+	"github.com/myzhang1029/penguin/share/tunnel"
+)
+
+// session is a client connected to the server
+type session struct {
+	id         int32
+	requestID  string
+	user       string
+	remoteAddr string
+	version    string
+	started    time.Time
+	remotes    settings.Remotes
+	tunnel     *tunnel.Tunnel
+	cancel     context.CancelFunc
+	// protocol, keepAlive and compress were
+	// negotiated with the client
+	protocol  string
+	keepAlive time.Duration
+	compress  string
+}
+
+// SessionSnapshot is the state of a session at a point in time
+type SessionSnapshot struct {
+	ID           int32
+	RequestID    string
+	User         string
+	RemoteAddr   string
+	Version      string
+	Started      time.Time
+	Remotes      []string
+	Capabilities SessionCapabilities
+	Tunnel       tunnel.Stats
+}
+
+// SessionCapabilities are the features of a session: the Protocol,
+// KeepAlive interval and Compress algorithm negotiated with the
+// client, and whether the server allows Reverse, Socks and Tun
+type SessionCapabilities struct {
+	Protocol  string
+	Reverse   bool
+	Socks     bool
+	KeepAlive time.Duration
+	Tun       bool
+	Compress  string `json:",omitempty"`
+}
+
+// snapshot captures the current state of the session
+func (s *Server) snapshot(sess *session) *SessionSnapshot {
+	//forward remotes are only known from the config,
+	//reverse remotes can also change at runtime
+	remotes := sess.remotes.Reversed(false)
+	remotes = append(remotes, sess.tunnel.Remotes()...)
+	return &SessionSnapshot{
+		ID:         sess.id,
+		RequestID:  sess.requestID,
+		User:       sess.user,
+		RemoteAddr: sess.remoteAddr,
+		Version:    sess.version,
+		Started:    sess.started,
+		Remotes:    remotes.Encode(),
+		Capabilities: SessionCapabilities{
+			Protocol:  sess.protocol,
+			Reverse:   s.config.Reverse,
+			Socks:     s.config.Socks5,
+			KeepAlive: sess.keepAlive,
+			Tun:       s.config.Tun,
+			Compress:  sess.compress,
+		},
+		Tunnel: sess.tunnel.Stats(),
+	}
+}
+
+// Restore returns the configuration of a server and the remotes
+// of a client which reproduce the session of snap, such as one taken
+// from the admin API: a server with the same capabilities, and remotes
+// of the same shape. As the snapshot does not reveal the addresses of
+// the session, the remotes listen on 127.0.0.1 at the ports returned by
+// listen, and reach the targets returned by target, for their protocol.
+// The client must offer the compression of the session, if any.
+func (snap *SessionSnapshot) Restore(listen, target func(proto string) string) (*Config, []string, error) {
+	c := &Config{
+		Reverse:   snap.Capabilities.Reverse,
+		Socks5:    snap.Capabilities.Socks,
+		KeepAlive: snap.Capabilities.KeepAlive,
+		Tun:       snap.Capabilities.Tun,
+	}
+	if snap.Capabilities.Compress != "" {
+		c.Compress = []string{snap.Capabilities.Compress}
+	}
+	remotes := []string{}
+	for _, s := range snap.Remotes {
+		r, err := settings.DecodeRemote(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid remote in snapshot: %s", err)
+		}
+		r.LocalHost = "127.0.0.1"
+		r.LocalPort = listen(r.LocalProto)
+		if !r.Socks {
+			host, port, err := net.SplitHostPort(target(r.RemoteProto))
+			if err != nil {
+				return nil, nil, err
+			}
+			r.RemoteHost, r.RemotePort = host, port
+		}
+		remotes = append(remotes, r.Encode())
+	}
+	return c, remotes, nil
+}
+
+// newRequestID generates a random id for correlating logs
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Sessions returns snapshots of all connected sessions
+func (s *Server) Sessions() []*SessionSnapshot {
+	snaps := []*SessionSnapshot{}
+	for _, sess := range s.registry.list() {
+		snaps = append(snaps, s.snapshot(sess))
+	}
+	return snaps
+}
+
+// Session returns a snapshot of the session with the given id
+func (s *Server) Session(id int32) (*SessionSnapshot, bool) {
+	sess, ok := s.registry.get(id)
+	if !ok {
+		return nil, false
+	}
+	return s.snapshot(sess), true
+}
+
+// KillSession disconnects the session with the given id,
+// returning false if there is no such session
+func (s *Server) KillSession(id int32) bool {
+	sess, ok := s.registry.get(id)
+	if !ok {
+		return false
+	}
+	sess.cancel()
+	return true
+}
+
+// registryShards is the number of independently
+// locked partitions of the session registry
+const registryShards = 16
+
+// sessionRegistry indexes the connected sessions by id.
+// Sessions are spread over shards by id so that
+// connects, disconnects and admin lookups for different
+// sessions do not contend on a single lock.
+type sessionRegistry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	sync.RWMutex
+	inner map[int32]*session
+}
+
+func (r *sessionRegistry) shard(id int32) *registryShard {
+	return &r.shards[uint32(id)%registryShards]
+}
+
+func (r *sessionRegistry) add(sess *session) {
+	s := r.shard(sess.id)
+	s.Lock()
+	if s.inner == nil {
+		s.inner = map[int32]*session{}
+	}
+	s.inner[sess.id] = sess
+	s.Unlock()
+}
+
+func (r *sessionRegistry) remove(id int32) {
+	s := r.shard(id)
+	s.Lock()
+	delete(s.inner, id)
+	s.Unlock()
+}
+
+func (r *sessionRegistry) len() int {
+	l := 0
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.RLock()
+		l += len(s.inner)
+		s.RUnlock()
+	}
+	return l
+}
+
+func (r *sessionRegistry) get(id int32) (*session, bool) {
+	s := r.shard(id)
+	s.RLock()
+	sess, ok := s.inner[id]
+	s.RUnlock()
+	return sess, ok
+}
+
+// list returns the sessions ordered by id
+func (r *sessionRegistry) list() []*session {
+	l := []*session{}
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.RLock()
+		for _, sess := range s.inner {
+			l = append(l, sess)
+		}
+		s.RUnlock()
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].id < l[j].id
+	})
+	return l
+}
@@ -0,0 +1,52 @@
+package chserver
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	r := &sessionRegistry{}
+	for id := int32(40); id > 0; id-- {
+		r.add(&session{id: id})
+	}
+	if l := r.len(); l != 40 {
+		t.Fatalf("expected 40 sessions, got %d", l)
+	}
+	r.remove(7)
+	if _, ok := r.get(7); ok {
+		t.Fatal("expected session 7 to be removed")
+	}
+	l := r.list()
+	if len(l) != 39 {
+		t.Fatalf("expected 39 sessions, got %d", len(l))
+	}
+	for i := 1; i < len(l); i++ {
+		if l[i-1].id >= l[i].id {
+			t.Fatalf("sessions not ordered by id: %d before %d", l[i-1].id, l[i].id)
+		}
+	}
+}
+
+func BenchmarkSessionRegistry(b *testing.B) {
+	r := &sessionRegistry{}
+	for id := int32(0); id < 1000; id++ {
+		r.add(&session{id: id})
+	}
+	var next int32 = 1000
+	b.RunParallel(func(pb *testing.PB) {
+		i := int32(0)
+		for pb.Next() {
+			//mostly lookups, with some connects and disconnects
+			switch {
+			case i%20 == 0:
+				id := atomic.AddInt32(&next, 1)
+				r.add(&session{id: id})
+				r.remove(id)
+			default:
+				r.get(i % 1000)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package chserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/ccrypto"
+	"github.com/myzhang1029/penguin/share/cnet"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+// listenRawTLS accepts clients of the raw TLS transport, which
+// speak SSH directly over TLS, with the TLS configuration of the
+// websocket listener, or a self-signed certificate as for QUIC
+func (s *Server) listenRawTLS(ctx context.Context, host string, tlsConf *tls.Config) error {
+	if tlsConf != nil {
+		tlsConf = tlsConf.Clone()
+	} else {
+		cert, err := ccrypto.SelfSignedCert(host)
+		if err != nil {
+			return err
+		}
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tlsConf.NextProtos = []string{cnet.TLSProtocol}
+	tlsConf.MinVersion = tls.VersionTLS12
+	addr := net.JoinHostPort(host, s.config.RawTLSPort)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return s.Errorf("tls: %s", err)
+	}
+	s.rawTLS = l
+	s.Infof("listening on tls://%s", addr)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleRawTLS(ctx, tls.Server(conn, tlsConf))
+		}
+	}()
+	return nil
+}
+
+// handleRawTLS runs the session of a raw TLS connection. The
+// websocket checks (path, PSK and bearer tokens) do not apply
+// to this transport.
+func (s *Server) handleRawTLS(ctx context.Context, conn *tls.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	if !s.handshakes.allow(remoteAddr, time.Now()) {
+		s.Debugf("ignoring client connection from %s, too many handshakes", remoteAddr)
+		s.metrics.Counter("penguin_handshakes_limited_total", 1)
+		return
+	}
+	hctx, cancel := context.WithTimeout(ctx, settings.EnvDuration("WS_TIMEOUT", 45*time.Second))
+	err := conn.HandshakeContext(hctx)
+	cancel()
+	if err != nil {
+		s.Debugf("tls: handshake with %s failed (%s)", remoteAddr, err)
+		return
+	}
+	id := atomic.AddInt32(&s.sessCount, 1)
+	requestID := newRequestID()
+	l := s.Fork("session#%d[%s]", id, requestID)
+	sess := &session{id: id, requestID: requestID, remoteAddr: remoteAddr}
+	s.handleSSH(ctx, l, sess, "", conn, s.sshConfig)
+}
@@ -0,0 +1,27 @@
+package chserver
+
+import "sync"
+
+// totpSteps remembers the time step of the last code
+// accepted from each user, so that a code which was
+// observed cannot be replayed within its window
+type totpSteps struct {
+	sync.Mutex
+	last map[string]int64
+}
+
+// advance records the step of a code of user, returning
+// false if the user has used a code of this or a later
+// step already
+func (t *totpSteps) advance(user string, step int64) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.last == nil {
+		t.last = map[string]int64{}
+	}
+	if last, ok := t.last[user]; ok && step <= last {
+		return false
+	}
+	t.last[user] = step
+	return true
+}
@@ -0,0 +1,61 @@
+package chserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/ccrypto"
+	"github.com/myzhang1029/penguin/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeConnMetadata is the ssh.ConnMetadata of a login attempt
+type fakeConnMetadata struct {
+	user string
+}
+
+func (m fakeConnMetadata) User() string          { return m.user }
+func (m fakeConnMetadata) SessionID() []byte     { return []byte("session-" + m.user) }
+func (m fakeConnMetadata) ClientVersion() []byte { return nil }
+func (m fakeConnMetadata) ServerVersion() []byte { return nil }
+func (m fakeConnMetadata) RemoteAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (m fakeConnMetadata) LocalAddr() net.Addr   { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestAuthTOTPQuestions(t *testing.T) {
+	key, _ := ccrypto.DecodeTOTPSecret("JBSWY3DPEHPK3PXP")
+	s, err := NewServer(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.users.AddUser(&settings.User{Name: "foo", Pass: "bar", TOTP: key})
+	s.users.AddUser(&settings.User{Name: "baz", Pass: "qux"})
+	login := func(user, pass, code string) (int, error) {
+		asked := 0
+		_, err := s.authUserInteractive(fakeConnMetadata{user}, func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			asked = len(questions)
+			return []string{pass, code}[:len(questions)], nil
+		})
+		return asked, err
+	}
+	//the questions do not tell the users apart
+	for _, user := range []string{"foo", "baz", "nobody"} {
+		if asked, _ := login(user, "wrong", "000000"); asked != 2 {
+			t.Fatalf("expected %s to be asked for a code, got %d questions", user, asked)
+		}
+	}
+	//users without a second factor ignore the code
+	if _, err := login("baz", "qux", ""); err != nil {
+		t.Fatalf("expected baz to log in, got %v", err)
+	}
+	//codes are only accepted once
+	code := ccrypto.TOTP(key, time.Now())
+	if _, err := login("foo", "bar", code); err != nil {
+		t.Fatalf("expected foo to log in, got %v", err)
+	}
+	if _, err := login("foo", "bar", code); err == nil {
+		t.Fatal("expected the replayed code to be rejected")
+	}
+}
+
+var _ ssh.ConnMetadata = fakeConnMetadata{}
@@ -0,0 +1,44 @@
+package ccrypto
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCertPool(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "penguin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	file := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(file, pemCert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	//subdirectories are skipped
+	if err := os.Mkdir(filepath.Join(dir, "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{file, dir} {
+		pool, err := LoadCertPool(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pool.Subjects()) != 1 {
+			t.Fatalf("expected 1 certificate from %s, got %d", path, len(pool.Subjects()))
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCertPool(dir); err == nil {
+		t.Fatal("expected a non-PEM file to be rejected")
+	}
+}
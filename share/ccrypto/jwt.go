@@ -0,0 +1,264 @@
+package ccrypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" //register digests for crypto.Hash
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//JWT is a parsed, not yet verified, JSON Web Token
+type JWT struct {
+	Alg    string
+	Kid    string
+	Claims map[string]interface{}
+	signed string
+	sig    []byte
+}
+
+//ParseJWT decodes a compact serialized JWT
+func ParseJWT(token string) (*JWT, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %s", err)
+	}
+	t := &JWT{Alg: header.Alg, Kid: header.Kid, signed: parts[0] + "." + parts[1]}
+	if err := decodeJWTPart(parts[1], &t.Claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	t.sig = sig
+	return t, nil
+}
+
+//IsJWT reports whether s has the shape of a compact JWT
+func IsJWT(s string) bool {
+	return strings.Count(s, ".") == 2 && !strings.ContainsAny(s, " :")
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+//VerifyHMAC checks an HS256, HS384 or HS512 signature
+func (t *JWT) VerifyHMAC(secret []byte) error {
+	if !strings.HasPrefix(t.Alg, "HS") {
+		return fmt.Errorf("unsupported algorithm '%s'", t.Alg)
+	}
+	id, err := jwtHash(t.Alg)
+	if err != nil {
+		return err
+	}
+	m := hmac.New(id.New, secret)
+	m.Write([]byte(t.signed))
+	if !hmac.Equal(m.Sum(nil), t.sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+//VerifyKey checks an RS*, PS* or ES* signature
+//against an RSA or ECDSA public key
+func (t *JWT) VerifyKey(key crypto.PublicKey) error {
+	id, err := jwtHash(t.Alg)
+	if err != nil {
+		return err
+	}
+	d := id.New()
+	d.Write([]byte(t.signed))
+	digest := d.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(t.Alg, "RS"):
+			if rsa.VerifyPKCS1v15(k, id, digest, t.sig) != nil {
+				return errors.New("invalid signature")
+			}
+			return nil
+		case strings.HasPrefix(t.Alg, "PS"):
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+			if rsa.VerifyPSS(k, id, digest, t.sig, opts) != nil {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(t.Alg, "ES") {
+			n := len(t.sig) / 2
+			if n == 0 || len(t.sig)%2 != 0 {
+				return errors.New("invalid signature")
+			}
+			r := new(big.Int).SetBytes(t.sig[:n])
+			s := new(big.Int).SetBytes(t.sig[n:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm '%s' does not match key", t.Alg)
+}
+
+//jwtHash returns the digest used by alg
+func jwtHash(alg string) (crypto.Hash, error) {
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			return crypto.SHA256, nil
+		case "384":
+			return crypto.SHA384, nil
+		case "512":
+			return crypto.SHA512, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported algorithm '%s'", alg)
+}
+
+//Validate checks the registered time claims against now, and the
+//issuer and audience claims when issuer or audience are not empty
+func (t *JWT) Validate(now time.Time, issuer, audience string) error {
+	//allow for some clock skew between the issuer and us
+	const leeway = 30 * time.Second
+	if exp, ok := t.Claims["exp"].(float64); !ok {
+		return errors.New("missing expiry")
+	} else if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := t.Claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+	if issuer != "" && t.Claims["iss"] != issuer {
+		return errors.New("unexpected issuer")
+	}
+	if audience != "" && !t.hasAudience(audience) {
+		return errors.New("unexpected audience")
+	}
+	return nil
+}
+
+func (t *JWT) hasAudience(audience string) bool {
+	switch aud := t.Claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Subject returns the sub claim
+func (t *JWT) Subject() string {
+	sub, _ := t.Claims["sub"].(string)
+	return sub
+}
+
+//Strings returns a claim which is either a string
+//or a list of strings
+func (t *JWT) Strings(claim string) []string {
+	switch v := t.Claims[claim].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		l := []string{}
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				l = append(l, s)
+			}
+		}
+		return l
+	}
+	return nil
+}
+
+//JWK is a single key of a JSON Web Key Set
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//PublicKey decodes an RSA or EC public key
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("malformed key")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve := curveByName(k.Crv)
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func curveByName(name string) elliptic.Curve {
+	switch name {
+	case "P-256":
+		return elliptic.P256()
+	case "P-384":
+		return elliptic.P384()
+	case "P-521":
+		return elliptic.P521()
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package ccrypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func encodeJWT(alg string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": "k1"})
+	c, _ := json.Marshal(claims)
+	msg := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return msg + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(msg)))
+}
+
+func TestJWTHMAC(t *testing.T) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"sub":     "foo",
+		"exp":     now.Add(time.Minute).Unix(),
+		"aud":     []string{"penguin"},
+		"remotes": []string{"^localhost:"},
+	}
+	token := encodeJWT("HS256", claims, func(b []byte) []byte {
+		m := hmac.New(sha256.New, []byte("secret"))
+		m.Write(b)
+		return m.Sum(nil)
+	})
+	if !IsJWT(token) {
+		t.Fatal("expected token to look like a JWT")
+	}
+	jwt, err := ParseJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jwt.VerifyHMAC([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if jwt.VerifyHMAC([]byte("wrong")) == nil {
+		t.Fatal("expected wrong secret to fail")
+	}
+	if err := jwt.Validate(now, "", "penguin"); err != nil {
+		t.Fatal(err)
+	}
+	if jwt.Validate(now, "", "other") == nil {
+		t.Fatal("expected wrong audience to fail")
+	}
+	if jwt.Validate(now, "issuer", "") == nil {
+		t.Fatal("expected missing issuer to fail")
+	}
+	if jwt.Validate(now.Add(2*time.Minute), "", "") == nil {
+		t.Fatal("expected expired token to fail")
+	}
+	if jwt.Subject() != "foo" || len(jwt.Strings("remotes")) != 1 {
+		t.Fatalf("unexpected claims %v", jwt.Claims)
+	}
+}
+
+func TestJWTECDSA(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{"sub": "foo", "exp": time.Now().Add(time.Minute).Unix()}
+	token := encodeJWT("ES256", claims, func(b []byte) []byte {
+		d := sha256.Sum256(b)
+		r, s, _ := ecdsa.Sign(rand.Reader, priv, d[:])
+		return append(pad(r, 32), pad(s, 32)...)
+	})
+	jwk := &JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(pad(priv.X, 32)),
+		Y:   base64.RawURLEncoding.EncodeToString(pad(priv.Y, 32)),
+	}
+	key, err := jwk.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt, err := ParseJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jwt.VerifyKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if jwt.VerifyHMAC([]byte("secret")) == nil {
+		t.Fatal("expected algorithm mismatch to fail")
+	}
+}
+
+func pad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
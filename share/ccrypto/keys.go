@@ -35,3 +35,10 @@ func FingerprintKey(k ssh.PublicKey) string {
 	bytes := sha256.Sum256(k.Marshal())
 	return base64.StdEncoding.EncodeToString(bytes[:])
 }
+
+//FingerprintSPKI calculates the SHA256 hash of the
+//SubjectPublicKeyInfo of an X.509 certificate
+func FingerprintSPKI(cert *x509.Certificate) string {
+	bytes := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(bytes[:])
+}
@@ -0,0 +1,92 @@
+package ccrypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//PSKParam is the name of the cookie or URL parameter which
+//carries the authenticator when the X-Penguin-Auth header
+//cannot be used (e.g. it is stripped by a proxy)
+const PSKParam = "penguin_auth"
+
+//SignPSK creates an authenticator proving knowledge of the psk
+//for a websocket upgrade to path at time t. It has the form
+//"<unix-time>:<nonce>:<mac>", where mac is the base64 encoded
+//HMAC-SHA256 of "<unix-time>:<nonce>:<path>" keyed with the psk.
+func SignPSK(psk, path string, t time.Time) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	msg := strconv.FormatInt(t.Unix(), 10) + ":" + hex.EncodeToString(b)
+	return msg + ":" + macPSK(psk, msg, path)
+}
+
+//VerifyPSK checks an authenticator created by SignPSK, which
+//must have been signed within window of now
+func VerifyPSK(psk, path, auth string, now time.Time, window time.Duration) error {
+	parts := strings.SplitN(auth, ":", 3)
+	if len(parts) != 3 {
+		return errors.New("malformed authenticator")
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errors.New("malformed timestamp")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > window || d < -window {
+		return errors.New("timestamp outside of window")
+	}
+	expect := macPSK(psk, parts[0]+":"+parts[1], path)
+	if !hmac.Equal([]byte(expect), []byte(parts[2])) {
+		return errors.New("incorrect mac")
+	}
+	return nil
+}
+
+//PSKPath derives a pseudo-random URL path for a websocket
+//upgrade at time t, so that connections do not all go to the
+//same endpoint. It has the form "/<nonce>/<mac>", where mac is
+//the truncated HMAC-SHA256 of "path:<unix-minute>:<nonce>"
+//keyed with the psk.
+func PSKPath(psk string, t time.Time) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	return "/" + nonce + "/" + macPSKPath(psk, t.Unix()/60, nonce)
+}
+
+//VerifyPSKPath checks a path created by PSKPath, which
+//must have been derived within window of now
+func VerifyPSKPath(psk, path string, now time.Time, window time.Duration) error {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 || len(parts[0]) != 16 {
+		return errors.New("malformed path")
+	}
+	from := now.Add(-window).Unix() / 60
+	to := now.Add(window).Unix() / 60
+	for minute := from; minute <= to; minute++ {
+		expect := macPSKPath(psk, minute, parts[0])
+		if hmac.Equal([]byte(expect), []byte(parts[1])) {
+			return nil
+		}
+	}
+	return errors.New("incorrect or expired path")
+}
+
+func macPSKPath(psk string, minute int64, nonce string) string {
+	m := hmac.New(sha256.New, []byte(psk))
+	m.Write([]byte("path:" + strconv.FormatInt(minute, 10) + ":" + nonce))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil)[:12])
+}
+
+func macPSK(psk, msg, path string) string {
+	m := hmac.New(sha256.New, []byte(psk))
+	m.Write([]byte(msg + ":" + path))
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
@@ -0,0 +1,55 @@
+package ccrypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyPSK(t *testing.T) {
+	now := time.Now()
+	auth := SignPSK("secret", "/", now)
+	if err := VerifyPSK("secret", "/", auth, now, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if SignPSK("secret", "/", now) == auth {
+		t.Fatal("expected authenticators to be unique")
+	}
+	for _, test := range []struct {
+		psk, path string
+		now       time.Time
+	}{
+		{"wrong", "/", now},
+		{"secret", "/other", now},
+		{"secret", "/", now.Add(2 * time.Minute)},
+		{"secret", "/", now.Add(-2 * time.Minute)},
+	} {
+		if VerifyPSK(test.psk, test.path, auth, test.now, time.Minute) == nil {
+			t.Fatalf("expected %+v to fail", test)
+		}
+	}
+}
+
+func TestVerifyPSKPath(t *testing.T) {
+	now := time.Now()
+	path := PSKPath("secret", now)
+	if err := VerifyPSKPath("secret", path, now, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if PSKPath("secret", now) == path {
+		t.Fatal("expected paths to be unique")
+	}
+	for _, test := range []struct {
+		psk, path string
+		now       time.Time
+	}{
+		{"wrong", path, now},
+		{"secret", path + "x", now},
+		{"secret", "/", now},
+		{"secret", path, now.Add(3 * time.Minute)},
+		{"secret", path, now.Add(-3 * time.Minute)},
+	} {
+		if VerifyPSKPath(test.psk, test.path, test.now, time.Minute) == nil {
+			t.Fatalf("expected %+v to fail", test)
+		}
+	}
+}
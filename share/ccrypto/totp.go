@@ -0,0 +1,70 @@
+package ccrypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	//TOTPStep is the time step of TOTP codes
+	TOTPStep = 30 * time.Second
+	//TOTPDigits is the number of digits in TOTP codes
+	TOTPDigits = 6
+)
+
+//DecodeTOTPSecret decodes a base32 TOTP secret, as
+//commonly shown by authenticator apps (case and
+//spacing are ignored, padding is optional)
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	s = strings.TrimRight(s, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid TOTP secret")
+	}
+	return key, nil
+}
+
+//TOTP computes the RFC 6238 code (HMAC-SHA1) for the given time
+func TOTP(key []byte, t time.Time) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/int64(TOTPStep/time.Second)))
+	m := hmac.New(sha1.New, key)
+	m.Write(counter)
+	sum := m.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+//VerifyTOTP checks a code against the given time,
+//allowing one step of clock skew in either direction
+func VerifyTOTP(key []byte, code string, t time.Time) bool {
+	_, ok := MatchTOTP(key, code, t)
+	return ok
+}
+
+//MatchTOTP is VerifyTOTP, also returning the time step
+//of the code, so that its reuse can be refused
+func MatchTOTP(key []byte, code string, t time.Time) (int64, bool) {
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	var step int64
+	ok := 0
+	for i := -1; i <= 1; i++ {
+		at := t.Add(time.Duration(i) * TOTPStep)
+		expect := TOTP(key, at)
+		if subtle.ConstantTimeCompare([]byte(expect), []byte(code)) == 1 {
+			step = at.Unix() / int64(TOTPStep/time.Second)
+			ok = 1
+		}
+	}
+	return step, ok == 1
+}
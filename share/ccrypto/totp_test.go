@@ -0,0 +1,34 @@
+package ccrypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	//RFC 6238 test vectors (SHA1), truncated to 6 digits
+	key, err := DecodeTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	} {
+		now := time.Unix(test.unix, 0)
+		if got := TOTP(key, now); got != test.code {
+			t.Fatalf("at %d expected %s, got %s", test.unix, test.code, got)
+		}
+		if !VerifyTOTP(key, test.code, now.Add(TOTPStep)) {
+			t.Fatalf("expected %s to be accepted one step later", test.code)
+		}
+		if VerifyTOTP(key, test.code, now.Add(3*TOTPStep)) {
+			t.Fatalf("expected %s to be rejected three steps later", test.code)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package cio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+//Framer multiplexes several streams over a single reader
+//and writer, such as stdin and stdout. Each frame is the
+//index of its stream (1 byte), the length of its payload
+//(2 bytes, big-endian) and the payload. A frame with an
+//empty payload closes the stream, and the next frame of
+//its index opens a new one. The indices are those of the
+//listeners, in the order of Listen.
+type Framer struct {
+	r         io.Reader
+	w         io.Writer
+	writeMut  sync.Mutex
+	mut       sync.Mutex
+	listeners []*FrameListener
+	streams   map[byte]*frameStream
+	runOnce   sync.Once
+}
+
+//maxFrame is the largest payload of a frame
+const maxFrame = 1<<16 - 1
+
+//NewFramer creates a Framer reading frames from r
+//and writing them to w
+func NewFramer(r io.Reader, w io.Writer) *Framer {
+	return &Framer{
+		r:       r,
+		w:       w,
+		streams: map[byte]*frameStream{},
+	}
+}
+
+//Listen returns a listener for the streams of the next
+//index, starting to read frames on first use
+func (f *Framer) Listen() (*FrameListener, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if len(f.listeners) > 0xff {
+		return nil, errors.New("too many framed streams")
+	}
+	l := &FrameListener{
+		framer:  f,
+		index:   byte(len(f.listeners)),
+		streams: make(chan *frameStream),
+		closed:  make(chan struct{}),
+	}
+	f.listeners = append(f.listeners, l)
+	f.runOnce.Do(func() {
+		go f.run()
+	})
+	return l, nil
+}
+
+//run demultiplexes frames until the reader fails
+func (f *Framer) run() {
+	header := make([]byte, 3)
+	for {
+		if _, err := io.ReadFull(f.r, header); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+		if _, err := io.ReadFull(f.r, payload); err != nil {
+			return
+		}
+		f.deliver(header[0], payload)
+	}
+}
+
+func (f *Framer) deliver(index byte, payload []byte) {
+	f.mut.Lock()
+	s, ok := f.streams[index]
+	if ok && len(payload) == 0 {
+		delete(f.streams, index)
+	}
+	var l *FrameListener
+	if !ok && len(payload) > 0 && int(index) < len(f.listeners) {
+		l = f.listeners[index]
+		s = newFrameStream(f, index)
+		f.streams[index] = s
+	}
+	f.mut.Unlock()
+	if len(payload) == 0 {
+		if s != nil {
+			s.push(nil)
+		}
+		return
+	}
+	if s == nil {
+		//no such listener, refuse the stream
+		f.writeFrame(index, nil)
+		return
+	}
+	s.push(payload)
+	if l != nil {
+		select {
+		case l.streams <- s:
+		case <-l.closed:
+			s.Close()
+		}
+	}
+}
+
+func (f *Framer) writeFrame(index byte, payload []byte) error {
+	frame := make([]byte, 3+len(payload))
+	frame[0] = index
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	copy(frame[3:], payload)
+	f.writeMut.Lock()
+	defer f.writeMut.Unlock()
+	_, err := f.w.Write(frame)
+	return err
+}
+
+//FrameListener accepts the streams of one index of a Framer
+type FrameListener struct {
+	framer    *Framer
+	index     byte
+	streams   chan *frameStream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+//Accept waits for the next stream of the listener
+func (l *FrameListener) Accept() (io.ReadWriteCloser, error) {
+	select {
+	case s := <-l.streams:
+		return s, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+//Close stops accepting streams
+func (l *FrameListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+//frameStream is one stream of a Framer,
+//buffering the frames it receives until read
+type frameStream struct {
+	framer    *Framer
+	index     byte
+	mut       sync.Mutex
+	cond      *sync.Cond
+	queue     [][]byte
+	eof       bool
+	closed    bool
+	closeOnce sync.Once
+}
+
+func newFrameStream(f *Framer, index byte) *frameStream {
+	s := &frameStream{framer: f, index: index}
+	s.cond = sync.NewCond(&s.mut)
+	return s
+}
+
+//push queues a payload, or the end of the stream if nil
+func (s *frameStream) push(payload []byte) {
+	s.mut.Lock()
+	if payload == nil {
+		s.eof = true
+	} else {
+		s.queue = append(s.queue, payload)
+	}
+	s.mut.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *frameStream) Read(b []byte) (int, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for len(s.queue) == 0 && !s.eof && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.queue) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, s.queue[0])
+	if n == len(s.queue[0]) {
+		s.queue = s.queue[1:]
+	} else {
+		s.queue[0] = s.queue[0][n:]
+	}
+	return n, nil
+}
+
+func (s *frameStream) Write(b []byte) (int, error) {
+	s.mut.Lock()
+	closed := s.closed
+	s.mut.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		if err := s.framer.writeFrame(s.index, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+//Close ends the stream on both sides
+func (s *frameStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.mut.Lock()
+		s.closed = true
+		s.mut.Unlock()
+		s.cond.Broadcast()
+		f := s.framer
+		f.mut.Lock()
+		if f.streams[s.index] == s {
+			delete(f.streams, s.index)
+		}
+		f.mut.Unlock()
+		f.writeFrame(s.index, nil)
+	})
+	return nil
+}
@@ -2,6 +2,7 @@ package cio
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
@@ -48,7 +49,11 @@ func (l *Logger) Errorf(f string, args ...interface{}) error {
 func (l *Logger) Fork(prefix string, args ...interface{}) *Logger {
 	//slip the parent prefix at the front
 	args = append([]interface{}{l.prefix}, args...)
-	ll := NewLogger(fmt.Sprintf("%s: "+prefix, args...))
+	//and write to the same output
+	ll := &Logger{
+		prefix: fmt.Sprintf("%s: "+prefix, args...),
+		logger: l.logger,
+	}
 	//store link to parent settings too
 	ll.Info = l.Info
 	if l.info != nil {
@@ -65,6 +70,17 @@ func (l *Logger) Fork(prefix string, args ...interface{}) *Logger {
 	return ll
 }
 
+//SetOutput sets where the logs are written, which is stderr
+//by default. It applies to all of the loggers forked from l.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.logger.SetOutput(w)
+}
+
+//Writer returns where the logs are written
+func (l *Logger) Writer() io.Writer {
+	return l.logger.Writer()
+}
+
 func (l *Logger) Prefix() string {
 	return l.prefix
 }
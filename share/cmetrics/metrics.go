@@ -0,0 +1,68 @@
+//Package cmetrics defines the sink which all penguin
+//instrumentation reports to, along with a few simple
+//implementations. Embedders can supply their own Sink
+//to forward metrics into another metrics library.
+package cmetrics
+
+//Sink receives metrics. Implementations must be
+//safe for concurrent use.
+type Sink interface {
+	//Counter adds delta to a monotonically increasing counter
+	Counter(name string, delta float64, labels ...Label)
+	//Gauge sets the current value of a gauge
+	Gauge(name string, value float64, labels ...Label)
+	//Histogram records an observation, such as a duration in seconds
+	Histogram(name string, value float64, labels ...Label)
+}
+
+//Label is a dimension of a metric
+type Label struct {
+	Name, Value string
+}
+
+//L is a short-hand for creating a Label
+func L(name, value string) Label {
+	return Label{Name: name, Value: value}
+}
+
+//Nop is a Sink which discards all metrics
+var Nop Sink = nop{}
+
+type nop struct{}
+
+func (nop) Counter(string, float64, ...Label)   {}
+func (nop) Gauge(string, float64, ...Label)     {}
+func (nop) Histogram(string, float64, ...Label) {}
+
+//OrNop returns s, or Nop if s is nil
+func OrNop(s Sink) Sink {
+	if s == nil {
+		return Nop
+	}
+	return s
+}
+
+//Multi reports metrics to all of the given sinks
+func Multi(sinks ...Sink) Sink {
+	return multi(sinks)
+}
+
+type multi []Sink
+
+func (m multi) Counter(name string, delta float64, labels ...Label) {
+	for _, s := range m {
+		s.Counter(name, delta, labels...)
+	}
+}
+
+func (m multi) Gauge(name string, value float64, labels ...Label) {
+	for _, s := range m {
+		s.Gauge(name, value, labels...)
+	}
+}
+
+func (m multi) Histogram(name string, value float64, labels ...Label) {
+	for _, s := range m {
+		s.Histogram(name, value, labels...)
+	}
+}
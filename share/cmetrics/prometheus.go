@@ -0,0 +1,161 @@
+package cmetrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//DefaultBuckets are the histogram buckets used by Prometheus
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+//Prometheus is a Sink which keeps metrics in memory and
+//serves them over HTTP in the Prometheus text format
+type Prometheus struct {
+	mut     sync.Mutex
+	metrics map[string]*promMetric
+	buckets []float64
+}
+
+type promMetric struct {
+	kind   string
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	labels  string
+	value   float64
+	counts  []uint64
+	sum     float64
+	samples uint64
+}
+
+//NewPrometheus creates an empty Prometheus sink
+func NewPrometheus() *Prometheus {
+	return &Prometheus{
+		metrics: map[string]*promMetric{},
+		buckets: DefaultBuckets,
+	}
+}
+
+func (p *Prometheus) series(kind, name string, labels []Label) *promSeries {
+	m, ok := p.metrics[name]
+	if !ok {
+		m = &promMetric{kind: kind, series: map[string]*promSeries{}}
+		p.metrics[name] = m
+	}
+	key := formatLabels(labels)
+	s, ok := m.series[key]
+	if !ok {
+		s = &promSeries{labels: key}
+		if kind == "histogram" {
+			s.counts = make([]uint64, len(p.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+//Counter implements Sink
+func (p *Prometheus) Counter(name string, delta float64, labels ...Label) {
+	p.mut.Lock()
+	p.series("counter", name, labels).value += delta
+	p.mut.Unlock()
+}
+
+//Gauge implements Sink
+func (p *Prometheus) Gauge(name string, value float64, labels ...Label) {
+	p.mut.Lock()
+	p.series("gauge", name, labels).value = value
+	p.mut.Unlock()
+}
+
+//Histogram implements Sink
+func (p *Prometheus) Histogram(name string, value float64, labels ...Label) {
+	p.mut.Lock()
+	s := p.series("histogram", name, labels)
+	for i, b := range p.buckets {
+		if value <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.samples++
+	p.mut.Unlock()
+}
+
+//ServeHTTP writes all metrics in the Prometheus text format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.WriteTo(w)
+}
+
+//WriteTo writes all metrics in the Prometheus text format
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	sb := strings.Builder{}
+	names := make([]string, 0, len(p.metrics))
+	for name := range p.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := p.metrics[name]
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, m.kind)
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := m.series[k]
+			if m.kind != "histogram" {
+				fmt.Fprintf(&sb, "%s%s %s\n", name, braces(s.labels), formatFloat(s.value))
+				continue
+			}
+			for i, b := range p.buckets {
+				le := joinLabels(s.labels, `le="`+formatFloat(b)+`"`)
+				fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, braces(le), s.counts[i])
+			}
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, braces(joinLabels(s.labels, `le="+Inf"`)), s.samples)
+			fmt.Fprintf(&sb, "%s_sum%s %s\n", name, braces(s.labels), formatFloat(s.sum))
+			fmt.Fprintf(&sb, "%s_count%s %d\n", name, braces(s.labels), s.samples)
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []Label) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l.Name + `="` + labelEscaper.Replace(l.Value) + `"`
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
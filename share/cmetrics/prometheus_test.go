@@ -0,0 +1,37 @@
+package cmetrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := NewPrometheus()
+	p.buckets = []float64{1, 10}
+	p.Counter("requests_total", 1, L("code", "200"))
+	p.Counter("requests_total", 2, L("code", "200"))
+	p.Counter("requests_total", 1, L("code", `a"b`))
+	p.Gauge("sessions", 3)
+	p.Gauge("sessions", 2)
+	p.Histogram("duration_seconds", 0.5)
+	p.Histogram("duration_seconds", 5)
+	sb := strings.Builder{}
+	if _, err := p.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# TYPE duration_seconds histogram
+duration_seconds_bucket{le="1"} 1
+duration_seconds_bucket{le="10"} 2
+duration_seconds_bucket{le="+Inf"} 2
+duration_seconds_sum 5.5
+duration_seconds_count 2
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="a\"b"} 1
+# TYPE sessions gauge
+sessions 2
+`
+	if got := sb.String(); got != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
@@ -0,0 +1,67 @@
+package cmetrics
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+//Statsd is a Sink which sends metrics to a statsd
+//daemon over UDP. Labels are sent as tags using the
+//widely supported "|#name:value" extension.
+type Statsd struct {
+	conn   net.Conn
+	prefix string
+}
+
+//NewStatsd creates a Statsd sink sending to addr (host:port),
+//with all metric names prefixed by prefix
+func NewStatsd(addr, prefix string) (*Statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Statsd{conn: conn, prefix: prefix}, nil
+}
+
+func (s *Statsd) send(name string, value float64, kind string, labels []Label) {
+	sb := strings.Builder{}
+	sb.WriteString(s.prefix)
+	sb.WriteString(name)
+	sb.WriteByte(':')
+	sb.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	sb.WriteByte('|')
+	sb.WriteString(kind)
+	for i, l := range labels {
+		if i == 0 {
+			sb.WriteString("|#")
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.Name)
+		sb.WriteByte(':')
+		sb.WriteString(l.Value)
+	}
+	//metrics are best-effort
+	s.conn.Write([]byte(sb.String()))
+}
+
+//Counter implements Sink
+func (s *Statsd) Counter(name string, delta float64, labels ...Label) {
+	s.send(name, delta, "c", labels)
+}
+
+//Gauge implements Sink
+func (s *Statsd) Gauge(name string, value float64, labels ...Label) {
+	s.send(name, value, "g", labels)
+}
+
+//Histogram implements Sink
+func (s *Statsd) Histogram(name string, value float64, labels ...Label) {
+	s.send(name, value, "h", labels)
+}
+
+//Close closes the underlying connection
+func (s *Statsd) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,110 @@
+package cnet
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+//Compressions are the supported compression algorithms
+var Compressions = []string{"zstd", "snappy"}
+
+//compressWriter is a compressing writer which can
+//emit what it buffered, and end the stream
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+//compressedRWC compresses what is written to an RWC,
+//flushing each write, and decompresses what is read
+type compressedRWC struct {
+	rwc      io.ReadWriteCloser
+	r        io.Reader
+	closeR   func()
+	w        compressWriter
+	writeMut sync.Mutex
+	wclosed  bool
+}
+
+//NewCompressedRWC wraps rwc with the given compression algorithm,
+//which both ends of rwc must use. Each write is flushed, so
+//that interactive streams are not held up.
+func NewCompressedRWC(rwc io.ReadWriteCloser, algorithm string) (io.ReadWriteCloser, error) {
+	c := &compressedRWC{rwc: rwc}
+	switch algorithm {
+	case "zstd":
+		//small windows, since every stream has its own
+		w, err := zstd.NewWriter(rwc,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(1<<17))
+		if err != nil {
+			return nil, err
+		}
+		r, err := zstd.NewReader(rwc,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxMemory(64<<20))
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		c.w, c.r, c.closeR = w, r, r.Close
+	case "snappy":
+		c.w, c.r, c.closeR = snappy.NewBufferedWriter(rwc), snappy.NewReader(rwc), func() {}
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", algorithm)
+	}
+	return c, nil
+}
+
+func (c *compressedRWC) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *compressedRWC) Write(b []byte) (int, error) {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	if c.wclosed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+//CloseWrite ends the compressed stream, and closes
+//the writing side of the RWC when it supports it
+func (c *compressedRWC) CloseWrite() error {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	if c.wclosed {
+		return nil
+	}
+	c.wclosed = true
+	err := c.w.Close()
+	if cw, ok := c.rwc.(interface{ CloseWrite() error }); ok {
+		if cerr := cw.CloseWrite(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (c *compressedRWC) Close() error {
+	c.writeMut.Lock()
+	if !c.wclosed {
+		c.wclosed = true
+		c.w.Close()
+	}
+	c.writeMut.Unlock()
+	err := c.rwc.Close()
+	c.closeR()
+	return err
+}
@@ -0,0 +1,155 @@
+package cnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Faults describes the misbehaviour injected by a fault conn,
+//to reproduce the middleboxes which split, delay and cut
+//connections in the wild
+type Faults struct {
+	//ShortReads returns a random prefix of the
+	//available data on each read
+	ShortReads bool
+	//ShortWrites splits each write into randomly
+	//sized writes to the underlying conn
+	ShortWrites bool
+	//Delay sleeps up to this long before each read and write
+	Delay time.Duration
+	//ErrorAfter closes the conn with an error after a random
+	//time between half and all of this duration
+	ErrorAfter time.Duration
+	//Seed makes the faults reproducible, 0 uses the time
+	Seed int64
+}
+
+//ErrInjectedFault is returned once a fault conn cuts the connection
+var ErrInjectedFault = errors.New("injected fault")
+
+//ParseFaults parses a comma separated list of faults, such as
+//"short-read,short-write,delay=5ms,error-after=1m,seed=42"
+func ParseFaults(spec string) (*Faults, error) {
+	f := &Faults{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		var err error
+		switch kv[0] {
+		case "short-read":
+			f.ShortReads = true
+		case "short-write":
+			f.ShortWrites = true
+		case "delay", "error-after", "seed":
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("fault '%s' requires a value", kv[0])
+			}
+			switch kv[0] {
+			case "delay":
+				f.Delay, err = time.ParseDuration(kv[1])
+			case "error-after":
+				f.ErrorAfter, err = time.ParseDuration(kv[1])
+			case "seed":
+				f.Seed, err = strconv.ParseInt(kv[1], 10, 64)
+			}
+		default:
+			return nil, fmt.Errorf("unknown fault '%s'", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault '%s': %s", item, err)
+		}
+	}
+	return f, nil
+}
+
+type faultConn struct {
+	net.Conn
+	faults  Faults
+	mut     sync.Mutex
+	rand    *rand.Rand
+	expires time.Time
+}
+
+//NewFaultConn wraps conn so that it misbehaves as described by
+//faults, while still following the io.Reader and io.Writer
+//contracts. It is intended for testing only.
+func NewFaultConn(conn net.Conn, faults Faults) net.Conn {
+	seed := faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c := &faultConn{
+		Conn:   conn,
+		faults: faults,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+	if d := faults.ErrorAfter; d > 0 {
+		c.expires = time.Now().Add(d/2 + c.intn(int(d/2)+1))
+	}
+	return c
+}
+
+//intn is a thread-safe rand.Intn returning a duration
+//(or a length) in [0, n)
+func (c *faultConn) intn(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return time.Duration(c.rand.Intn(n))
+}
+
+//inject applies the delay and cuts the conn when it expires
+func (c *faultConn) inject() error {
+	if c.faults.Delay > 0 {
+		time.Sleep(c.intn(int(c.faults.Delay)))
+	}
+	if !c.expires.IsZero() && time.Now().After(c.expires) {
+		c.Conn.Close()
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	if err := c.inject(); err != nil {
+		return 0, err
+	}
+	if c.faults.ShortReads && len(b) > 1 {
+		b = b[:1+int(c.intn(len(b)))]
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if !c.faults.ShortWrites {
+		if err := c.inject(); err != nil {
+			return 0, err
+		}
+		return c.Conn.Write(b)
+	}
+	//split into many writes, any of which may fail
+	n := 0
+	for n < len(b) {
+		if err := c.inject(); err != nil {
+			return n, err
+		}
+		l := 1 + int(c.intn(len(b)-n))
+		m, err := c.Conn.Write(b[n : n+l])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
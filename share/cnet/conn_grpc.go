@@ -0,0 +1,121 @@
+package cnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//GRPCContentType is the content type of the gRPC requests
+//which carry penguin connections as a bidirectional stream
+const GRPCContentType = "application/grpc"
+
+//GRPCPath is the method of the gRPC requests, unless
+//the server URL has another path
+const GRPCPath = "/penguin.Tunnel/Connect"
+
+//maxGRPCMessage bounds the messages read, which are
+//as large as the writes of the other end
+const maxGRPCMessage = 4 << 20
+
+//IsGRPC checks whether contentType is of a gRPC request
+func IsGRPC(contentType string) bool {
+	return contentType == GRPCContentType || strings.HasPrefix(contentType, GRPCContentType+"+")
+}
+
+//grpcStream frames a stream as the messages of a gRPC
+//stream, each a protobuf message with the data as its
+//first field (bytes data = 1)
+type grpcStream struct {
+	rwc     io.ReadWriteCloser
+	header  [5]byte
+	pending []byte
+}
+
+//NewGRPCStream converts the body of an HTTP/2 request or
+//response, and the writer of the other, into a RWC which
+//exchanges gRPC messages, see NewHTTPStream
+func NewGRPCStream(r io.ReadCloser, w io.Writer) io.ReadWriteCloser {
+	return &grpcStream{rwc: NewHTTPStream(r, w)}
+}
+
+func (s *grpcStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if _, err := io.ReadFull(s.rwc, s.header[:]); err != nil {
+			return 0, err
+		}
+		if s.header[0] != 0 {
+			return 0, errors.New("compressed gRPC messages are not supported")
+		}
+		size := binary.BigEndian.Uint32(s.header[1:])
+		if size > maxGRPCMessage {
+			return 0, fmt.Errorf("gRPC message too large (%d bytes)", size)
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(s.rwc, msg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		data, err := grpcData(msg)
+		if err != nil {
+			return 0, err
+		}
+		s.pending = data
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *grpcStream) Write(b []byte) (int, error) {
+	//the header, the tag of the field and its length
+	msg := make([]byte, 6+binary.MaxVarintLen64, 6+binary.MaxVarintLen64+len(b))
+	msg[5] = 0x0a
+	n := 6 + binary.PutUvarint(msg[6:], uint64(len(b)))
+	binary.BigEndian.PutUint32(msg[1:], uint32(n-5+len(b)))
+	msg = append(msg[:n], b...)
+	if _, err := s.rwc.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *grpcStream) Close() error {
+	return s.rwc.Close()
+}
+
+//grpcData extracts the data field of a message
+func grpcData(msg []byte) ([]byte, error) {
+	var data []byte
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, errors.New("malformed gRPC message")
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0:
+			_, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return nil, errors.New("malformed gRPC message")
+			}
+			msg = msg[n:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return nil, errors.New("malformed gRPC message")
+			}
+			if tag>>3 == 1 {
+				data = msg[n : n+int(size)]
+			}
+			msg = msg[n+int(size):]
+		default:
+			return nil, fmt.Errorf("unsupported gRPC wire type %d", tag&7)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,71 @@
+package cnet
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+//StreamContentType is the content type of the HTTP/2
+//requests which carry penguin connections as their body
+const StreamContentType = "application/x-penguin"
+
+//PollHeader is set on the requests of the long-polling
+//transport, to "open" to start a session, and then to
+//the key of the session
+const PollHeader = "X-Penguin-Poll"
+
+//StreamProtocolHeader carries the protocol version of penguin
+//connections over HTTP/2 streams and WebTransport sessions
+const StreamProtocolHeader = "X-Penguin-Protocol"
+
+//ProtocolsHeader lists the protocol versions which the server
+//supports, when it refuses those offered by a client
+const ProtocolsHeader = "X-Penguin-Protocols"
+
+//httpStream is one direction of an HTTP/2 exchange
+//read from, and the other written to
+type httpStream struct {
+	r      io.ReadCloser
+	w      io.Writer
+	mut    sync.Mutex
+	closed bool
+}
+
+//NewHTTPStream converts the body of an HTTP/2 request or
+//response, and the writer of the other, into a RWC. Writes
+//are flushed when w is an http.Flusher, and none happen once
+//closed, so that a handler may return after closing it.
+func NewHTTPStream(r io.ReadCloser, w io.Writer) io.ReadWriteCloser {
+	return &httpStream{r: r, w: w}
+}
+
+func (s *httpStream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+func (s *httpStream) Write(b []byte) (int, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := s.w.Write(b)
+	if f, ok := s.w.(http.Flusher); ok && err == nil {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (s *httpStream) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if c, ok := s.w.(io.Closer); ok {
+		c.Close()
+	}
+	return s.r.Close()
+}
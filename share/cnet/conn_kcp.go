@@ -0,0 +1,24 @@
+package cnet
+
+import (
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+//The forward error correction of penguin's KCP transport,
+//which both ends must use: 3 parity packets for 10 of data
+const (
+	KCPDataShards   = 10
+	KCPParityShards = 3
+)
+
+//ConfigureKCP tunes a KCP session for lossy, high-latency
+//links, favouring latency over bandwidth as kcptun's "fast"
+//mode does. The session is not encrypted, SSH already is.
+func ConfigureKCP(s *kcp.UDPSession) {
+	s.SetStreamMode(true)
+	s.SetWriteDelay(false)
+	s.SetNoDelay(1, 20, 2, 1)
+	s.SetWindowSize(1024, 1024)
+	s.SetMtu(1350)
+	s.SetACKNoDelay(true)
+}
@@ -0,0 +1,143 @@
+package cnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//PaddingHeader asks the server to pad the websocket messages,
+//and to send dummy ones at random intervals averaging its value.
+//The server echoes it once it agrees.
+const PaddingHeader = "X-Penguin-Padding"
+
+//MinPaddingInterval bounds the rate of dummy messages
+const MinPaddingInterval = 10 * time.Millisecond
+
+//paddingBuckets are the sizes which websocket messages
+//are padded to, so that their sizes leak little
+var paddingBuckets = []int{128, 256, 512, 1024, 2048, 4096, 8192, 16384}
+
+//types of padded messages, followed by the
+//size of the data (2 bytes, big-endian)
+const (
+	paddingData  = 'd'
+	paddingDummy = 'p'
+)
+
+const paddingHeader = 3
+
+type paddedConn struct {
+	*websocket.Conn
+	writeMut  sync.Mutex
+	buff      []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+//NewPaddedWebSocketConn converts a websocket.Conn into a
+//net.Conn whose messages are padded to bucketed sizes, with
+//dummy messages sent at random intervals averaging interval,
+//none if zero, to defeat classifiers of message sizes and timing
+func NewPaddedWebSocketConn(websocketConn *websocket.Conn, interval time.Duration) net.Conn {
+	c := &paddedConn{
+		Conn: websocketConn,
+		done: make(chan struct{}),
+	}
+	if interval > 0 {
+		go c.sendDummies(interval)
+	}
+	return c
+}
+
+func (c *paddedConn) Read(dst []byte) (int, error) {
+	for len(c.buff) == 0 {
+		_, msg, err := c.Conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) < paddingHeader {
+			return 0, errors.New("short padded message")
+		}
+		size := int(binary.BigEndian.Uint16(msg[1:]))
+		if paddingHeader+size > len(msg) {
+			return 0, errors.New("invalid padded message")
+		}
+		if msg[0] == paddingData {
+			c.buff = msg[paddingHeader : paddingHeader+size]
+		}
+	}
+	n := copy(dst, c.buff)
+	c.buff = c.buff[n:]
+	return n, nil
+}
+
+func (c *paddedConn) Write(b []byte) (int, error) {
+	max := paddingBuckets[len(paddingBuckets)-1] - paddingHeader
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > max {
+			n = max
+		}
+		if err := c.writeMessage(paddingData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+//writeMessage writes data in a message of the smallest bucket
+func (c *paddedConn) writeMessage(typ byte, data []byte) error {
+	size := paddingBuckets[len(paddingBuckets)-1]
+	for _, s := range paddingBuckets {
+		if paddingHeader+len(data) <= s {
+			size = s
+			break
+		}
+	}
+	msg := make([]byte, size)
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[1:], uint16(len(data)))
+	copy(msg[paddingHeader:], data)
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	return c.Conn.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+//sendDummies sends messages of random sizes, carrying no data,
+//after random delays of up to twice interval
+func (c *paddedConn) sendDummies(interval time.Duration) {
+	for {
+		select {
+		case <-time.After(time.Duration(rand.Int63n(2 * int64(interval)))):
+		case <-c.done:
+			return
+		}
+		size := paddingBuckets[rand.Intn(len(paddingBuckets))]
+		if err := c.writeMessage(paddingDummy, make([]byte, rand.Intn(size-paddingHeader+1))); err != nil {
+			return
+		}
+	}
+}
+
+func (c *paddedConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *paddedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,73 @@
+package cnet
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+)
+
+//QUICProtocol is the ALPN protocol of penguin's QUIC transport
+const QUICProtocol = "penguin"
+
+//TLSProtocol is the ALPN protocol of penguin's raw TLS transport
+const TLSProtocol = "penguin-tls"
+
+//quicStream is a bidirectional stream of a
+//QUIC connection or of a WebTransport session
+type quicStream interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+type quicConn struct {
+	quicStream
+	local, remote net.Addr
+	close         func() error
+}
+
+//NewQUICConn converts a stream of a QUIC connection into a
+//net.Conn, which closes the whole connection when closed
+func NewQUICConn(conn *quic.Conn, stream *quic.Stream) net.Conn {
+	return &quicConn{
+		quicStream: stream,
+		local:      conn.LocalAddr(),
+		remote:     conn.RemoteAddr(),
+		close: func() error {
+			//the stream only closes its writing side
+			stream.CancelRead(0)
+			return conn.CloseWithError(0, "")
+		},
+	}
+}
+
+//NewWebTransportConn converts a stream of a WebTransport session
+//into a net.Conn, which closes the whole session when closed
+func NewWebTransportConn(sess *webtransport.Session, stream *webtransport.Stream) net.Conn {
+	return &quicConn{
+		quicStream: stream,
+		local:      sess.LocalAddr(),
+		remote:     sess.RemoteAddr(),
+		close: func() error {
+			stream.CancelRead(0)
+			return sess.CloseWithError(0, "")
+		},
+	}
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *quicConn) Close() error {
+	c.quicStream.Close()
+	return c.close()
+}
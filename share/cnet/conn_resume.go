@@ -0,0 +1,474 @@
+package cnet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//resumeMagic starts the hello of a resumable connection,
+//which cannot be mistaken for an SSH version string
+const resumeMagic = "\x00PGR"
+
+//resumeWindow is how much data a resumable connection keeps
+//for retransmission before writes block on the peer's acks
+const resumeWindow = 1 << 20
+
+//resumeChunk is the largest payload of a data frame
+const resumeChunk = 32 << 10
+
+//frame types of a resumable connection, each followed by an
+//8-byte value: the payload size, or the total bytes received
+const (
+	resumeData  = 'd'
+	resumeAck   = 'a'
+	resumeClose = 'c'
+)
+
+//statuses of the reply to a resume hello
+const (
+	resumeOK       = 0
+	ResumeUnknown  = 1
+	ResumeDisabled = 2
+)
+
+//ErrResumeUnknown is returned when the server no longer
+//has the session which the client tried to resume
+var ErrResumeUnknown = errors.New("session expired on server")
+
+//ErrResumeDisabled is returned when the server does
+//not resume sessions
+var ErrResumeDisabled = errors.New("server does not resume sessions")
+
+//ResumeHello is sent by the client before the SSH handshake,
+//and each time it reconnects to resume the session
+type ResumeHello struct {
+	Token    string
+	Received uint64
+}
+
+//NewResumeToken returns a random token naming the
+//session of a resumable connection
+func NewResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return string(b)
+}
+
+//ReadResumeHello reads the hello of a resumable connection, or
+//nil when conn starts with anything else, such as the SSH version
+//of older clients. The returned conn is then read from instead.
+func ReadResumeHello(conn net.Conn) (net.Conn, *ResumeHello, error) {
+	magic := make([]byte, len(resumeMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		return nil, nil, err
+	}
+	if string(magic) != resumeMagic {
+		return &prefixConn{Conn: conn, prefix: magic}, nil, nil
+	}
+	b := make([]byte, 16+8)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, nil, err
+	}
+	return conn, &ResumeHello{
+		Token:    string(b[:16]),
+		Received: binary.BigEndian.Uint64(b[16:]),
+	}, nil
+}
+
+//RejectResume replies to a resume hello with one
+//of the ResumeUnknown and ResumeDisabled statuses
+func RejectResume(conn net.Conn, status byte) error {
+	return writeResumeReply(conn, status, 0)
+}
+
+func writeResumeReply(conn net.Conn, status byte, received uint64) error {
+	b := append([]byte(resumeMagic), status, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(b[len(resumeMagic)+1:], received)
+	_, err := conn.Write(b)
+	return err
+}
+
+//prefixConn replays the bytes read ahead of a conn
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+//ResumableConn is a connection which outlives the conns carrying
+//it, so that the SSH connection on top of it survives while the
+//client reconnects. Both ends count the bytes they received,
+//and retransmit what the other end had not received when
+//the conn dropped.
+type ResumableConn struct {
+	token   string
+	grace   time.Duration
+	mut     sync.Mutex
+	cond    *sync.Cond
+	conn    net.Conn
+	lost    chan struct{}
+	expiry  *time.Timer
+	closed  bool
+	eof     bool
+	done    chan struct{}
+	err     error
+	in      []byte
+	recv    uint64
+	acked   uint64
+	unacked []byte
+	sent    uint64
+	//writeMut orders the frames written to conn
+	writeMut sync.Mutex
+}
+
+//NewResumableConn returns a resumable connection, which is
+//closed once it has been detached for longer than grace
+func NewResumableConn(token string, grace time.Duration) *ResumableConn {
+	c := &ResumableConn{
+		token: token,
+		grace: grace,
+		done:  make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mut)
+	return c
+}
+
+//Token names the session of the connection
+func (c *ResumableConn) Token() string {
+	return c.token
+}
+
+//Done is closed once the connection is closed
+func (c *ResumableConn) Done() <-chan struct{} {
+	return c.done
+}
+
+//Connect sends the client's hello on conn, and carries the
+//connection over it once the server accepts. The returned
+//channel is closed once conn is lost.
+func (c *ResumableConn) Connect(conn net.Conn) (<-chan struct{}, error) {
+	recv := c.detach()
+	b := append([]byte(resumeMagic), c.token...)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(b[len(b)-8:], recv)
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, len(resumeMagic)+1+8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if string(reply[:len(resumeMagic)]) != resumeMagic {
+		return nil, ErrResumeDisabled
+	}
+	switch reply[len(resumeMagic)] {
+	case resumeOK:
+	case ResumeUnknown:
+		return nil, ErrResumeUnknown
+	default:
+		return nil, ErrResumeDisabled
+	}
+	return c.attach(conn, binary.BigEndian.Uint64(reply[len(resumeMagic)+1:]))
+}
+
+//Accept replies to the client's hello on conn, and carries the
+//connection over it, replacing the conn it may still have. The
+//returned channel is closed once conn is lost.
+func (c *ResumableConn) Accept(conn net.Conn, hello *ResumeHello) (<-chan struct{}, error) {
+	recv := c.detach()
+	if err := writeResumeReply(conn, resumeOK, recv); err != nil {
+		return nil, err
+	}
+	return c.attach(conn, hello.Received)
+}
+
+//detach drops the current conn, if any, and returns
+//how many bytes were received until then
+func (c *ResumableConn) detach() uint64 {
+	c.mut.Lock()
+	conn, lost := c.conn, c.lost
+	c.mut.Unlock()
+	if conn != nil {
+		conn.Close()
+		<-lost
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.recv
+}
+
+//attach retransmits what the peer has not received,
+//and then carries the connection over conn
+func (c *ResumableConn) attach(conn net.Conn, peerRecv uint64) (<-chan struct{}, error) {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	c.mut.Lock()
+	if c.closed {
+		c.mut.Unlock()
+		return nil, io.ErrClosedPipe
+	}
+	if peerRecv < c.acked || peerRecv > c.sent {
+		c.mut.Unlock()
+		c.Close()
+		return nil, errors.New("resumed at an invalid offset")
+	}
+	c.ack(peerRecv)
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	lost := make(chan struct{})
+	c.conn, c.lost = conn, lost
+	pending := append([]byte(nil), c.unacked...)
+	c.mut.Unlock()
+	acks := make(chan struct{}, 1)
+	go c.readFrames(conn, lost, acks)
+	go c.writeAcks(conn, lost, acks)
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > resumeChunk {
+			n = resumeChunk
+		}
+		if err := writeResumeFrame(conn, resumeData, uint64(n), pending[:n]); err != nil {
+			conn.Close()
+			break
+		}
+		pending = pending[n:]
+	}
+	return lost, nil
+}
+
+//ack drops the data received by the peer, c.mut held
+func (c *ResumableConn) ack(peerRecv uint64) {
+	if peerRecv <= c.acked || peerRecv > c.sent {
+		return
+	}
+	c.unacked = c.unacked[peerRecv-c.acked:]
+	c.acked = peerRecv
+	c.cond.Broadcast()
+}
+
+func writeResumeFrame(conn net.Conn, typ byte, value uint64, payload []byte) error {
+	b := make([]byte, 9, 9+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint64(b[1:], value)
+	_, err := conn.Write(append(b, payload...))
+	return err
+}
+
+//readFrames reads the frames of conn until it is lost,
+//and then waits for the next conn until the grace expires
+func (c *ResumableConn) readFrames(conn net.Conn, lost chan struct{}, acks chan struct{}) {
+	defer close(lost)
+	header := make([]byte, 9)
+	var lastAck uint64
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			break
+		}
+		value := binary.BigEndian.Uint64(header[1:])
+		if header[0] == resumeData && value <= resumeChunk {
+			b := make([]byte, value)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				break
+			}
+			c.mut.Lock()
+			for len(c.in) >= resumeWindow && !c.closed {
+				c.cond.Wait()
+			}
+			c.in = append(c.in, b...)
+			c.recv += value
+			recv := c.recv
+			c.cond.Broadcast()
+			c.mut.Unlock()
+			if recv-lastAck >= resumeWindow/4 {
+				lastAck = recv
+				select {
+				case acks <- struct{}{}:
+				default:
+				}
+			}
+		} else if header[0] == resumeAck {
+			c.mut.Lock()
+			c.ack(value)
+			c.mut.Unlock()
+		} else if header[0] == resumeClose {
+			c.mut.Lock()
+			c.eof = true
+			c.cond.Broadcast()
+			c.mut.Unlock()
+			break
+		} else {
+			break
+		}
+	}
+	conn.Close()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.conn != conn {
+		return
+	}
+	c.conn = nil
+	if !c.closed && !c.eof {
+		c.expiry = time.AfterFunc(c.grace, c.expire)
+	}
+}
+
+//writeAcks tells the peer how much was received, so that
+//it can drop the data it keeps for retransmission
+func (c *ResumableConn) writeAcks(conn net.Conn, lost chan struct{}, acks chan struct{}) {
+	for {
+		select {
+		case <-acks:
+		case <-lost:
+			return
+		}
+		c.writeMut.Lock()
+		c.mut.Lock()
+		recv := c.recv
+		c.mut.Unlock()
+		err := writeResumeFrame(conn, resumeAck, recv, nil)
+		c.writeMut.Unlock()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+//expire closes the connection once it
+//has been detached for the grace period
+func (c *ResumableConn) expire() {
+	c.mut.Lock()
+	expired := c.conn == nil && !c.closed
+	if expired {
+		c.err = errors.New("resumption timed out")
+	}
+	c.mut.Unlock()
+	if expired {
+		c.Close()
+	}
+}
+
+func (c *ResumableConn) Read(b []byte) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for len(c.in) == 0 && !c.closed && !c.eof {
+		c.cond.Wait()
+	}
+	if len(c.in) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, c.in)
+	c.in = c.in[n:]
+	c.cond.Broadcast()
+	return n, nil
+}
+
+//Write keeps b until the peer acknowledges it, and sends
+//it on the current conn, if any. It only blocks once the
+//peer is a whole window behind.
+func (c *ResumableConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > resumeChunk {
+			n = resumeChunk
+		}
+		c.mut.Lock()
+		for len(c.unacked) >= resumeWindow && !c.closed {
+			c.cond.Wait()
+		}
+		c.mut.Unlock()
+		c.writeMut.Lock()
+		c.mut.Lock()
+		if c.closed {
+			c.mut.Unlock()
+			c.writeMut.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		c.unacked = append(c.unacked, b[:n]...)
+		c.sent += uint64(n)
+		conn := c.conn
+		c.mut.Unlock()
+		//once lost, the data is retransmitted by the next conn
+		if conn != nil && writeResumeFrame(conn, resumeData, uint64(n), b[:n]) != nil {
+			conn.Close()
+		}
+		c.writeMut.Unlock()
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+//Close ends the connection, telling the peer if it is attached
+func (c *ResumableConn) Close() error {
+	c.mut.Lock()
+	if c.closed {
+		c.mut.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	conn := c.conn
+	c.cond.Broadcast()
+	c.mut.Unlock()
+	if conn != nil {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeMut.Lock()
+		writeResumeFrame(conn, resumeClose, 0, nil)
+		c.writeMut.Unlock()
+		conn.Close()
+	}
+	return nil
+}
+
+func (c *ResumableConn) LocalAddr() net.Addr {
+	return resumableAddr{}
+}
+
+func (c *ResumableConn) RemoteAddr() net.Addr {
+	return resumableAddr{}
+}
+
+func (c *ResumableConn) SetDeadline(t time.Time) error {
+	return nil //no-op
+}
+
+func (c *ResumableConn) SetReadDeadline(t time.Time) error {
+	return nil //no-op
+}
+
+func (c *ResumableConn) SetWriteDeadline(t time.Time) error {
+	return nil //no-op
+}
+
+type resumableAddr struct{}
+
+func (resumableAddr) Network() string {
+	return "tcp"
+}
+
+func (resumableAddr) String() string {
+	return ""
+}
@@ -0,0 +1,103 @@
+package cnet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+//The operations of the queries of the datagram transports
+//(DNS and ICMP), which clients send one at a time, and resend
+//until answered: opening a session with a new key, uploading
+//data, answered with data to download, and closing the
+//session. QueryClosed answers those of unknown sessions.
+const (
+	QueryOpen   = 'o'
+	QueryData   = 'd'
+	QueryClose  = 'c'
+	QueryClosed = 'x'
+)
+
+//Query is a query of the datagram transports, or its answer
+type Query struct {
+	Op       byte
+	Key      string
+	Protocol string
+	Seq      uint32
+	Data     []byte
+}
+
+//The expected throughput of the datagram transports,
+//in bytes per second, see settings.KeepAlive.Adapt
+const (
+	DNSThroughput  = 2 << 10
+	ICMPThroughput = 64 << 10
+)
+
+//ICMPPayload is the size of the payloads of the echo
+//requests and replies of the ICMP transport
+const ICMPPayload = 1200
+
+//icmpHeader is the magic, operation, key and sequence
+//number before the data of the echo payloads
+const icmpHeader = 12
+
+//ICMPDataSize is how much data an echo payload carries
+const ICMPDataSize = ICMPPayload - icmpHeader
+
+var (
+	icmpQuery  = [3]byte{'p', 'g', 'q'}
+	icmpAnswer = [3]byte{'p', 'g', 'a'}
+)
+
+//ICMPPayload encodes q, or its answer, as the payload of an
+//echo request or reply. Its key is 8 hexadecimal digits.
+func (q Query) ICMPPayload(answer bool) []byte {
+	data := q.Data
+	if q.Op == QueryOpen && !answer {
+		data = []byte(q.Protocol)
+	}
+	b := make([]byte, icmpHeader, icmpHeader+len(data))
+	magic := icmpQuery
+	if answer {
+		magic = icmpAnswer
+	}
+	copy(b, magic[:])
+	b[3] = q.Op
+	hex.Decode(b[4:8], []byte(q.Key))
+	binary.BigEndian.PutUint32(b[8:], q.Seq)
+	return append(b, data...)
+}
+
+//ParseICMPPayload decodes the payload of an echo request
+//or reply, which is an answer when true
+func ParseICMPPayload(b []byte) (Query, bool, error) {
+	var q Query
+	if len(b) < icmpHeader {
+		return q, false, errors.New("not a penguin payload")
+	}
+	var magic [3]byte
+	copy(magic[:], b)
+	answer := magic == icmpAnswer
+	if !answer && magic != icmpQuery {
+		return q, false, errors.New("not a penguin payload")
+	}
+	q.Op = b[3]
+	q.Key = hex.EncodeToString(b[4:8])
+	q.Seq = binary.BigEndian.Uint32(b[8:])
+	q.Data = b[icmpHeader:]
+	if q.Op == QueryOpen && !answer {
+		q.Protocol = string(q.Data)
+		q.Data = nil
+	}
+	return q, answer, nil
+}
+
+//NewQueryKey generates the key of a session, which
+//clients choose, or a nonce
+func NewQueryKey() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,519 @@
+package cnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//ErrResolveDisabled is returned when a hostname
+//is dialed while name resolution is disabled
+var ErrResolveDisabled = errors.New("resolving hostnames is disabled")
+
+//resolverTimeout bounds the queries to
+//DNS and DNS-over-HTTPS servers
+const resolverTimeout = 10 * time.Second
+
+//Resolver controls how hostnames are resolved, so that
+//dials do not depend on (or leak to) the host's resolver
+type Resolver struct {
+	spec     string
+	disabled bool
+	dns      *net.Resolver
+	server   string
+	doh      string
+	client   *http.Client
+	cache    *resolverCache
+}
+
+//NewResolver parses a resolver setting:
+//  none                          only IP addresses can be dialed
+//  1.1.1.1 or [2606:4700::1]:53  a DNS server
+//  https://1.1.1.1/dns-query     a DNS-over-HTTPS (RFC 8484) server
+//An empty setting returns nil, the system resolver.
+func NewResolver(spec string) (*Resolver, error) {
+	r := &Resolver{spec: spec}
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "none":
+		r.disabled = true
+	case strings.HasPrefix(spec, "https://"):
+		r.doh = spec
+		r.client = &http.Client{Timeout: resolverTimeout}
+	default:
+		server := spec
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		host, _, _ := net.SplitHostPort(server)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid DNS server '%s', expected an IP address", spec)
+		}
+		r.server = server
+	}
+	return r, nil
+}
+
+//Cached returns a resolver which caches the resolutions of r
+//for their TTL, up to max. A nil r caches the system resolver.
+func (r *Resolver) Cached(max time.Duration) *Resolver {
+	c := &Resolver{spec: "system", dns: net.DefaultResolver}
+	if r != nil {
+		*c = *r
+	}
+	c.cache = newResolverCache(max)
+	return c
+}
+
+func (r *Resolver) String() string {
+	if r == nil {
+		return "system"
+	}
+	if r.cache != nil {
+		return fmt.Sprintf("%s (cached for up to %s)", r.spec, r.cache.max)
+	}
+	return r.spec
+}
+
+//LookupIP returns the addresses of host. A nil
+//Resolver uses the system resolver.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r != nil && r.cache != nil {
+		return r.cache.lookup(ctx, host, r.lookup)
+	}
+	ips, _, err := r.lookup(ctx, host)
+	return ips, err
+}
+
+//lookup resolves host, along with the TTL of
+//its addresses, negative if the resolver hides it
+func (r *Resolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var addrs []net.IPAddr
+	var err error
+	switch {
+	case r == nil:
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	case r.disabled:
+		return nil, -1, ErrResolveDisabled
+	case r.dns != nil:
+		addrs, err = r.dns.LookupIPAddr(ctx, host)
+	default:
+		return r.lookupRecords(ctx, host)
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, -1, nil
+}
+
+//lookupRecords queries the A and AAAA records of host
+//from the DNS or DNS-over-HTTPS server, for their TTL
+func (r *Resolver) lookupRecords(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	ttl := time.Duration(-1)
+	var err error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		var found []net.IP
+		var t time.Duration
+		found, t, err = r.query(ctx, host, qtype)
+		if len(found) > 0 && (ttl < 0 || t < ttl) {
+			ttl = t
+		}
+		ips = append(ips, found...)
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, -1, err
+	}
+	return ips, ttl, nil
+}
+
+//query returns the addresses of host in the records of
+//qtype, along with the lowest TTL of the records
+func (r *Resolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	//DNS-over-HTTPS queries use the ID 0, for caching
+	if r.doh == "" {
+		query.ID = uint16(rand.Uint32())
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.doh != "" {
+		b, err = r.exchangeDoH(ctx, b)
+	} else {
+		b, err = r.exchangeDNS(ctx, query.ID, b)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var reply dnsmessage.Message
+	if err := reply.Unpack(b); err != nil {
+		return nil, 0, fmt.Errorf("invalid DNS reply: %s", err)
+	}
+	if reply.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("lookup %s failed: %s", host, reply.RCode)
+	}
+	var ips []net.IP
+	var ttl uint32
+	for _, a := range reply.Answers {
+		switch res := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(res.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(res.AAAA[:]))
+		default:
+			continue
+		}
+		if len(ips) == 1 || a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+//exchangeDoH sends query to the DNS-over-HTTPS server,
+//returning its reply
+func (r *Resolver) exchangeDoH(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", r.doh, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS query failed: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+//exchangeDNS sends query to the DNS server over UDP,
+//returning its reply, or repeats it over TCP when the
+//reply is truncated
+func (r *Resolver) exchangeDNS(ctx context.Context, id uint16, query []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(resolverTimeout)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 65535)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		//skip the replies to other queries
+		var p dnsmessage.Parser
+		h, err := p.Start(b[:n])
+		if err != nil || h.ID != id {
+			continue
+		}
+		if !h.Truncated {
+			return b[:n], nil
+		}
+		break
+	}
+	tcp, err := d.DialContext(ctx, "tcp", r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(deadline)
+	//messages over TCP are prefixed with their length
+	n := len(query)
+	if _, err := tcp.Write(append([]byte{byte(n >> 8), byte(n)}, query...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(tcp, b[:2]); err != nil {
+		return nil, err
+	}
+	n = int(b[0])<<8 | int(b[1])
+	if _, err := io.ReadFull(tcp, b[:n]); err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+//DialFunc connects to addr, like net.Dialer's DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+//Dial connects to addr without a context
+func (f DialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+//DialContext connects to addr
+func (f DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+//Dialer makes the outbound connections of a tunnel
+type Dialer struct {
+	//the FallbackDelay of net.Dialer is the head start of each
+	//address over the next when racing them, 250ms if zero
+	net.Dialer
+	//Dial, if set, makes the connections instead of net.Dialer,
+	//for programs which bring their own network. The Egress
+	//has no effect then.
+	Dial DialFunc
+	//Resolver resolves hostnames, nil uses the system resolver
+	Resolver *Resolver
+	//Egress is where connections leave from, unless
+	//overridden by the first matching EgressRule
+	Egress      *Egress
+	EgressRules []EgressRule
+	//Upstream, if set, is the proxy which TCP connections are
+	//dialed through. Hostnames are resolved by the proxy,
+	//unless the Dialer has a Resolver.
+	Upstream *Upstream
+}
+
+//egress returns the egress of a dial to addr
+func (d *Dialer) egress(addr string) *Egress {
+	for _, r := range d.EgressRules {
+		if r.Match.MatchString(addr) {
+			return r.Egress
+		}
+	}
+	return d.Egress
+}
+
+//DialContext connects to addr, resolving its host with the
+//Dialer's Resolver and trying each address in turn, or racing
+//them per RFC 8305 for TCP. A nil Dialer behaves like net.Dial.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d == nil {
+		var nd net.Dialer
+		return nd.DialContext(ctx, network, addr)
+	}
+	if d.Upstream != nil {
+		return d.dialUpstream(ctx, network, addr)
+	}
+	egress := d.egress(addr)
+	if d.Resolver == nil && egress == nil {
+		return d.forward(&d.Dialer)(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.Resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	nd := d.Dialer
+	if egress != nil {
+		egress.apply(&nd, network)
+	}
+	var addrs []string
+	for _, ip := range ips {
+		//honour tcp4/udp6 etc. and the egress address
+		if (strings.HasSuffix(network, "4") && ip.To4() == nil) ||
+			(strings.HasSuffix(network, "6") && ip.To4() != nil) ||
+			(egress != nil && !egress.allows(ip)) {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no suitable address found for %s", host)
+	}
+	if strings.HasPrefix(network, "tcp") && nd.FallbackDelay >= 0 {
+		delay := nd.FallbackDelay
+		if delay == 0 {
+			delay = happyEyeballsDelay
+		}
+		return dialParallel(ctx, d.forward(&nd), network, interleave(addrs), delay)
+	}
+	for _, a := range addrs {
+		var c net.Conn
+		if c, err = d.forward(&nd)(ctx, network, a); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+//happyEyeballsDelay is the head start of each connection
+//attempt over the next, as recommended by RFC 8305
+const happyEyeballsDelay = 250 * time.Millisecond
+
+//interleave orders addrs by alternating address
+//families, starting with IPv6 (RFC 8305 section 4)
+func interleave(addrs []string) []string {
+	var v6, v4 []string
+	for _, a := range addrs {
+		if strings.HasPrefix(a, "[") {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+	sorted := make([]string, 0, len(addrs))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			sorted = append(sorted, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			sorted = append(sorted, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+//dialParallel connects to the first of addrs to answer, starting
+//each attempt once the previous one has had delay to connect, or
+//has failed, so that an unreachable address family costs delay
+//rather than a full timeout
+func dialParallel(ctx context.Context, dial DialFunc, network string, addrs []string, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	var err error
+	var wait <-chan time.Time
+	next, pending := 0, 0
+	for next < len(addrs) || pending > 0 {
+		if wait == nil && next < len(addrs) {
+			go func(addr string) {
+				c, err := dial(ctx, network, addr)
+				results <- dialResult{c, err}
+			}(addrs[next])
+			next++
+			pending++
+			wait = time.After(delay)
+		}
+		select {
+		case <-wait:
+			wait = nil
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				//close the attempts which connect too late
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err = r.err
+			wait = nil
+		}
+	}
+	return nil, err
+}
+
+func (d *Dialer) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("cannot dial %s through the upstream proxy", network)
+	}
+	if d.Resolver != nil {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := d.Resolver.LookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ips[0].String(), port)
+	}
+	return d.Upstream.dial(ctx, d.forward(&d.Dialer), addr)
+}
+
+//forward is the Dial of d, or else nd
+func (d *Dialer) forward(nd *net.Dialer) DialFunc {
+	if d.Dial != nil {
+		return d.Dial
+	}
+	return nd.DialContext
+}
+
+//SetKeepAlive sets the TCP keepalive period of conn, if it
+//is a TCP connection. 0 keeps the default of Go (15s), and
+//a negative period disables the keepalives.
+func SetKeepAlive(conn net.Conn, period time.Duration) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok || period == 0 {
+		return
+	}
+	if period < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(period)
+}
+
+//TuneTCP sets the Nagle's algorithm and the socket buffer
+//sizes of conn, if it is a TCP connection. Sizes of 0 keep
+//the defaults of the system.
+func TuneTCP(conn net.Conn, nagle bool, sendBuffer, receiveBuffer int) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(!nagle)
+	if sendBuffer > 0 {
+		tc.SetWriteBuffer(sendBuffer)
+	}
+	if receiveBuffer > 0 {
+		tc.SetReadBuffer(receiveBuffer)
+	}
+}
@@ -0,0 +1,149 @@
+package cnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeConn records whether it was closed
+type fakeConn struct {
+	net.Conn
+	addr   string
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newFakeConn(addr string) *fakeConn {
+	c, _ := net.Pipe()
+	return &fakeConn{Conn: c, addr: addr, closed: make(chan struct{})}
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+//fakeDial answers each address after its delay, with a
+//fakeConn or, if it has no delay, with an error. The
+//start of each attempt is sent on started.
+func fakeDial(delays map[string]time.Duration, started chan<- string) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		started <- addr
+		d, ok := delays[addr]
+		if !ok {
+			return nil, errors.New("refused " + addr)
+		}
+		select {
+		case <-time.After(d):
+			return newFakeConn(addr), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	addrs := interleave([]string{"192.0.2.1:80", "192.0.2.2:80", "[2001:db8::1]:80", "[2001:db8::2]:80", "[2001:db8::3]:80"})
+	expected := []string{"[2001:db8::1]:80", "192.0.2.1:80", "[2001:db8::2]:80", "192.0.2.2:80", "[2001:db8::3]:80"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("expected %v, got %v", expected, addrs)
+	}
+	addrs = interleave([]string{"192.0.2.1:80", "192.0.2.2:80"})
+	if !reflect.DeepEqual(addrs, []string{"192.0.2.1:80", "192.0.2.2:80"}) {
+		t.Fatalf("expected the order of a single family to be kept, got %v", addrs)
+	}
+}
+
+func TestDialParallelDelay(t *testing.T) {
+	started := make(chan string, 2)
+	dial := fakeDial(map[string]time.Duration{"a": time.Hour, "b": 0}, started)
+	start := time.Now()
+	c, err := dialParallel(context.Background(), dial, "tcp", []string{"a", "b"}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr := c.(*fakeConn).addr; addr != "b" {
+		t.Fatalf("expected b to connect, got %s", addr)
+	}
+	//a hangs, so b starts after its head start
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected b to wait for the head start of a, started after %s", elapsed)
+	}
+	if first := <-started; first != "a" {
+		t.Fatalf("expected a to start first, got %s", first)
+	}
+}
+
+func TestDialParallelFallback(t *testing.T) {
+	started := make(chan string, 2)
+	dial := fakeDial(map[string]time.Duration{"b": 0}, started)
+	start := time.Now()
+	//a fails at once, so b does not wait for the head start
+	c, err := dialParallel(context.Background(), dial, "tcp", []string{"a", "b"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr := c.(*fakeConn).addr; addr != "b" {
+		t.Fatalf("expected b to connect, got %s", addr)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected b to start once a failed, took %s", elapsed)
+	}
+}
+
+func TestDialParallelLateWinner(t *testing.T) {
+	started := make(chan string, 2)
+	late := make(chan *fakeConn, 1)
+	delays := map[string]time.Duration{"a": 50 * time.Millisecond, "b": 100 * time.Millisecond}
+	dial := fakeDial(delays, started)
+	//keep the connection of b, to check that it is closed
+	spy := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(context.Background(), network, addr)
+		if addr == "b" && err == nil {
+			late <- c.(*fakeConn)
+		}
+		return c, err
+	}
+	c, err := dialParallel(context.Background(), spy, "tcp", []string{"a", "b"}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr := c.(*fakeConn).addr; addr != "a" {
+		t.Fatalf("expected a to connect, got %s", addr)
+	}
+	select {
+	case b := <-late:
+		select {
+		case <-b.closed:
+		case <-time.After(time.Second):
+			t.Fatal("expected the late connection to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected b to connect late")
+	}
+	select {
+	case <-c.(*fakeConn).closed:
+		t.Fatal("expected the winner to stay open")
+	default:
+	}
+}
+
+func TestDialParallelAllFail(t *testing.T) {
+	started := make(chan string, 3)
+	dial := fakeDial(map[string]time.Duration{}, started)
+	_, err := dialParallel(context.Background(), dial, "tcp", []string{"a", "b", "c"}, time.Hour)
+	if err == nil || err.Error() != "refused c" {
+		t.Fatalf("expected the error of the last attempt, got %v", err)
+	}
+	if len(started) != 3 {
+		t.Fatalf("expected every address to be tried, got %d", len(started))
+	}
+}
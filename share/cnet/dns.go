@@ -0,0 +1,115 @@
+package cnet
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//dnsEncoding encodes the data of queries in labels, lower
+//case since resolvers may change the case of names
+var dnsEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+//DNSName is the name of q in zone, without the trailing
+//dot, which is under the delegated zone of the server:
+//  <key>.<protocol>.o  opens a session
+//  [<data>.]<seq>.<key>.d  uploads data
+//  <nonce>.<key>.c  closes the session
+func (q Query) DNSName(zone string) string {
+	var labels []string
+	switch q.Op {
+	case QueryOpen:
+		labels = []string{q.Key, q.Protocol}
+	case QueryData:
+		data := dnsEncoding.EncodeToString(q.Data)
+		for len(data) > 63 {
+			labels = append(labels, data[:63])
+			data = data[63:]
+		}
+		if data != "" {
+			labels = append(labels, data)
+		}
+		labels = append(labels, strconv.FormatUint(uint64(q.Seq), 16), q.Key)
+	case QueryClose:
+		labels = []string{NewQueryKey(), q.Key}
+	}
+	return strings.Join(append(labels, string(q.Op), strings.TrimSuffix(zone, ".")), ".")
+}
+
+//ParseDNSQuery parses the name of a query in zone
+func ParseDNSQuery(name, zone string) (Query, error) {
+	var q Query
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	suffix := "." + strings.ToLower(strings.TrimSuffix(zone, "."))
+	if !strings.HasSuffix(name, suffix) {
+		return q, errors.New("not in the zone")
+	}
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	n := len(labels)
+	if n < 3 || len(labels[n-1]) != 1 {
+		return q, errors.New("malformed query")
+	}
+	q.Op = labels[n-1][0]
+	switch q.Op {
+	case QueryOpen:
+		q.Key, q.Protocol = labels[n-3], labels[n-2]
+	case QueryData:
+		q.Key = labels[n-2]
+		seq, err := strconv.ParseUint(labels[n-3], 16, 32)
+		if err != nil {
+			return q, err
+		}
+		q.Seq = uint32(seq)
+		q.Data, err = dnsEncoding.DecodeString(strings.Join(labels[:n-3], ""))
+		if err != nil {
+			return q, err
+		}
+	case QueryClose:
+		q.Key = labels[n-2]
+	default:
+		return q, fmt.Errorf("unknown operation '%c'", q.Op)
+	}
+	return q, nil
+}
+
+//DNSUploadSize is how much data a query in zone carries
+func DNSUploadSize(zone string) int {
+	//the name is at most 253 characters, of which the
+	//sequence number, key and operation take up to 21
+	avail := 253 - 21 - len(strings.TrimSuffix(zone, "."))
+	//with a dot between labels of 63 characters
+	chars := avail * 63 / 64
+	return chars * 5 / 8
+}
+
+//DNSDownloadSize is how much data the answer to a query
+//of name carries, in a response of at most size bytes
+func DNSDownloadSize(name string, size int) int {
+	//the header, question, answer record and EDNS record
+	rdata := size - 12 - (len(strings.TrimSuffix(name, ".")) + 2 + 4) - 12 - 11
+	//with a length before each string of 255 characters
+	chars := rdata - rdata/256 - 1
+	if chars < 4 {
+		return 0
+	}
+	return chars / 4 * 3
+}
+
+//DNSTXT encodes b as the strings of a TXT record
+func DNSTXT(b []byte) []string {
+	s := base64.StdEncoding.EncodeToString(b)
+	txt := []string{}
+	for len(s) > 255 {
+		txt = append(txt, s[:255])
+		s = s[255:]
+	}
+	return append(txt, s)
+}
+
+//DNSTXTData decodes the strings of a TXT record
+func DNSTXTData(txt []string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(txt, ""))
+}
@@ -0,0 +1,65 @@
+package cnet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+//Egress is the local address or network
+//interface outbound connections leave from
+type Egress struct {
+	IP        net.IP
+	Interface string
+}
+
+//ParseEgress parses an IP address or the name of an interface
+func ParseEgress(s string) (*Egress, error) {
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return &Egress{IP: ip}, nil
+	}
+	if _, err := net.InterfaceByName(s); err != nil {
+		return nil, fmt.Errorf("invalid egress '%s': not an IP address or interface", s)
+	}
+	if !bindToDeviceSupported {
+		return nil, fmt.Errorf("binding to interface '%s' is not supported on this platform", s)
+	}
+	return &Egress{Interface: s}, nil
+}
+
+func (e *Egress) String() string {
+	if e.IP != nil {
+		return e.IP.String()
+	}
+	return e.Interface
+}
+
+//allows reports whether ip can be reached from the egress address
+func (e *Egress) allows(ip net.IP) bool {
+	return e.IP == nil || (e.IP.To4() == nil) == (ip.To4() == nil)
+}
+
+//apply configures d to dial from the egress
+func (e *Egress) apply(d *net.Dialer, network string) {
+	if e.IP != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: e.IP}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: e.IP}
+		}
+	}
+	if e.Interface != "" {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, e.Interface)
+		}
+	}
+}
+
+//EgressRule overrides the egress for matching addresses
+type EgressRule struct {
+	Match interface {
+		MatchString(addr string) bool
+	}
+	Egress *Egress
+}
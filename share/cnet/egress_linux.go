@@ -0,0 +1,15 @@
+package cnet
+
+import "syscall"
+
+const bindToDeviceSupported = true
+
+func bindToDevice(c syscall.RawConn, device string) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.BindToDevice(int(fd), device)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
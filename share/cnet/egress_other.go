@@ -0,0 +1,14 @@
+//+build !linux
+
+package cnet
+
+import (
+	"errors"
+	"syscall"
+)
+
+const bindToDeviceSupported = false
+
+func bindToDevice(c syscall.RawConn, device string) error {
+	return errors.New("binding to an interface is not supported")
+}
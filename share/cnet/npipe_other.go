@@ -0,0 +1,21 @@
+//+build !windows
+
+package cnet
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errNoPipes = errors.New("named pipes are only supported on Windows")
+
+//ListenPipe listens on the named pipe at path
+func ListenPipe(path string) (net.Listener, error) {
+	return nil, errNoPipes
+}
+
+//DialPipe connects to the named pipe at path
+func DialPipe(ctx context.Context, path string) (net.Conn, error) {
+	return nil, errNoPipes
+}
@@ -0,0 +1,238 @@
+package cnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+//pipeBuffer is the size of the buffers of the pipes
+const pipeBuffer = 65536
+
+var errPipeDeadline = errors.New("named pipes do not support deadlines")
+
+//pipeAddr is the path of a named pipe
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "npipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+//pipeName converts path, which may be written with forward
+//slashes (//./pipe/name), into the name of a named pipe
+func pipeName(path string) (*uint16, error) {
+	return windows.UTF16PtrFromString(strings.Replace(path, "/", `\`, -1))
+}
+
+//pipeIO waits for an overlapped operation on h, which
+//is cancelled when h is closed
+func pipeIO(h windows.Handle, op func(o *windows.Overlapped) error) (uint32, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+	o := &windows.Overlapped{HEvent: event}
+	var n uint32
+	err = op(o)
+	if err == windows.ERROR_IO_PENDING {
+		err = windows.GetOverlappedResult(h, o, &n, true)
+	} else if err == nil {
+		err = windows.GetOverlappedResult(h, o, &n, true)
+	}
+	return n, err
+}
+
+//pipeConn is a connection over an instance of a named pipe,
+//whose reads and writes are overlapped so that they do not
+//wait for each other
+type pipeConn struct {
+	h      windows.Handle
+	path   string
+	mut    sync.RWMutex
+	closed int32
+	//server instances are disconnected when closed
+	server bool
+}
+
+//op runs an operation unless the pipe is closed
+func (c *pipeConn) op(op func(o *windows.Overlapped) error) (int, error) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return 0, net.ErrClosed
+	}
+	n, err := pipeIO(c.h, op)
+	switch err {
+	case nil:
+	case windows.ERROR_BROKEN_PIPE, windows.ERROR_PIPE_NOT_CONNECTED, windows.ERROR_NO_DATA:
+		err = io.EOF
+	case windows.ERROR_OPERATION_ABORTED:
+		err = net.ErrClosed
+	}
+	return int(n), err
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := c.op(func(o *windows.Overlapped) error {
+		var done uint32
+		return windows.ReadFile(c.h, b, &done, o)
+	})
+	if err == windows.ERROR_MORE_DATA {
+		err = nil
+	}
+	return n, err
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n, err := c.op(func(o *windows.Overlapped) error {
+			var done uint32
+			return windows.WriteFile(c.h, b, &done, o)
+		})
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+//Close cancels the pending operations, then
+//closes the handle once they have returned
+func (c *pipeConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	for !c.mut.TryLock() {
+		windows.CancelIoEx(c.h, nil)
+		time.Sleep(time.Millisecond)
+	}
+	defer c.mut.Unlock()
+	if c.server {
+		windows.FlushFileBuffers(c.h)
+		windows.DisconnectNamedPipe(c.h)
+	}
+	return windows.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return pipeAddr(c.path) }
+func (c *pipeConn) RemoteAddr() net.Addr               { return pipeAddr(c.path) }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return errPipeDeadline }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return errPipeDeadline }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return errPipeDeadline }
+
+//pipeListener accepts the clients of a named pipe,
+//each on a new instance of the pipe
+type pipeListener struct {
+	path   string
+	name   *uint16
+	mut    sync.Mutex
+	next   windows.Handle
+	closed bool
+}
+
+//ListenPipe listens on the named pipe at path
+func ListenPipe(path string) (net.Listener, error) {
+	name, err := pipeName(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &pipeListener{path: path, name: name}
+	//the first instance fails if the pipe exists
+	if l.next, err = l.instance(windows.FILE_FLAG_FIRST_PIPE_INSTANCE); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *pipeListener) instance(flags uint32) (windows.Handle, error) {
+	return windows.CreateNamedPipe(l.name,
+		windows.PIPE_ACCESS_DUPLEX|windows.FILE_FLAG_OVERLAPPED|flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, pipeBuffer, pipeBuffer, 0, nil)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mut.Lock()
+	if l.closed {
+		l.mut.Unlock()
+		return nil, net.ErrClosed
+	}
+	h := l.next
+	l.mut.Unlock()
+	_, err := pipeIO(h, func(o *windows.Overlapped) error {
+		return windows.ConnectNamedPipe(h, o)
+	})
+	if err == windows.ERROR_PIPE_CONNECTED {
+		//connected before the call
+		err = nil
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.closed {
+		//h was closed with the listener
+		return nil, net.ErrClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	//the next client waits on a new instance
+	if l.next, err = l.instance(0); err != nil {
+		l.closed = true
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return &pipeConn{h: h, path: l.path, server: true}, nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	windows.CancelIoEx(l.next, nil)
+	return windows.CloseHandle(l.next)
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.path)
+}
+
+//DialPipe connects to the named pipe at path,
+//waiting while its instances are all busy
+func DialPipe(ctx context.Context, path string) (net.Conn, error) {
+	name, err := pipeName(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := windows.CreateFile(name,
+			windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil,
+			windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return &pipeConn{h: h, path: path}, nil
+		}
+		if err != windows.ERROR_PIPE_BUSY {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
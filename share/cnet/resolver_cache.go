@@ -0,0 +1,79 @@
+package cnet
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+//resolverCacheFloor is the shortest time a resolution is
+//cached for, however low its TTL, so that forwards with high
+//connection rates do not query the resolver for each one
+const resolverCacheFloor = 5 * time.Second
+
+//resolverCacheSize is the number of hostnames beyond
+//which the expired resolutions are swept
+const resolverCacheSize = 1024
+
+//resolverCache caches resolutions for their TTL, at least
+//resolverCacheFloor but at most max, or for max if the resolver
+//hides the TTL. Once expired, a resolution is still used for up to
+//max while the resolver fails, so that its brief outages do
+//not break the forwards.
+type resolverCache struct {
+	max     time.Duration
+	mut     sync.Mutex
+	entries map[string]resolverEntry
+}
+
+type resolverEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func newResolverCache(max time.Duration) *resolverCache {
+	return &resolverCache{
+		max:     max,
+		entries: map[string]resolverEntry{},
+	}
+}
+
+//lookup returns the cached addresses of host,
+//or else resolves it with resolve
+func (c *resolverCache) lookup(ctx context.Context, host string, resolve func(context.Context, string) ([]net.IP, time.Duration, error)) ([]net.IP, error) {
+	now := time.Now()
+	c.mut.Lock()
+	e, ok := c.entries[host]
+	c.mut.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.ips, nil
+	}
+	ips, ttl, err := resolve(ctx, host)
+	if err != nil {
+		if ok && now.Before(e.expires.Add(c.max)) {
+			return e.ips, nil
+		}
+		return nil, err
+	}
+	if ttl < 0 {
+		ttl = c.max
+	}
+	if ttl < resolverCacheFloor {
+		ttl = resolverCacheFloor
+	}
+	if ttl > c.max {
+		ttl = c.max
+	}
+	c.mut.Lock()
+	if len(c.entries) >= resolverCacheSize {
+		for h, e := range c.entries {
+			if now.After(e.expires.Add(c.max)) {
+				delete(c.entries, h)
+			}
+		}
+	}
+	c.entries[host] = resolverEntry{ips: ips, expires: now.Add(ttl)}
+	c.mut.Unlock()
+	return ips, nil
+}
@@ -0,0 +1,171 @@
+package cnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolverCacheClamp(t *testing.T) {
+	c := newResolverCache(time.Minute)
+	for _, test := range []struct {
+		ttl     time.Duration
+		expires time.Duration
+	}{
+		{time.Second, resolverCacheFloor},
+		{30 * time.Second, 30 * time.Second},
+		{time.Hour, time.Minute},
+		{-1, time.Minute},
+	} {
+		host := "ttl" + test.ttl.String()
+		start := time.Now()
+		_, err := c.lookup(context.Background(), host, func(context.Context, string) ([]net.IP, time.Duration, error) {
+			return []net.IP{net.IPv4(127, 0, 0, 1)}, test.ttl, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expires := c.entries[host].expires.Sub(start)
+		if expires < test.expires || expires > test.expires+time.Second {
+			t.Fatalf("expected a TTL of %s to be cached for %s, got %s", test.ttl, test.expires, expires)
+		}
+	}
+}
+
+func TestResolverCacheStale(t *testing.T) {
+	c := newResolverCache(time.Minute)
+	ip := net.IPv4(127, 0, 0, 1)
+	resolves := 0
+	failing := func(context.Context, string) ([]net.IP, time.Duration, error) {
+		resolves++
+		return nil, 0, errors.New("resolver down")
+	}
+	//fresh resolutions do not query the resolver
+	c.entries["fresh"] = resolverEntry{ips: []net.IP{ip}, expires: time.Now().Add(time.Second)}
+	if ips, err := c.lookup(context.Background(), "fresh", failing); err != nil || !ips[0].Equal(ip) || resolves != 0 {
+		t.Fatalf("expected the cached address, got %v (%v) after %d resolves", ips, err, resolves)
+	}
+	//expired ones are used while the resolver fails
+	c.entries["expired"] = resolverEntry{ips: []net.IP{ip}, expires: time.Now().Add(-time.Second)}
+	if ips, err := c.lookup(context.Background(), "expired", failing); err != nil || !ips[0].Equal(ip) || resolves != 1 {
+		t.Fatalf("expected the expired address, got %v (%v) after %d resolves", ips, err, resolves)
+	}
+	//but only for up to max
+	c.entries["stale"] = resolverEntry{ips: []net.IP{ip}, expires: time.Now().Add(-2 * time.Minute)}
+	if _, err := c.lookup(context.Background(), "stale", failing); err == nil {
+		t.Fatal("expected the resolver's error")
+	}
+	if _, err := c.lookup(context.Background(), "unknown", failing); err == nil {
+		t.Fatal("expected the resolver's error")
+	}
+}
+
+func TestResolverCacheSweep(t *testing.T) {
+	c := newResolverCache(time.Minute)
+	ip := net.IPv4(127, 0, 0, 1)
+	for i := 0; i < resolverCacheSize-1; i++ {
+		c.entries[strconv.Itoa(i)] = resolverEntry{ips: []net.IP{ip}, expires: time.Now().Add(-2 * time.Minute)}
+	}
+	//still usable while the resolver fails
+	c.entries["expired"] = resolverEntry{ips: []net.IP{ip}, expires: time.Now().Add(-time.Second)}
+	_, err := c.lookup(context.Background(), "new", func(context.Context, string) ([]net.IP, time.Duration, error) {
+		return []net.IP{ip}, time.Minute, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 2 {
+		t.Fatalf("expected the stale resolutions to be swept, got %d left", len(c.entries))
+	}
+	if _, ok := c.entries["expired"]; !ok {
+		t.Fatal("expected the usable resolution to be kept")
+	}
+}
+
+//dnsServer answers A queries for 127.0.0.1 with a TTL
+//of 60s, over TCP when the UDP query is truncated
+func dnsServer(t *testing.T) (addr string, closer func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	answer := func(b []byte, truncate bool) []byte {
+		var m dnsmessage.Message
+		if m.Unpack(b) != nil || len(m.Questions) != 1 {
+			return nil
+		}
+		m.Response = true
+		m.Truncated = truncate
+		if q := m.Questions[0]; q.Type == dnsmessage.TypeA && !truncate {
+			m.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			}}
+		}
+		reply, _ := m.Pack()
+		return reply
+	}
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			//A queries are truncated, to be repeated over TCP
+			var p dnsmessage.Parser
+			p.Start(b[:n])
+			q, _ := p.Question()
+			conn.WriteTo(answer(b[:n], q.Type == dnsmessage.TypeA), from)
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 512)
+			if _, err := io.ReadFull(c, b[:2]); err == nil {
+				n := int(binary.BigEndian.Uint16(b))
+				if _, err := io.ReadFull(c, b[:n]); err == nil {
+					reply := answer(b[:n], false)
+					c.Write(append([]byte{byte(len(reply) >> 8), byte(len(reply))}, reply...))
+				}
+			}
+			c.Close()
+		}
+	}()
+	return conn.LocalAddr().String(), func() { ln.Close(); conn.Close() }
+}
+
+func TestResolverTTL(t *testing.T) {
+	addr, closer := dnsServer(t)
+	defer closer()
+	r, err := NewResolver(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, ttl, err := r.lookup(context.Background(), "penguin.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected 127.0.0.1, got %v", ips)
+	}
+	if ttl != time.Minute {
+		t.Fatalf("expected the TTL of the records, got %s", ttl)
+	}
+}
@@ -0,0 +1,63 @@
+package cnet
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+//serialRates are the baud rates of termios
+var serialRates = map[int]uint32{
+	1200: unix.B1200, 2400: unix.B2400, 4800: unix.B4800,
+	9600: unix.B9600, 19200: unix.B19200, 38400: unix.B38400,
+	57600: unix.B57600, 115200: unix.B115200, 230400: unix.B230400,
+	460800: unix.B460800, 500000: unix.B500000, 576000: unix.B576000,
+	921600: unix.B921600, 1000000: unix.B1000000, 1152000: unix.B1152000,
+	1500000: unix.B1500000, 2000000: unix.B2000000, 2500000: unix.B2500000,
+	3000000: unix.B3000000, 3500000: unix.B3500000, 4000000: unix.B4000000,
+}
+
+//OpenSerial opens the serial device at path for exclusive use,
+//in raw mode (8N1) at the given baud rate, or at its current rate
+//if 0. The device supports deadlines.
+func OpenSerial(path string, baud int) (*os.File, error) {
+	rate, ok := serialRates[baud]
+	if baud != 0 && !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("open", err)
+	}
+	fail := func(op string, err error) (*os.File, error) {
+		unix.Close(fd)
+		return nil, os.NewSyscallError(op, err)
+	}
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		//not a terminal
+		return fail("TCGETS", err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.TIOCEXCL, 0); err != nil {
+		return fail("TIOCEXCL", err)
+	}
+	//as cfmakeraw(3)
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+		unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8 | unix.CLOCAL | unix.CREAD
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if baud != 0 {
+		t.Cflag &^= unix.CBAUD
+		t.Cflag |= rate
+		t.Ispeed, t.Ospeed = rate, rate
+	}
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		return fail("TCSETS", err)
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
@@ -0,0 +1,13 @@
+//+build !linux
+
+package cnet
+
+import (
+	"errors"
+	"os"
+)
+
+//OpenSerial opens the serial device at path
+func OpenSerial(path string, baud int) (*os.File, error) {
+	return nil, errors.New("serial devices are only supported on Linux")
+}
@@ -0,0 +1,28 @@
+package cnet
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+//OpenTun creates the TUN device of the given name, which
+//reads and writes one IP packet at a time. The device is
+//removed once closed, and supports deadlines.
+func OpenTun(name string) (*os.File, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("open", err)
+	}
+	//struct ifreq: the name, then the flags
+	var ifr [40]byte
+	copy(ifr[:syscall.IFNAMSIZ-1], name)
+	*(*uint16)(unsafe.Pointer(&ifr[syscall.IFNAMSIZ])) = syscall.IFF_TUN | syscall.IFF_NO_PI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("TUNSETIFF", errno)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
@@ -0,0 +1,13 @@
+//+build !linux
+
+package cnet
+
+import (
+	"errors"
+	"os"
+)
+
+//OpenTun creates the TUN device of the given name
+func OpenTun(name string) (*os.File, error) {
+	return nil, errors.New("TUN devices are only supported on Linux")
+}
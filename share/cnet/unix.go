@@ -0,0 +1,28 @@
+package cnet
+
+import (
+	"net"
+	"os"
+)
+
+//ListenUnix listens on the unix socket at path, replacing
+//a stale socket which a dead process left behind
+func ListenUnix(path string) (*net.UnixListener, error) {
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	l, err := net.ListenUnix("unix", addr)
+	if err == nil {
+		return l, nil
+	}
+	if fi, serr := os.Lstat(path); serr != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil, err
+	}
+	if conn, derr := net.Dial("unix", path); derr == nil {
+		//in use
+		conn.Close()
+		return nil, err
+	}
+	if rerr := os.Remove(path); rerr != nil {
+		return nil, err
+	}
+	return net.ListenUnix("unix", addr)
+}
@@ -4,16 +4,17 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
 //InterruptContext returns a context which is
-//cancelled on OS Interrupt
+//cancelled on OS Interrupt or SIGTERM
 func InterruptContext() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt) //windows compatible?
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 		<-sig
 		signal.Stop(sig)
 		cancel()
@@ -0,0 +1,63 @@
+package cos
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+//daemonEnv marks the background copy of the process
+const daemonEnv = "PENGUIN_DAEMON"
+
+//Daemonize starts this program again in the background,
+//detached from the terminal and with its output appended
+//to logFile (or discarded), and returns true in the calling
+//process, which should then exit. It returns false in the
+//background process.
+func Daemonize(logFile string) (bool, error) {
+	if os.Getenv(daemonEnv) != "" {
+		os.Unsetenv(daemonEnv)
+		return false, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		return false, err
+	}
+	defer null.Close()
+	out := null
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		out = f
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = null
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = daemonAttr()
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	//report a daemon which fails to start, such as on bad
+	//options, instead of leaving it to the log file
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		return true, fmt.Errorf("daemon failed to start: %s", err)
+	case <-time.After(time.Second):
+	}
+	return true, nil
+}
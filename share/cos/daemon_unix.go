@@ -0,0 +1,12 @@
+//+build !windows
+
+package cos
+
+import "syscall"
+
+//daemonAttr starts the daemon in a new session, without a
+//controlling terminal. As the daemon never opens a terminal,
+//it cannot acquire one again, and no second fork is needed.
+func daemonAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
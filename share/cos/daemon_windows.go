@@ -0,0 +1,18 @@
+//+build windows
+
+package cos
+
+import "syscall"
+
+//not defined by package syscall
+const detachedProcess = 0x00000008
+
+//daemonAttr starts the daemon without a console, in its
+//own process group so that it does not receive the Ctrl+C
+//of the console it was started from
+func daemonAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP,
+		HideWindow:    true,
+	}
+}
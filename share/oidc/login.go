@@ -0,0 +1,107 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//Login is a token source for interactive clients. It
+//logs in with the device flow, caches the token on disk
+//and refreshes it when it expires.
+type Login struct {
+	Issuer   string
+	ClientID string
+	Scope    string
+	//CacheFile stores the token between runs,
+	//leave empty to disable caching
+	CacheFile string
+	//Prompt tells the user how to complete the login
+	Prompt func(uri, code string)
+	//Logf reports non-fatal problems
+	Logf     func(format string, args ...interface{})
+	mut      sync.Mutex
+	provider *Provider
+	token    *Token
+}
+
+//Token returns a valid id token, logging in if needed
+func (l *Login) Token(ctx context.Context) (string, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.token == nil && l.CacheFile != "" {
+		l.token = l.load()
+	}
+	if l.token.Valid(time.Now()) {
+		return l.token.IDToken, nil
+	}
+	if l.provider == nil {
+		p, err := Discover(ctx, l.Issuer)
+		if err != nil {
+			return "", err
+		}
+		l.provider = p
+	}
+	var t *Token
+	if l.token != nil && l.token.RefreshToken != "" {
+		var err error
+		if t, err = l.provider.Refresh(ctx, l.ClientID, l.token.RefreshToken); err != nil {
+			l.logf("failed to refresh token (%s), logging in again", err)
+		}
+	}
+	if t == nil {
+		var err error
+		if t, err = l.provider.DeviceLogin(ctx, l.ClientID, l.Scope, l.Prompt); err != nil {
+			return "", err
+		}
+	}
+	l.token = t
+	if l.CacheFile != "" {
+		if err := l.save(); err != nil {
+			l.logf("failed to cache token (%s)", err)
+		}
+	}
+	return t.IDToken, nil
+}
+
+func (l *Login) logf(format string, args ...interface{}) {
+	if l.Logf != nil {
+		l.Logf(format, args...)
+	}
+}
+
+func (l *Login) load() *Token {
+	b, err := ioutil.ReadFile(l.CacheFile)
+	if err != nil {
+		return nil
+	}
+	var cached struct {
+		Issuer   string `json:"issuer"`
+		ClientID string `json:"client_id"`
+		Token
+	}
+	//ignore tokens for other providers
+	if json.Unmarshal(b, &cached) != nil || cached.Issuer != l.Issuer || cached.ClientID != l.ClientID {
+		return nil
+	}
+	return &cached.Token
+}
+
+func (l *Login) save() error {
+	b, err := json.Marshal(struct {
+		Issuer   string `json:"issuer"`
+		ClientID string `json:"client_id"`
+		*Token
+	}{l.Issuer, l.ClientID, l.token})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.CacheFile), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.CacheFile, b, 0600)
+}
@@ -0,0 +1,208 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/ccrypto"
+)
+
+//Provider is the subset of an OpenID Connect
+//discovery document used by penguin
+type Provider struct {
+	Issuer                      string `json:"issuer"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+	client                      *http.Client
+}
+
+//Discover fetches the discovery document of issuer
+func Discover(ctx context.Context, issuer string) (*Provider, error) {
+	u := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{client: &http.Client{Timeout: 30 * time.Second}}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery failed: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %s", err)
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("discovery document is for issuer '%s'", p.Issuer)
+	}
+	return p, nil
+}
+
+//Token is the result of a successful login
+type Token struct {
+	IDToken      string    `json:"id_token"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+//Valid reports whether the token can still be used at now
+func (t *Token) Valid(now time.Time) bool {
+	return t != nil && t.IDToken != "" && now.Add(time.Minute).Before(t.Expiry)
+}
+
+//tokenError is an OAuth2 error response
+type tokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *tokenError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+//post submits a form to endpoint and decodes the JSON response
+//into v, or returns a *tokenError
+func (p *Provider) post(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &tokenError{}
+		if json.Unmarshal(b, e) != nil || e.Code == "" {
+			return fmt.Errorf("request failed: %s", resp.Status)
+		}
+		return e
+	}
+	return json.Unmarshal(b, v)
+}
+
+//token requests a token with the given grant
+func (p *Provider) token(ctx context.Context, form url.Values) (*Token, error) {
+	var resp struct {
+		IDToken      string `json:"id_token"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := p.post(ctx, p.TokenEndpoint, form, &resp); err != nil {
+		return nil, err
+	}
+	if resp.IDToken == "" {
+		return nil, errors.New("no id_token in response (is the openid scope requested?)")
+	}
+	t := &Token{
+		IDToken:      resp.IDToken,
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}
+	//the id token is what we present, so prefer its own expiry
+	if jwt, err := ccrypto.ParseJWT(t.IDToken); err == nil {
+		if exp, ok := jwt.Claims["exp"].(float64); ok {
+			t.Expiry = time.Unix(int64(exp), 0)
+		}
+	}
+	return t, nil
+}
+
+//DeviceLogin performs an OAuth 2.0 device authorization grant
+//(RFC 8628). prompt is called once with the URL the user needs
+//to visit and the code they need to enter there.
+func (p *Provider) DeviceLogin(ctx context.Context, clientID, scope string, prompt func(uri, code string)) (*Token, error) {
+	if p.DeviceAuthorizationEndpoint == "" {
+		return nil, errors.New("provider does not support the device flow")
+	}
+	var auth struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                *int   `json:"interval"`
+	}
+	form := url.Values{"client_id": {clientID}, "scope": {scope}}
+	if err := p.post(ctx, p.DeviceAuthorizationEndpoint, form, &auth); err != nil {
+		return nil, err
+	}
+	uri := auth.VerificationURIComplete
+	if uri == "" {
+		uri = auth.VerificationURI
+	}
+	prompt(uri, auth.UserCode)
+	//the polling interval defaults to 5 seconds (RFC 8628 3.2)
+	interval := 5 * time.Second
+	if auth.Interval != nil {
+		interval = time.Duration(*auth.Interval) * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	form = url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {auth.DeviceCode},
+		"client_id":   {clientID},
+	}
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		t, err := p.token(ctx, form)
+		if e, ok := err.(*tokenError); ok {
+			switch e.Code {
+			case "authorization_pending":
+				if auth.ExpiresIn > 0 && time.Now().After(deadline) {
+					return nil, errors.New("login timed out")
+				}
+				continue
+			case "slow_down":
+				interval += 5 * time.Second
+				continue
+			}
+		}
+		return t, err
+	}
+}
+
+//Refresh exchanges a refresh token for a new token
+func (p *Provider) Refresh(ctx context.Context, clientID, refreshToken string) (*Token, error) {
+	t, err := p.token(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {clientID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	//providers may not rotate refresh tokens
+	if t.RefreshToken == "" {
+		t.RefreshToken = refreshToken
+	}
+	return t, nil
+}
@@ -3,11 +3,136 @@ package settings
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 type Config struct {
 	Version string
+	//Protocol is the client's protocol version, which
+	//older clients only sent as the websocket subprotocol
+	Protocol string `json:",omitempty"`
+	//MinProtocol is the oldest protocol version which the
+	//client supports, Protocol being the newest
+	MinProtocol string `json:",omitempty"`
 	Remotes
+	//Reply asks the server to acknowledge the config
+	//with a ConfigReply. Older clients treat any reply
+	//payload as an error, so it is opt-in.
+	Reply bool `json:",omitempty"`
+	//KeepAlive is the client's proposal, which
+	//older servers ignore
+	KeepAlive *KeepAlive `json:",omitempty"`
+	//Compress are the compression algorithms which the
+	//client offers, in order of preference
+	Compress []string `json:",omitempty"`
+	//Throughput is what the client's transport is expected
+	//to carry, in bytes per second, when it is a slow one
+	Throughput int `json:",omitempty"`
+}
+
+//ConfigReply is the server's acknowledgement of a Config
+type ConfigReply struct {
+	//RequestID correlates the logs of both ends of a session
+	RequestID string
+	//KeepAlive is settled by the server when the client
+	//proposed one: the client then sends all the pings
+	KeepAlive *KeepAlive `json:",omitempty"`
+	//Compress is the compression algorithm of the channels,
+	//chosen by the server among those offered, if any
+	Compress string `json:",omitempty"`
+	//Protocol is the version negotiated by the server,
+	//the newest which both ends support
+	Protocol string `json:",omitempty"`
+	//RemoteOptions tells that the server honours the
+	//options of remotes, which older servers ignore
+	RemoteOptions bool `json:",omitempty"`
+}
+
+//NegotiateCompression chooses the first of the offered
+//compression algorithms which is also allowed, or none
+func NegotiateCompression(offered, allowed []string) string {
+	for _, o := range offered {
+		for _, a := range allowed {
+			if o == a {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
+//KeepAlive settings of a connection
+type KeepAlive struct {
+	//Interval between pings, zero sends none
+	Interval time.Duration
+	//Timeout after which the connection is closed, when
+	//a ping is not replied to, or none has arrived
+	Timeout time.Duration
+	//Misses is the number of timeouts in a row after which
+	//the peer is declared dead and the connection closed,
+	//zero is one. Older peers ignore it.
+	Misses int `json:",omitempty"`
+}
+
+//Negotiate takes the stricter of the settings of both
+//sides, the shorter interval and timeout, where zero is
+//unset. The timeout defaults to the interval.
+func (k KeepAlive) Negotiate(other KeepAlive) KeepAlive {
+	n := KeepAlive{
+		Interval: stricter(k.Interval, other.Interval),
+		Timeout:  stricter(k.Timeout, other.Timeout),
+		Misses:   fewer(k.Misses, other.Misses),
+	}
+	if n.Timeout == 0 {
+		n.Timeout = n.Interval
+	}
+	return n
+}
+
+//Deadline is how long the peer may go without a
+//reply to a ping, before it is declared dead
+func (k KeepAlive) Deadline() time.Duration {
+	if k.Misses > 1 {
+		return time.Duration(k.Misses) * k.Timeout
+	}
+	return k.Timeout
+}
+
+//adaptWindow is how much data a ping
+//may be queued behind on a slow transport
+const adaptWindow = 64 << 10
+
+//Adapt lengthens the timeout for a transport of the given
+//throughput, in bytes per second, so that it covers a ping
+//queued behind a window of data. Zero is a fast transport.
+func (k KeepAlive) Adapt(throughput int) KeepAlive {
+	if throughput <= 0 || k.Timeout == 0 {
+		return k
+	}
+	if min := time.Duration(adaptWindow/throughput) * time.Second; k.Timeout < min {
+		k.Timeout = min
+	}
+	return k
+}
+
+func stricter(a, b time.Duration) time.Duration {
+	if a <= 0 || (b > 0 && b < a) {
+		a = b
+	}
+	if a < 0 {
+		return 0
+	}
+	return a
+}
+
+func fewer(a, b int) int {
+	if a <= 0 || (b > 0 && b < a) {
+		a = b
+	}
+	if a < 0 {
+		return 0
+	}
+	return a
 }
 
 func DecodeConfig(b []byte) (*Config, error) {
@@ -24,3 +149,16 @@ func EncodeConfig(c Config) []byte {
 	b, _ := json.Marshal(c)
 	return b
 }
+
+func DecodeConfigReply(b []byte) (*ConfigReply, error) {
+	r := &ConfigReply{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("invalid JSON config reply")
+	}
+	return r, nil
+}
+
+func EncodeConfigReply(r ConfigReply) []byte {
+	b, _ := json.Marshal(r)
+	return b
+}
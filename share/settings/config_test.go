@@ -0,0 +1,75 @@
+package settings
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegotiateKeepAlive(t *testing.T) {
+	for _, test := range []struct {
+		a, b, expect KeepAlive
+	}{
+		{KeepAlive{25 * time.Second, 0, 0}, KeepAlive{10 * time.Second, 0, 0}, KeepAlive{10 * time.Second, 10 * time.Second, 0}},
+		{KeepAlive{25 * time.Second, 5 * time.Second, 0}, KeepAlive{10 * time.Second, 0, 0}, KeepAlive{10 * time.Second, 5 * time.Second, 0}},
+		{KeepAlive{0, 0, 0}, KeepAlive{25 * time.Second, 0, 0}, KeepAlive{25 * time.Second, 25 * time.Second, 0}},
+		{KeepAlive{-1, 0, 0}, KeepAlive{0, 0, 0}, KeepAlive{0, 0, 0}},
+		{KeepAlive{25 * time.Second, 0, 3}, KeepAlive{10 * time.Second, 0, 0}, KeepAlive{10 * time.Second, 10 * time.Second, 3}},
+		{KeepAlive{25 * time.Second, 0, 3}, KeepAlive{10 * time.Second, 0, 2}, KeepAlive{10 * time.Second, 10 * time.Second, 2}},
+	} {
+		if got := test.a.Negotiate(test.b); got != test.expect {
+			t.Errorf("%+v with %+v: expected %+v, got %+v", test.a, test.b, test.expect, got)
+		}
+		if got := test.b.Negotiate(test.a); got != test.expect {
+			t.Errorf("%+v with %+v: expected %+v, got %+v", test.b, test.a, test.expect, got)
+		}
+	}
+}
+
+func TestKeepAliveDeadline(t *testing.T) {
+	for _, test := range []struct {
+		k      KeepAlive
+		expect time.Duration
+	}{
+		{KeepAlive{25 * time.Second, 10 * time.Second, 0}, 10 * time.Second},
+		{KeepAlive{25 * time.Second, 10 * time.Second, 1}, 10 * time.Second},
+		{KeepAlive{25 * time.Second, 10 * time.Second, 3}, 30 * time.Second},
+	} {
+		if got := test.k.Deadline(); got != test.expect {
+			t.Errorf("%+v: expected %s, got %s", test.k, test.expect, got)
+		}
+	}
+}
+
+func TestAdaptKeepAlive(t *testing.T) {
+	for _, test := range []struct {
+		k          KeepAlive
+		throughput int
+		expect     KeepAlive
+	}{
+		{KeepAlive{25 * time.Second, 25 * time.Second, 0}, 0, KeepAlive{25 * time.Second, 25 * time.Second, 0}},
+		{KeepAlive{25 * time.Second, 25 * time.Second, 0}, 64 << 10, KeepAlive{25 * time.Second, 25 * time.Second, 0}},
+		{KeepAlive{25 * time.Second, 25 * time.Second, 0}, 1 << 10, KeepAlive{25 * time.Second, 64 * time.Second, 0}},
+		{KeepAlive{0, 0, 0}, 1 << 10, KeepAlive{0, 0, 0}},
+	} {
+		if got := test.k.Adapt(test.throughput); got != test.expect {
+			t.Errorf("%+v at %d B/s: expected %+v, got %+v", test.k, test.throughput, test.expect, got)
+		}
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	for _, tc := range []struct {
+		offered, allowed []string
+		expected         string
+	}{
+		{[]string{"zstd", "snappy"}, []string{"snappy", "zstd"}, "zstd"},
+		{[]string{"snappy", "zstd"}, []string{"zstd"}, "zstd"},
+		{[]string{"zstd"}, []string{"snappy"}, ""},
+		{nil, []string{"zstd"}, ""},
+		{[]string{"zstd"}, nil, ""},
+	} {
+		if got := NegotiateCompression(tc.offered, tc.allowed); got != tc.expected {
+			t.Errorf("offered %v, allowed %v: expected '%s', got '%s'", tc.offered, tc.allowed, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package settings
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseNetworks parses a list of networks in CIDR notation,
+// or single IP addresses, such as "10.0.0.0/8,127.0.0.1"
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s'", s)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,39 @@
+package settings
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks("127.0.0.1, 10.0.0.0/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contains := func(ip string) bool {
+		for _, n := range networks {
+			if n.Contains(net.ParseIP(ip)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "::1"} {
+		if !contains(ip) {
+			t.Errorf("expected %s to be allowed", ip)
+		}
+	}
+	for _, ip := range []string{"127.0.0.2", "11.0.0.1", "::2"} {
+		if contains(ip) {
+			t.Errorf("expected %s to be denied", ip)
+		}
+	}
+	if networks, err := ParseNetworks(""); err != nil || len(networks) != 0 {
+		t.Errorf("expected no networks, got %v (%v)", networks, err)
+	}
+	for _, s := range []string{"localhost", "10.0.0.0/33"} {
+		if _, err := ParseNetworks(s); err == nil {
+			t.Errorf("expected %s to be invalid", s)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package settings
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Profile is a named set of client options, with
+// the same names as the command line flags, plus the
+// server and the remotes, e.g.
+//   {"server": "https://example.com", "remotes": ["3000"],
+//    "auth": "user:pass", "header": ["Foo: Bar"]}
+type Profile map[string]interface{}
+
+// DefaultProfileFile is the PENGUIN_PROFILES environment variable,
+// or else profiles.json in the user config directory
+func DefaultProfileFile() string {
+	if file := Env("PROFILES"); file != "" {
+		return file
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "penguin", "profiles.json")
+}
+
+// LoadProfile reads the named profile from file, which holds
+// an object of profiles by name
+func LoadProfile(file, name string) (Profile, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %s", err)
+	}
+	profiles := map[string]Profile{}
+	if err := json.Unmarshal(b, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %s", file, err)
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile '%s' not found in %s", name, file)
+	}
+	return profile, nil
+}
+
+// Apply sets the flags which were not given on the command line,
+// and completes the positional args, a server and its remotes. A
+// server in args replaces the profile's, and remotes in args
+// replace the profile's remotes.
+func (profile Profile) Apply(flags *flag.FlagSet, args []string) ([]string, error) {
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var server string
+	var remotes []string
+	for name, value := range profile {
+		var values []string
+		switch v := value.(type) {
+		case string:
+			values = []string{v}
+		case bool:
+			values = []string{strconv.FormatBool(v)}
+		case float64:
+			values = []string{strconv.FormatFloat(v, 'f', -1, 64)}
+		case []interface{}:
+			for _, e := range v {
+				s, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("profile option '%s' must be a list of strings", name)
+				}
+				values = append(values, s)
+			}
+		default:
+			return nil, fmt.Errorf("invalid value for profile option '%s'", name)
+		}
+		switch {
+		case name == "server" && len(values) == 1:
+			server = values[0]
+		case name == "remotes":
+			remotes = values
+		case flags.Lookup(name) == nil:
+			return nil, fmt.Errorf("unknown profile option '%s'", name)
+		case given[name]:
+			// the command line takes precedence
+		default:
+			for _, v := range values {
+				if err := flags.Set(name, v); err != nil {
+					return nil, fmt.Errorf("invalid profile option '%s': %s", name, err)
+				}
+			}
+		}
+	}
+	// the command line overrides the server, and then the remotes
+	if len(args) == 0 {
+		args = []string{server}
+	}
+	if len(args) == 1 {
+		args = append(args, remotes...)
+	}
+	return args, nil
+}
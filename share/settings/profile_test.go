@@ -0,0 +1,124 @@
+package settings
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// repeated is a flag which may be given several times
+type repeated []string
+
+func (r *repeated) String() string     { return strings.Join(*r, ",") }
+func (r *repeated) Set(s string) error { *r = append(*r, s); return nil }
+
+type profileFlags struct {
+	*flag.FlagSet
+	auth      *string
+	keepAlive *time.Duration
+	retries   *int
+	verbose   *bool
+	headers   repeated
+}
+
+func newProfileFlags(args ...string) (*profileFlags, []string) {
+	f := &profileFlags{FlagSet: flag.NewFlagSet("client", flag.ContinueOnError)}
+	f.auth = f.String("auth", "", "")
+	f.keepAlive = f.Duration("keepalive", 25*time.Second, "")
+	f.retries = f.Int("max-retry-count", -1, "")
+	f.verbose = f.Bool("v", false, "")
+	f.Var(&f.headers, "header", "")
+	f.Parse(args)
+	return f, f.Args()
+}
+
+func testProfile() Profile {
+	return Profile{
+		"server":          "https://penguin.example.com",
+		"remotes":         []interface{}{"3000", "socks"},
+		"auth":            "user:pass",
+		"keepalive":       "10s",
+		"max-retry-count": float64(3),
+		"v":               true,
+		"header":          []interface{}{"Foo: Bar", "Baz: Qux"},
+	}
+}
+
+func TestProfileApply(t *testing.T) {
+	f, args := newProfileFlags("--auth", "other:pass")
+	args, err := testProfile().Apply(f.FlagSet, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"https://penguin.example.com", "3000", "socks"}; !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+	//the command line takes precedence
+	if *f.auth != "other:pass" {
+		t.Fatalf("expected the auth of the command line, got %s", *f.auth)
+	}
+	if *f.keepAlive != 10*time.Second || *f.retries != 3 || !*f.verbose {
+		t.Fatalf("expected the profile's options, got %s, %d, %v", *f.keepAlive, *f.retries, *f.verbose)
+	}
+	//each element of a list is a repetition of the flag
+	if expected := (repeated{"Foo: Bar", "Baz: Qux"}); !reflect.DeepEqual(f.headers, expected) {
+		t.Fatalf("expected headers %v, got %v", expected, f.headers)
+	}
+}
+
+func TestProfileApplyArgs(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		//a server replaces the profile's
+		{[]string{"https://other.example.com"}, []string{"https://other.example.com", "3000", "socks"}},
+		//and remotes replace the profile's too
+		{[]string{"https://other.example.com", "4000"}, []string{"https://other.example.com", "4000"}},
+	} {
+		f, _ := newProfileFlags()
+		args, err := testProfile().Apply(f.FlagSet, test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, test.expected) {
+			t.Fatalf("expected %v, got %v", test.expected, args)
+		}
+	}
+}
+
+func TestProfileApplyInvalid(t *testing.T) {
+	for _, profile := range []Profile{
+		{"nosuchoption": "1"},
+		{"header": []interface{}{"Foo: Bar", float64(1)}},
+		{"auth": map[string]interface{}{}},
+		{"keepalive": "soon"},
+	} {
+		f, args := newProfileFlags()
+		if _, err := profile.Apply(f.FlagSet, args); err == nil {
+			t.Fatalf("expected %v to be invalid", profile)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "profiles.json")
+	err := ioutil.WriteFile(file, []byte(`{"work": {"server": "https://penguin.example.com", "remotes": ["3000"]}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := LoadProfile(file, "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile["server"] != "https://penguin.example.com" {
+		t.Fatalf("unexpected profile %v", profile)
+	}
+	if _, err := LoadProfile(file, "home"); err == nil {
+		t.Fatal("expected a missing profile to fail")
+	}
+}
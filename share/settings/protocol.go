@@ -0,0 +1,61 @@
+package settings
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//protocolPrefix precedes the number of each protocol version
+const protocolPrefix = "penguin-v"
+
+//protocolNumber parses the number of a protocol version
+func protocolNumber(p string) (int, bool) {
+	if !strings.HasPrefix(p, protocolPrefix) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(p[len(protocolPrefix):])
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+//ProtocolVersions lists the protocol versions from max
+//down to min, or none if either is not a version
+func ProtocolVersions(min, max string) []string {
+	lo, ok1 := protocolNumber(min)
+	hi, ok2 := protocolNumber(max)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	var versions []string
+	for n := hi; n >= lo; n-- {
+		versions = append(versions, protocolPrefix+strconv.Itoa(n))
+	}
+	return versions
+}
+
+//NegotiateProtocol chooses the newest protocol version
+//supported by both the peer, from min to max, and us,
+//from ourMin to ourMax
+func NegotiateProtocol(min, max, ourMin, ourMax string) (string, error) {
+	lo, ok1 := protocolNumber(min)
+	hi, ok2 := protocolNumber(max)
+	if !ok1 || !ok2 {
+		return "", fmt.Errorf("invalid protocol versions '%s' to '%s'", min, max)
+	}
+	ourLo, _ := protocolNumber(ourMin)
+	ourHi, _ := protocolNumber(ourMax)
+	if hi > ourHi {
+		hi = ourHi
+	}
+	if lo < ourLo {
+		lo = ourLo
+	}
+	if hi < lo {
+		return "", fmt.Errorf("protocols '%s' to '%s' are not within the supported '%s' to '%s'",
+			min, max, ourMin, ourMax)
+	}
+	return protocolPrefix + strconv.Itoa(hi), nil
+}
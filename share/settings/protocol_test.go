@@ -0,0 +1,45 @@
+package settings
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProtocolVersions(t *testing.T) {
+	for _, tc := range []struct {
+		min, max string
+		expected []string
+	}{
+		{"penguin-v1", "penguin-v1", []string{"penguin-v1"}},
+		{"penguin-v1", "penguin-v3", []string{"penguin-v3", "penguin-v2", "penguin-v1"}},
+		{"penguin-v2", "penguin-v1", nil},
+		{"graphql-ws", "penguin-v1", nil},
+	} {
+		if got := ProtocolVersions(tc.min, tc.max); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s to %s: expected %v, got %v", tc.min, tc.max, tc.expected, got)
+		}
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		min, max, ourMin, ourMax string
+		expected                 string
+	}{
+		{"penguin-v1", "penguin-v1", "penguin-v1", "penguin-v1", "penguin-v1"},
+		{"penguin-v1", "penguin-v3", "penguin-v1", "penguin-v2", "penguin-v2"},
+		{"penguin-v2", "penguin-v2", "penguin-v1", "penguin-v3", "penguin-v2"},
+		{"penguin-v1", "penguin-v1", "penguin-v2", "penguin-v3", ""},
+		{"penguin-v4", "penguin-v5", "penguin-v2", "penguin-v3", ""},
+		{"penguin-v1", "chisel-v3", "penguin-v1", "penguin-v1", ""},
+	} {
+		got, err := NegotiateProtocol(tc.min, tc.max, tc.ourMin, tc.ourMax)
+		if tc.expected == "" {
+			if err == nil {
+				t.Errorf("%s to %s with %s to %s: expected an error, got %s", tc.min, tc.max, tc.ourMin, tc.ourMax, got)
+			}
+		} else if err != nil || got != tc.expected {
+			t.Errorf("%s to %s with %s to %s: expected %s, got %s (%v)", tc.min, tc.max, tc.ourMin, tc.ourMax, tc.expected, got, err)
+		}
+	}
+}
@@ -2,11 +2,19 @@ package settings
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jpillora/sizestr"
 )
 
 // short-hand conversions (see remote_test)
@@ -25,28 +33,349 @@ import (
 //   127.0.0.1:1080:socks
 //     local  127.0.0.1:1080
 //     remote socks
+//   8080:httpproxy
+//     local  127.0.0.1:8080
+//     remote httpproxy (through socks)
+//   12345:tproxy
+//     local  127.0.0.1:12345
+//     remote tproxy (the original destination, through socks)
 //   stdio:example.com:22
 //     local  stdio
 //     remote example.com:22
 //   1.1.1.1:53/udp
 //     local  127.0.0.1:53/udp
 //     remote 1.1.1.1:53/udp
+//   localhost:postgres ->
+//     local  0.0.0.0:5432
+//     remote localhost:5432
+//   tun:penguin0:penguin1 ->
+//     local  tun penguin0
+//     remote tun penguin1
+//   R:0.0.0.0:1080:socks?auth=user:pass
+//     local  0.0.0.0:1080 (requiring user:pass)
+//     remote socks
+//   3000:example.com:22?rate=1mbps
+//     local  0.0.0.0:3000 (at up to 1mbps each way)
+//     remote example.com:22
+//   R:8080:localhost:80?maxconns=100
+//     local  0.0.0.0:8080 (with up to 100 connections)
+//     remote localhost:80
+//   2222:backup:22?nodelay=false&sndbuf=4MB&rcvbuf=4MB
+//     local  0.0.0.0:2222 (with Nagle and 4MB socket buffers)
+//     remote backup:22
+//   8000-8002:target:8000-8002 (see DecodeRemotes)
+//     local  0.0.0.0:8000, 0.0.0.0:8001, 0.0.0.0:8002
+//     remote target:8000, target:8001, target:8002
+//   unix:/tmp/db.sock:db:5432
+//     local  unix socket /tmp/db.sock
+//     remote db:5432
+//   3306:unix:/var/run/mysqld/mysqld.sock
+//     local  0.0.0.0:3306
+//     remote unix socket /var/run/mysqld/mysqld.sock
+//   2375:npipe:////./pipe/docker_engine
+//     local  0.0.0.0:2375
+//     remote named pipe \\.\pipe\docker_engine (Windows only)
+//   2000:serial:/dev/ttyUSB0?baud=115200
+//     local  0.0.0.0:2000
+//     remote serial device /dev/ttyUSB0 at 115200 baud (Linux only)
+//   R:5000-5002:localhost:6000,6005-6006
+//     local  0.0.0.0:5000, 0.0.0.0:5001, 0.0.0.0:5002
+//     remote localhost:6000, localhost:6005, localhost:6006
+//   8080:web1:80,web2:80?lb=leastconn
+//     local  0.0.0.0:8080
+//     remote web1:80 or web2:80, whichever has fewer connections
 
 type Remote struct {
 	LocalHost, LocalPort, LocalProto    string
 	RemoteHost, RemotePort, RemoteProto string
 	Socks, Reverse, Stdio               bool
+	//HTTPProxy remotes serve an HTTP proxy on the local side,
+	//whose targets are dialed by the SOCKS server of the far end
+	HTTPProxy bool
+	//Transparent remotes accept connections redirected by the
+	//firewall (Linux only), whose original destinations are
+	//dialed by the SOCKS server of the far end
+	Transparent bool
+	//SNI remotes listen on the server, and dial the host named by
+	//the TLS ClientHello of each connection at the client, if it
+	//matches SNIAllow, on RemotePort
+	SNI bool
+	//Tun remotes bridge the TUN device named LocalHost
+	//with the one named RemoteHost at the far end
+	Tun bool
+	//SocksAuth, as <user>:<pass>, requires SOCKS5
+	//username/password authentication on the listener
+	//of a socks remote, instead of the tunnel's own
+	SocksAuth string `json:",omitempty"`
+	//Rate limits the traffic of all the connections of
+	//the remote, in bits per second each way, 0 for none
+	Rate int64 `json:",omitempty"`
+	//MaxConns is the maximum of concurrent
+	//connections of the remote, 0 for any
+	MaxConns int `json:",omitempty"`
+	//Nagle enables Nagle's algorithm on the connections
+	//accepted by the remote, instead of TCP_NODELAY
+	Nagle bool `json:",omitempty"`
+	//SendBuffer and ReceiveBuffer are the socket buffer sizes
+	//of the connections accepted by the remote, 0 for the
+	//defaults of the system
+	SendBuffer    int `json:",omitempty"`
+	ReceiveBuffer int `json:",omitempty"`
+	//Baud is the baud rate of the serial device of
+	//the remote, 0 for its current rate
+	Baud int `json:",omitempty"`
+	//SNIAllow are the hosts which an SNI remote may dial,
+	//each a hostname or a wildcard (*.example.com)
+	SNIAllow []string `json:",omitempty"`
+	//TLS remotes are wrapped in TLS by the far end, once dialed,
+	//verified with the CA bundle of TLSCA on the far end (the
+	//system's if empty) unless TLSInsecure, for TLSServerName
+	//(the remote host if empty). Only reverse remotes, whose far
+	//end is the client, can have a TLSCA.
+	TLS           bool   `json:",omitempty"`
+	TLSCA         string `json:",omitempty"`
+	TLSInsecure   bool   `json:",omitempty"`
+	TLSServerName string `json:",omitempty"`
+	//TerminateTLS remotes accept TLS connections on the server,
+	//with its certificates, and forward their plaintext
+	TerminateTLS bool `json:",omitempty"`
+	//ProxyProtocol remotes send a PROXY protocol (v2) header
+	//with the addresses of each accepted connection to the
+	//remote host, once dialed
+	ProxyProtocol bool `json:",omitempty"`
+	//Targets are the remote hosts (<host>:<port>) of a remote
+	//which has several, the first being RemoteHost:RemotePort,
+	//which each connection dials one of
+	Targets []string `json:",omitempty"`
+	//Balance chooses among the Targets, "roundrobin"
+	//(the default) or "leastconn"
+	Balance string `json:",omitempty"`
+	//Check is the health check of the targets, "tcp" or
+	//"http", made by the far end every CheckInterval (10s if
+	//0), at CheckPath ("/" if empty) for HTTP. Connections
+	//avoid the targets which fail it, and are refused while
+	//all of them do.
+	Check         string        `json:",omitempty"`
+	CheckPath     string        `json:",omitempty"`
+	CheckInterval time.Duration `json:",omitempty"`
+	//DialRetries is the number of times the far end retries
+	//to dial the remote host, with backoff, when it fails
+	//transiently
+	DialRetries int `json:",omitempty"`
+	//IdleTimeout closes the connections of the remote which
+	//carried no data either way for this long, 0 for never
+	IdleTimeout time.Duration `json:",omitempty"`
 }
 
 const revPrefix = "R:"
 
+//remoteParts splits a remote at its colons, but
+//not at those of bracketed IPv6 addresses
+var remoteParts = regexp.MustCompile(`(\[[^\[\]]+\]|[^\[\]:]+):?`)
+
+//portList matches a range (5000-5010) or a set (5000,5002,6000-6010)
+//of ports, optionally followed by their protocol
+var portList = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*(?i:/(tcp|udp))?$`)
+
+//socketRemote matches the remotes with a unix socket or a
+//named pipe on either side, or a serial device, see decodeSocket
+var socketRemote = regexp.MustCompile(`(^|:)(unix:[./@]|npipe:[/\\]|serial:/)`)
+
+//sniPattern matches a hostname, or a wildcard of its subdomains
+var sniPattern = regexp.MustCompile(`^(\*\.)?[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+//extraTarget matches the targets which follow the
+//first one of a remote, see splitTargets
+var extraTarget = regexp.MustCompile(`^(\[[^\[\]]+\]|[^\[\]:]+):([^:]+)$`)
+
+//MaxDialRetries is the most retries of a remote
+const MaxDialRetries = 10
+
+//maxPortRange is the most ports which
+//a single remote may expand into
+const maxPortRange = 1024
+
 func DecodeRemote(s string) (*Remote, error) {
+	options := ""
+	if i := strings.Index(s, "?"); i >= 0 {
+		s, options = s[:i], s[i+1:]
+	}
+	s, targets, err := splitTargets(s)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decodeRemote(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) > 0 {
+		if !r.hasHostTarget() {
+			return nil, errors.New("only TCP remote hosts can have several targets")
+		}
+		r.Targets = append([]string{r.RemoteHost + ":" + r.RemotePort}, targets...)
+	}
+	if err := r.decodeOptions(options); err != nil {
+		return nil, err
+	}
+	if r.SNI && len(r.SNIAllow) == 0 {
+		return nil, errors.New("sni remotes need the hosts they may dial (?allow=...)")
+	}
+	if !r.TLS && (r.TLSCA != "" || r.TLSInsecure || r.TLSServerName != "") {
+		return nil, errors.New("ca, insecure and servername need ?tls")
+	}
+	//the server must not read files at the paths of clients
+	if r.TLSCA != "" && !r.Reverse {
+		return nil, errors.New("ca is only supported by reverse remotes")
+	}
+	if r.Check != "http" && r.CheckPath != "" {
+		return nil, errors.New("checkpath needs ?check=http")
+	}
+	if r.Check == "" && r.CheckInterval != 0 {
+		return nil, errors.New("checkinterval needs ?check")
+	}
+	return r, nil
+}
+
+//DecodeRemotes decodes a remote whose ports may be ranges or sets,
+//e.g. 8000-8010:target:8000-8010, into a remote for each port.
+//The remote ports pair with the local ones in order, unless a
+//single remote port is given for all of them. The whole
+//expansion is validated before any of it is returned.
+func DecodeRemotes(s string) (Remotes, error) {
+	spec, options := s, ""
+	if i := strings.Index(s, "?"); i >= 0 {
+		spec, options = s[:i], s[i:]
+	}
+	prefix := ""
+	if strings.HasPrefix(spec, revPrefix) {
+		spec = strings.TrimPrefix(spec, revPrefix)
+		prefix = revPrefix
+	}
+	var parts []string
+	for _, p := range remoteParts.FindAllStringSubmatch(spec, -1) {
+		parts = append(parts, p[1])
+	}
+	var at []int
+	var lists [][]string
+	for i, p := range parts {
+		if !strings.ContainsAny(p, "-,") || !portList.MatchString(p) {
+			continue
+		}
+		ports, err := expandPorts(p)
+		if err != nil {
+			return nil, err
+		}
+		at = append(at, i)
+		lists = append(lists, ports)
+	}
+	if len(at) == 0 {
+		r, err := DecodeRemote(s)
+		if err != nil {
+			return nil, err
+		}
+		return Remotes{r}, nil
+	}
+	if len(at) > 2 || (len(at) == 2 && len(lists[0]) != len(lists[1])) {
+		return nil, errors.New("the local and remote port ranges must be of the same size")
+	}
+	rs := Remotes{}
+	listening := map[string]bool{}
+	for k := range lists[0] {
+		expanded := append([]string{}, parts...)
+		for j, i := range at {
+			expanded[i] = lists[j][k]
+		}
+		r, err := DecodeRemote(prefix + strings.Join(expanded, ":") + options)
+		if err != nil {
+			return nil, err
+		}
+		if r.Stdio {
+			return nil, errors.New("stdio remotes cannot have port ranges")
+		}
+		local := r.LocalHost + ":" + r.LocalPort + "/" + r.LocalProto
+		if listening[local] {
+			return nil, fmt.Errorf("the remote listens on %s more than once", local)
+		}
+		listening[local] = true
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+//splitTargets splits the targets which follow the first
+//one of a remote, comma-separated, from the remote. The
+//commas of port sets do not separate targets.
+func splitTargets(s string) (string, []string, error) {
+	pieces := strings.Split(s, ",")
+	i := len(pieces)
+	for i > 1 {
+		m := extraTarget.FindStringSubmatch(pieces[i-1])
+		if m == nil || portList.MatchString(m[1]) {
+			break
+		}
+		i--
+	}
+	var targets []string
+	for _, t := range pieces[i:] {
+		m := extraTarget.FindStringSubmatch(t)
+		host, port := m[1], m[2]
+		if !isPort(port) {
+			var err error
+			if port, err = lookupService(port, "tcp"); err != nil {
+				return "", nil, err
+			}
+		}
+		if !isHost(host) {
+			return "", nil, fmt.Errorf("invalid target '%s'", t)
+		}
+		targets = append(targets, host+":"+port)
+	}
+	return strings.Join(pieces[:i], ","), targets, nil
+}
+
+//expandPorts lists the ports of a range or a set
+func expandPorts(s string) ([]string, error) {
+	s, proto := L4Proto(s)
+	if proto != "" {
+		proto = "/" + proto
+	}
+	var ports []string
+	for _, item := range strings.Split(s, ",") {
+		first, last := item, item
+		if i := strings.Index(item, "-"); i >= 0 {
+			first, last = item[:i], item[i+1:]
+		}
+		lo, _ := strconv.Atoi(first)
+		hi, _ := strconv.Atoi(last)
+		if !isPort(first) || !isPort(last) || lo > hi {
+			return nil, fmt.Errorf("invalid port range '%s'", item)
+		}
+		if len(ports)+hi-lo+1 > maxPortRange {
+			return nil, fmt.Errorf("port ranges are limited to %d ports", maxPortRange)
+		}
+		for p := lo; p <= hi; p++ {
+			ports = append(ports, strconv.Itoa(p)+proto)
+		}
+	}
+	return ports, nil
+}
+
+func decodeRemote(s string) (*Remote, error) {
 	reverse := false
 	if strings.HasPrefix(s, revPrefix) {
 		s = strings.TrimPrefix(s, revPrefix)
 		reverse = true
 	}
-	parts := regexp.MustCompile(`(\[[^\[\]]+\]|[^\[\]:]+):?`).FindAllStringSubmatch(s, -1)
+	if s == "tun" || strings.HasPrefix(s, "tun:") {
+		if reverse {
+			return nil, errors.New("tun cannot be reversed")
+		}
+		return decodeTun(s)
+	}
+	if socketRemote.MatchString(s) {
+		return decodeSocket(s, reverse)
+	}
+	parts := remoteParts.FindAllStringSubmatch(s, -1)
 	if len(parts) <= 0 || len(parts) >= 5 {
 		return nil, errors.New("invalid remote")
 	}
@@ -56,11 +385,15 @@ func DecodeRemote(s string) (*Remote, error) {
 	//to provide the defaults)
 	for i := len(parts) - 1; i >= 0; i-- {
 		p := parts[i][1]
-		//remote portion is socks?
-		if i == len(parts)-1 && p == "socks" {
-			r.Socks = true
+		//remote portion is socks or a proxy?
+		if i == len(parts)-1 && (p == "socks" || p == "httpproxy" || p == "tproxy" || p == "sni") {
+			r.Socks = p == "socks"
+			r.HTTPProxy = p == "httpproxy"
+			r.Transparent = p == "tproxy"
+			r.SNI = p == "sni"
 			continue
 		}
+		dynamic := r.Socks || r.HTTPProxy || r.Transparent || r.SNI
 		//local portion is stdio?
 		if i == 0 && p == "stdio" {
 			r.Stdio = true
@@ -74,20 +407,29 @@ func DecodeRemote(s string) (*Remote, error) {
 				r.LocalProto = proto
 			}
 		}
+		if !isPort(p) && isPortIndex(i, len(parts), dynamic) {
+			//this position only accepts ports,
+			//so try it as a service name instead
+			port, err := lookupService(p, r.RemoteProto)
+			if err != nil {
+				return nil, err
+			}
+			p = port
+		}
 		if isPort(p) {
-			if !r.Socks && r.RemotePort == "" {
+			if !dynamic && r.RemotePort == "" {
 				r.RemotePort = p
 			}
 			r.LocalPort = p
 			continue
 		}
-		if !r.Socks && (r.RemotePort == "" && r.LocalPort == "") {
+		if !dynamic && (r.RemotePort == "" && r.LocalPort == "") {
 			return nil, errors.New("missing ports")
 		}
 		if !isHost(p) {
 			return nil, errors.New("invalid host")
 		}
-		if !r.Socks && r.RemoteHost == "" {
+		if !dynamic && r.RemoteHost == "" {
 			r.RemoteHost = p
 		} else {
 			r.LocalHost = p
@@ -102,6 +444,30 @@ func DecodeRemote(s string) (*Remote, error) {
 		if r.LocalPort == "" {
 			r.LocalPort = "1080"
 		}
+	} else if r.HTTPProxy {
+		//http proxy defaults
+		if r.LocalHost == "" {
+			r.LocalHost = "127.0.0.1"
+		}
+		if r.LocalPort == "" {
+			r.LocalPort = "8080"
+		}
+	} else if r.Transparent {
+		if r.LocalHost == "" {
+			r.LocalHost = "127.0.0.1"
+		}
+		if r.LocalPort == "" {
+			return nil, errors.New("transparent proxies need a port")
+		}
+	} else if r.SNI {
+		if r.LocalHost == "" {
+			r.LocalHost = "0.0.0.0"
+		}
+		if r.LocalPort == "" {
+			r.LocalPort = "443"
+		}
+		//dial the same port, unless ?port= says otherwise
+		r.RemotePort = r.LocalPort
 	} else {
 		//non-socks defaults
 		if r.LocalHost == "" {
@@ -126,12 +492,481 @@ func DecodeRemote(s string) (*Remote, error) {
 	if r.Socks && r.RemoteProto != "tcp" {
 		return nil, errors.New("only TCP SOCKS is supported")
 	}
+	if r.HTTPProxy && (r.RemoteProto != "tcp" || r.Stdio) {
+		return nil, errors.New("HTTP proxies must listen on TCP")
+	}
+	if r.Transparent && (r.RemoteProto != "tcp" || r.Stdio || r.Reverse) {
+		return nil, errors.New("transparent proxies must listen on TCP on the client")
+	}
+	if r.SNI && (r.RemoteProto != "tcp" || r.Stdio || !r.Reverse) {
+		return nil, errors.New("sni remotes must listen on TCP on the server")
+	}
 	if r.Stdio && r.Reverse {
 		return nil, errors.New("stdio cannot be reversed")
 	}
 	return r, nil
 }
 
+//decodeTun decodes tun[:<local-device>[:<remote-device>]],
+//the remote device defaulting to the local one
+func decodeTun(s string) (*Remote, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return nil, errors.New("invalid tun remote")
+	}
+	r := &Remote{
+		Tun:         true,
+		LocalHost:   "penguin0",
+		LocalProto:  "tcp",
+		RemoteProto: "tcp",
+	}
+	if len(parts) > 1 {
+		r.LocalHost = parts[1]
+	}
+	r.RemoteHost = r.LocalHost
+	if len(parts) > 2 {
+		r.RemoteHost = parts[2]
+	}
+	for _, name := range []string{r.LocalHost, r.RemoteHost} {
+		if !tunName.MatchString(name) {
+			return nil, fmt.Errorf("invalid tun device name '%s'", name)
+		}
+	}
+	return r, nil
+}
+
+//decodeSocket decodes the remotes with a unix socket (unix:<path>)
+//or a named pipe (npipe:<path>) on either side, or a serial device
+//(serial:<path>) on the remote side:
+//  unix:<local-path>:<remote>  (the local path cannot contain colons)
+//  [<local-host>:]<local-port>:unix:<remote-path>
+//  unix:<local-path>:unix:<remote-path>
+//  stdio:unix:<remote-path>
+func decodeSocket(s string, reverse bool) (*Remote, error) {
+	r := &Remote{Reverse: reverse}
+	local, remote := "", s
+	if proto, path := socketPath(s); proto != "" {
+		if proto == "serial" {
+			return nil, errors.New("serial devices can only be remotes")
+		}
+		i := strings.Index(path, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s needs a remote", describeSocket(proto))
+		}
+		r.LocalHost, r.LocalProto = path[:i], proto
+		remote = path[i+1:]
+	} else {
+		i := socketRemote.FindStringIndex(s)[0]
+		local, remote = s[:i], s[i+1:]
+	}
+	if proto, path := socketPath(remote); proto != "" {
+		r.RemoteHost, r.RemoteProto = path, proto
+	} else {
+		rr, err := decodeRemote(remote)
+		if err != nil {
+			return nil, err
+		}
+		if rr.RemoteProto != "tcp" || rr.Reverse || rr.Stdio || rr.Tun || rr.Transparent || rr.SNI {
+			return nil, fmt.Errorf("%s can only be forwarded to TCP remotes", describeSocket(r.LocalProto))
+		}
+		r.RemoteHost, r.RemotePort, r.RemoteProto = rr.RemoteHost, rr.RemotePort, "tcp"
+		r.Socks, r.HTTPProxy = rr.Socks, rr.HTTPProxy
+	}
+	switch {
+	case r.LocalProto != "":
+	case local == "stdio":
+		if reverse {
+			return nil, errors.New("stdio cannot be reversed")
+		}
+		r.Stdio, r.LocalHost, r.LocalProto = true, "0.0.0.0", "tcp"
+	default:
+		host, port := "0.0.0.0", local
+		if i := strings.LastIndex(local, ":"); i >= 0 {
+			host, port = local[:i], local[i+1:]
+		}
+		if !isPort(port) {
+			var err error
+			if port, err = lookupService(port, "tcp"); err != nil {
+				return nil, err
+			}
+		}
+		if !isHost(host) {
+			return nil, errors.New("invalid host")
+		}
+		r.LocalHost, r.LocalPort, r.LocalProto = host, port, "tcp"
+	}
+	return r, nil
+}
+
+//socketPath splits "unix:<path>", "npipe:<path>" and
+//"serial:<path>" into their protocol and path. As for Docker,
+//the path of a named pipe may follow "npipe://", as in
+//npipe:////./pipe/docker_engine.
+func socketPath(s string) (proto, path string) {
+	for _, proto := range []string{"unix", "npipe", "serial"} {
+		if strings.HasPrefix(s, proto+":") {
+			path = strings.TrimPrefix(s, proto+":")
+			if proto == "npipe" && strings.HasPrefix(path, "////") {
+				path = path[2:]
+			}
+			return proto, path
+		}
+	}
+	return "", s
+}
+
+func describeSocket(proto string) string {
+	if proto == "npipe" {
+		return "named pipes"
+	}
+	return "unix sockets"
+}
+
+//IsSocket reports whether proto is that of a
+//unix socket or a named pipe
+func IsSocket(proto string) bool {
+	return proto == "unix" || proto == "npipe"
+}
+
+//decodeOptions applies the options which follow
+//a remote after a '?', encoded like a URL query
+func (r *Remote) decodeOptions(query string) error {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return fmt.Errorf("invalid options: %s", err)
+	}
+	for key, v := range values {
+		value := v[len(v)-1]
+		switch key {
+		case "auth":
+			if !r.Socks {
+				return errors.New("only socks remotes take credentials")
+			}
+			if user, _ := ParseAuth(value); user == "" {
+				return errors.New("auth must be <user>:<pass>")
+			}
+			r.SocksAuth = value
+		case "rate":
+			if r.Tun {
+				return errors.New("tun remotes cannot be throttled")
+			}
+			if r.Rate, err = ParseRate(value); err != nil {
+				return err
+			}
+		case "maxconns":
+			if r.MaxConns, err = strconv.Atoi(value); err != nil || r.MaxConns <= 0 {
+				return fmt.Errorf("invalid maxconns '%s'", value)
+			}
+			if r.Tun || r.LocalProto == "udp" {
+				return errors.New("only TCP remotes take maxconns")
+			}
+		case "nodelay", "sndbuf", "rcvbuf":
+			if r.Tun || r.Stdio || r.LocalProto != "tcp" {
+				return fmt.Errorf("only TCP listeners take %s", key)
+			}
+			if key == "nodelay" {
+				nodelay, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("invalid nodelay '%s'", value)
+				}
+				r.Nagle = !nodelay
+				continue
+			}
+			size, err := sizestr.Parse(value)
+			if err != nil || size <= 0 || size > math.MaxInt32 {
+				return fmt.Errorf("invalid %s '%s'", key, value)
+			}
+			if key == "sndbuf" {
+				r.SendBuffer = int(size)
+			} else {
+				r.ReceiveBuffer = int(size)
+			}
+		case "baud":
+			if r.RemoteProto != "serial" {
+				return errors.New("only serial devices take a baud rate")
+			}
+			if r.Baud, err = strconv.Atoi(value); err != nil || r.Baud <= 0 {
+				return fmt.Errorf("invalid baud rate '%s'", value)
+			}
+		case "allow":
+			if !r.SNI {
+				return errors.New("only sni remotes take allowed hosts")
+			}
+			r.SNIAllow = nil
+			for _, host := range strings.Split(value, ",") {
+				if !sniPattern.MatchString(host) {
+					return fmt.Errorf("invalid allowed host '%s'", host)
+				}
+				r.SNIAllow = append(r.SNIAllow, strings.ToLower(host))
+			}
+		case "port":
+			if !r.SNI {
+				return errors.New("only sni remotes take a port")
+			}
+			if !isPort(value) {
+				return fmt.Errorf("invalid port '%s'", value)
+			}
+			r.RemotePort = value
+		case "terminate":
+			if r.TerminateTLS, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid terminate '%s'", value)
+			}
+			if !r.Reverse || r.Stdio || r.LocalProto != "tcp" || r.SNI || r.Transparent {
+				return errors.New("only reverse TCP listeners can terminate TLS")
+			}
+		case "tls", "insecure":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s'", key, value)
+			}
+			if key == "insecure" {
+				r.TLSInsecure = enabled
+				continue
+			}
+			if r.RemoteProto != "tcp" || r.Socks || r.HTTPProxy || r.Transparent || r.SNI || r.Tun {
+				return errors.New("only TCP remote hosts can be dialed with TLS")
+			}
+			r.TLS = enabled
+		case "lb":
+			if len(r.Targets) == 0 {
+				return errors.New("only remotes with several targets take lb")
+			}
+			if value != "roundrobin" && value != "leastconn" {
+				return fmt.Errorf("unknown load balancing '%s'", value)
+			}
+			r.Balance = value
+		case "check":
+			if value != "tcp" && value != "http" {
+				return fmt.Errorf("unknown check '%s'", value)
+			}
+			if !r.hasHostTarget() || r.Stdio {
+				return errors.New("only TCP listeners to TCP remote hosts take checks")
+			}
+			r.Check = value
+		case "checkpath":
+			if !strings.HasPrefix(value, "/") {
+				return fmt.Errorf("invalid checkpath '%s'", value)
+			}
+			r.CheckPath = value
+		case "checkinterval":
+			if r.CheckInterval, err = time.ParseDuration(value); err != nil || r.CheckInterval < time.Second {
+				return fmt.Errorf("invalid checkinterval '%s'", value)
+			}
+		case "idle":
+			if r.IdleTimeout, err = time.ParseDuration(value); err != nil || r.IdleTimeout < time.Second {
+				return fmt.Errorf("invalid idle '%s'", value)
+			}
+			if r.Tun || r.Stdio || r.LocalProto == "udp" {
+				return errors.New("only the connections of TCP listeners take idle")
+			}
+		case "retries":
+			if r.DialRetries, err = strconv.Atoi(value); err != nil || r.DialRetries < 0 || r.DialRetries > MaxDialRetries {
+				return fmt.Errorf("invalid retries '%s', at most %d", value, MaxDialRetries)
+			}
+			if !r.hasHostTarget() {
+				return errors.New("only TCP remote hosts take retries")
+			}
+		case "proxyproto":
+			if r.ProxyProtocol, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid proxyproto '%s'", value)
+			}
+			if r.RemoteProto != "tcp" || r.Socks || r.HTTPProxy || r.Transparent || r.Tun || r.Stdio {
+				return errors.New("only TCP listeners to TCP remote hosts take proxyproto")
+			}
+		case "ca":
+			r.TLSCA = value
+		case "servername":
+			if strings.HasPrefix(value, "*.") || !sniPattern.MatchString(value) && net.ParseIP(value) == nil {
+				return fmt.Errorf("invalid servername '%s'", value)
+			}
+			r.TLSServerName = value
+		default:
+			return fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+	return nil
+}
+
+//options encodes the options of the remote, if any
+func (r Remote) options() string {
+	v := url.Values{}
+	if r.SocksAuth != "" {
+		v.Set("auth", r.SocksAuth)
+	}
+	if r.Rate > 0 {
+		v.Set("rate", FormatRate(r.Rate))
+	}
+	if r.MaxConns > 0 {
+		v.Set("maxconns", strconv.Itoa(r.MaxConns))
+	}
+	if r.Nagle {
+		v.Set("nodelay", "false")
+	}
+	if r.SendBuffer > 0 {
+		v.Set("sndbuf", strconv.Itoa(r.SendBuffer))
+	}
+	if r.ReceiveBuffer > 0 {
+		v.Set("rcvbuf", strconv.Itoa(r.ReceiveBuffer))
+	}
+	if r.Baud > 0 {
+		v.Set("baud", strconv.Itoa(r.Baud))
+	}
+	if len(r.SNIAllow) > 0 {
+		v.Set("allow", strings.Join(r.SNIAllow, ","))
+	}
+	if r.SNI && r.RemotePort != r.LocalPort {
+		v.Set("port", r.RemotePort)
+	}
+	r.setTLSOptions(v)
+	if r.TerminateTLS {
+		v.Set("terminate", "true")
+	}
+	if r.ProxyProtocol {
+		v.Set("proxyproto", "true")
+	}
+	if r.Balance != "" {
+		v.Set("lb", r.Balance)
+	}
+	if r.Check != "" {
+		v.Set("check", r.Check)
+	}
+	if r.CheckPath != "" {
+		v.Set("checkpath", r.CheckPath)
+	}
+	if r.CheckInterval != 0 {
+		v.Set("checkinterval", r.CheckInterval.String())
+	}
+	if r.DialRetries > 0 {
+		v.Set("retries", strconv.Itoa(r.DialRetries))
+	}
+	if r.IdleTimeout > 0 {
+		v.Set("idle", r.IdleTimeout.String())
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return "?" + v.Encode()
+}
+
+//setTLSOptions sets the options of TLS origination in v
+func (r Remote) setTLSOptions(v url.Values) {
+	if !r.TLS {
+		return
+	}
+	v.Set("tls", "true")
+	if r.TLSCA != "" {
+		v.Set("ca", r.TLSCA)
+	}
+	if r.TLSInsecure {
+		v.Set("insecure", "true")
+	}
+	if r.TLSServerName != "" {
+		v.Set("servername", r.TLSServerName)
+	}
+}
+
+//Target is the remote portion which the far end dials,
+//followed by the options which it applies when dialing
+func (r Remote) Target() string {
+	v := url.Values{}
+	if r.Baud > 0 {
+		v.Set("baud", strconv.Itoa(r.Baud))
+	}
+	r.setTLSOptions(v)
+	if r.DialRetries > 0 {
+		v.Set("retries", strconv.Itoa(r.DialRetries))
+	}
+	if len(v) == 0 {
+		return r.Remote()
+	}
+	return r.Remote() + "?" + v.Encode()
+}
+
+//hasHostTarget reports whether the remote
+//dials a TCP host, rather than a proxy
+func (r Remote) hasHostTarget() bool {
+	return r.RemoteProto == "tcp" && r.RemotePort != "" && !r.Tun && !r.SNI
+}
+
+//ForTarget is the remote dialing
+//only the i-th of its Targets
+func (r Remote) ForTarget(i int) Remote {
+	t := r.Targets[i]
+	j := strings.LastIndex(t, ":")
+	r.RemoteHost, r.RemotePort = t[:j], t[j+1:]
+	r.Targets, r.Balance = nil, ""
+	r.Check, r.CheckPath, r.CheckInterval = "", "", 0
+	return r
+}
+
+//CheckTarget is the Target of the health check of the i-th of
+//the Targets, or of the remote host when there are none
+func (r Remote) CheckTarget(i int) string {
+	c := r
+	if len(r.Targets) > 0 {
+		c = r.ForTarget(i)
+	}
+	v := url.Values{}
+	c.setTLSOptions(v)
+	if r.ProxyProtocol {
+		//with no addresses
+		v.Set("proxyproto", "")
+	}
+	v.Set("check", r.Check)
+	if r.CheckPath != "" {
+		v.Set("checkpath", r.CheckPath)
+	}
+	return c.Remote() + "?" + v.Encode()
+}
+
+//HasOptions reports whether the remote has options,
+//which peers older than them ignore
+func (r Remote) HasOptions() bool {
+	return r.options() != ""
+}
+
+//rateUnits are the units of rates, in bits per second
+var rateUnits = []struct {
+	suffix string
+	bits   int64
+}{
+	{"gbps", 1000 * 1000 * 1000},
+	{"mbps", 1000 * 1000},
+	{"kbps", 1000},
+	{"bps", 1},
+}
+
+//ParseRate parses a rate in bits per second, such
+//as 1mbps or 1.5gbps (with units of 1000)
+func ParseRate(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	for _, u := range rateUnits {
+		if !strings.HasSuffix(lower, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(lower, u.suffix), 64)
+		if err != nil || n*float64(u.bits) < 1 {
+			break
+		}
+		return int64(n * float64(u.bits)), nil
+	}
+	return 0, fmt.Errorf("invalid rate '%s', expected e.g. 1mbps", s)
+}
+
+//FormatRate formats a rate in bits per
+//second in the largest exact unit
+func FormatRate(bits int64) string {
+	for _, u := range rateUnits {
+		if bits%u.bits == 0 {
+			return strconv.FormatInt(bits/u.bits, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(bits, 10) + "bps"
+}
+
+//tunName matches the interface names of Linux (IFNAMSIZ)
+var tunName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
 func isPort(s string) bool {
 	n, err := strconv.Atoi(s)
 	if err != nil {
@@ -143,6 +978,41 @@ func isPort(s string) bool {
 	return true
 }
 
+//isPortIndex reports whether the i-th of n remote parts
+//can only be a port. Other positions are ambiguous
+//between hosts and ports, so service names are not
+//looked up there.
+func isPortIndex(i, n int, socks bool) bool {
+	if socks {
+		//<local-host>:<local-port>:socks
+		return n == 3 && i == 1
+	}
+	//<remote-port> or <local-host>:<local-port>:...
+	return i == n-1 || (n == 4 && i == 1)
+}
+
+//lookupService resolves a service name (e.g. https)
+//into a port using the system's services database
+func lookupService(name, proto string) (string, error) {
+	if proto == "" {
+		proto = "tcp"
+	}
+	if name == "" || !isServiceName(name) {
+		return "", fmt.Errorf("invalid port or service name '%s'", name)
+	}
+	n, err := net.LookupPort(proto, name)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("unknown %s service '%s'", proto, name)
+	}
+	return strconv.Itoa(n), nil
+}
+
+var serviceName = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+func isServiceName(s string) bool {
+	return serviceName.MatchString(s)
+}
+
 func isHost(s string) bool {
 	_, err := url.Parse("//" + s)
 	if err != nil {
@@ -187,10 +1057,13 @@ func (r Remote) Encode() string {
 	if r.RemoteProto == "udp" {
 		remote += "/udp"
 	}
+	if r.Tun {
+		return "tun:" + r.LocalHost + ":" + r.RemoteHost
+	}
 	if r.Reverse {
-		return "R:" + local + ":" + remote
+		return "R:" + local + ":" + remote + r.options()
 	}
-	return local + ":" + remote
+	return local + ":" + remote + r.options()
 }
 
 //Local is the decodable local portion
@@ -198,6 +1071,12 @@ func (r Remote) Local() string {
 	if r.Stdio {
 		return "stdio"
 	}
+	if r.Tun {
+		return "tun:" + r.LocalHost
+	}
+	if IsSocket(r.LocalProto) {
+		return r.LocalProto + ":" + r.LocalHost
+	}
 	if r.LocalHost == "" {
 		r.LocalHost = "0.0.0.0"
 	}
@@ -209,6 +1088,24 @@ func (r Remote) Remote() string {
 	if r.Socks {
 		return "socks"
 	}
+	if r.HTTPProxy {
+		return "httpproxy"
+	}
+	if r.Transparent {
+		return "tproxy"
+	}
+	if r.SNI {
+		return "sni"
+	}
+	if r.Tun {
+		return "tun:" + r.RemoteHost
+	}
+	if len(r.Targets) > 0 {
+		return strings.Join(r.Targets, ",")
+	}
+	if IsSocket(r.RemoteProto) || r.RemoteProto == "serial" {
+		return r.RemoteProto + ":" + r.RemoteHost
+	}
 	if r.RemoteHost == "" {
 		r.RemoteHost = "127.0.0.1"
 	}
@@ -219,11 +1116,34 @@ func (r Remote) Remote() string {
 //user has access to a given remote
 func (r Remote) UserAddr() string {
 	if r.Reverse {
+		if IsSocket(r.LocalProto) {
+			return "R:" + r.Local()
+		}
 		return "R:" + r.LocalHost + ":" + r.LocalPort
 	}
+	if r.Tun || IsSocket(r.RemoteProto) || r.RemoteProto == "serial" {
+		return r.Remote()
+	}
 	return r.RemoteHost + ":" + r.RemotePort
 }
 
+//AllowsSNI checks if an SNI remote may dial host. A wildcard
+//(*.example.com) allows the subdomains of any depth, but
+//not the domain itself.
+func (r Remote) AllowsSNI(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range r.SNIAllow {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1 {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
 //CanListen checks if the port can be listened on
 func (r Remote) CanListen() bool {
 	//valid protocols
@@ -235,6 +1155,19 @@ func (r Remote) CanListen() bool {
 			return true
 		}
 		return false
+	case "unix":
+		//stale sockets are replaced, live ones are not
+		if fi, err := os.Lstat(r.LocalHost); err == nil && fi.Mode()&os.ModeSocket == 0 {
+			return false
+		}
+		if conn, err := net.Dial("unix", r.LocalHost); err == nil {
+			conn.Close()
+			return false
+		}
+		_, err := os.Stat(filepath.Dir(r.LocalHost))
+		return err == nil
+	case "npipe":
+		return runtime.GOOS == "windows"
 	case "udp":
 		addr, err := net.ResolveUDPAddr("udp", r.Local())
 		if err != nil {
@@ -3,6 +3,7 @@ package settings
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestRemoteDecode(t *testing.T) {
@@ -67,6 +68,75 @@ func TestRemoteDecode(t *testing.T) {
 			},
 			"127.0.0.1:1081:socks",
 		},
+		{
+			"8081:httpproxy",
+			Remote{
+				LocalHost: "127.0.0.1",
+				LocalPort: "8081",
+				HTTPProxy: true,
+			},
+			"127.0.0.1:8081:httpproxy",
+		},
+		{
+			"R:httpproxy",
+			Remote{
+				LocalHost: "127.0.0.1",
+				LocalPort: "8080",
+				HTTPProxy: true,
+				Reverse:   true,
+			},
+			"R:127.0.0.1:8080:httpproxy",
+		},
+		{
+			"0.0.0.0:12345:tproxy",
+			Remote{
+				LocalHost:   "0.0.0.0",
+				LocalPort:   "12345",
+				Transparent: true,
+			},
+			"0.0.0.0:12345:tproxy",
+		},
+		{
+			"R:sni?allow=*.example.com,Example.com",
+			Remote{
+				LocalPort:  "443",
+				RemotePort: "443",
+				SNI:        true,
+				Reverse:    true,
+				SNIAllow:   []string{"*.example.com", "example.com"},
+			},
+			"R:0.0.0.0:443:sni?allow=%2A.example.com%2Cexample.com",
+		},
+		{
+			"R:127.0.0.1:8443:sni?allow=git.internal&port=443",
+			Remote{
+				LocalHost:  "127.0.0.1",
+				LocalPort:  "8443",
+				RemotePort: "443",
+				SNI:        true,
+				Reverse:    true,
+				SNIAllow:   []string{"git.internal"},
+			},
+			"R:127.0.0.1:8443:sni?allow=git.internal&port=443",
+		},
+		{
+			"tun:tun3",
+			Remote{
+				LocalHost:  "tun3",
+				RemoteHost: "tun3",
+				Tun:        true,
+			},
+			"tun:tun3:tun3",
+		},
+		{
+			"tun:penguin0:penguin1",
+			Remote{
+				LocalHost:  "penguin0",
+				RemoteHost: "penguin1",
+				Tun:        true,
+			},
+			"tun:penguin0:penguin1",
+		},
 		{
 			"1.1.1.1:53/udp",
 			Remote{
@@ -111,6 +181,233 @@ func TestRemoteDecode(t *testing.T) {
 			},
 			"R:[::]:3000:[::1]:3000",
 		},
+		{
+			"localhost:https",
+			Remote{
+				LocalPort:  "443",
+				RemoteHost: "localhost",
+				RemotePort: "443",
+			},
+			"0.0.0.0:443:localhost:443",
+		},
+		{
+			"127.0.0.1:ssh:example.com:https",
+			Remote{
+				LocalHost:  "127.0.0.1",
+				LocalPort:  "22",
+				RemoteHost: "example.com",
+				RemotePort: "443",
+			},
+			"127.0.0.1:22:example.com:443",
+		},
+		{
+			"1.1.1.1:domain/udp",
+			Remote{
+				LocalPort:   "53",
+				LocalProto:  "udp",
+				RemoteHost:  "1.1.1.1",
+				RemotePort:  "53",
+				RemoteProto: "udp",
+			},
+			"0.0.0.0:53:1.1.1.1:53/udp",
+		},
+		{
+			"R:0.0.0.0:1080:socks?auth=user:pa%3Fss",
+			Remote{
+				LocalHost: "0.0.0.0",
+				LocalPort: "1080",
+				Socks:     true,
+				Reverse:   true,
+				SocksAuth: "user:pa?ss",
+			},
+			"R:0.0.0.0:1080:socks?auth=user%3Apa%3Fss",
+		},
+		{
+			"3000:example.com:22?rate=1.5Mbps",
+			Remote{
+				LocalPort:  "3000",
+				RemoteHost: "example.com",
+				RemotePort: "22",
+				Rate:       1500000,
+			},
+			"0.0.0.0:3000:example.com:22?rate=1500kbps",
+		},
+		{
+			"R:8080:localhost:80?maxconns=100&rate=8kbps",
+			Remote{
+				LocalPort:  "8080",
+				RemoteHost: "localhost",
+				RemotePort: "80",
+				Reverse:    true,
+				Rate:       8000,
+				MaxConns:   100,
+			},
+			"R:0.0.0.0:8080:localhost:80?maxconns=100&rate=8kbps",
+		},
+		{
+			"2222:backup:22?nodelay=false&sndbuf=4MB&rcvbuf=65536",
+			Remote{
+				LocalPort:     "2222",
+				RemoteHost:    "backup",
+				RemotePort:    "22",
+				Nagle:         true,
+				SendBuffer:    4000000,
+				ReceiveBuffer: 65536,
+			},
+			"0.0.0.0:2222:backup:22?nodelay=false&rcvbuf=65536&sndbuf=4000000",
+		},
+		{
+			"unix:/tmp/db.sock:db:5432",
+			Remote{
+				LocalHost:  "/tmp/db.sock",
+				LocalProto: "unix",
+				RemoteHost: "db",
+				RemotePort: "5432",
+			},
+			"unix:/tmp/db.sock:db:5432",
+		},
+		{
+			"R:127.0.0.1:3306:unix:/var/run/mysqld/mysqld.sock",
+			Remote{
+				LocalHost:   "127.0.0.1",
+				LocalPort:   "3306",
+				RemoteHost:  "/var/run/mysqld/mysqld.sock",
+				RemoteProto: "unix",
+				Reverse:     true,
+			},
+			"R:127.0.0.1:3306:unix:/var/run/mysqld/mysqld.sock",
+		},
+		{
+			"unix:./socks.sock:socks",
+			Remote{
+				LocalHost:  "./socks.sock",
+				LocalProto: "unix",
+				Socks:      true,
+			},
+			"unix:./socks.sock:socks",
+		},
+		{
+			"stdio:unix:/var/run/docker.sock",
+			Remote{
+				LocalHost:   "0.0.0.0",
+				Stdio:       true,
+				RemoteHost:  "/var/run/docker.sock",
+				RemoteProto: "unix",
+			},
+			"stdio:unix:/var/run/docker.sock",
+		},
+		{
+			"2375:npipe:////./pipe/docker_engine",
+			Remote{
+				LocalPort:   "2375",
+				RemoteHost:  "//./pipe/docker_engine",
+				RemoteProto: "npipe",
+			},
+			"0.0.0.0:2375:npipe://./pipe/docker_engine",
+		},
+		{
+			`R:npipe:\\.\pipe\penguin:localhost:80`,
+			Remote{
+				LocalHost:  `\\.\pipe\penguin`,
+				LocalProto: "npipe",
+				RemoteHost: "localhost",
+				RemotePort: "80",
+				Reverse:    true,
+			},
+			`R:npipe:\\.\pipe\penguin:localhost:80`,
+		},
+		{
+			"2000:serial:/dev/ttyUSB0?baud=115200",
+			Remote{
+				LocalPort:   "2000",
+				RemoteHost:  "/dev/ttyUSB0",
+				RemoteProto: "serial",
+				Baud:        115200,
+			},
+			"0.0.0.0:2000:serial:/dev/ttyUSB0?baud=115200",
+		},
+		{
+			"R:5432:db:5432?tls=true&ca=/etc/ssl/db.pem&servername=db.example.com",
+			Remote{
+				LocalPort:     "5432",
+				RemoteHost:    "db",
+				RemotePort:    "5432",
+				Reverse:       true,
+				TLS:           true,
+				TLSCA:         "/etc/ssl/db.pem",
+				TLSServerName: "db.example.com",
+			},
+			"R:0.0.0.0:5432:db:5432?ca=%2Fetc%2Fssl%2Fdb.pem&servername=db.example.com&tls=true",
+		},
+		{
+			"R:8443:10.0.0.5:443?insecure=1&tls=1",
+			Remote{
+				LocalPort:   "8443",
+				RemoteHost:  "10.0.0.5",
+				RemotePort:  "443",
+				Reverse:     true,
+				TLS:         true,
+				TLSInsecure: true,
+			},
+			"R:0.0.0.0:8443:10.0.0.5:443?insecure=true&tls=true",
+		},
+		{
+			"R:443:localhost:8080?terminate=true",
+			Remote{
+				LocalPort:    "443",
+				RemoteHost:   "localhost",
+				RemotePort:   "8080",
+				Reverse:      true,
+				TerminateTLS: true,
+			},
+			"R:0.0.0.0:443:localhost:8080?terminate=true",
+		},
+		{
+			"R:25:localhost:2525?proxyproto=true",
+			Remote{
+				LocalPort:     "25",
+				RemoteHost:    "localhost",
+				RemotePort:    "2525",
+				Reverse:       true,
+				ProxyProtocol: true,
+			},
+			"R:0.0.0.0:25:localhost:2525?proxyproto=true",
+		},
+		{
+			"8080:web1:80,web2:http,[::1]:8080?lb=leastconn",
+			Remote{
+				LocalPort:  "8080",
+				RemoteHost: "web1",
+				RemotePort: "80",
+				Targets:    []string{"web1:80", "web2:80", "[::1]:8080"},
+				Balance:    "leastconn",
+			},
+			"0.0.0.0:8080:web1:80,web2:80,[::1]:8080?lb=leastconn",
+		},
+		{
+			"8080:web1:80,web2:80?check=http&checkpath=/healthz&checkinterval=30s",
+			Remote{
+				LocalPort:     "8080",
+				RemoteHost:    "web1",
+				RemotePort:    "80",
+				Targets:       []string{"web1:80", "web2:80"},
+				Check:         "http",
+				CheckPath:     "/healthz",
+				CheckInterval: 30 * time.Second,
+			},
+			"0.0.0.0:8080:web1:80,web2:80?check=http&checkinterval=30s&checkpath=%2Fhealthz",
+		},
+		{
+			"R:5432:db:5432?idle=30m",
+			Remote{
+				LocalPort:   "5432",
+				RemoteHost:  "db",
+				RemotePort:  "5432",
+				Reverse:     true,
+				IdleTimeout: 30 * time.Minute,
+			},
+			"R:0.0.0.0:5432:db:5432?idle=30m0s",
+		},
 	} {
 		//expected defaults
 		expected := test.Output
@@ -136,3 +433,219 @@ func TestRemoteDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoteDecodeServiceError(t *testing.T) {
+	for _, input := range []string{
+		"localhost:no-such-service",
+		"3000:google.com",
+		"R:2222:localhost:ssh_",
+		"3000:localhost:22?auth=user:pass",
+		"socks?auth=nopass",
+		"socks?nosuchoption=1",
+		"3000?rate=fast",
+		"tun?rate=1mbps",
+		"3000?maxconns=0",
+		"53/udp?maxconns=10",
+		"3000?nodelay=maybe",
+		"3000?sndbuf=0",
+		"stdio:example.com:22?rcvbuf=1MB",
+		"unix:/tmp/dns.sock:1.1.1.1:53/udp",
+		"unix:/tmp/a.sock",
+		"3000:unix:",
+		"unix:/tmp/a.sock:localhost:80?nodelay=false",
+		"serial:/dev/ttyS0:localhost:80",
+		"3000:localhost:80?baud=9600",
+		"2000:serial:/dev/ttyUSB0?baud=fast",
+		"R:443:sni",
+		"443:sni?allow=example.com",
+		"R:443:sni?allow=example.com:443",
+		"R:443:sni?allow=*",
+		"R:443:localhost:443?allow=example.com",
+		"R:443:sni?allow=example.com&port=https",
+		"3000:localhost:80?tls=yes",
+		"3000:localhost:80?insecure=true",
+		"socks?tls=true",
+		"53:1.1.1.1:853/udp?tls=true",
+		"3000:localhost:80?tls=true&servername=*.example.com",
+		"3000:localhost:80?tls=true&ca=/etc/ssl/ca.pem",
+		"443:localhost:8080?terminate=true",
+		"R:443:sni?allow=example.com&terminate=true",
+		"socks?proxyproto=true",
+		"stdio:localhost:22?proxyproto=true",
+		"53:1.1.1.1:53/udp?proxyproto=true",
+		"3000:localhost:80?lb=roundrobin",
+		"3000:web1:80,web2:80?lb=random",
+		"53:1.1.1.1:53/udp,8.8.8.8:53",
+		"socks,web2:80",
+		"3000:web1:80,web2:nosuchservice",
+		"3000:localhost:80?check=icmp",
+		"socks?check=tcp",
+		"stdio:localhost:22?check=tcp",
+		"3000:localhost:80?check=tcp&checkpath=/",
+		"3000:localhost:80?checkinterval=10s",
+		"3000:localhost:80?check=tcp&checkinterval=10ms",
+		"3000:localhost:80?retries=11",
+		"3000:localhost:80?retries=-1",
+		"socks?retries=3",
+		"3000:localhost:80?idle=500ms",
+		"53:1.1.1.1:53/udp?idle=1m",
+		"stdio:localhost:22?idle=1m",
+	} {
+		if _, err := DecodeRemote(input); err == nil {
+			t.Fatalf("decode '%s' expected to fail", input)
+		}
+	}
+}
+
+func TestRemoteDecodeRanges(t *testing.T) {
+	for _, test := range []struct {
+		Input   string
+		Encoded []string
+	}{
+		{
+			"R:5000-5002:localhost:6000-6002",
+			[]string{
+				"R:0.0.0.0:5000:localhost:6000",
+				"R:0.0.0.0:5001:localhost:6001",
+				"R:0.0.0.0:5002:localhost:6002",
+			},
+		},
+		{
+			"R:127.0.0.1:8080,8443:localhost:80,443?maxconns=10",
+			[]string{
+				"R:127.0.0.1:8080:localhost:80?maxconns=10",
+				"R:127.0.0.1:8443:localhost:443?maxconns=10",
+			},
+		},
+		{
+			"R:53,5353/udp",
+			[]string{
+				"R:0.0.0.0:53:127.0.0.1:53/udp",
+				"R:0.0.0.0:5353:127.0.0.1:5353/udp",
+			},
+		},
+		{
+			"8000-8002:target:8000-8002",
+			[]string{
+				"0.0.0.0:8000:target:8000",
+				"0.0.0.0:8001:target:8001",
+				"0.0.0.0:8002:target:8002",
+			},
+		},
+		{
+			"127.0.0.1:1080-1081:socks",
+			[]string{
+				"127.0.0.1:1080:socks",
+				"127.0.0.1:1081:socks",
+			},
+		},
+		{
+			"R:[::1]:2222:localhost:22",
+			[]string{"R:[::1]:2222:localhost:22"},
+		},
+	} {
+		rs, err := DecodeRemotes(test.Input)
+		if err != nil {
+			t.Fatalf("decode '%s' failed: %s", test.Input, err)
+		}
+		var encoded []string
+		for _, r := range rs {
+			encoded = append(encoded, r.Encode())
+		}
+		if !reflect.DeepEqual(encoded, test.Encoded) {
+			t.Fatalf("decode '%s' expected\n  %v\ngot\n  %v", test.Input, test.Encoded, encoded)
+		}
+	}
+	for _, input := range []string{
+		"R:5000-5010:localhost:6000-6005",
+		"R:5010-5000:localhost:22",
+		"R:5000-5001:localhost:22-23:24",
+		"R:5000-70000:localhost:5000-70000",
+		"R:1-2000:localhost:1-2000",
+		"R:3000:localhost:5000-5001",
+		"stdio:localhost:22-23",
+	} {
+		if _, err := DecodeRemotes(input); err == nil {
+			t.Fatalf("decode '%s' expected to fail", input)
+		}
+	}
+}
+
+func TestRemoteForTarget(t *testing.T) {
+	r, err := DecodeRemote("R:8080:web1:80,[::1]:8080?lb=leastconn&rate=1mbps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := r.ForTarget(1).Encode(); e != "R:0.0.0.0:8080:[::1]:8080?rate=1mbps" {
+		t.Fatalf("expected the second target alone, got %s", e)
+	}
+}
+
+func TestRemoteCheckTarget(t *testing.T) {
+	r, err := DecodeRemote("8080:web1:80,web2:443?check=http&tls=true&proxyproto=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := r.CheckTarget(1); c != "web2:443?check=http&proxyproto=&tls=true" {
+		t.Fatalf("unexpected check target %s", c)
+	}
+}
+
+func TestRemoteTarget(t *testing.T) {
+	r, err := DecodeRemote("R:8080:localhost:80?retries=3&rate=1mbps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DialRetries != 3 {
+		t.Fatalf("expected 3 retries, got %d", r.DialRetries)
+	}
+	//only the options of the far end
+	if target := r.Target(); target != "localhost:80?retries=3" {
+		t.Fatalf("unexpected target %s", target)
+	}
+}
+
+func TestRemoteAllowsSNI(t *testing.T) {
+	r, err := DecodeRemote("R:sni?allow=*.example.com,git.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, allowed := range map[string]bool{
+		"www.example.com":    true,
+		"a.b.example.com":    true,
+		"WWW.Example.COM.":   true,
+		"example.com":        false,
+		"www.example.com.au": false,
+		"badexample.com":     false,
+		"git.internal":       true,
+		"www.git.internal":   false,
+		"":                   false,
+	} {
+		if r.AllowsSNI(host) != allowed {
+			t.Fatalf("'%s' expected allowed=%v", host, allowed)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		bits  int64
+	}{
+		{"1mbps", 1000000},
+		{"2.5kbps", 2500},
+		{"1Gbps", 1000000000},
+		{"800bps", 800},
+		{"1mb", 0},
+		{"0kbps", 0},
+		{"-1mbps", 0},
+	} {
+		bits, err := ParseRate(test.input)
+		if test.bits == 0 && err == nil {
+			t.Fatalf("expected '%s' to be invalid", test.input)
+		}
+		if test.bits != 0 && (err != nil || bits != test.bits) {
+			t.Fatalf("expected '%s' to be %d, got %d (%v)", test.input, test.bits, bits, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package settings
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//SSHAlgorithms restricts the algorithms of the SSH connections,
+//each list in order of preference. An empty list keeps the
+//defaults of golang.org/x/crypto/ssh.
+type SSHAlgorithms struct {
+	Ciphers      []string
+	KeyExchanges []string
+	MACs         []string
+}
+
+//the algorithms which golang.org/x/crypto/ssh supports on
+//both ends (the group exchanges are client-only)
+var (
+	sshCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc",
+		"arcfour256", "arcfour128", "arcfour",
+	}
+	sshKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	sshMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+//Apply checks that the algorithms are supported,
+//and restricts the configuration c to them
+func (a SSHAlgorithms) Apply(c *ssh.Config) error {
+	for _, list := range []struct {
+		kind      string
+		names     []string
+		supported []string
+	}{
+		{"cipher", a.Ciphers, sshCiphers},
+		{"key exchange", a.KeyExchanges, sshKeyExchanges},
+		{"MAC", a.MACs, sshMACs},
+	} {
+	names:
+		for _, name := range list.names {
+			for _, s := range list.supported {
+				if name == s {
+					continue names
+				}
+			}
+			return fmt.Errorf("unsupported SSH %s '%s'", list.kind, name)
+		}
+	}
+	c.Ciphers = a.Ciphers
+	c.KeyExchanges = a.KeyExchanges
+	c.MACs = a.MACs
+	return nil
+}
@@ -0,0 +1,27 @@
+package settings
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHAlgorithms(t *testing.T) {
+	var c ssh.Config
+	a := SSHAlgorithms{Ciphers: []string{"aes256-gcm@openssh.com"}}
+	if err := a.Apply(&c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Ciphers) != 1 || c.KeyExchanges != nil || c.MACs != nil {
+		t.Fatalf("unexpected config %+v", c)
+	}
+	for _, a := range []SSHAlgorithms{
+		{Ciphers: []string{"aes256-gcm"}},
+		{KeyExchanges: []string{"diffie-hellman-group-exchange-sha256"}},
+		{MACs: []string{"aes128-ctr"}},
+	} {
+		if err := a.Apply(&c); err == nil {
+			t.Errorf("expected %+v to be rejected", a)
+		}
+	}
+}
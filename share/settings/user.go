@@ -3,6 +3,7 @@ package settings
 import (
 	"regexp"
 	"strings"
+	"time"
 )
 
 var UserAllowAll = regexp.MustCompile("")
@@ -18,13 +19,51 @@ func ParseAuth(auth string) (string, string) {
 type User struct {
 	Name  string
 	Pass  string
-	Addrs []*regexp.Regexp
+	Addrs []AddrMatcher
+	// TOTP is the decoded secret of the user's second
+	// factor, or nil if the user has none
+	TOTP []byte
+	// Windows restrict when the user may connect, in
+	// Location (or local time). Empty allows any time.
+	Windows  []TimeWindow
+	Location *time.Location
+	// Disconnect closes sessions which are still
+	// running when a window ends
+	Disconnect bool
+	// Quota is the number of bytes the user may transfer,
+	// 0 uses the server's default
+	Quota int64
+	// SocksAuth requires credentials on the listeners
+	// of the user's reverse socks remotes
+	SocksAuth bool
+}
+
+// AllowedAt reports whether the user may connect at t
+func (u *User) AllowedAt(t time.Time) bool {
+	if len(u.Windows) == 0 {
+		return true
+	}
+	if u.Location != nil {
+		t = t.In(u.Location)
+	}
+	for _, w := range u.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
 }
 
 func (u *User) HasAccess(addr string) bool {
+	// deny rules take precedence over any allow
+	for _, r := range u.Addrs {
+		if _, deny := r.(denyAddr); deny && r.MatchString(addr) {
+			return false
+		}
+	}
 	m := false
 	for _, r := range u.Addrs {
-		if r.MatchString(addr) {
+		if _, deny := r.(denyAddr); !deny && r.MatchString(addr) {
 			m = true
 			break
 		}
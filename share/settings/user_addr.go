@@ -0,0 +1,171 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AddrMatcher matches the addresses a user may access.
+// *regexp.Regexp and the patterns of ParseAddr implement it.
+type AddrMatcher interface {
+	MatchString(addr string) bool
+}
+
+// ParseAddr compiles an address entry of the authfile. Entries are
+// regular expressions, except for "" and "*" which allow everything,
+// and for patterns which cannot be (meaningful) regular expressions:
+//   10.0.0.0/8:1000-2000        a network and a port range
+//   *.internal.example.com:443  any subdomain
+//   example.com:*               any port
+//   R:0.0.0.0:8000-8100         reverse remotes
+// Entries starting with ! deny the addresses they match,
+// regardless of the order of the entries.
+func ParseAddr(s string) (AddrMatcher, error) {
+	if strings.HasPrefix(s, "!") {
+		if strings.HasPrefix(s, "!!") {
+			return nil, errors.New("invalid address deny rule")
+		}
+		addr, err := ParseAddr(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		return denyAddr{addr}, nil
+	}
+	if s == "" || s == "*" {
+		return UserAllowAll, nil
+	}
+	if p, ok, err := parseAddrPattern(s); ok {
+		if err != nil {
+			return nil, fmt.Errorf("invalid address pattern '%s': %s", s, err)
+		}
+		return p, nil
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, errors.New("invalid address regex")
+	}
+	return re, nil
+}
+
+// denyAddr is an entry whose matches are denied
+type denyAddr struct {
+	AddrMatcher
+}
+
+// addrPattern matches a host (or network) and a port range
+type addrPattern struct {
+	raw     string
+	reverse bool
+	//exactly one of network, domain (for *.<domain>),
+	//host or anyHost is set
+	network *net.IPNet
+	domain  string
+	host    string
+	anyHost bool
+	lo, hi  int
+}
+
+// parseAddrPattern reports whether s is a pattern rather
+// than a regular expression and parses it if so
+func parseAddrPattern(s string) (*addrPattern, bool, error) {
+	p := &addrPattern{raw: s}
+	if strings.HasPrefix(s, revPrefix) {
+		p.reverse = true
+		s = strings.TrimPrefix(s, revPrefix)
+	}
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return nil, false, nil
+	}
+	host, port := s[:i], s[i+1:]
+	//IPv6 as [fd00::1] and networks as [fd00::/8] or [fd00::]/8
+	if strings.HasPrefix(host, "[") {
+		host = strings.Replace(host[1:], "]", "", 1)
+	}
+	if !addrPatternPort.MatchString(port) {
+		return nil, false, nil
+	}
+	isRange := port == "*" || strings.Contains(port, "-")
+	isWildcard := host == "*" || strings.HasPrefix(host, "*.")
+	isNetwork := strings.Contains(host, "/")
+	//anything else is left to be a regex, as before
+	if !isRange && !isWildcard && !isNetwork {
+		return nil, false, nil
+	}
+	switch {
+	case host == "*":
+		p.anyHost = true
+	case isWildcard:
+		p.domain = strings.ToLower(host[1:])
+		if !addrPatternHost.MatchString(p.domain[1:]) {
+			return nil, true, errors.New("invalid domain")
+		}
+	case isNetwork:
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, true, errors.New("invalid network")
+		}
+		p.network = network
+	default:
+		if net.ParseIP(host) == nil && !addrPatternHost.MatchString(host) {
+			return nil, false, nil
+		}
+		p.host = strings.ToLower(host)
+	}
+	p.lo, p.hi = 0, 65535
+	if port != "*" {
+		ports := strings.SplitN(port, "-", 2)
+		p.lo, _ = strconv.Atoi(ports[0])
+		p.hi = p.lo
+		if len(ports) == 2 {
+			p.hi, _ = strconv.Atoi(ports[1])
+		}
+		if p.lo > p.hi || p.hi > 65535 {
+			return nil, true, errors.New("invalid port range")
+		}
+	}
+	return p, true, nil
+}
+
+var (
+	addrPatternPort = regexp.MustCompile(`^(\*|\d{1,5}|\d{1,5}-\d{1,5})$`)
+	addrPatternHost = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+)
+
+// MatchString matches addresses in the form of UserAddr
+func (p *addrPattern) MatchString(addr string) bool {
+	if strings.HasPrefix(addr, revPrefix) != p.reverse {
+		return false
+	}
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(addr, revPrefix))
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < p.lo || port > p.hi {
+		return false
+	}
+	switch {
+	case p.anyHost:
+		return true
+	case p.network != nil:
+		//hostnames are not resolved, so they never match a network
+		ip := net.ParseIP(host)
+		return ip != nil && p.network.Contains(ip)
+	case p.domain != "":
+		host = strings.ToLower(host)
+		return len(host) > len(p.domain) && strings.HasSuffix(host, p.domain)
+	}
+	if ip := net.ParseIP(p.host); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+	return strings.EqualFold(host, p.host)
+}
+
+func (p *addrPattern) String() string {
+	return p.raw
+}
@@ -0,0 +1,145 @@
+package settings
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		entry   string
+		match   []string
+		nomatch []string
+	}{
+		{"", []string{"example.com:443", "R:0.0.0.0:80"}, nil},
+		{"*", []string{"example.com:443", "R:0.0.0.0:80"}, nil},
+		{"^example\\.com:443$", []string{"example.com:443"}, []string{"example.com:4430"}},
+		//plain entries remain regular expressions
+		{"example.com:443", []string{"example.com:4430", "xexample.com:443"}, nil},
+		{"10.0.0.0/8:1000-2000",
+			[]string{"10.1.2.3:1000", "10.255.0.1:2000"},
+			[]string{"10.1.2.3:999", "10.1.2.3:2001", "11.0.0.1:1500", "ten.example.com:1500", "R:10.1.2.3:1500"}},
+		{"*.internal.example.com:443",
+			[]string{"a.internal.example.com:443", "a.b.INTERNAL.example.com:443"},
+			[]string{"internal.example.com:443", "a.internal.example.com:80", "ainternal.example.com:443"}},
+		{"example.com:*", []string{"example.com:1", "EXAMPLE.com:65535"}, []string{"www.example.com:80"}},
+		{"*:22", []string{"example.com:22", "[::1]:22"}, []string{"example.com:23"}},
+		{"[fd00::]/8:80-81", []string{"[fd12::1]:81"}, []string{"[fd12::1]:82"}},
+		{"[fd00::/8]:80-81", []string{"[fd12::1]:80"}, []string{"[fe80::1]:80", "10.0.0.1:80"}},
+		{"::1:*", []string{"[::1]:5432", "[0::1]:1"}, []string{"127.0.0.1:5432"}},
+		{"R:0.0.0.0:8000-8100", []string{"R:0.0.0.0:8050"}, []string{"0.0.0.0:8050", "R:127.0.0.1:8050"}},
+		{"R:*:8000-8100", []string{"R:127.0.0.1:8050"}, []string{"R:127.0.0.1:80"}},
+	} {
+		addr, err := ParseAddr(tc.entry)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.entry, err)
+		}
+		u := &User{Addrs: []AddrMatcher{addr}}
+		for _, a := range tc.match {
+			if !u.HasAccess(a) {
+				t.Errorf("%s: expected %s to match", tc.entry, a)
+			}
+		}
+		for _, a := range tc.nomatch {
+			if u.HasAccess(a) {
+				t.Errorf("%s: expected %s not to match", tc.entry, a)
+			}
+		}
+	}
+}
+
+func TestParseAddrInvalid(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33:80", "10.0.0.0/8:2000-1000", "*.example.com:70000", "*..com:80", "("} {
+		if _, err := ParseAddr(entry); err == nil {
+			t.Errorf("%s: expected an error", entry)
+		}
+	}
+	//entries which look like regular expressions stay ones
+	addr, err := ParseAddr(".*:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := addr.(*regexp.Regexp); !ok {
+		t.Fatalf("expected a regex, got %T", addr)
+	}
+}
+
+func TestDenyAddr(t *testing.T) {
+	u := &User{}
+	for _, entry := range []string{"*", "!169.254.169.254:*", "!*.internal.example.com:*", "!^R:"} {
+		addr, err := ParseAddr(entry)
+		if err != nil {
+			t.Fatalf("%s: %s", entry, err)
+		}
+		u.Addrs = append(u.Addrs, addr)
+	}
+	for addr, allowed := range map[string]bool{
+		"example.com:443":            true,
+		"169.254.169.254:80":         false,
+		"169.254.169.253:80":         true,
+		"db.internal.example.com:22": false,
+		"R:0.0.0.0:8000":             false,
+	} {
+		if u.HasAccess(addr) != allowed {
+			t.Errorf("%s: expected access %v", addr, allowed)
+		}
+	}
+	//denies alone allow nothing
+	deny, _ := ParseAddr("!10.0.0.0/8:*")
+	if (&User{Addrs: []AddrMatcher{deny}}).HasAccess("example.com:80") {
+		t.Error("expected no access without an allow")
+	}
+	if _, err := ParseAddr("!!10.0.0.0/8:*"); err == nil {
+		t.Error("expected an error for a double negation")
+	}
+}
+
+func TestTimeWindows(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	u := &User{Location: berlin}
+	for _, s := range []string{"Mon-Fri 09:00-17:30", "Sat 22:00-02:00", "Sun,Wed 20:00-24:00"} {
+		w, err := ParseTimeWindow(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		u.Windows = append(u.Windows, w)
+	}
+	//2021-06-07 is a Monday
+	at := func(day, h, m int) time.Time {
+		return time.Date(2021, 6, 7+day, h, m, 0, 0, berlin)
+	}
+	for _, tc := range []struct {
+		t       time.Time
+		allowed bool
+	}{
+		{at(0, 9, 0), true},
+		{at(0, 8, 59), false},
+		{at(4, 17, 29), true},
+		{at(4, 17, 30), false},
+		{at(5, 12, 0), false},
+		{at(5, 23, 0), true},
+		{at(6, 1, 59), true},
+		{at(6, 2, 0), false},
+		{at(6, 21, 0), true},
+		{at(2, 23, 59), true},
+		//in other time zones
+		{at(0, 9, 0).UTC(), true},
+		{at(0, 8, 0).UTC(), false},
+	} {
+		if u.AllowedAt(tc.t) != tc.allowed {
+			t.Errorf("%s: expected allowed %v", tc.t, tc.allowed)
+		}
+	}
+	if !(&User{}).AllowedAt(time.Now()) {
+		t.Error("expected users without windows to be allowed")
+	}
+	for _, s := range []string{"", "Mon-Fri 9-17", "Funday", "Mon 09:00-25:00", "Mon 09:60-10:00", "Mon 09:00-10:00 x"} {
+		if _, err := ParseTimeWindow(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
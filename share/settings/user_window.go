@@ -0,0 +1,97 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a weekly recurring period of time, such as
+// "Mon-Fri 09:00-17:30". Periods ending before they
+// start continue into the next day, e.g. "Sat 22:00-02:00".
+type TimeWindow struct {
+	days     [7]bool
+	from, to int //minutes since midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseTimeWindow parses "<days> [<hh:mm>-<hh:mm>]", where days
+// are a comma separated list of weekdays or ranges of them
+// (e.g. "Mon-Fri,Sun") or "*" for every day
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	w := TimeWindow{to: 24 * 60}
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid time window '%s'", s)
+	}
+	for _, days := range strings.Split(fields[0], ",") {
+		if days == "*" {
+			for d := range w.days {
+				w.days[d] = true
+			}
+			continue
+		}
+		r := strings.SplitN(strings.ToLower(days), "-", 2)
+		from, ok := weekdays[r[0]]
+		to := from
+		if ok && len(r) == 2 {
+			to, ok = weekdays[r[1]]
+		}
+		if !ok {
+			return w, fmt.Errorf("invalid days '%s' in time window", days)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	if len(fields) == 2 {
+		r := strings.SplitN(fields[1], "-", 2)
+		var err error
+		if len(r) != 2 {
+			err = errors.New("expected <hh:mm>-<hh:mm>")
+		}
+		if err == nil {
+			w.from, err = parseClock(r[0])
+		}
+		if err == nil {
+			w.to, err = parseClock(r[1])
+		}
+		if err != nil {
+			return w, fmt.Errorf("invalid hours '%s' in time window: %s", fields[1], err)
+		}
+	}
+	return w, nil
+}
+
+// parseClock returns the minutes since midnight of hh:mm
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+	return h*60 + m, nil
+}
+
+// Contains reports whether t is inside the window,
+// in the location of t
+func (w TimeWindow) Contains(t time.Time) bool {
+	day := t.Weekday()
+	min := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return w.days[day] && w.from <= min && min < w.to
+	}
+	//overnight, started today or yesterday
+	return (w.days[day] && min >= w.from) || (w.days[(day+6)%7] && min < w.to)
+}
@@ -5,50 +5,107 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"regexp"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/jpillora/sizestr"
+	"github.com/myzhang1029/penguin/share/ccrypto"
 	"github.com/myzhang1029/penguin/share/cio"
 )
 
+// usersShards is the number of independently
+// locked partitions of a Users set
+const usersShards = 32
+
+// Users is a concurrent-safe set of users. Keys are
+// spread over a fixed number of shards so that lookups
+// during authentication do not contend with each other
+// or with updates to unrelated keys.
 type Users struct {
+	shards [usersShards]usersShard
+}
+
+type usersShard struct {
 	sync.RWMutex
 	inner map[string]*User
 }
 
 func NewUsers() *Users {
-	return &Users{inner: map[string]*User{}}
+	u := &Users{}
+	for i := range u.shards {
+		u.shards[i].inner = map[string]*User{}
+	}
+	return u
+}
+
+// shard returns the partition holding key
+func (u *Users) shard(key string) *usersShard {
+	return &u.shards[u.shardIndex(key)]
+}
+
+// shardIndex hashes key with FNV-1a
+func (u *Users) shardIndex(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h % usersShards
 }
 
 // Len returns the numbers of users
 func (u *Users) Len() int {
-	u.RLock()
-	l := len(u.inner)
-	u.RUnlock()
+	l := 0
+	for i := range u.shards {
+		s := &u.shards[i]
+		s.RLock()
+		l += len(s.inner)
+		s.RUnlock()
+	}
 	return l
 }
 
+// HasTOTP reports whether any of the users
+// has a second factor
+func (u *Users) HasTOTP() bool {
+	for i := range u.shards {
+		s := &u.shards[i]
+		s.RLock()
+		for _, user := range s.inner {
+			if user.TOTP != nil {
+				s.RUnlock()
+				return true
+			}
+		}
+		s.RUnlock()
+	}
+	return false
+}
+
 // Get user from the index by key
 func (u *Users) Get(key string) (*User, bool) {
-	u.RLock()
-	user, found := u.inner[key]
-	u.RUnlock()
+	s := u.shard(key)
+	s.RLock()
+	user, found := s.inner[key]
+	s.RUnlock()
 	return user, found
 }
 
 // Set a users into the list by specific key
 func (u *Users) Set(key string, user *User) {
-	u.Lock()
-	u.inner[key] = user
-	u.Unlock()
+	s := u.shard(key)
+	s.Lock()
+	s.inner[key] = user
+	s.Unlock()
 }
 
 // Del ete a users from the list
 func (u *Users) Del(key string) {
-	u.Lock()
-	delete(u.inner, key)
-	u.Unlock()
+	s := u.shard(key)
+	s.Lock()
+	delete(s.inner, key)
+	s.Unlock()
 }
 
 // AddUser adds a users to the set
@@ -59,13 +116,24 @@ func (u *Users) AddUser(user *User) {
 // Reset all users to the given set,
 // Use nil to remove all.
 func (u *Users) Reset(users []*User) {
-	m := map[string]*User{}
-	for _, u := range users {
-		m[u.Name] = u
+	var m [usersShards]map[string]*User
+	for i := range m {
+		m[i] = map[string]*User{}
+	}
+	for _, user := range users {
+		m[u.shardIndex(user.Name)][user.Name] = user
+	}
+	// take every shard lock (always in order) so
+	// readers never observe a partially swapped set
+	for i := range u.shards {
+		u.shards[i].Lock()
+	}
+	for i := range u.shards {
+		u.shards[i].inner = m[i]
+	}
+	for i := range u.shards {
+		u.shards[i].Unlock()
 	}
-	u.Lock()
-	u.inner = m
-	u.Unlock()
 }
 
 // UserIndex is a reloadable user source
@@ -129,31 +197,106 @@ func (u *UserIndex) loadUserIndex() error {
 	if err != nil {
 		return fmt.Errorf("failed to read auth file: %s, error: %s", u.configFile, err)
 	}
-	var raw map[string][]string
+	var raw map[string]json.RawMessage
 	if err := json.Unmarshal(b, &raw); err != nil {
 		return errors.New("invalid JSON: " + err.Error())
 	}
+	users, err := ParseUsers(raw)
+	if err != nil {
+		return err
+	}
+	//swap
+	u.Reset(users)
+	return nil
+}
+
+// ParseUsers decodes the entries of an auth file, which
+// map "<user:pass>" to the user's addresses or settings
+func ParseUsers(raw map[string]json.RawMessage) ([]*User, error) {
 	users := []*User{}
-	for auth, remotes := range raw {
-		user := &User{}
-		user.Name, user.Pass = ParseAuth(auth)
-		if user.Name == "" {
-			return errors.New("invalid user:pass string")
+	for auth, value := range raw {
+		name, pass := ParseAuth(auth)
+		if name == "" {
+			return nil, errors.New("invalid user:pass string")
 		}
-		for _, r := range remotes {
-			if r == "" || r == "*" {
-				user.Addrs = append(user.Addrs, UserAllowAll)
-			} else {
-				re, err := regexp.Compile(r)
-				if err != nil {
-					return errors.New("invalid address regex")
-				}
-				user.Addrs = append(user.Addrs, re)
-			}
+		entry, err := decodeUserEntry(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry for user %s: %s", name, err)
+		}
+		user, err := entry.user(name, pass)
+		if err != nil {
+			return nil, err
 		}
 		users = append(users, user)
 	}
-	//swap
-	u.Reset(users)
-	return nil
+	return users, nil
+}
+
+// userEntry is the value of a user in the auth file, which is
+// either a list of addresses or an object with further settings:
+//   {"<user:pass>": ["<addr-regex>"]}
+//   {"<user:pass>": {"addrs": ["<addr-regex>"], "totp": "<base32-secret>"}}
+//   {"<user:pass>": {"addrs": ["<addr-regex>"], "windows": ["Mon-Fri 09:00-17:00"],
+//     "timezone": "Europe/Berlin", "disconnect": true}}
+//   {"<user:pass>": {"addrs": ["<addr-regex>"], "quota": "10GB"}}
+//   {"<user:pass>": {"addrs": ["R:0.0.0.0:1080"], "socksauth": true}}
+type userEntry struct {
+	Addrs      []string
+	TOTP       string
+	Windows    []string
+	Timezone   string
+	Disconnect bool
+	Quota      string
+	SocksAuth  bool
+}
+
+func decodeUserEntry(value json.RawMessage) (*userEntry, error) {
+	entry := &userEntry{}
+	if err := json.Unmarshal(value, &entry.Addrs); err == nil {
+		return entry, nil
+	}
+	if err := json.Unmarshal(value, entry); err != nil {
+		return nil, errors.New("expected a list of addresses or an object")
+	}
+	return entry, nil
+}
+
+// user builds the user described by the entry
+func (entry *userEntry) user(name, pass string) (*User, error) {
+	user := &User{Name: name, Pass: pass}
+	for _, r := range entry.Addrs {
+		addr, err := ParseAddr(r)
+		if err != nil {
+			return nil, err
+		}
+		user.Addrs = append(user.Addrs, addr)
+	}
+	if entry.TOTP != "" {
+		var err error
+		if user.TOTP, err = ccrypto.DecodeTOTPSecret(entry.TOTP); err != nil {
+			return nil, fmt.Errorf("invalid entry for user %s: %s", name, err)
+		}
+	}
+	for _, s := range entry.Windows {
+		w, err := ParseTimeWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry for user %s: %s", name, err)
+		}
+		user.Windows = append(user.Windows, w)
+	}
+	if entry.Timezone != "" {
+		var err error
+		if user.Location, err = time.LoadLocation(entry.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid entry for user %s: %s", name, err)
+		}
+	}
+	user.Disconnect = entry.Disconnect
+	user.SocksAuth = entry.SocksAuth
+	if entry.Quota != "" {
+		var err error
+		if user.Quota, err = sizestr.Parse(entry.Quota); err != nil || user.Quota <= 0 {
+			return nil, fmt.Errorf("invalid entry for user %s: invalid quota '%s'", name, entry.Quota)
+		}
+	}
+	return user, nil
 }
@@ -0,0 +1,105 @@
+package settings
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// usersQuery reads the users table, which external tooling
+// may modify at any time:
+//   CREATE TABLE penguin_users (
+//     name     TEXT PRIMARY KEY,
+//     password TEXT NOT NULL,
+//     addrs    TEXT,  -- JSON list of address regexes
+//     totp     TEXT   -- base32 secret of the second factor
+//   );
+const usersQuery = "SELECT name, password, addrs, totp FROM penguin_users"
+
+// ParseAuthDB splits an auth database URL into the database/sql
+// driver name and its data source name. Supported are
+// sqlite:///path/to/users.db and postgres:// URLs.
+func ParseAuthDB(dbURL string) (driver, dsn string, err error) {
+	switch {
+	case strings.HasPrefix(dbURL, "sqlite://"):
+		dsn = strings.TrimPrefix(dbURL, "sqlite://")
+		if dsn == "" {
+			return "", "", errors.New("missing sqlite database path")
+		}
+		return "sqlite3", dsn, nil
+	case strings.HasPrefix(dbURL, "postgres://"),
+		strings.HasPrefix(dbURL, "postgresql://"):
+		return "postgres", dbURL, nil
+	}
+	return "", "", fmt.Errorf("unsupported auth database '%s'", dbURL)
+}
+
+// LoadUsersDB loads users from a database and polls it for
+// changes. The database driver must have been registered.
+func (u *UserIndex) LoadUsersDB(dbURL string) error {
+	driver, dsn, err := ParseAuthDB(dbURL)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	u.Infof("loading users from %s database", driver)
+	if err := u.loadUserDB(db); err != nil {
+		db.Close()
+		return err
+	}
+	go u.pollUserDB(db, EnvDuration("AUTHDB_POLL", 10*time.Second))
+	return nil
+}
+
+// pollUserDB periodically reloads the users, keeping
+// the previous set when the database is unavailable
+func (u *UserIndex) pollUserDB(db *sql.DB, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := u.loadUserDB(db); err != nil {
+			u.Infof("failed to reload users from the database: %s", err)
+		}
+	}
+}
+
+// loadUserDB is responsible for loading the users table
+func (u *UserIndex) loadUserDB(db *sql.DB) error {
+	rows, err := db.Query(usersQuery)
+	if err != nil {
+		return fmt.Errorf("failed to query users: %s", err)
+	}
+	defer rows.Close()
+	users := []*User{}
+	for rows.Next() {
+		var name, pass string
+		var addrs, totp sql.NullString
+		if err := rows.Scan(&name, &pass, &addrs, &totp); err != nil {
+			return fmt.Errorf("failed to read users: %s", err)
+		}
+		if name == "" {
+			return errors.New("invalid empty username")
+		}
+		entry := &userEntry{TOTP: totp.String}
+		if addrs.String != "" {
+			if err := json.Unmarshal([]byte(addrs.String), &entry.Addrs); err != nil {
+				return fmt.Errorf("invalid addrs for user %s: expected a JSON list", name)
+			}
+		}
+		user, err := entry.user(name, pass)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read users: %s", err)
+	}
+	//swap
+	u.Reset(users)
+	return nil
+}
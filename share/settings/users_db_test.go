@@ -0,0 +1,90 @@
+package settings
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/myzhang1029/penguin/share/cio"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestParseAuthDB(t *testing.T) {
+	for _, tc := range []struct{ url, driver, dsn string }{
+		{"sqlite:///var/lib/penguin/users.db", "sqlite3", "/var/lib/penguin/users.db"},
+		{"sqlite://users.db", "sqlite3", "users.db"},
+		{"postgres://u:p@db/penguin", "postgres", "postgres://u:p@db/penguin"},
+		{"postgresql://db/penguin", "postgres", "postgresql://db/penguin"},
+	} {
+		driver, dsn, err := ParseAuthDB(tc.url)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.url, err)
+		}
+		if driver != tc.driver || dsn != tc.dsn {
+			t.Fatalf("%s: got %s %s", tc.url, driver, dsn)
+		}
+	}
+	for _, u := range []string{"sqlite://", "mysql://db", "users.db"} {
+		if _, _, err := ParseAuthDB(u); err == nil {
+			t.Fatalf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestUsersDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "penguin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE penguin_users (
+		name TEXT PRIMARY KEY, password TEXT NOT NULL, addrs TEXT, totp TEXT);
+		INSERT INTO penguin_users VALUES ('alice', 'secret', '["^example\\.com:443$"]', NULL);
+		INSERT INTO penguin_users VALUES ('bob', 'hunter2', NULL, 'JBSWY3DPEHPK3PXP');`); err != nil {
+		t.Fatal(err)
+	}
+	index := NewUserIndex(cio.NewLogger("test"))
+	if err := index.LoadUsersDB("sqlite://" + path); err != nil {
+		t.Fatal(err)
+	}
+	alice, ok := index.Get("alice")
+	if !ok || alice.Pass != "secret" {
+		t.Fatalf("expected alice to be loaded, got %v", alice)
+	}
+	if !alice.HasAccess("example.com:443") || alice.HasAccess("example.com:80") {
+		t.Fatal("unexpected access for alice")
+	}
+	bob, ok := index.Get("bob")
+	if !ok || bob.TOTP == nil || bob.HasAccess("example.com:443") {
+		t.Fatalf("unexpected entry for bob: %v", bob)
+	}
+	//changes are picked up on reload
+	if _, err := db.Exec(`DELETE FROM penguin_users WHERE name = 'bob'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.loadUserDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.Get("bob"); ok {
+		t.Fatal("expected bob to be removed")
+	}
+	//invalid rows keep the previous set
+	if _, err := db.Exec(`INSERT INTO penguin_users VALUES ('eve', 'x', '["("]', NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.loadUserDB(db); err == nil {
+		t.Fatal("expected an invalid regex error")
+	}
+	if _, ok := index.Get("alice"); !ok {
+		t.Fatal("expected alice to be kept")
+	}
+}
@@ -0,0 +1,92 @@
+package settings
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestUsersConcurrent(t *testing.T) {
+	users := NewUsers()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				name := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				users.AddUser(&User{Name: name})
+				if _, ok := users.Get(name); !ok {
+					t.Errorf("user %s not found after add", name)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if l := users.Len(); l != 800 {
+		t.Fatalf("expected 800 users, got %d", l)
+	}
+	users.Reset([]*User{{Name: "a"}, {Name: "b"}})
+	if l := users.Len(); l != 2 {
+		t.Fatalf("expected 2 users after reset, got %d", l)
+	}
+	if _, ok := users.Get("0-0"); ok {
+		t.Fatal("expected user to be removed by reset")
+	}
+	users.Del("a")
+	if _, ok := users.Get("a"); ok {
+		t.Fatal("expected user to be deleted")
+	}
+}
+
+func benchmarkUsers(n int) (*Users, []string) {
+	users := NewUsers()
+	names := make([]string, n)
+	list := make([]*User, n)
+	for i := range names {
+		names[i] = "user" + strconv.Itoa(i)
+		list[i] = &User{Name: names[i]}
+	}
+	users.Reset(list)
+	return users, names
+}
+
+func BenchmarkUsersGet(b *testing.B) {
+	users, names := benchmarkUsers(1000)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			users.Get(names[i%len(names)])
+			i++
+		}
+	})
+}
+
+func BenchmarkUsersGetSet(b *testing.B) {
+	users, names := benchmarkUsers(1000)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			name := names[i%len(names)]
+			if i%10 == 0 {
+				users.Set(name, &User{Name: name})
+			} else {
+				users.Get(name)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkUsersReset(b *testing.B) {
+	users, _ := benchmarkUsers(1000)
+	_, names := benchmarkUsers(1000)
+	list := make([]*User, len(names))
+	for i, name := range names {
+		list[i] = &User{Name: name}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		users.Reset(list)
+	}
+}
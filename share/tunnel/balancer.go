@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"sync"
+
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+//checkFall is the number of failed checks in a
+//row after which a target is considered down
+const checkFall = 2
+
+//balancer chooses among the targets of a remote
+//for each of its connections
+type balancer struct {
+	mu        sync.Mutex
+	leastConn bool
+	next      int
+	//active counts the open connections of each target
+	active []int
+	//down are the targets which failed their checks,
+	//fails counts the failures in a row of each target
+	down  []bool
+	fails []int
+}
+
+//newBalancer is the balancer of the remote, nil
+//if it has a single target which is not checked
+func newBalancer(remote *settings.Remote) *balancer {
+	n := len(remote.Targets)
+	if n == 0 {
+		if remote.Check == "" {
+			return nil
+		}
+		n = 1
+	}
+	return &balancer{
+		leastConn: remote.Balance == "leastconn",
+		active:    make([]int, n),
+		down:      make([]bool, n),
+		fails:     make([]int, n),
+	}
+}
+
+//pick chooses the target of a new connection among those
+//which are up, in turns or as the one with the fewest
+//connections (in turns among equals), or -1 if all of them
+//are down. The target must be released once the
+//connection closes.
+func (b *balancer) pick() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := -1
+	for j := 0; j < len(b.active); j++ {
+		k := (b.next + j) % len(b.active)
+		if b.down[k] {
+			continue
+		}
+		if i < 0 || b.active[k] < b.active[i] {
+			i = k
+		}
+		if !b.leastConn {
+			break
+		}
+	}
+	if i < 0 {
+		return -1
+	}
+	b.next = (i + 1) % len(b.active)
+	b.active[i]++
+	return i
+}
+
+func (b *balancer) release(i int) {
+	b.mu.Lock()
+	b.active[i]--
+	b.mu.Unlock()
+}
+
+//report records whether a check of target i passed,
+//and whether the target went up or down with it
+func (b *balancer) report(i int, passed bool) (up, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if passed {
+		b.fails[i] = 0
+		changed = b.down[i]
+		b.down[i] = false
+		return true, changed
+	}
+	b.fails[i]++
+	if b.fails[i] == checkFall {
+		b.down[i] = true
+		return false, true
+	}
+	return !b.down[i], false
+}
@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cio"
+)
+
+//idleWatch closes the ends of a stream once
+//neither carried data for the timeout
+type idleWatch struct {
+	//last is when data was last carried, in nanoseconds
+	last int64
+	done chan struct{}
+}
+
+//watchIdle starts watching the stream between
+//ends, which its wrapped ends report to
+func watchIdle(l *cio.Logger, timeout time.Duration, ends ...io.Closer) *idleWatch {
+	w := &idleWatch{
+		last: time.Now().UnixNano(),
+		done: make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case now := <-ticker.C:
+				if now.Sub(time.Unix(0, atomic.LoadInt64(&w.last))) < timeout {
+					continue
+				}
+				l.Debugf("idle for %s, closing", timeout)
+				for _, c := range ends {
+					c.Close()
+				}
+				return
+			}
+		}
+	}()
+	return w
+}
+
+//stop stops watching, once the stream closed
+func (w *idleWatch) stop() {
+	close(w.done)
+}
+
+func (w *idleWatch) wrap(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &idleRWC{ReadWriteCloser: rwc, w: w}
+}
+
+//idleRWC is an end of a watched stream
+type idleRWC struct {
+	io.ReadWriteCloser
+	w *idleWatch
+}
+
+func (c *idleRWC) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.w.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleRWC) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.w.last, time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//proxySignature starts the headers of PROXY protocol v2
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//withProxyAddrs adds the source and destination addresses
+//of src to target, for the far end to send them in a PROXY
+//protocol header once it dialed target
+func withProxyAddrs(target string, src io.ReadWriteCloser) string {
+	addrs := ""
+	if conn, ok := src.(net.Conn); ok {
+		addrs = conn.RemoteAddr().String() + "," + conn.LocalAddr().String()
+	}
+	sep := "?"
+	if strings.Contains(target, "?") {
+		sep = "&"
+	}
+	return target + sep + url.Values{"proxyproto": {addrs}}.Encode()
+}
+
+//proxyHeader is the PROXY protocol v2 header of a TCP
+//connection between the addresses of addrs (<src>,<dst>),
+//or of a local connection if they are not IP addresses
+func proxyHeader(addrs string) []byte {
+	var b bytes.Buffer
+	b.Write(proxySignature)
+	src, dst := splitProxyAddrs(addrs)
+	if src == nil || dst == nil {
+		//LOCAL, with no addresses
+		b.Write([]byte{0x20, 0x00, 0, 0})
+		return b.Bytes()
+	}
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	family := byte(0x11) //TCP over IPv4
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		family = 0x21 //TCP over IPv6
+	}
+	b.Write([]byte{0x21, family})
+	binary.Write(&b, binary.BigEndian, uint16(2*len(srcIP)+4))
+	b.Write(srcIP)
+	b.Write(dstIP)
+	binary.Write(&b, binary.BigEndian, uint16(src.Port))
+	binary.Write(&b, binary.BigEndian, uint16(dst.Port))
+	return b.Bytes()
+}
+
+//splitProxyAddrs parses <src>,<dst>,
+//to nil addresses if they are not IP ones
+func splitProxyAddrs(addrs string) (*net.TCPAddr, *net.TCPAddr) {
+	i := strings.Index(addrs, ",")
+	if i < 0 {
+		return nil, nil
+	}
+	return parseIPAddr(addrs[:i]), parseIPAddr(addrs[i+1:])
+}
+
+func parseIPAddr(s string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 65535 {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
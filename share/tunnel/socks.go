@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+//socks commands and replies used by the proxies
+const (
+	socksConnectCmd   = 1
+	socksBindCmd      = 2
+	socksAssociateCmd = 3
+	socksSucceeded    = 0
+	socksFailure      = 1
+	socksNotAllowed   = 2
+	socksUnsupported  = 7
+)
+
+//socksAddr encodes the address type, address and port
+//of target as they appear in socks requests and replies
+func socksAddr(target string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 0 || portNum > 65535 {
+		return nil, fmt.Errorf("invalid port '%s'", port)
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("host name too long")
+		}
+		b = append(b, 3, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 1)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, 4)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(portNum>>8), byte(portNum)), nil
+}
+
+//socksReply replies to the request of a socks client
+func socksReply(conn net.Conn, code byte, bound string) error {
+	addr, err := socksAddr(bound)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append([]byte{5, code, 0}, addr...))
+	return err
+}
+
+//readSocksAddr reads an address encoded by socksAddr,
+//returning it as host:port along with its encoding
+func readSocksAddr(r io.Reader) (string, []byte, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", nil, err
+	}
+	var size int
+	switch b[0] {
+	case 1:
+		size = 1 + net.IPv4len + 2
+	case 4:
+		size = 1 + net.IPv6len + 2
+	case 3:
+		size = 2 + int(b[1]) + 2
+	default:
+		return "", nil, errors.New("invalid socks address")
+	}
+	b = append(b, make([]byte, size-len(b))...)
+	if _, err := io.ReadFull(r, b[2:]); err != nil {
+		return "", nil, err
+	}
+	var host string
+	if b[0] == 3 {
+		host = string(b[2 : size-2])
+	} else {
+		host = net.IP(b[1 : size-2]).String()
+	}
+	port := binary.BigEndian.Uint16(b[size-2:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), b, nil
+}
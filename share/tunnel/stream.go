@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cmetrics"
+)
+
+//Stats is a snapshot of a tunnel's counters
+type Stats struct {
+	Connections int32
+	Open        int32
+	Sent        int64
+	Received    int64
+	Streams     []StreamStats
+	//RTT is the smoothed round-trip time of the keepalives
+	//which this side sends, zero until one is replied to
+	RTT time.Duration
+}
+
+//StreamStats is a snapshot of a single proxied connection.
+//Sent counts bytes towards the remote end of the stream,
+//Received counts bytes coming back from it.
+type StreamStats struct {
+	ID       int32
+	Remote   string
+	Inbound  bool
+	Opened   time.Time
+	Sent     int64
+	Received int64
+}
+
+//stream is a proxied connection tracked by the tunnel
+type stream struct {
+	StreamStats
+}
+
+//direction labels the stream's metrics
+func (s *stream) direction() cmetrics.Label {
+	if s.Inbound {
+		return cmetrics.L("direction", "inbound")
+	}
+	return cmetrics.L("direction", "outbound")
+}
+
+type streams struct {
+	sync.Mutex
+	next       int32
+	live       map[int32]*stream
+	sent, recv int64
+}
+
+//open starts tracking a new stream
+func (ss *streams) open(remote string, inbound bool) *stream {
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.live == nil {
+		ss.live = map[int32]*stream{}
+	}
+	ss.next++
+	s := &stream{StreamStats{
+		ID:      ss.next,
+		Remote:  remote,
+		Inbound: inbound,
+		Opened:  time.Now(),
+	}}
+	ss.live[s.ID] = s
+	return s
+}
+
+//close stops tracking the stream, keeping its totals
+func (ss *streams) close(s *stream) {
+	ss.Lock()
+	defer ss.Unlock()
+	delete(ss.live, s.ID)
+	ss.sent += atomic.LoadInt64(&s.Sent)
+	ss.recv += atomic.LoadInt64(&s.Received)
+}
+
+//snapshot returns the live streams and
+//the byte totals including them
+func (ss *streams) snapshot() (list []StreamStats, sent, recv int64) {
+	ss.Lock()
+	defer ss.Unlock()
+	sent, recv = ss.sent, ss.recv
+	for _, s := range ss.live {
+		st := s.StreamStats
+		st.Sent = atomic.LoadInt64(&s.Sent)
+		st.Received = atomic.LoadInt64(&s.Received)
+		sent += st.Sent
+		recv += st.Received
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, sent, recv
+}
+
+//wrapRemote counts the traffic to and from
+//the remote end of the stream
+func (s *stream) wrapRemote(remote io.ReadWriteCloser) io.ReadWriteCloser {
+	return &streamRWC{ReadWriteCloser: remote, sent: &s.Sent, recv: &s.Received}
+}
+
+//wrapLocal counts the traffic from and to
+//the local end of the stream
+func (s *stream) wrapLocal(local io.ReadWriteCloser) io.ReadWriteCloser {
+	return &streamRWC{ReadWriteCloser: local, sent: &s.Received, recv: &s.Sent}
+}
+
+type streamRWC struct {
+	io.ReadWriteCloser
+	sent, recv *int64
+}
+
+func (c *streamRWC) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddInt64(c.recv, int64(n))
+	return n, err
+}
+
+func (c *streamRWC) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddInt64(c.sent, int64(n))
+	return n, err
+}
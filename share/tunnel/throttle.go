@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+//rateLimiter is a token bucket of bytes, shared by
+//the connections of a throttled remote. Takers may
+//overdraw it, and then wait until it is refilled.
+type rateLimiter struct {
+	mut    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+//newRateLimiter limits to the rate in bits per
+//second, or returns nil, which limits nothing
+func newRateLimiter(bits int64) *rateLimiter {
+	if bits <= 0 {
+		return nil
+	}
+	rate := float64(bits) / 8
+	//a tenth of a second, and at least a packet
+	burst := rate / 10
+	if burst < 1500 {
+		burst = 1500
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+//chunk is the most which is
+//worth taking at once
+func (r *rateLimiter) chunk() int {
+	return int(r.burst)
+}
+
+//wait takes n tokens, blocking
+//while the bucket is overdrawn
+func (r *rateLimiter) wait(n int) {
+	if r == nil {
+		return
+	}
+	r.mut.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	debt := -r.tokens
+	r.mut.Unlock()
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / r.rate * float64(time.Second)))
+	}
+}
+
+//throttledRWC limits the rates at which the local end
+//of a connection of a throttled remote is read and written
+type throttledRWC struct {
+	io.ReadWriteCloser
+	read, write *rateLimiter
+}
+
+//throttle limits the rates of the local end of a
+//connection to those of the remote, if any
+func (p *Proxy) throttle(src io.ReadWriteCloser) io.ReadWriteCloser {
+	if p.up == nil {
+		return src
+	}
+	return &throttledRWC{ReadWriteCloser: src, read: p.up, write: p.down}
+}
+
+func (c *throttledRWC) Read(b []byte) (int, error) {
+	if n := c.read.chunk(); len(b) > n {
+		b = b[:n]
+	}
+	n, err := c.ReadWriteCloser.Read(b)
+	c.read.wait(n)
+	return n, err
+}
+
+func (c *throttledRWC) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := c.write.chunk()
+		if n > len(b) {
+			n = len(b)
+		}
+		c.write.wait(n)
+		m, err := c.ReadWriteCloser.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
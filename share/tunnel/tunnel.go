@@ -1,17 +1,25 @@
+//Package tunnel is the SSH tunnel shared by the penguin
+//client and server: it binds the remotes on one end and
+//dials them on the other. Its exported API follows semantic
+//versioning, like that of chclient.
 package tunnel
 
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"os"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-socks5"
 	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/cmetrics"
 	"github.com/myzhang1029/penguin/share/cnet"
 	"github.com/myzhang1029/penguin/share/settings"
 	"golang.org/x/crypto/ssh"
@@ -25,6 +33,117 @@ type Config struct {
 	Outbound  bool
 	Socks     bool
 	KeepAlive time.Duration
+	//Metrics receives the tunnel's instrumentation
+	Metrics cmetrics.Sink
+	//RemoteMetrics counts the bytes of each remote, which
+	//suits the few remotes of a client rather than the
+	//arbitrary addresses dialed by a server
+	RemoteMetrics bool
+	//ValidateRemotes is consulted before binding remotes
+	//requested by the peer at runtime. When unset, such
+	//requests are rejected.
+	ValidateRemotes func(settings.Remotes) error
+	//Dialer makes the connections to the remotes
+	//requested by the peer, nil uses net.Dial
+	Dialer *cnet.Dialer
+	//AdmitStream is consulted before each new stream,
+	//which is refused when it returns an error
+	AdmitStream func() error
+	//UDP limits the UDP remotes of the tunnel
+	UDP UDPConfig
+	//Framer, when set, carries the stdio remotes as framed
+	//streams, in their order, instead of stdin and stdout
+	Framer *cio.Framer
+	//Listeners restricts who may use the listeners of the
+	//tunnel's remotes
+	Listeners ListenerConfig
+	//Tun allows the peer to bridge its tun remotes with TUN
+	//devices created here (Linux only, requires CAP_NET_ADMIN)
+	Tun bool
+	//TCPKeepAlive is the TCP keepalive period of the connections
+	//accepted by the listeners of remotes and of those dialed to
+	//their targets, see cnet.SetKeepAlive
+	TCPKeepAlive time.Duration
+	//Unix allows the peer to reach unix sockets
+	//and named pipes here
+	Unix bool
+	//Serial allows the peer to bridge serial devices here
+	Serial bool
+	//TerminateTLS is the TLS configuration of the remotes
+	//which terminate TLS, nil if none may
+	TerminateTLS *tls.Config
+	//AdmitBind is consulted with the address of the listener
+	//of each socks BIND request, which is refused when it
+	//returns an error. BIND opens a listener here, so it is
+	//only served by tunnels accepting Inbound remotes.
+	AdmitBind func(addr string) error
+	//TLSCAs are the CA bundles which the ca option of TLS
+	//remotes may name here, those of the local remotes,
+	//so that the peer cannot have other files read
+	TLSCAs []string
+}
+
+//UDPConfig limits the UDP flows relayed by a tunnel,
+//zero values use the defaults
+type UDPConfig struct {
+	//IdleTimeout closes a flow at the exit node once no
+	//reply arrived for this long (default 15s, or the
+	//UDP_DEADLINE environment variable)
+	IdleTimeout time.Duration
+	//MaxFlows is the maximum of concurrent flows at the
+	//exit node, packets of new flows beyond it are
+	//dropped (default 100)
+	MaxFlows int
+	//MaxSize is the maximum datagram size (default 9012,
+	//or the UDP_MAX_SIZE environment variable)
+	MaxSize int
+}
+
+func (c UDPConfig) withDefaults() UDPConfig {
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = settings.EnvDuration("UDP_DEADLINE", 15*time.Second)
+	}
+	if c.MaxFlows <= 0 {
+		c.MaxFlows = settings.EnvInt("UDP_MAX_FLOWS", 100)
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = settings.EnvInt("UDP_MAX_SIZE", 9012)
+	}
+	return c
+}
+
+//ListenerConfig restricts who may use the listeners of
+//a tunnel, so that other users of a shared host cannot
+//ride it
+type ListenerConfig struct {
+	//Allow, when not empty, only accepts the connections
+	//and datagrams from these networks
+	Allow []*net.IPNet
+	//SocksUser and SocksPass, when set, require SOCKS5
+	//username/password authentication on socks remotes
+	SocksUser, SocksPass string
+}
+
+//allows reports whether addr may use the listeners
+func (c ListenerConfig) allows(addr net.Addr) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	for _, network := range c.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 //Tunnel represents an SSH tunnel with proxy capabilities.
@@ -36,22 +155,36 @@ type Config struct {
 //communicates with the endpoint and returns the response.
 type Tunnel struct {
 	Config
-	//ssh connection
+	//ssh connections, new streams are spread
+	//over them when there are several
 	activeConnMut  sync.RWMutex
 	activatingConn waitGroup
-	activeConn     ssh.Conn
+	activeConns    []ssh.Conn
+	nextConn       uint32
 	//proxies
+	proxyMut   sync.Mutex
 	proxyCount int
+	proxies    map[string]*boundProxy
+	//in-process listeners
+	listenersMut sync.Mutex
+	listeners    map[string]*Listener
 	//internals
 	connStats   cnet.ConnCount
+	streams     streams
 	socksServer *socks5.Server
+	//rtt is the smoothed round-trip time
+	//of the keepalives, in nanoseconds
+	rtt int64
 }
 
 //New Tunnel from the given Config
 func New(c Config) *Tunnel {
 	c.Logger = c.Logger.Fork("tun")
+	c.Metrics = cmetrics.OrNop(c.Metrics)
+	c.UDP = c.UDP.withDefaults()
 	t := &Tunnel{
-		Config: c,
+		Config:  c,
+		proxies: map[string]*boundProxy{},
 	}
 	t.activatingConn.Add(1)
 	//setup socks server (not listening on any port!)
@@ -59,9 +192,13 @@ func New(c Config) *Tunnel {
 	if c.Socks {
 		sl := log.New(ioutil.Discard, "", 0)
 		if t.Logger.Debug {
-			sl = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
+			sl = log.New(t.Logger.Writer(), "[socks]", log.Ldate|log.Ltime)
 		}
-		t.socksServer, _ = socks5.New(&socks5.Config{Logger: sl})
+		sc := &socks5.Config{Logger: sl, Dial: t.dialTCP}
+		if c.Dialer != nil {
+			sc.Resolver = socksResolver{c.Dialer.Resolver, c.Dialer.Upstream != nil}
+		}
+		t.socksServer, _ = socks5.New(sc)
 		extra += " (SOCKS enabled)"
 	}
 	t.Debugf("created%s", extra)
@@ -70,6 +207,21 @@ func New(c Config) *Tunnel {
 
 //BindSSH provides an active SSH for use for tunnelling
 func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Request, chans <-chan ssh.NewChannel) error {
+	return t.bindSSH(ctx, c, reqs, chans, settings.KeepAlive{Interval: t.Config.KeepAlive}, true)
+}
+
+//BindSSHKeepAlive is BindSSH with the keepalive negotiated for
+//this connection instead of Config.KeepAlive. When ping is set,
+//pings are sent at the interval, their round-trip time is
+//measured, and the connection is closed when a reply misses
+//the timeout as many times in a row as allowed. Otherwise, it
+//is closed when no ping arrives within the interval and
+//those timeouts.
+func (t *Tunnel) BindSSHKeepAlive(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Request, chans <-chan ssh.NewChannel, keepAlive settings.KeepAlive, ping bool) error {
+	return t.bindSSH(ctx, c, reqs, chans, keepAlive, ping)
+}
+
+func (t *Tunnel) bindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Request, chans <-chan ssh.NewChannel, keepAlive settings.KeepAlive, ping bool) error {
 	//link ctx to ssh-conn
 	go func() {
 		<-ctx.Done()
@@ -80,41 +232,65 @@ func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Reque
 	}()
 	//mark active and unblock
 	t.activeConnMut.Lock()
-	if t.activeConn != nil {
-		panic("double bind ssh")
+	for _, active := range t.activeConns {
+		if active == c {
+			panic("double bind ssh")
+		}
+	}
+	t.activeConns = append(t.activeConns, c)
+	if len(t.activeConns) == 1 {
+		t.activatingConn.Done()
 	}
-	t.activeConn = c
 	t.activeConnMut.Unlock()
-	t.activatingConn.Done()
 	//optional keepalive loop against this connection
-	if t.Config.KeepAlive > 0 {
-		go t.keepAliveLoop(c)
+	if keepAlive.Interval > 0 {
+		if ping {
+			go t.keepAliveLoop(c, keepAlive)
+		} else {
+			reqs = t.expectPings(c, reqs, keepAlive.Interval+keepAlive.Deadline())
+		}
 	}
 	//block until closed
-	go t.handleSSHRequests(reqs)
+	go t.handleSSHRequests(ctx, reqs)
 	go t.handleSSHChannels(chans)
 	t.Debugf("SSH connected")
 	err := c.Wait()
 	t.Debugf("SSH disconnected")
 	//mark inactive and block
-	t.activatingConn.Add(1)
 	t.activeConnMut.Lock()
-	t.activeConn = nil
+	for i, active := range t.activeConns {
+		if active == c {
+			t.activeConns = append(t.activeConns[:i:i], t.activeConns[i+1:]...)
+			break
+		}
+	}
+	if len(t.activeConns) == 0 {
+		t.activatingConn.Add(1)
+	}
 	t.activeConnMut.Unlock()
 	return err
 }
 
+//activeSSH returns one of the active connections
+//in turn, or nil when there is none
+func (t *Tunnel) activeSSH() ssh.Conn {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	if len(t.activeConns) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(&t.nextConn, 1)
+	return t.activeConns[n%uint32(len(t.activeConns))]
+}
+
 //getSSH blocks while connecting
 func (t *Tunnel) getSSH(ctx context.Context) ssh.Conn {
 	//cancelled already?
 	if isDone(ctx) {
 		return nil
 	}
-	t.activeConnMut.RLock()
-	c := t.activeConn
-	t.activeConnMut.RUnlock()
 	//connected already?
-	if c != nil {
+	if c := t.activeSSH(); c != nil {
 		return c
 	}
 	//connecting...
@@ -124,10 +300,7 @@ func (t *Tunnel) getSSH(ctx context.Context) ssh.Conn {
 	case <-time.After(settings.EnvDuration("SSH_WAIT", 35*time.Second)):
 		return nil //a bit longer than ssh timeout
 	case <-t.activatingConnWait():
-		t.activeConnMut.RLock()
-		c := t.activeConn
-		t.activeConnMut.RUnlock()
-		return c
+		return t.activeSSH()
 	}
 }
 
@@ -146,45 +319,321 @@ func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) er
 	if len(remotes) == 0 {
 		return errors.New("no remotes")
 	}
-	if !t.Inbound {
-		return errors.New("inbound connections blocked")
-	}
-	proxies := make([]*Proxy, len(remotes))
-	for i, remote := range remotes {
-		p, err := NewProxy(t.Logger, t, t.proxyCount, remote)
-		if err != nil {
-			return err
-		}
-		proxies[i] = p
-		t.proxyCount++
+	eg, ctx := errgroup.WithContext(ctx)
+	proxies, err := t.bindProxies(ctx, remotes)
+	if err != nil {
+		return err
 	}
 	//TODO: handle tunnel close
-	eg, ctx := errgroup.WithContext(ctx)
 	for _, proxy := range proxies {
 		p := proxy
-		eg.Go(func() error {
-			return p.Run(ctx)
-		})
+		eg.Go(p.run)
 	}
 	t.Debugf("bound proxies")
-	err := eg.Wait()
+	err = eg.Wait()
 	t.Debugf("unbound proxies")
 	return err
 }
 
-func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn) {
-	//ping forever
-	for {
-		time.Sleep(t.Config.KeepAlive)
-		_, b, err := sshConn.SendRequest("ping", true, nil)
+//AddRemotes binds the given remotes alongside the ones already
+//bound, and returns once they are listening. The remotes are
+//added as a whole: if any of them fails to bind, the others
+//are released again before the error is returned.
+func (t *Tunnel) AddRemotes(ctx context.Context, remotes []*settings.Remote) error {
+	proxies, err := t.bindProxies(ctx, remotes)
+	if err != nil {
+		return err
+	}
+	for _, proxy := range proxies {
+		p := proxy
+		go func() {
+			if err := p.run(); err != nil {
+				p.Infof("proxy error: %s", err)
+			}
+		}()
+	}
+	return nil
+}
+
+//RemoveRemotes closes the proxies of the given remotes and waits
+//for them to stop. Nothing is removed unless all of the remotes
+//are currently bound.
+func (t *Tunnel) RemoveRemotes(remotes []*settings.Remote) error {
+	t.proxyMut.Lock()
+	proxies := make([]*boundProxy, len(remotes))
+	for i, r := range remotes {
+		p, ok := t.proxies[r.Encode()]
+		if !ok {
+			t.proxyMut.Unlock()
+			return fmt.Errorf("remote %s is not bound", r)
+		}
+		proxies[i] = p
+	}
+	for _, p := range proxies {
+		delete(t.proxies, p.remote.Encode())
+	}
+	t.proxyMut.Unlock()
+	for _, p := range proxies {
+		p.cancel()
+		<-p.done
+	}
+	return nil
+}
+
+//bindProxies creates and registers a proxy for each
+//remote, rolling back all of them on the first failure
+func (t *Tunnel) bindProxies(ctx context.Context, remotes []*settings.Remote) ([]*boundProxy, error) {
+	if !t.Inbound {
+		return nil, errors.New("inbound connections blocked")
+	}
+	t.proxyMut.Lock()
+	defer t.proxyMut.Unlock()
+	proxies := make([]*boundProxy, 0, len(remotes))
+	rollback := func() {
+		for _, p := range proxies {
+			delete(t.proxies, p.remote.Encode())
+			p.close()
+		}
+	}
+	for _, remote := range remotes {
+		key := remote.Encode()
+		if _, exists := t.proxies[key]; exists {
+			rollback()
+			return nil, fmt.Errorf("remote %s is already bound", remote)
+		}
+		p, err := NewProxy(t.Logger, t, t.proxyCount, remote)
 		if err != nil {
-			break
+			rollback()
+			return nil, err
+		}
+		t.proxyCount++
+		pctx, cancel := context.WithCancel(ctx)
+		bp := &boundProxy{
+			Proxy:  p,
+			tunnel: t,
+			ctx:    pctx,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		t.proxies[key] = bp
+		proxies = append(proxies, bp)
+	}
+	return proxies, nil
+}
+
+//Remotes returns the remotes currently bound by this tunnel
+func (t *Tunnel) Remotes() settings.Remotes {
+	t.proxyMut.Lock()
+	defer t.proxyMut.Unlock()
+	rs := settings.Remotes{}
+	for _, p := range t.proxies {
+		rs = append(rs, p.remote)
+	}
+	return rs
+}
+
+//boundProxy is a proxy registered with its tunnel,
+//which can be individually closed
+type boundProxy struct {
+	*Proxy
+	tunnel *Tunnel
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (p *boundProxy) run() error {
+	defer func() {
+		t := p.tunnel
+		t.proxyMut.Lock()
+		if t.proxies[p.remote.Encode()] == p {
+			delete(t.proxies, p.remote.Encode())
+		}
+		t.proxyMut.Unlock()
+		p.cancel()
+		close(p.done)
+	}()
+	return p.Proxy.Run(p.ctx)
+}
+
+//RequestRemotes asks the peer to bind ("add-remotes") or
+//unbind ("del-remotes") the given remotes on its side
+func RequestRemotes(c ssh.Conn, typ string, remotes settings.Remotes) error {
+	payload := settings.EncodeConfig(settings.Config{Remotes: remotes})
+	ok, reply, err := c.SendRequest(typ, true, payload)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if len(reply) > 0 {
+			return errors.New(string(reply))
 		}
-		if len(b) > 0 && !bytes.Equal(b, []byte("pong")) {
-			t.Debugf("strange ping response")
+		return fmt.Errorf("%s request rejected", typ)
+	}
+	return nil
+}
+
+func (t *Tunnel) admitStream() error {
+	if t.Config.AdmitStream == nil {
+		return nil
+	}
+	return t.Config.AdmitStream()
+}
+
+func (t *Tunnel) udpConfig() UDPConfig {
+	return t.Config.UDP
+}
+
+func (t *Tunnel) framer() *cio.Framer {
+	return t.Config.Framer
+}
+
+func (t *Tunnel) tcpKeepAlive() time.Duration {
+	return t.Config.TCPKeepAlive
+}
+
+func (t *Tunnel) metrics() cmetrics.Sink {
+	return t.Metrics
+}
+
+func (t *Tunnel) listenerConfig() ListenerConfig {
+	return t.Config.Listeners
+}
+
+func (t *Tunnel) terminateTLS() *tls.Config {
+	return t.Config.TerminateTLS
+}
+
+func (t *Tunnel) openStream(remote string, inbound bool) *stream {
+	s := t.streams.open(remote, inbound)
+	t.Metrics.Counter("penguin_streams_opened_total", 1, s.direction())
+	return s
+}
+
+func (t *Tunnel) closeStream(s *stream) {
+	t.streams.close(s)
+	dir := s.direction()
+	t.Metrics.Counter("penguin_streams_closed_total", 1, dir)
+	t.Metrics.Counter("penguin_stream_sent_bytes_total", float64(atomic.LoadInt64(&s.Sent)), dir)
+	t.Metrics.Counter("penguin_stream_received_bytes_total", float64(atomic.LoadInt64(&s.Received)), dir)
+	t.Metrics.Histogram("penguin_stream_duration_seconds", time.Since(s.Opened).Seconds(), dir)
+	if t.Config.RemoteMetrics {
+		remote := cmetrics.L("remote", s.Remote)
+		t.Metrics.Counter("penguin_remote_sent_bytes_total", float64(atomic.LoadInt64(&s.Sent)), remote)
+		t.Metrics.Counter("penguin_remote_received_bytes_total", float64(atomic.LoadInt64(&s.Received)), remote)
+	}
+}
+
+//Stats returns a snapshot of the tunnel's counters and live streams
+func (t *Tunnel) Stats() Stats {
+	open, total := t.connStats.Counts()
+	list, sent, recv := t.streams.snapshot()
+	return Stats{
+		Connections: total,
+		Open:        open,
+		Sent:        sent,
+		Received:    recv,
+		Streams:     list,
+		RTT:         time.Duration(atomic.LoadInt64(&t.rtt)),
+	}
+}
+
+func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn, keepAlive settings.KeepAlive) {
+	misses := keepAlive.Misses
+	if misses < 1 {
+		misses = 1
+	}
+	//ping forever
+	for {
+		time.Sleep(keepAlive.Interval)
+		t0 := time.Now()
+		replied := make(chan error, 1)
+		go func() {
+			_, b, err := sshConn.SendRequest("ping", true, nil)
+			if err == nil && len(b) > 0 && !bytes.Equal(b, []byte("pong")) {
+				err = errors.New("strange ping response")
+				t.Debugf("%s", err)
+			}
+			replied <- err
+		}()
+		//each timeout without the reply counts as a miss,
+		//since further pings would only queue behind it
+		for missed := 0; ; {
+			var timeout <-chan time.Time
+			if keepAlive.Timeout > 0 {
+				timeout = time.After(keepAlive.Timeout)
+			}
+			select {
+			case err := <-replied:
+				if err != nil {
+					sshConn.Close()
+					return
+				}
+			case <-timeout:
+				missed++
+				t.Metrics.Counter("penguin_keepalive_missed_total", 1)
+				if missed < misses {
+					t.Infof("keepalive missed (%d/%d)", missed, misses)
+					continue
+				}
+				t.Infof("keepalive timed out after %s, peer is dead", time.Since(t0).Round(time.Millisecond))
+				//close ssh connection on missing ping response
+				sshConn.Close()
+				return
+			}
 			break
 		}
+		rtt := time.Since(t0)
+		srtt := t.updateRTT(rtt)
+		t.Debugf("keepalive RTT %s (smoothed %s)", rtt.Round(time.Microsecond), srtt.Round(time.Microsecond))
+		t.Metrics.Histogram("penguin_keepalive_rtt_seconds", rtt.Seconds())
+		t.Metrics.Gauge("penguin_keepalive_srtt_seconds", srtt.Seconds())
 	}
-	//close ssh connection on abnormal ping
-	sshConn.Close()
+}
+
+//updateRTT smooths the round-trip time with a new sample,
+//weighing it by 1/8 as TCP does (RFC 6298)
+func (t *Tunnel) updateRTT(sample time.Duration) time.Duration {
+	srtt := time.Duration(atomic.LoadInt64(&t.rtt))
+	if srtt == 0 {
+		srtt = sample
+	} else {
+		srtt += (sample - srtt) / 8
+	}
+	atomic.StoreInt64(&t.rtt, int64(srtt))
+	return srtt
+}
+
+//expectPings passes on the requests of the peer, closing the
+//connection when no ping arrives within d of the previous one
+func (t *Tunnel) expectPings(sshConn ssh.Conn, reqs <-chan *ssh.Request, d time.Duration) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		for {
+			select {
+			case r, ok := <-reqs:
+				if !ok {
+					return
+				}
+				if r.Type == "ping" {
+					if !timer.Stop() {
+						<-timer.C
+					}
+					timer.Reset(d)
+				}
+				out <- r
+			case <-timer.C:
+				t.Infof("no keepalive received in %s", d)
+				sshConn.Close()
+				for r := range reqs {
+					out <- r
+				}
+				return
+			}
+		}
+	}()
+	return out
 }
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"io"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"golang.org/x/crypto/ssh"
+)
+
+//Compress wraps an SSH connection, and its incoming channels,
+//so that the payloads of all channels are compressed with the
+//given algorithm, negotiated by both ends. The wrapped values
+//are then bound instead.
+func Compress(c ssh.Conn, chans <-chan ssh.NewChannel, algorithm string) (ssh.Conn, <-chan ssh.NewChannel) {
+	wrapped := make(chan ssh.NewChannel)
+	go func() {
+		defer close(wrapped)
+		for ch := range chans {
+			wrapped <- &compressedNewChannel{ch, algorithm}
+		}
+	}()
+	return &compressedConn{c, algorithm}, wrapped
+}
+
+type compressedConn struct {
+	ssh.Conn
+	algorithm string
+}
+
+func (c *compressedConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := c.Conn.OpenChannel(name, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	cch, err := compressChannel(ch, c.algorithm)
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	return cch, reqs, nil
+}
+
+type compressedNewChannel struct {
+	ssh.NewChannel
+	algorithm string
+}
+
+func (n *compressedNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := n.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	cch, err := compressChannel(ch, n.algorithm)
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	return cch, reqs, nil
+}
+
+//compressedChannel is an ssh.Channel whose
+//payload is compressed
+type compressedChannel struct {
+	ssh.Channel
+	rwc io.ReadWriteCloser
+}
+
+func compressChannel(ch ssh.Channel, algorithm string) (ssh.Channel, error) {
+	rwc, err := cnet.NewCompressedRWC(ch, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedChannel{Channel: ch, rwc: rwc}, nil
+}
+
+func (c *compressedChannel) Read(b []byte) (int, error) {
+	return c.rwc.Read(b)
+}
+
+func (c *compressedChannel) Write(b []byte) (int, error) {
+	return c.rwc.Write(b)
+}
+
+func (c *compressedChannel) CloseWrite() error {
+	return c.rwc.(interface{ CloseWrite() error }).CloseWrite()
+}
+
+func (c *compressedChannel) Close() error {
+	return c.rwc.Close()
+}
@@ -2,12 +2,18 @@ package tunnel
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jpillora/sizestr"
 	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/cmetrics"
+	"github.com/myzhang1029/penguin/share/cnet"
 	"github.com/myzhang1029/penguin/share/settings"
 	"golang.org/x/crypto/ssh"
 )
@@ -15,6 +21,15 @@ import (
 //sshTunnel exposes a subset of Tunnel to subtypes
 type sshTunnel interface {
 	getSSH(ctx context.Context) ssh.Conn
+	admitStream() error
+	openStream(remote string, inbound bool) *stream
+	closeStream(s *stream)
+	udpConfig() UDPConfig
+	framer() *cio.Framer
+	listenerConfig() ListenerConfig
+	tcpKeepAlive() time.Duration
+	metrics() cmetrics.Sink
+	terminateTLS() *tls.Config
 }
 
 //Proxy is the inbound portion of a Tunnel
@@ -26,38 +41,94 @@ type Proxy struct {
 	remote *settings.Remote
 	dialer net.Dialer
 	tcp    *net.TCPListener
+	unix   *net.UnixListener
+	pipe   net.Listener
 	udp    *udpListener
+	stdio  *cio.FrameListener
+	tun    *os.File
 	mu     sync.Mutex
+	//up and down limit the traffic to and
+	//from the remote, when it is throttled
+	up, down *rateLimiter
+	//conns counts the open connections,
+	//when the remote has a maximum
+	conns int32
+	//targets chooses the target of each
+	//connection, when the remote has several
+	targets *balancer
 }
 
 //NewProxy creates a Proxy
 func NewProxy(logger *cio.Logger, sshTun sshTunnel, index int, remote *settings.Remote) (*Proxy, error) {
 	id := index + 1
 	p := &Proxy{
-		Logger: logger.Fork("proxy#%s", remote.String()),
-		sshTun: sshTun,
-		id:     id,
-		remote: remote,
+		Logger:  logger.Fork("proxy#%s", remote.String()),
+		sshTun:  sshTun,
+		id:      id,
+		remote:  remote,
+		up:      newRateLimiter(remote.Rate),
+		down:    newRateLimiter(remote.Rate),
+		targets: newBalancer(remote),
 	}
 	return p, p.listen()
 }
 
 func (p *Proxy) listen() error {
-	if p.remote.Stdio {
+	if p.remote.Tun {
+		dev, err := cnet.OpenTun(p.remote.LocalHost)
+		if err != nil {
+			return p.Errorf("tun: %s", err)
+		}
+		p.Infof("created tun device %s", dev.Name())
+		p.tun = dev
+	} else if p.remote.Stdio {
 		//TODO check if pipes active?
+		if f := p.sshTun.framer(); f != nil {
+			l, err := f.Listen()
+			if err != nil {
+				return p.Errorf("stdio: %s", err)
+			}
+			p.stdio = l
+		}
 	} else if p.remote.LocalProto == "tcp" {
 		addr, err := net.ResolveTCPAddr("tcp", p.remote.LocalHost+":"+p.remote.LocalPort)
 		if err != nil {
 			return p.Errorf("resolve: %s", err)
 		}
-		l, err := net.ListenTCP("tcp", addr)
+		var l *net.TCPListener
+		if p.remote.Transparent {
+			var transparent bool
+			l, transparent, err = listenTransparent(addr)
+			if err == nil && !transparent {
+				p.Debugf("cannot set IP_TRANSPARENT, only REDIRECT is supported")
+			}
+		} else {
+			l, err = net.ListenTCP("tcp", addr)
+		}
 		if err != nil {
 			return p.Errorf("tcp: %s", err)
 		}
 		p.Infof("listening")
 		p.tcp = l
+	} else if p.remote.LocalProto == "unix" {
+		l, err := cnet.ListenUnix(p.remote.LocalHost)
+		if err != nil {
+			return p.Errorf("unix: %s", err)
+		}
+		p.Infof("listening")
+		p.unix = l
+	} else if p.remote.LocalProto == "npipe" {
+		l, err := cnet.ListenPipe(p.remote.LocalHost)
+		if err != nil {
+			return p.Errorf("npipe: %s", err)
+		}
+		p.Infof("listening")
+		p.pipe = l
 	} else if p.remote.LocalProto == "udp" {
 		l, err := listenUDP(p.Logger, p.sshTun, p.remote)
+		if err == nil {
+			l.up, l.down = p.up, p.down
+		}
 		if err != nil {
 			return err
 		}
@@ -69,13 +140,44 @@ func (p *Proxy) listen() error {
 	return nil
 }
 
+//close releases the listener of a proxy which is not running
+func (p *Proxy) close() {
+	if p.tcp != nil {
+		p.tcp.Close()
+	}
+	if p.unix != nil {
+		p.unix.Close()
+	}
+	if p.pipe != nil {
+		p.pipe.Close()
+	}
+	if p.udp != nil {
+		p.udp.inbound.Close()
+	}
+	if p.stdio != nil {
+		p.stdio.Close()
+	}
+	if p.tun != nil {
+		p.tun.Close()
+	}
+}
+
 //Run enables the proxy and blocks while its active,
 //close the proxy by cancelling the context.
 func (p *Proxy) Run(ctx context.Context) error {
-	if p.remote.Stdio {
+	if p.remote.Check != "" {
+		go p.runChecks(ctx)
+	}
+	if p.remote.Tun {
+		return p.runTun(ctx)
+	} else if p.remote.Stdio {
 		return p.runStdio(ctx)
 	} else if p.remote.LocalProto == "tcp" {
-		return p.runTCP(ctx)
+		return p.runListener(ctx, p.tcp)
+	} else if p.remote.LocalProto == "unix" {
+		return p.runListener(ctx, p.unix)
+	} else if p.remote.LocalProto == "npipe" {
+		return p.runListener(ctx, p.pipe)
 	} else if p.remote.LocalProto == "udp" {
 		return p.udp.run(ctx)
 	}
@@ -84,6 +186,9 @@ func (p *Proxy) Run(ctx context.Context) error {
 
 func (p *Proxy) runStdio(ctx context.Context) error {
 	defer p.Infof("closed")
+	if p.stdio != nil {
+		return p.runFramed(ctx)
+	}
 	for {
 		p.pipeRemote(ctx, cio.Stdio)
 		select {
@@ -95,18 +200,47 @@ func (p *Proxy) runStdio(ctx context.Context) error {
 	}
 }
 
-func (p *Proxy) runTCP(ctx context.Context) error {
+//runFramed accepts the framed streams of the proxy,
+//each of which is a connection to the remote
+func (p *Proxy) runFramed(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.stdio.Close()
+		case <-done:
+		}
+	}()
+	for {
+		src, err := p.stdio.Accept()
+		if err != nil {
+			return nil
+		}
+		go func() {
+			if !p.admitConn(src) {
+				return
+			}
+			defer p.releaseConn()
+			p.pipeRemote(ctx, src)
+		}()
+	}
+}
+
+//runListener accepts the connections of the TCP,
+//unix socket or named pipe listener of the proxy
+func (p *Proxy) runListener(ctx context.Context, l net.Listener) error {
 	done := make(chan struct{})
 	//implements missing net.ListenContext
 	go func() {
 		select {
 		case <-ctx.Done():
-			p.tcp.Close()
+			l.Close()
 		case <-done:
 		}
 	}()
 	for {
-		src, err := p.tcp.Accept()
+		src, err := l.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
@@ -118,33 +252,114 @@ func (p *Proxy) runTCP(ctx context.Context) error {
 			close(done)
 			return err
 		}
-		go p.pipeRemote(ctx, src)
+		cnet.SetKeepAlive(src, p.sshTun.tcpKeepAlive())
+		cnet.TuneTCP(src, p.remote.Nagle, p.remote.SendBuffer, p.remote.ReceiveBuffer)
+		go p.guardRemote(ctx, src)
 	}
 }
 
 func (p *Proxy) pipeRemote(ctx context.Context, src io.ReadWriteCloser) {
+	target := p.remote.Target()
+	if p.targets != nil {
+		i := p.targets.pick()
+		if i < 0 {
+			p.Infof("refused connection, no target is up")
+			src.Close()
+			return
+		}
+		defer p.targets.release(i)
+		if len(p.remote.Targets) > 0 {
+			target = p.remote.ForTarget(i).Target()
+		}
+	}
+	if p.remote.ProxyProtocol {
+		target = withProxyAddrs(target, src)
+	}
+	p.pipeChannel(ctx, src, target, nil)
+}
+
+//pipeChannel pipes src to a channel opened to the given
+//remote of the far end, once handshake (if any) succeeded
+//on the channel
+func (p *Proxy) pipeChannel(ctx context.Context, src io.ReadWriteCloser, remote string, handshake func(dst io.ReadWriter) error) {
 	defer src.Close()
+	l := p.connLogger()
+	l.Debugf("open")
+	//ssh request for tcp connection for this proxy's remote
+	dst := p.openChannel(ctx, l, remote)
+	if dst == nil {
+		return
+	}
+	if handshake != nil {
+		if err := handshake(dst); err != nil {
+			l.Infof("handshake error: %s", err)
+			dst.Close()
+			return
+		}
+	}
+	st := p.sshTun.openStream(p.remote.Remote(), true)
+	defer p.sshTun.closeStream(st)
+	local, channel := p.throttle(src), st.wrapRemote(dst)
+	if p.remote.IdleTimeout > 0 {
+		w := watchIdle(l, p.remote.IdleTimeout, src, dst)
+		defer w.stop()
+		local, channel = w.wrap(local), w.wrap(channel)
+	}
+	//then pipe
+	s, r := cio.Pipe(local, channel)
+	l.Debugf("close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
+}
 
+//connLogger numbers a new connection of the proxy
+func (p *Proxy) connLogger() *cio.Logger {
 	p.mu.Lock()
 	p.count++
 	cid := p.count
 	p.mu.Unlock()
+	return p.Fork("conn#%d", cid)
+}
 
-	l := p.Fork("conn#%d", cid)
-	l.Debugf("open")
+//openChannel opens a channel to the given remote
+//of the far end, or logs why it could not
+func (p *Proxy) openChannel(ctx context.Context, l *cio.Logger, remote string) ssh.Channel {
+	if err := p.sshTun.admitStream(); err != nil {
+		l.Infof("refused: %s", err)
+		return nil
+	}
 	sshConn := p.sshTun.getSSH(ctx)
 	if sshConn == nil {
 		l.Debugf("no remote connection")
-		return
+		return nil
 	}
-	//ssh request for tcp connection for this proxy's remote
-	dst, reqs, err := sshConn.OpenChannel("penguin", []byte(p.remote.Remote()))
+	dst, reqs, err := sshConn.OpenChannel("penguin", []byte(remote))
 	if err != nil {
 		l.Infof("stream error: %s", err)
-		return
+		return nil
 	}
 	go ssh.DiscardRequests(reqs)
-	//then pipe
-	s, r := cio.Pipe(src, dst)
-	l.Debugf("close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
+	return dst
+}
+
+//admitConn counts a connection of the proxy, or refuses
+//it when the remote's maximum of connections is open
+func (p *Proxy) admitConn(src io.Closer) bool {
+	max := int32(p.remote.MaxConns)
+	if max <= 0 {
+		return true
+	}
+	if atomic.AddInt32(&p.conns, 1) > max {
+		atomic.AddInt32(&p.conns, -1)
+		p.Infof("refused connection, %d connections open", max)
+		p.sshTun.metrics().Counter("penguin_remote_refused_total", 1, cmetrics.L("remote", p.remote.String()))
+		src.Close()
+		return false
+	}
+	return true
+}
+
+//releaseConn uncounts a connection of the proxy
+func (p *Proxy) releaseConn() {
+	if p.remote.MaxConns > 0 {
+		atomic.AddInt32(&p.conns, -1)
+	}
 }
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"context"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cmetrics"
+)
+
+//runChecks checks the targets of the proxy
+//every interval, until ctx is done
+func (p *Proxy) runChecks(ctx context.Context) {
+	interval := p.remote.CheckInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for i := range p.targets.active {
+			p.checkTarget(ctx, i)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//checkTarget has the far end check the i-th target,
+//whose state is unknown while there is no connection
+func (p *Proxy) checkTarget(ctx context.Context, i int) {
+	sshConn := p.sshTun.getSSH(ctx)
+	if sshConn == nil {
+		return
+	}
+	name := p.remote.RemoteHost + ":" + p.remote.RemotePort
+	if len(p.remote.Targets) > 0 {
+		name = p.remote.Targets[i]
+	}
+	ch, _, err := sshConn.OpenChannel("penguin", []byte(p.remote.CheckTarget(i)))
+	if err == nil {
+		ch.Close()
+	}
+	up, changed := p.targets.report(i, err == nil)
+	if changed && up {
+		p.Infof("target %s is up", name)
+	} else if changed {
+		p.Infof("target %s is down (%s)", name, err)
+	}
+	state := 0.0
+	if up {
+		state = 1
+	}
+	p.sshTun.metrics().Gauge("penguin_target_up", state,
+		cmetrics.L("remote", p.remote.String()), cmetrics.L("target", name))
+}
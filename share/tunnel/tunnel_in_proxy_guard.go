@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+)
+
+//guardRemote pipes a connection accepted by the proxy
+//once it passed the checks of the tunnel's ListenerConfig
+func (p *Proxy) guardRemote(ctx context.Context, src net.Conn) {
+	c := p.sshTun.listenerConfig()
+	if !c.allows(src.RemoteAddr()) {
+		p.Infof("refused connection from %s", src.RemoteAddr())
+		src.Close()
+		return
+	}
+	if !p.admitConn(src) {
+		return
+	}
+	defer p.releaseConn()
+	if p.remote.TerminateTLS {
+		var ok bool
+		if src, ok = p.terminateTLS(src); !ok {
+			return
+		}
+	}
+	if p.remote.HTTPProxy {
+		p.serveHTTPProxy(ctx, src)
+		return
+	}
+	if p.remote.Transparent {
+		p.serveTransparent(ctx, src)
+		return
+	}
+	if p.remote.SNI {
+		p.serveSNI(ctx, src)
+		return
+	}
+	if p.remote.Socks {
+		p.serveSocks(ctx, src)
+		return
+	}
+	p.pipeRemote(ctx, src)
+}
+
+//readSocksMethods reads the authentication methods
+//which a SOCKS5 client offers after its version
+func readSocksMethods(conn net.Conn) ([]byte, error) {
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(conn, n); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, n[0])
+	_, err := io.ReadFull(conn, methods)
+	return methods, err
+}
+
+//socksGreet negotiates no authentication with a SOCKS5
+//client, which sent its version already
+func socksGreet(conn net.Conn) error {
+	methods, err := readSocksMethods(conn)
+	if err != nil {
+		return err
+	}
+	for _, m := range methods {
+		if m == 0 {
+			_, err := conn.Write([]byte{5, 0})
+			return err
+		}
+	}
+	conn.Write([]byte{5, 0xff})
+	return errors.New("no authentication not offered")
+}
+
+//socksAuthenticate negotiates SOCKS5 username/password
+//authentication (RFC 1929) with a client, which sent
+//its version already
+func socksAuthenticate(conn net.Conn, user, pass string) error {
+	methods, err := readSocksMethods(conn)
+	if err != nil {
+		return err
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == 2
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return errors.New("username/password not offered")
+	}
+	if _, err := conn.Write([]byte{5, 2}); err != nil {
+		return err
+	}
+	//version, then length-prefixed username and password
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != 1 {
+		return errors.New("unsupported authentication version")
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare(username, []byte(user))
+	passOK := subtle.ConstantTimeCompare(password, []byte(pass))
+	if userOK&passOK != 1 {
+		conn.Write([]byte{1, 1})
+		return errors.New("invalid username or password")
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+//socksReplay is a greeted socks connection, which replays
+//a greeting without authentication and the request of the
+//client to the socks server at the far end, and hides the
+//reply to the greeting from the client
+type socksReplay struct {
+	net.Conn
+	replay []byte
+	reply  []byte
+}
+
+func (s *socksReplay) Read(b []byte) (int, error) {
+	if len(s.replay) > 0 {
+		n := copy(b, s.replay)
+		s.replay = s.replay[n:]
+		return n, nil
+	}
+	return s.Conn.Read(b)
+}
+
+func (s *socksReplay) Write(b []byte) (int, error) {
+	n := 0
+	if len(s.reply) < 2 {
+		n = 2 - len(s.reply)
+		if n > len(b) {
+			n = len(b)
+		}
+		s.reply = append(s.reply, b[:n]...)
+		b = b[n:]
+		if len(s.reply) < 2 {
+			return n, nil
+		}
+		if s.reply[0] != 5 || s.reply[1] != 0 {
+			return n, errors.New("socks server requires authentication")
+		}
+	}
+	m, err := s.Conn.Write(b)
+	return n + m, err
+}
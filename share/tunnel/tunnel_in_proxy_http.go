@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+//serveHTTPProxy serves a client of an HTTP proxy remote,
+//dialing the target of its request through the socks
+//server of the far end. CONNECT requests are tunneled,
+//others are forwarded as the only request of the connection.
+func (p *Proxy) serveHTTPProxy(ctx context.Context, src net.Conn) {
+	conn := &httpProxyConn{Conn: src, r: bufio.NewReader(src)}
+	src.SetReadDeadline(time.Now().Add(30 * time.Second))
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		p.Debugf("http proxy request: %s", err)
+		src.Close()
+		return
+	}
+	src.SetReadDeadline(time.Time{})
+	target := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			conn.respond(http.StatusBadRequest)
+			src.Close()
+			return
+		}
+		target = req.URL.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "80")
+		}
+		//one request per connection, so that
+		//each has its own target
+		req.Close = true
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+	}
+	p.pipeChannel(ctx, conn, "socks", func(dst io.ReadWriter) error {
+		if err := socksConnect(dst, target); err != nil {
+			return err
+		}
+		if req.Method == http.MethodConnect {
+			return conn.respond(http.StatusOK)
+		}
+		conn.responded = true
+		return req.Write(dst)
+	})
+}
+
+//httpProxyConn is a client of an HTTP proxy, which
+//is told about failures before the target is connected
+type httpProxyConn struct {
+	net.Conn
+	r         *bufio.Reader
+	responded bool
+}
+
+func (c *httpProxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *httpProxyConn) respond(code int) error {
+	c.responded = true
+	_, err := fmt.Fprintf(c.Conn, "HTTP/1.1 %d %s\r\n\r\n", code, http.StatusText(code))
+	return err
+}
+
+func (c *httpProxyConn) Close() error {
+	if !c.responded {
+		c.respond(http.StatusBadGateway)
+	}
+	return c.Conn.Close()
+}
+
+//socksConnect asks the socks server at the other
+//end of conn to connect to target, without
+//authentication, and waits for its reply
+func socksConnect(conn io.ReadWriter, target string) error {
+	addr, err := socksAddr(target)
+	if err != nil {
+		return err
+	}
+	if _, port, _ := net.SplitHostPort(target); port == "0" {
+		return fmt.Errorf("invalid port '%s'", port)
+	}
+	//greeting, then the connect request
+	req := append([]byte{5, 1, 0, 5, socksConnectCmd, 0}, addr...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return errors.New("socks server requires authentication")
+	}
+	if reply[3] != socksSucceeded {
+		return fmt.Errorf("socks connect failed (%d)", reply[3])
+	}
+	//skip the bound address and port
+	_, _, err = readSocksAddr(conn)
+	return err
+}
@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+//serveSNI pipes a client of an SNI remote to the host
+//named by its TLS ClientHello, which the far end dials
+//if the remote allows it. TLS is not terminated.
+func (p *Proxy) serveSNI(ctx context.Context, src net.Conn) {
+	src.SetReadDeadline(time.Now().Add(30 * time.Second))
+	host, hello, err := peekSNI(src)
+	src.SetReadDeadline(time.Time{})
+	if err != nil {
+		p.Debugf("sni: %s", err)
+		src.Close()
+		return
+	}
+	if !p.remote.AllowsSNI(host) {
+		p.Infof("refused connection from %s to '%s'", src.RemoteAddr(), host)
+		src.Close()
+		return
+	}
+	target := net.JoinHostPort(host, p.remote.RemotePort)
+	if p.remote.ProxyProtocol {
+		target = withProxyAddrs(target, src)
+	}
+	conn := &sniConn{Conn: src, r: io.MultiReader(bytes.NewReader(hello), src)}
+	p.pipeChannel(ctx, conn, target, nil)
+}
+
+//errHelloRead stops the handshake once the ClientHello is read
+var errHelloRead = errors.New("client hello read")
+
+//peekSNI reads the TLS ClientHello from r, returning
+//the server name which it carries and the bytes read
+func peekSNI(r io.Reader) (string, []byte, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, err
+	}
+	if hello.ServerName == "" {
+		return "", nil, errors.New("no server name in the client hello")
+	}
+	return hello.ServerName, buf.Bytes(), nil
+}
+
+//readOnlyConn lets crypto/tls parse a ClientHello,
+//without anything written back to the client
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (c readOnlyConn) Close() error {
+	return nil
+}
+
+func (c readOnlyConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c readOnlyConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//sniConn is a client of an SNI remote, whose
+//ClientHello is read again by the target
+type sniConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
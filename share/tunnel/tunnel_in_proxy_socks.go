@@ -0,0 +1,319 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/sizestr"
+	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/settings"
+	"golang.org/x/sync/errgroup"
+)
+
+//serveSocks serves a client of a socks remote. UDP ASSOCIATE
+//requests are relayed by the proxy itself, as the client
+//sends its datagrams here, others are replayed to the socks
+//server of the far end. SOCKS4 clients are translated.
+func (p *Proxy) serveSocks(ctx context.Context, src net.Conn) {
+	user, pass := p.socksAuth()
+	src.SetDeadline(time.Now().Add(10 * time.Second))
+	version := make([]byte, 1)
+	_, err := io.ReadFull(src, version)
+	if err == nil && version[0] == 4 {
+		p.serveSocks4(ctx, src)
+		return
+	}
+	if err == nil && version[0] != 5 {
+		err = errors.New("unsupported socks version")
+	}
+	if err != nil {
+		p.Debugf("socks request from %s: %s", src.RemoteAddr(), err)
+		src.Close()
+		return
+	}
+	if user != "" {
+		err = socksAuthenticate(src, user, pass)
+	} else {
+		err = socksGreet(src)
+	}
+	if err != nil {
+		p.Infof("socks authentication from %s: %s", src.RemoteAddr(), err)
+		src.Close()
+		return
+	}
+	//version, command and reserved byte, then the address
+	header := make([]byte, 3)
+	var target string
+	var addr []byte
+	if _, err = io.ReadFull(src, header); err == nil {
+		if header[0] != 5 {
+			err = errors.New("unsupported socks version")
+		} else {
+			target, addr, err = readSocksAddr(src)
+		}
+	}
+	if err != nil {
+		p.Debugf("socks request from %s: %s", src.RemoteAddr(), err)
+		src.Close()
+		return
+	}
+	src.SetDeadline(time.Time{})
+	if header[1] == socksAssociateCmd {
+		p.serveSocksUDP(ctx, src, target)
+		return
+	}
+	replay := append([]byte{5, 1, 0}, header...)
+	p.pipeRemote(ctx, &socksReplay{Conn: src, replay: append(replay, addr...)})
+}
+
+//socksAuth returns the credentials which the clients of
+//the proxy must send, if any, those of the remote first
+func (p *Proxy) socksAuth() (string, string) {
+	if p.remote.SocksAuth != "" {
+		return settings.ParseAuth(p.remote.SocksAuth)
+	}
+	c := p.sshTun.listenerConfig()
+	return c.SocksUser, c.SocksPass
+}
+
+//SOCKS4 replies
+const (
+	socks4Granted  = 90
+	socks4Rejected = 91
+)
+
+//serveSocks4 serves a SOCKS4 or SOCKS4a client, which sent
+//its version already, by connecting to its target through
+//the socks server of the far end. SOCKS4 has no passwords,
+//so its clients are refused when the listeners require them.
+func (p *Proxy) serveSocks4(ctx context.Context, src net.Conn) {
+	conn := &socks4Conn{Conn: src}
+	cmd, target, err := readSocks4Request(src)
+	if err == nil && cmd != socksConnectCmd {
+		err = fmt.Errorf("unsupported command %d", cmd)
+	}
+	if user, _ := p.socksAuth(); err == nil && user != "" {
+		err = errors.New("authentication required")
+	}
+	if err != nil {
+		p.Infof("socks4 request from %s: %s", src.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	src.SetDeadline(time.Time{})
+	p.pipeChannel(ctx, conn, "socks", func(dst io.ReadWriter) error {
+		if err := socksConnect(dst, target); err != nil {
+			return err
+		}
+		return conn.reply(socks4Granted)
+	})
+}
+
+//readSocks4Request reads the command and the target of a
+//SOCKS4 request, whose host name follows the user ID in
+//SOCKS4a requests, which have an invalid IP of 0.0.0.x
+func readSocks4Request(r io.Reader) (byte, string, error) {
+	req := make([]byte, 7)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return 0, "", err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(req[1:])))
+	ip := net.IP(req[3:7])
+	if _, err := readSocks4String(r); err != nil {
+		return 0, "", err
+	}
+	if ip[0] != 0 || ip[1] != 0 || ip[2] != 0 || ip[3] == 0 {
+		return req[0], net.JoinHostPort(ip.String(), port), nil
+	}
+	host, err := readSocks4String(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return req[0], net.JoinHostPort(host, port), nil
+}
+
+//readSocks4String reads a null-terminated string
+func readSocks4String(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == 255 {
+			return "", errors.New("string too long")
+		}
+		s = append(s, b[0])
+	}
+}
+
+//socks4Conn is a SOCKS4 client, which is told
+//about failures before the target is connected
+type socks4Conn struct {
+	net.Conn
+	replied bool
+}
+
+func (c *socks4Conn) reply(code byte) error {
+	c.replied = true
+	_, err := c.Conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (c *socks4Conn) Close() error {
+	if !c.replied {
+		c.reply(socks4Rejected)
+	}
+	return c.Conn.Close()
+}
+
+//serveSocksUDP serves a UDP ASSOCIATE request, relaying the
+//datagrams of the client through a channel to the far end,
+//which sends them on, until the client closes src. client
+//is the address which the client expects to send from.
+func (p *Proxy) serveSocksUDP(ctx context.Context, src net.Conn, client string) {
+	defer src.Close()
+	l := p.connLogger()
+	l.Debugf("open udp association")
+	//bind on the address which the client reached
+	local := src.LocalAddr().(*net.TCPAddr)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		l.Infof("udp association: %s", err)
+		socksReply(src, socksFailure, "0.0.0.0:0")
+		return
+	}
+	defer conn.Close()
+	dst := p.openChannel(ctx, l, "socks/udp")
+	if dst == nil {
+		socksReply(src, socksFailure, "0.0.0.0:0")
+		return
+	}
+	st := p.sshTun.openStream(p.remote.Remote(), true)
+	defer p.sshTun.closeStream(st)
+	rwc := st.wrapRemote(dst)
+	defer rwc.Close()
+	if err := socksReply(src, socksSucceeded, conn.LocalAddr().String()); err != nil {
+		l.Debugf("udp association: %s", err)
+		return
+	}
+	a := &socksAssociation{
+		Logger: l,
+		conn:   conn,
+		udpChannel: &udpChannel{
+			r: gob.NewDecoder(rwc),
+			w: gob.NewEncoder(rwc),
+			c: rwc,
+		},
+		client: src.RemoteAddr().(*net.TCPAddr).IP,
+		maxMTU: p.sshTun.udpConfig().MaxSize,
+		up:     p.up,
+		down:   p.down,
+	}
+	//clients which know their address
+	//may only send from it
+	if host, port, err := net.SplitHostPort(client); err == nil && port != "0" {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			a.peer, _ = net.ResolveUDPAddr("udp", client)
+		}
+	}
+	//the association ends with the control
+	//connection, or with the channel
+	stop := sync.Once{}
+	closeAll := func() {
+		stop.Do(func() {
+			src.Close()
+			conn.Close()
+			rwc.Close()
+		})
+	}
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		defer closeAll()
+		_, err := io.Copy(io.Discard, src)
+		return err
+	})
+	eg.Go(func() error {
+		defer closeAll()
+		return a.runInbound()
+	})
+	eg.Go(func() error {
+		defer closeAll()
+		return a.runOutbound()
+	})
+	eg.Wait()
+	l.Debugf("close udp association (sent %s received %s)", sizestr.ToString(atomic.LoadInt64(&st.Sent)), sizestr.ToString(atomic.LoadInt64(&st.Received)))
+}
+
+//socksAssociation relays the datagrams of a socks
+//client, which carry the socks header naming their
+//destination, through a channel
+type socksAssociation struct {
+	*cio.Logger
+	*udpChannel
+	conn   *net.UDPConn
+	client net.IP
+	peerMu sync.Mutex
+	peer   *net.UDPAddr
+	maxMTU int
+	//up and down throttle the association
+	//like the other connections of the remote
+	up, down *rateLimiter
+}
+
+func (a *socksAssociation) runInbound() error {
+	buff := make([]byte, a.maxMTU)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buff)
+		if err != nil {
+			return err
+		}
+		//only accept datagrams of the client, and
+		//reply to the port which it sends from
+		a.peerMu.Lock()
+		if a.peer == nil && addr.IP.Equal(a.client) {
+			a.peer = addr
+		}
+		peer := a.peer
+		a.peerMu.Unlock()
+		if peer == nil || !peer.IP.Equal(addr.IP) || peer.Port != addr.Port {
+			a.Debugf("refused datagram from %s", addr)
+			continue
+		}
+		a.up.wait(n)
+		if err := a.encode(addr.String(), buff[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *socksAssociation) runOutbound() error {
+	for {
+		p := udpPacket{}
+		if err := a.decode(&p); err != nil {
+			return err
+		}
+		a.peerMu.Lock()
+		peer := a.peer
+		a.peerMu.Unlock()
+		if peer == nil {
+			continue
+		}
+		a.down.wait(len(p.Payload))
+		if _, err := a.conn.WriteToUDP(p.Payload, peer); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+//terminateTLS completes the TLS handshake of a client of
+//a remote which terminates TLS, or closes it on failure
+func (p *Proxy) terminateTLS(src net.Conn) (net.Conn, bool) {
+	c := p.sshTun.terminateTLS()
+	if c == nil {
+		p.Infof("refused connection from %s, TLS termination is not enabled", src.RemoteAddr())
+		src.Close()
+		return nil, false
+	}
+	conn := tls.Server(src, c)
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		p.Debugf("tls handshake with %s failed (%s)", src.RemoteAddr(), err)
+		conn.Close()
+		return nil, false
+	}
+	conn.SetDeadline(time.Time{})
+	if conn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		//a LetsEncrypt challenge, answered by the handshake
+		conn.Close()
+		return nil, false
+	}
+	return conn, true
+}
@@ -0,0 +1,30 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+//serveTransparent pipes a connection redirected to a
+//transparent proxy remote to its original destination,
+//dialed through the socks server of the far end
+func (p *Proxy) serveTransparent(ctx context.Context, src net.Conn) {
+	target, err := originalDst(src)
+	if err != nil {
+		p.Infof("original destination: %s", err)
+		src.Close()
+		return
+	}
+	//connections made to the listener itself
+	//would otherwise loop through the tunnel
+	listenPort := p.tcp.Addr().(*net.TCPAddr).Port
+	if target == src.LocalAddr().String() && src.LocalAddr().(*net.TCPAddr).Port == listenPort {
+		p.Infof("refused connection from %s, which was not redirected", src.RemoteAddr())
+		src.Close()
+		return
+	}
+	p.pipeChannel(ctx, src, "socks", func(dst io.ReadWriter) error {
+		return socksConnect(dst, target)
+	})
+}
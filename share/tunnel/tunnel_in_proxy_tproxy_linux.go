@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+//soOriginalDst is SO_ORIGINAL_DST of netfilter,
+//which is also IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+//listenTransparent listens for connections redirected
+//by the firewall. IP_TRANSPARENT (for TPROXY) requires
+//CAP_NET_ADMIN, without which only REDIRECT works.
+func listenTransparent(addr *net.TCPAddr) (*net.TCPListener, bool, error) {
+	transparent := true
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+				if network == "tcp6" {
+					level, opt = syscall.SOL_IPV6, 75 //IPV6_TRANSPARENT
+				}
+				if err := syscall.SetsockoptInt(int(fd), level, opt, 1); err != nil {
+					transparent = false
+				}
+			})
+		},
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, false, err
+	}
+	return l.(*net.TCPListener), transparent, nil
+}
+
+//originalDst recovers the destination of a redirected
+//connection, which is the local address of the connection
+//when it was intercepted with TPROXY
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn.LocalAddr().String(), nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	local := tc.LocalAddr().(*net.TCPAddr)
+	var dst string
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			//sockaddr_in fits in the ipv6_mreq
+			var mreq *syscall.IPv6Mreq
+			mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if serr == nil {
+				sa := mreq.Multiaddr
+				port := binary.BigEndian.Uint16(sa[2:4])
+				dst = net.JoinHostPort(net.IP(sa[4:8]).String(), strconv.Itoa(int(port)))
+			}
+		} else {
+			//sockaddr_in6 fits in the ip6_mtuinfo
+			var info *syscall.IPv6MTUInfo
+			info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if serr == nil {
+				//the port is in network byte order
+				port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+				dst = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+			}
+		}
+	}); err != nil {
+		return "", err
+	}
+	if serr != nil {
+		//not NATed, so intercepted with TPROXY
+		return local.String(), nil
+	}
+	return dst, nil
+}
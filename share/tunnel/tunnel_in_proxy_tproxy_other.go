@@ -0,0 +1,18 @@
+//+build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoTransparent = errors.New("transparent proxies are only supported on Linux")
+
+func listenTransparent(addr *net.TCPAddr) (*net.TCPListener, bool, error) {
+	return nil, false, errNoTransparent
+}
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", errNoTransparent
+}
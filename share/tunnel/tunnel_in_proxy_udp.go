@@ -45,7 +45,7 @@ func listenUDP(l *cio.Logger, sshTun sshTunnel, remote *settings.Remote) (*udpLi
 		sshTun:  sshTun,
 		remote:  remote,
 		inbound: conn,
-		maxMTU:  settings.EnvInt("UDP_MAX_SIZE", 9012),
+		maxMTU:  sshTun.udpConfig().MaxSize,
 	}
 	u.Debugf("UDP max size: %d bytes", u.maxMTU)
 	return u, nil
@@ -60,6 +60,9 @@ type udpListener struct {
 	outbound    *udpChannel
 	sent, recv  int64
 	maxMTU      int
+	//up and down limit the traffic to and
+	//from the remote, when it is throttled
+	up, down *rateLimiter
 }
 
 func (u *udpListener) run(ctx context.Context) error {
@@ -94,6 +97,10 @@ func (u *udpListener) runInbound(ctx context.Context) error {
 		if err != nil {
 			return u.Errorf("read error: %w", err)
 		}
+		if !u.sshTun.listenerConfig().allows(addr) {
+			u.Debugf("refused datagram from %s", addr)
+			continue
+		}
 		//upsert ssh channel
 		uc, err := u.getUDPChan(ctx)
 		if err != nil {
@@ -102,6 +109,7 @@ func (u *udpListener) runInbound(ctx context.Context) error {
 			}
 			return u.Errorf("inbound-udpchan: %w", err)
 		}
+		u.up.wait(n)
 		//send over channel, including source address
 		b := buff[:n]
 		if err := uc.encode(addr.String(), b); err != nil {
@@ -139,6 +147,7 @@ func (u *udpListener) runOutbound(ctx context.Context) error {
 		if err != nil {
 			return u.Errorf("resolve error: %w", err)
 		}
+		u.down.wait(len(p.Payload))
 		n, err := u.inbound.WriteToUDP(p.Payload, addr)
 		if err != nil {
 			return u.Errorf("write error: %w", err)
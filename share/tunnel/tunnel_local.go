@@ -0,0 +1,162 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/myzhang1029/penguin/share/cnet"
+	"golang.org/x/crypto/ssh"
+)
+
+//Dial opens a TCP stream to hostPort through the
+//tunnel, without listening on any local port. It
+//blocks while the tunnel is (re)connecting.
+func (t *Tunnel) Dial(ctx context.Context, hostPort string) (net.Conn, error) {
+	if err := t.admitStream(); err != nil {
+		return nil, err
+	}
+	sshConn := t.getSSH(ctx)
+	if sshConn == nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("tunnel not connected")
+	}
+	ch, reqs, err := sshConn.OpenChannel("penguin", []byte(hostPort))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	st := t.openStream(hostPort, true)
+	return newChannelConn(st.wrapRemote(ch), hostPort, func() {
+		t.closeStream(st)
+	}), nil
+}
+
+//Listener accepts the streams that the peer opens to
+//its address, so reverse remotes can be served in-process
+type Listener struct {
+	tunnel   *Tunnel
+	hostPort string
+	conns    chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+//Listen registers an in-process listener for hostPort. Streams
+//the peer opens to hostPort are accepted from the listener
+//instead of being dialed. hostPort should not be resolvable
+//(e.g. use the reserved .invalid domain), as it shadows any
+//real address of the same name.
+func (t *Tunnel) Listen(hostPort string) (*Listener, error) {
+	t.listenersMut.Lock()
+	defer t.listenersMut.Unlock()
+	if _, ok := t.listeners[hostPort]; ok {
+		return nil, fmt.Errorf("%s is already being listened on", hostPort)
+	}
+	l := &Listener{
+		tunnel:   t,
+		hostPort: hostPort,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	if t.listeners == nil {
+		t.listeners = map[string]*Listener{}
+	}
+	t.listeners[hostPort] = l
+	return l, nil
+}
+
+func (t *Tunnel) listener(hostPort string) *Listener {
+	t.listenersMut.Lock()
+	defer t.listenersMut.Unlock()
+	return t.listeners[hostPort]
+}
+
+//Accept waits for the next stream
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+//Close stops accepting streams, new streams
+//to the address are rejected
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		t := l.tunnel
+		t.listenersMut.Lock()
+		if t.listeners[l.hostPort] == l {
+			delete(t.listeners, l.hostPort)
+		}
+		t.listenersMut.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+//Addr returns the address streams are opened to
+func (l *Listener) Addr() net.Addr {
+	return channelAddr(l.hostPort)
+}
+
+//handleLocal hands an accepted stream to an in-process
+//listener and blocks until it is closed
+func (t *Tunnel) handleLocal(ln *Listener, src io.ReadWriteCloser, st *stream) error {
+	done := make(chan struct{})
+	var once sync.Once
+	conn := newChannelConn(st.wrapLocal(src), ln.hostPort, func() {
+		once.Do(func() { close(done) })
+	})
+	select {
+	case ln.conns <- conn:
+	case <-ln.closed:
+		return errors.New("listener closed")
+	}
+	<-done
+	return nil
+}
+
+//channelConn is a net.Conn over an ssh channel, which
+//has no deadlines or meaningful local address
+type channelConn struct {
+	net.Conn
+	remote  string
+	onClose func()
+	once    sync.Once
+}
+
+func newChannelConn(rwc io.ReadWriteCloser, remote string, onClose func()) net.Conn {
+	return &channelConn{
+		Conn:    cnet.NewRWCConn(rwc),
+		remote:  remote,
+		onClose: onClose,
+	}
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return channelAddr(c.remote)
+}
+
+func (c *channelConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.onClose)
+	return err
+}
+
+type channelAddr string
+
+func (a channelAddr) Network() string {
+	return "penguin"
+}
+
+func (a channelAddr) String() string {
+	return string(a)
+}
@@ -1,11 +1,18 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/jpillora/backoff"
 	"github.com/jpillora/sizestr"
 	"github.com/myzhang1029/penguin/share/cio"
 	"github.com/myzhang1029/penguin/share/cnet"
@@ -13,17 +20,51 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func (t *Tunnel) handleSSHRequests(reqs <-chan *ssh.Request) {
+func (t *Tunnel) handleSSHRequests(ctx context.Context, reqs <-chan *ssh.Request) {
 	for r := range reqs {
 		switch r.Type {
 		case "ping":
 			r.Reply(true, []byte("pong"))
+		case "add-remotes", "del-remotes":
+			t.handleRemotesRequest(ctx, r)
 		default:
 			t.Debugf("unknown request: %s", r.Type)
 		}
 	}
 }
 
+//handleRemotesRequest binds or unbinds remotes on behalf of the peer
+func (t *Tunnel) handleRemotesRequest(ctx context.Context, r *ssh.Request) {
+	failed := func(err error) {
+		t.Debugf("%s failed: %s", r.Type, err)
+		r.Reply(false, []byte(err.Error()))
+	}
+	if t.Config.ValidateRemotes == nil {
+		failed(errors.New("runtime remotes not supported"))
+		return
+	}
+	c, err := settings.DecodeConfig(r.Payload)
+	if err != nil {
+		failed(err)
+		return
+	}
+	if r.Type == "add-remotes" {
+		if err := t.Config.ValidateRemotes(c.Remotes); err != nil {
+			failed(err)
+			return
+		}
+		err = t.AddRemotes(ctx, c.Remotes)
+	} else {
+		err = t.RemoveRemotes(c.Remotes)
+	}
+	if err != nil {
+		failed(err)
+		return
+	}
+	t.Debugf("%s: %v", r.Type, c.Remotes)
+	r.Reply(true, nil)
+}
+
 func (t *Tunnel) handleSSHChannels(chans <-chan ssh.NewChannel) {
 	for ch := range chans {
 		go t.handleSSHChannel(ch)
@@ -31,26 +72,71 @@ func (t *Tunnel) handleSSHChannels(chans <-chan ssh.NewChannel) {
 }
 
 func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
-	if !t.Config.Outbound {
-		t.Debugf("denied outbound connection")
-		ch.Reject(ssh.Prohibited, "Denied outbound connection")
-		return
-	}
 	remote := string(ch.ExtraData())
 	//extract protocol
 	hostPort, proto := settings.L4Proto(remote)
 	udp := proto == "udp"
+	//in-process listeners are allowed explicitly
+	var ln *Listener
+	if !udp {
+		ln = t.listener(hostPort)
+	}
+	if !t.Config.Outbound && ln == nil {
+		t.Debugf("denied outbound connection")
+		ch.Reject(ssh.Prohibited, "Denied outbound connection")
+		return
+	}
 	socks := hostPort == "socks"
 	if socks && t.socksServer == nil {
 		t.Debugf("denied socks request, please enable socks")
 		ch.Reject(ssh.Prohibited, "SOCKS5 is not enabled")
 		return
 	}
+	if !udp && ln == nil && t.handleCheck(ch, hostPort) {
+		return
+	}
+	if err := t.admitStream(); err != nil {
+		t.Debugf("refused stream: %s", err)
+		ch.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+	socket := (strings.HasPrefix(hostPort, "unix:") || strings.HasPrefix(hostPort, "npipe:")) && ln == nil
+	if socket && !t.Config.Unix {
+		t.Debugf("denied unix socket or named pipe request, please enable them")
+		ch.Reject(ssh.Prohibited, "Unix sockets and named pipes are not enabled")
+		return
+	}
+	serial := strings.HasPrefix(hostPort, "serial:") && ln == nil
+	if serial && !t.Config.Serial {
+		t.Debugf("denied serial device request, please enable serial devices")
+		ch.Reject(ssh.Prohibited, "Serial devices are not enabled")
+		return
+	}
+	var tun *os.File
+	if strings.HasPrefix(hostPort, "tun:") && ln == nil {
+		if !t.Config.Tun {
+			t.Debugf("denied tun request, please enable tun")
+			ch.Reject(ssh.Prohibited, "TUN devices are not enabled")
+			return
+		}
+		dev, err := cnet.OpenTun(strings.TrimPrefix(hostPort, "tun:"))
+		if err != nil {
+			t.Debugf("tun: %s", err)
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		tun = dev
+	}
 	sshChan, reqs, err := ch.Accept()
 	if err != nil {
 		t.Debugf("failed to accept stream: %s", err)
+		if tun != nil {
+			tun.Close()
+		}
 		return
 	}
+	st := t.openStream(remote, false)
+	defer t.closeStream(st)
 	stream := io.ReadWriteCloser(sshChan)
 	//cnet.MeterRWC(t.Logger.Fork("sshchan"), sshChan)
 	defer stream.Close()
@@ -59,12 +145,22 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 	//ready to handle
 	t.connStats.Open()
 	l.Debugf("open %s", t.connStats.String())
-	if socks {
-		err = t.handleSocks(stream)
+	if ln != nil {
+		err = t.handleLocal(ln, stream, st)
+	} else if tun != nil {
+		err = t.handleTun(l, st.wrapLocal(stream), tun)
+	} else if socks && udp {
+		err = t.handleSocksUDP(l, st.wrapLocal(stream))
+	} else if socks {
+		err = t.handleSocks(l, st.wrapLocal(stream))
 	} else if udp {
-		err = t.handleUDP(l, stream, hostPort)
+		err = t.handleUDP(l, st.wrapLocal(stream), hostPort)
+	} else if socket {
+		err = t.handleSocket(l, stream, st, hostPort)
+	} else if serial {
+		err = t.handleSerial(l, stream, st, strings.TrimPrefix(hostPort, "serial:"))
 	} else {
-		err = t.handleTCP(l, stream, hostPort)
+		err = t.handleTCP(l, stream, st, hostPort)
 	}
 	t.connStats.Close()
 	errmsg := ""
@@ -74,16 +170,160 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 	l.Debugf("close %s%s", t.connStats.String(), errmsg)
 }
 
-func (t *Tunnel) handleSocks(src io.ReadWriteCloser) error {
-	return t.socksServer.ServeConn(cnet.NewRWCConn(src))
+//handleSocks serves a socks client. BIND requests are
+//served by the tunnel, others are replayed to the socks
+//server, which only knows CONNECT.
+func (t *Tunnel) handleSocks(l *cio.Logger, src io.ReadWriteCloser) error {
+	conn := cnet.NewRWCConn(src)
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+	if version[0] != 5 {
+		return errors.New("unsupported socks version")
+	}
+	if err := socksGreet(conn); err != nil {
+		return err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	target, addr, err := readSocksAddr(conn)
+	if err != nil {
+		return err
+	}
+	if header[1] == socksBindCmd {
+		return t.handleSocksBind(l, conn, target)
+	}
+	replay := append([]byte{5, 1, 0}, header...)
+	return t.socksServer.ServeConn(&socksReplay{Conn: conn, replay: append(replay, addr...)})
+}
+
+//socksResolver resolves the hostnames of
+//SOCKS requests with the tunnel's resolver
+type socksResolver struct {
+	r *cnet.Resolver
+	//upstream leaves hostnames to the upstream proxy
+	upstream bool
+}
+
+func (s socksResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if s.upstream && s.r == nil {
+		//dialed by name
+		return ctx, nil, nil
+	}
+	ips, err := s.r.LookupIP(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+//dialTCP dials the target of a remote
+func (t *Tunnel) dialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := t.Config.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cnet.SetKeepAlive(conn, t.Config.TCPKeepAlive)
+	return conn, nil
+}
+
+//dialRetrying dials the target of a remote, retrying up to
+//retries times with backoff while it fails transiently
+func (t *Tunnel) dialRetrying(l *cio.Logger, addr string, retries int) (net.Conn, error) {
+	if retries > settings.MaxDialRetries {
+		retries = settings.MaxDialRetries
+	}
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    5 * time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+	for {
+		conn, err := t.dialTCP(context.Background(), "tcp", addr)
+		if err == nil || retries <= 0 || !transientDialError(err) {
+			return conn, err
+		}
+		retries--
+		d := b.Duration()
+		l.Debugf("dial failed (%s), retrying in %s", err, d)
+		time.Sleep(d)
+	}
+}
+
+//transientDialError reports whether dialing may succeed
+//if retried, unlike for invalid or unknown addresses
+func transientDialError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var addrErr *net.AddrError
+	return !errors.As(err, &addrErr)
 }
 
-func (t *Tunnel) handleTCP(l *cio.Logger, src io.ReadWriteCloser, hostPort string) error {
-	dst, err := net.Dial("tcp", hostPort)
+func (t *Tunnel) handleTCP(l *cio.Logger, src io.ReadWriteCloser, st *stream, hostPort string) error {
+	options := ""
+	if i := strings.Index(hostPort, "?"); i >= 0 {
+		hostPort, options = hostPort[:i], hostPort[i+1:]
+	}
+	v, _ := url.ParseQuery(options)
+	retries, _ := strconv.Atoi(v.Get("retries"))
+	dst, err := t.dialRetrying(l, hostPort, retries)
+	if err != nil {
+		return err
+	}
+	if options != "" {
+		conn, err := t.applyDialOptions(dst, hostPort, options)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		dst = conn
+	}
+	s, r := cio.Pipe(src, st.wrapRemote(dst))
+	l.Debugf("sent %s received %s", sizestr.ToString(s), sizestr.ToString(r))
+	return nil
+}
+
+//handleSerial bridges the serial device of target,
+//as <path>[?baud=<rate>]
+func (t *Tunnel) handleSerial(l *cio.Logger, src io.ReadWriteCloser, st *stream, target string) error {
+	path, baud := target, 0
+	if i := strings.Index(target, "?baud="); i >= 0 {
+		var err error
+		if baud, err = strconv.Atoi(target[i+len("?baud="):]); err != nil {
+			return fmt.Errorf("invalid baud rate: %s", err)
+		}
+		path = target[:i]
+	}
+	dev, err := cnet.OpenSerial(path, baud)
+	if err != nil {
+		return err
+	}
+	s, r := cio.Pipe(src, st.wrapRemote(dev))
+	l.Debugf("sent %s received %s", sizestr.ToString(s), sizestr.ToString(r))
+	return nil
+}
+
+//handleSocket connects to the unix socket or named pipe of
+//target, which the dialer of the tunnel does not apply to
+func (t *Tunnel) handleSocket(l *cio.Logger, src io.ReadWriteCloser, st *stream, target string) error {
+	var dst net.Conn
+	var err error
+	if path := strings.TrimPrefix(target, "npipe:"); path != target {
+		dst, err = cnet.DialPipe(context.Background(), path)
+	} else {
+		var d net.Dialer
+		dst, err = d.DialContext(context.Background(), "unix", strings.TrimPrefix(target, "unix:"))
+	}
 	if err != nil {
 		return err
 	}
-	s, r := cio.Pipe(src, dst)
+	s, r := cio.Pipe(src, st.wrapRemote(dst))
 	l.Debugf("sent %s received %s", sizestr.ToString(s), sizestr.ToString(r))
 	return nil
 }
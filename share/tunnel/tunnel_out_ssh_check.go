@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//handleCheck answers a health check of the target of ch,
+//as <host>:<port>?check=<tcp|http>[&checkpath=<path>], by
+//accepting ch if the target passes it and rejecting ch
+//otherwise. It reports whether ch was a check.
+func (t *Tunnel) handleCheck(ch ssh.NewChannel, hostPort string) bool {
+	i := strings.Index(hostPort, "?")
+	if i < 0 {
+		return false
+	}
+	options := hostPort[i+1:]
+	v, err := url.ParseQuery(options)
+	if err != nil || v.Get("check") == "" {
+		return false
+	}
+	if err := t.checkTarget(hostPort[:i], options, v); err != nil {
+		t.Debugf("check of %s failed: %s", hostPort[:i], err)
+		ch.Reject(ssh.ConnectionFailed, err.Error())
+		return true
+	}
+	if c, reqs, err := ch.Accept(); err == nil {
+		go ssh.DiscardRequests(reqs)
+		c.Close()
+	}
+	return true
+}
+
+//checkTarget dials target, and for HTTP checks requests the
+//checked path, which must answer with a 2xx or 3xx status
+func (t *Tunnel) checkTarget(target, options string, v url.Values) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dst, err := t.dialTCP(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	conn, err := t.applyDialOptions(dst, target, options)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if v.Get("check") != "http" {
+		return nil
+	}
+	path := v.Get("checkpath")
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+target+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "penguin-check")
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jpillora/sizestr"
+	"github.com/myzhang1029/penguin/share/cio"
+	"github.com/myzhang1029/penguin/share/cnet"
+)
+
+//socksBindTimeout is how long a BIND
+//request waits for its connection
+const socksBindTimeout = 2 * time.Minute
+
+//handleSocksBind serves a BIND request of a socks client,
+//listening for a single connection from target, which is
+//then piped to the client. The client learns the address
+//to give to target from the first reply, and the address
+//of the connection from the second.
+func (t *Tunnel) handleSocksBind(l *cio.Logger, conn net.Conn, target string) error {
+	if !t.Config.Inbound {
+		socksReply(conn, socksUnsupported, "0.0.0.0:0")
+		return errors.New("bind requires reverse port forwarding")
+	}
+	if d := t.Config.Dialer; d != nil && d.Upstream != nil {
+		socksReply(conn, socksUnsupported, "0.0.0.0:0")
+		return errors.New("cannot bind through an upstream proxy")
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		socksReply(conn, socksFailure, "0.0.0.0:0")
+		return err
+	}
+	defer ln.Close()
+	if t.Config.AdmitBind != nil {
+		if err := t.Config.AdmitBind(ln.Addr().String()); err != nil {
+			socksReply(conn, socksNotAllowed, "0.0.0.0:0")
+			return err
+		}
+	}
+	bound := socksBindAddr(ln, target)
+	l.Debugf("socks bind on %s for %s", bound, target)
+	if err := socksReply(conn, socksSucceeded, bound); err != nil {
+		return err
+	}
+	//the client only expects target, when it
+	//knows its address
+	var expected net.IP
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			expected = ip
+		}
+	}
+	ln.SetDeadline(time.Now().Add(socksBindTimeout))
+	var peer *net.TCPConn
+	for peer == nil {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			socksReply(conn, socksFailure, "0.0.0.0:0")
+			return err
+		}
+		if expected != nil && !c.RemoteAddr().(*net.TCPAddr).IP.Equal(expected) {
+			l.Debugf("socks bind refused connection from %s", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		peer = c
+	}
+	ln.Close()
+	defer peer.Close()
+	cnet.SetKeepAlive(peer, t.Config.TCPKeepAlive)
+	if err := socksReply(conn, socksSucceeded, peer.RemoteAddr().String()); err != nil {
+		return err
+	}
+	s, r := cio.Pipe(conn, peer)
+	l.Debugf("socks bind sent %s received %s", sizestr.ToString(s), sizestr.ToString(r))
+	return nil
+}
+
+//socksBindAddr is the address of ln as target would reach
+//it, on the interface which routes towards target
+func socksBindAddr(ln *net.TCPListener, target string) string {
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	if c, err := net.Dial("udp", target); err == nil {
+		defer c.Close()
+		return net.JoinHostPort(c.LocalAddr().(*net.UDPAddr).IP.String(), port)
+	}
+	return net.JoinHostPort("0.0.0.0", port)
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/ccrypto"
+)
+
+//applyDialOptions sends the PROXY protocol header of conn,
+//dialed to addr, and wraps it in TLS as its options say
+func (t *Tunnel) applyDialOptions(conn net.Conn, addr, options string) (net.Conn, error) {
+	v, err := url.ParseQuery(options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options: %s", err)
+	}
+	if addrs, ok := v["proxyproto"]; ok {
+		if _, err := conn.Write(proxyHeader(addrs[0])); err != nil {
+			return nil, err
+		}
+	}
+	return t.originateTLS(conn, addr, v)
+}
+
+//originateTLS wraps conn, dialed to addr, in TLS as its
+//options (tls, ca, insecure and servername) say, if at all
+func (t *Tunnel) originateTLS(conn net.Conn, addr string, v url.Values) (net.Conn, error) {
+	var err error
+	if enabled, _ := strconv.ParseBool(v.Get("tls")); !enabled {
+		return conn, nil
+	}
+	c := &tls.Config{ServerName: v.Get("servername")}
+	if c.ServerName == "" {
+		c.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	c.InsecureSkipVerify, _ = strconv.ParseBool(v.Get("insecure"))
+	if ca := v.Get("ca"); ca != "" {
+		if !t.allowsCA(ca) {
+			return nil, fmt.Errorf("CA bundle '%s' is not allowed", ca)
+		}
+		if c.RootCAs, err = ccrypto.LoadCertPool(ca); err != nil {
+			return nil, err
+		}
+	}
+	tlsConn := tls.Client(conn, c)
+	tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake: %s", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+//allowsCA reports whether ca is one of Config.TLSCAs
+func (t *Tunnel) allowsCA(ca string) bool {
+	for _, allowed := range t.Config.TLSCAs {
+		if ca == allowed {
+			return true
+		}
+	}
+	return false
+}
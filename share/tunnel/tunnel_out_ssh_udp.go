@@ -1,7 +1,10 @@
 package tunnel
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"io"
 	"net"
 	"os"
@@ -9,12 +12,13 @@ import (
 	"time"
 
 	"github.com/myzhang1029/penguin/share/cio"
-	"github.com/myzhang1029/penguin/share/settings"
+	"github.com/myzhang1029/penguin/share/cnet"
 )
 
 func (t *Tunnel) handleUDP(l *cio.Logger, rwc io.ReadWriteCloser, hostPort string) error {
 	conns := &udpConns{
 		Logger: l,
+		dialer: t.Config.Dialer,
 		m:      map[string]*udpConn{},
 	}
 	defer conns.closeAll()
@@ -27,7 +31,9 @@ func (t *Tunnel) handleUDP(l *cio.Logger, rwc io.ReadWriteCloser, hostPort strin
 			c: rwc,
 		},
 		udpConns: conns,
-		maxMTU:   settings.EnvInt("UDP_MAX_SIZE", 9012),
+		maxMTU:   t.Config.UDP.MaxSize,
+		timeout:  t.Config.UDP.IdleTimeout,
+		maxConns: t.Config.UDP.MaxFlows,
 	}
 	h.Debugf("UDP max size: %d bytes", h.maxMTU)
 	for {
@@ -43,7 +49,9 @@ type udpHandler struct {
 	hostPort string
 	*udpChannel
 	*udpConns
-	maxMTU int
+	maxMTU   int
+	timeout  time.Duration
+	maxConns int
 }
 
 func (h *udpHandler) handleWrite(p *udpPacket) error {
@@ -51,40 +59,38 @@ func (h *udpHandler) handleWrite(p *udpPacket) error {
 		return err
 	}
 	//dial now, we know we must write
-	conn, exists, err := h.udpConns.dial(p.Src, h.hostPort)
+	conn, exists, err := h.udpConns.dial(p.Src, h.hostPort, h.maxConns)
+	if err == errTooManyFlows {
+		//drop the packet, like a full queue would
+		h.Debugf("exceeded max udp connections (%d)", h.maxConns)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	//however, we dont know if we must read...
-	//spawn up to <max-conns> go-routines to wait
-	//for a reply.
-	//TODO configurable
-	//TODO++ dont use go-routines, switch to pollable
+	//however, we dont know if we must read,
+	//so wait for replies until the flow is idle
+	//TODO dont use go-routines, switch to pollable
 	//  array of listeners where all listeners are
 	//  sweeped periodically, removing the idle ones
-	const maxConns = 100
 	if !exists {
-		if h.udpConns.len() <= maxConns {
-			go h.handleRead(p, conn)
-		} else {
-			h.Debugf("exceeded max udp connections (%d)", maxConns)
-		}
+		go h.handleRead(p, conn)
 	}
-	_, err = conn.Write(p.Payload)
-	if err != nil {
-		return err
+	//the flow may just have been closed as idle,
+	//which only loses this packet
+	if _, err := conn.Write(p.Payload); err != nil {
+		h.Debugf("write error: %s", err)
 	}
 	return nil
 }
 
 func (h *udpHandler) handleRead(p *udpPacket, conn *udpConn) {
 	//ensure connection is cleaned up
-	defer h.udpConns.remove(conn.id)
+	defer h.udpConns.remove(conn)
 	buff := make([]byte, h.maxMTU)
 	for {
-		//response must arrive within 15 seconds
-		deadline := settings.EnvDuration("UDP_DEADLINE", 15*time.Second)
-		conn.SetReadDeadline(time.Now().Add(deadline))
+		//response must arrive before the flow is idle
+		conn.SetReadDeadline(time.Now().Add(h.timeout))
 		//read response
 		n, err := conn.Read(buff)
 		if err != nil {
@@ -103,18 +109,112 @@ func (h *udpHandler) handleRead(p *udpPacket, conn *udpConn) {
 	}
 }
 
+//handleSocksUDP sends on the datagrams of a socks UDP
+//association, each prefixed by the socks header naming
+//its destination, and returns the replies likewise
+func (t *Tunnel) handleSocksUDP(l *cio.Logger, rwc io.ReadWriteCloser) error {
+	conns := &udpConns{
+		Logger: l,
+		dialer: t.Config.Dialer,
+		m:      map[string]*udpConn{},
+	}
+	defer conns.closeAll()
+	h := &udpHandler{
+		Logger: l,
+		udpChannel: &udpChannel{
+			r: gob.NewDecoder(rwc),
+			w: gob.NewEncoder(rwc),
+			c: rwc,
+		},
+		udpConns: conns,
+		maxMTU:   t.Config.UDP.MaxSize,
+		timeout:  t.Config.UDP.IdleTimeout,
+		maxConns: t.Config.UDP.MaxFlows,
+	}
+	for {
+		p := udpPacket{}
+		if err := h.decode(&p); err != nil {
+			return err
+		}
+		//reserved bytes and fragment number,
+		//fragments are not supported
+		if len(p.Payload) < 3 || p.Payload[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(p.Payload[3:])
+		target, _, err := readSocksAddr(r)
+		if err != nil {
+			h.Debugf("socks datagram: %s", err)
+			continue
+		}
+		//a flow per destination, as the
+		//association has a single source
+		conn, exists, err := conns.dial(target, target, h.maxConns)
+		if err == errTooManyFlows {
+			h.Debugf("exceeded max udp connections (%d)", h.maxConns)
+			continue
+		}
+		if err != nil {
+			h.Debugf("dial %s: %s", target, err)
+			continue
+		}
+		if !exists {
+			go h.handleSocksRead(p.Src, conn)
+		}
+		if _, err := conn.Write(p.Payload[len(p.Payload)-r.Len():]); err != nil {
+			h.Debugf("write error: %s", err)
+		}
+	}
+}
+
+//handleSocksRead returns the replies of a flow of a
+//socks UDP association, prefixed by their source
+func (h *udpHandler) handleSocksRead(src string, conn *udpConn) {
+	defer h.udpConns.remove(conn)
+	addr, err := socksAddr(conn.RemoteAddr().String())
+	if err != nil {
+		h.Debugf("socks datagram: %s", err)
+		return
+	}
+	header := append([]byte{0, 0, 0}, addr...)
+	buff := make([]byte, len(header)+h.maxMTU)
+	copy(buff, header)
+	for {
+		conn.SetReadDeadline(time.Now().Add(h.timeout))
+		n, err := conn.Read(buff[len(header):])
+		if err != nil {
+			if !os.IsTimeout(err) && err != io.EOF {
+				h.Debugf("read error: %s", err)
+			}
+			return
+		}
+		if err := h.encode(src, buff[:len(header)+n]); err != nil {
+			h.Debugf("encode error: %s", err)
+			return
+		}
+	}
+}
+
 type udpConns struct {
 	*cio.Logger
 	sync.Mutex
-	m map[string]*udpConn
+	dialer *cnet.Dialer
+	m      map[string]*udpConn
 }
 
-func (cs *udpConns) dial(id, addr string) (*udpConn, bool, error) {
+var errTooManyFlows = errors.New("too many udp flows")
+
+//dial returns the flow of id, dialing addr if there is
+//none yet and fewer than max flows
+func (cs *udpConns) dial(id, addr string, max int) (*udpConn, bool, error) {
 	cs.Lock()
 	defer cs.Unlock()
 	conn, ok := cs.m[id]
 	if !ok {
-		c, err := net.Dial("udp", addr)
+		if len(cs.m) >= max {
+			return nil, false, errTooManyFlows
+		}
+		c, err := cs.dialer.DialContext(context.Background(), "udp", addr)
 		if err != nil {
 			return nil, false, err
 		}
@@ -127,17 +227,13 @@ func (cs *udpConns) dial(id, addr string) (*udpConn, bool, error) {
 	return conn, ok, nil
 }
 
-func (cs *udpConns) len() int {
-	cs.Lock()
-	l := len(cs.m)
-	cs.Unlock()
-	return l
-}
-
-func (cs *udpConns) remove(id string) {
+func (cs *udpConns) remove(conn *udpConn) {
 	cs.Lock()
-	delete(cs.m, id)
+	if cs.m[conn.id] == conn {
+		delete(cs.m, conn.id)
+	}
 	cs.Unlock()
+	conn.Close()
 }
 
 func (cs *udpConns) closeAll() {
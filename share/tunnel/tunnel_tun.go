@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/myzhang1029/penguin/share/cio"
+)
+
+//tunConn carries the packets of a TUN device as a stream,
+//each prefixed with its length (2 bytes, big-endian)
+type tunConn struct {
+	dev     *os.File
+	rbuf    []byte
+	pending []byte
+	wbuf    []byte
+}
+
+func newTunConn(dev *os.File) *tunConn {
+	//clear the deadline which closed the previous stream
+	dev.SetReadDeadline(time.Time{})
+	return &tunConn{dev: dev, rbuf: make([]byte, 2+0xffff)}
+}
+
+func (c *tunConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		n, err := c.dev.Read(c.rbuf[2:])
+		if err != nil {
+			if os.IsTimeout(err) {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(c.rbuf, uint16(n))
+		c.pending = c.rbuf[:2+n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *tunConn) Write(b []byte) (int, error) {
+	c.wbuf = append(c.wbuf, b...)
+	for len(c.wbuf) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < size {
+			break
+		}
+		//packets are dropped while the device is down
+		if _, err := c.dev.Write(c.wbuf[2:size]); errors.Is(err, os.ErrClosed) {
+			return 0, err
+		}
+		c.wbuf = c.wbuf[size:]
+	}
+	return len(b), nil
+}
+
+//Close ends the stream, leaving the device open
+func (c *tunConn) Close() error {
+	return c.dev.SetReadDeadline(time.Now())
+}
+
+//runTun bridges the device of a tun remote with the far
+//end, reconnecting while the proxy is active
+func (p *Proxy) runTun(ctx context.Context) error {
+	defer p.Infof("closed")
+	defer p.tun.Close()
+	for {
+		p.pipeRemote(ctx, newTunConn(p.tun))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+			//the connection may not be ready,
+			//or the far end refused the device
+		}
+	}
+}
+
+//handleTun bridges a stream with a TUN device,
+//closing the device once the stream ends
+func (t *Tunnel) handleTun(l *cio.Logger, src io.ReadWriteCloser, dev *os.File) error {
+	defer dev.Close()
+	l.Infof("bridging tun device %s", dev.Name())
+	cio.Pipe(src, newTunConn(dev))
+	return nil
+}
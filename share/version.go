@@ -1,9 +1,23 @@
 package chshare
 
+import "github.com/myzhang1029/penguin/share/settings"
+
 //ProtocolVersion of penguin. When backwards
 //incompatible changes are made, this will
-//be incremented to signify a protocol
-//mismatch.
+//be incremented, and clients and servers
+//use the newest version which both support.
 const ProtocolVersion = "penguin-v1"
 
+//MinProtocolVersion is the oldest protocol version which
+//is still supported, so that clients and servers of
+//neighbouring releases negotiate one during rolling
+//upgrades
+const MinProtocolVersion = "penguin-v1"
+
+//ProtocolVersions are the supported protocol
+//versions, newest first
+func ProtocolVersions() []string {
+	return settings.ProtocolVersions(MinProtocolVersion, ProtocolVersion)
+}
+
 var BuildVersion = "0.0.0-src"
@@ -1,10 +1,17 @@
 package e2e_test
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
 	"testing"
+	"time"
 
 	chclient "github.com/myzhang1029/penguin/client"
 	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/share/ccrypto"
 )
 
 //TODO tests for:
@@ -46,3 +53,108 @@ func TestAuth(t *testing.T) {
 		t.Fatalf("expected exclamation mark added again")
 	}
 }
+
+func TestAuthTOTP(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	authfile, err := ioutil.TempFile("", "users*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(authfile.Name())
+	authfile.WriteString(`{"foo:bar": {"addrs": [""], "totp": "` + secret + `"}}`)
+	authfile.Close()
+	key, _ := ccrypto.DecodeTOTPSecret(secret)
+	for _, test := range []struct {
+		auth string
+		ok   bool
+	}{
+		{"foo:bar:" + ccrypto.TOTP(key, time.Now()), true},
+		{"foo:bar:000000", false},
+		{"foo:bar", false},
+	} {
+		tmpPort := availablePort()
+		teardown := simpleSetup(t,
+			&chserver.Config{
+				AuthFile: authfile.Name(),
+			},
+			&chclient.Config{
+				Remotes: []string{tmpPort + ":$FILEPORT"},
+				Auth:    test.auth,
+			})
+		result, err := post("http://localhost:"+tmpPort, "foo")
+		teardown()
+		if test.ok && (err != nil || result != "foo!") {
+			t.Fatalf("expected %s to authenticate, got %v", test.auth, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("expected %s to be rejected", test.auth)
+		}
+	}
+}
+
+func TestAuthRetryNetworkOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := availablePort()
+	server, err := chserver.NewServer(&chserver.Config{Auth: "foo:bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:        "http://127.0.0.1:" + port,
+		Remotes:       []string{availablePort() + ":127.0.0.1:1"},
+		Auth:          "foo:wrong",
+		MaxRetryCount: -1,
+		RetryOn:       "network-only",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//the client gives up instead of retrying forever
+	if err := client.Wait(); !errors.Is(err, chclient.ErrAuth) {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+}
+
+func TestRetryOnBusyReverse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//the reverse port is in use on the server
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := availablePort()
+	server, err := chserver.NewServer(&chserver.Config{Auth: "foo:bar", Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:           "http://127.0.0.1:" + port,
+		Remotes:          []string{"R:" + busy.Addr().String() + ":127.0.0.1:1"},
+		Auth:             "foo:bar",
+		MaxRetryCount:    1,
+		MaxRetryInterval: 10 * time.Millisecond,
+		RetryOn:          "network-only",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//the port may be free again, so this is retried
+	if err := client.Wait(); !errors.Is(err, chclient.ErrGaveUp) {
+		t.Fatalf("expected the client to retry, got %v", err)
+	}
+}
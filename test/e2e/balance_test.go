@@ -0,0 +1,111 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestBalanceTargets(t *testing.T) {
+	aPort, aCloser := namedEcho(t, "a:")
+	defer aCloser()
+	bPort, bCloser := namedEcho(t, "b:")
+	defer bCloser()
+	rrPort := availablePort()
+	lcPort := availablePort()
+	targets := ":127.0.0.1:" + aPort + ",127.0.0.1:" + bPort
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{
+				rrPort + targets,
+				lcPort + targets + "?lb=leastconn",
+			},
+		})
+	defer teardown()
+	echo := func(port string) (net.Conn, string) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("x"))
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		return conn, string(b)
+	}
+	//in turns
+	for i, expected := range []string{"a:x", "b:x", "a:x", "b:x"} {
+		conn, got := echo(rrPort)
+		conn.Close()
+		if got != expected {
+			t.Fatalf("connection #%d expected %s, got %s", i+1, expected, got)
+		}
+	}
+	//to the target with fewer connections
+	held, got := echo(lcPort)
+	defer held.Close()
+	if got != "a:x" {
+		t.Fatalf("expected a:x, got %s", got)
+	}
+	for i := 0; i < 3; i++ {
+		//the previous connection is
+		//released once its pipe ends
+		time.Sleep(50 * time.Millisecond)
+		conn, got := echo(lcPort)
+		conn.Close()
+		if got != "b:x" {
+			t.Fatalf("expected b:x while a has a connection, got %s", got)
+		}
+	}
+}
+
+func TestCheckTargets(t *testing.T) {
+	aPort, aCloser := namedEcho(t, "a:")
+	defer aCloser()
+	//nothing listens on the other targets
+	deadPort := availablePort()
+	checkedPort := availablePort()
+	downPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{
+				checkedPort + ":127.0.0.1:" + deadPort + ",127.0.0.1:" + aPort + "?check=tcp&checkinterval=1s",
+				downPort + ":127.0.0.1:" + deadPort + "?check=tcp&checkinterval=1s",
+			},
+		})
+	defer teardown()
+	//the dead targets fail their second check
+	time.Sleep(1500 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+checkedPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("x"))
+		b := make([]byte, 3)
+		_, err = io.ReadFull(conn, b)
+		conn.Close()
+		if err != nil || string(b) != "a:x" {
+			t.Fatalf("connection #%d expected a:x, got %q (%v)", i+1, b, err)
+		}
+	}
+	//connections are refused while all targets are down
+	conn, err := net.Dial("tcp", "127.0.0.1:"+downPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
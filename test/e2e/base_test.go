@@ -26,6 +26,26 @@ func TestBase(t *testing.T) {
 	}
 }
 
+func TestPortRange(t *testing.T) {
+	ports := []string{availablePort(), availablePort()}
+	//both local ports forward to the file server
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{ports[0] + "," + ports[1] + ":127.0.0.1:$FILEPORT"},
+		})
+	defer teardown()
+	for _, port := range ports {
+		result, err := post("http://localhost:"+port, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "foo!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+}
+
 func TestReverse(t *testing.T) {
 	tmpPort := availablePort()
 	//setup server, client, fileserver
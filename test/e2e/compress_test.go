@@ -0,0 +1,87 @@
+package e2e_test
+
+import (
+	"strings"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestCompress(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		server []string
+		client []string
+	}{
+		{"zstd", []string{"zstd", "snappy"}, []string{"zstd"}},
+		{"snappy", []string{"zstd", "snappy"}, []string{"snappy", "zstd"}},
+		{"none", []string{"snappy"}, []string{"zstd"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpPort := availablePort()
+			revPort := availablePort()
+			teardown := simpleSetup(t,
+				&chserver.Config{
+					Reverse:  true,
+					Compress: tc.server,
+				},
+				&chclient.Config{
+					Remotes: []string{
+						tmpPort + ":$FILEPORT",
+						"R:" + revPort + ":$FILEPORT",
+					},
+					Compress: tc.client,
+				})
+			defer teardown()
+			body := strings.Repeat("compressible ", 1<<14)
+			for _, port := range []string{tmpPort, revPort} {
+				result, err := post("http://localhost:"+port, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result != body+"!" {
+					t.Fatalf("expected the body with an exclamation mark added, got %d bytes", len(result))
+				}
+			}
+		})
+	}
+}
+
+func TestCompressUnsupported(t *testing.T) {
+	_, err := chserver.NewServer(&chserver.Config{Compress: []string{"gzip"}})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported compression")
+	}
+}
+
+func TestWsCompress(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		server bool
+	}{
+		{"deflate", true},
+		{"refused", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpPort := availablePort()
+			teardown := simpleSetup(t,
+				&chserver.Config{
+					WsCompress: tc.server,
+				},
+				&chclient.Config{
+					Remotes:    []string{tmpPort + ":$FILEPORT"},
+					WsCompress: true,
+				})
+			defer teardown()
+			body := strings.Repeat("compressible ", 1<<14)
+			result, err := post("http://localhost:"+tmpPort, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != body+"!" {
+				t.Fatalf("payload corrupted (got %d bytes, expected %d)", len(result), len(body)+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package e2e_test
+
+import (
+	"strings"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestDNS(t *testing.T) {
+	tmpPort := availablePort()
+	revPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Reverse: true,
+			DNSZone: "tunnel.penguin.test",
+			DNSPort: availablePort(),
+		},
+		&chclient.Config{
+			Remotes: []string{
+				tmpPort + ":$FILEPORT",
+				"R:" + revPort + ":$FILEPORT",
+			},
+			Transport: "dns",
+		})
+	defer teardown()
+	//larger than a query or an answer
+	body := strings.Repeat("foo", 1000)
+	for _, port := range []string{tmpPort, revPort} {
+		result, err := post("http://localhost:"+port, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != body+"!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+}
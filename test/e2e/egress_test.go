@@ -0,0 +1,67 @@
+package e2e_test
+
+import (
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+//sourceServer replies with the source IP of each connection
+func sourceServer(t *testing.T) (port string, closer func()) {
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			c.Write([]byte(host))
+			c.Close()
+		}
+	}()
+	_, port, _ = net.SplitHostPort(l.Addr().String())
+	return port, func() { l.Close() }
+}
+
+func TestEgressBind(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux routes all of 127.0.0.0/8 to the loopback")
+	}
+	port, closer := sourceServer(t)
+	defer closer()
+	tmpPort1 := availablePort()
+	tmpPort2 := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			EgressBind: []string{"127.0.0.2", "localhost:*=127.0.0.3"},
+		},
+		&chclient.Config{
+			Remotes: []string{
+				tmpPort1 + ":127.0.0.1:" + port,
+				tmpPort2 + ":localhost:" + port,
+			},
+		})
+	defer teardown()
+	for port, source := range map[string]string{tmpPort1: "127.0.0.2", tmpPort2: "127.0.0.3"} {
+		c, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != source {
+			t.Fatalf("expected the connection to come from %s, got '%s'", source, b)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package e2e_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/share/cio"
+)
+
+//syncBuffer is a bytes.Buffer which the loggers can share
+type syncBuffer struct {
+	mut sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.buf.String()
+}
+
+func TestEmbedLoggerDial(t *testing.T) {
+	logs := &syncBuffer{}
+	logger := cio.NewLogger("embedded")
+	logger.SetOutput(logs)
+	logger.Info = true
+	var clientDials, serverDials int32
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Logger: logger,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&serverDials, 1)
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Logger:  logger,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&clientDials, 1)
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil || result != "foo!" {
+		t.Fatalf("expected exclamation mark added, got %v", err)
+	}
+	if atomic.LoadInt32(&clientDials) == 0 || atomic.LoadInt32(&serverDials) == 0 {
+		t.Fatal("expected the injected dialers to be used")
+	}
+	for _, prefix := range []string{"embedded: server: ", "embedded: client: "} {
+		if !strings.Contains(logs.String(), prefix) {
+			t.Fatalf("expected logs with prefix '%s', got:\n%s", prefix, logs.String())
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package e2e_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+//startServer starts a server on port until ctx is done
+func startServer(ctx context.Context, t *testing.T, port string) *chserver.Server {
+	server, err := chserver.NewServer(&chserver.Config{KeySeed: "failover"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Debug = debug
+	if err := server.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+//waitSessions waits for the server to have n sessions
+func waitSessions(t *testing.T, server *chserver.Server, n int) {
+	for i := 0; i < 50; i++ {
+		if len(server.Sessions()) == n {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("expected %d sessions, got %d", n, len(server.Sessions()))
+}
+
+func TestFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	primaryPort := availablePort()
+	secondaryPort := availablePort()
+	secondary := startServer(ctx, t, secondaryPort)
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:        "http://127.0.0.1:" + primaryPort,
+		Failover:      []string{"http://127.0.0.1:" + secondaryPort},
+		Failback:      100 * time.Millisecond,
+		MaxRetryCount: -1,
+		Remotes:       []string{availablePort() + ":127.0.0.1:1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Debug = debug
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//the primary is down, so the client fails over
+	waitSessions(t, secondary, 1)
+	//and returns once it is back up
+	primary := startServer(ctx, t, primaryPort)
+	waitSessions(t, primary, 1)
+	waitSessions(t, secondary, 0)
+	cancel()
+	client.Wait()
+}
+
+func TestPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ports := []string{availablePort(), availablePort()}
+	servers := []*chserver.Server{startServer(ctx, t, ports[0]), startServer(ctx, t, ports[1])}
+	//each server reaches its own /health
+	tmpPort := availablePort()
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:        "http://127.0.0.1:" + ports[0],
+		Pool:          []string{"http://127.0.0.1:" + ports[1]},
+		MaxRetryCount: -1,
+		Remotes:       []string{tmpPort + ":127.0.0.1:" + ports[0]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Debug = debug
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitSessions(t, servers[0], 1)
+	waitSessions(t, servers[1], 1)
+	//streams are spread over both sessions
+	for i := 0; i < 4; i++ {
+		if _, err := post("http://localhost:"+tmpPort, "foo"); err != nil {
+			t.Fatal(err)
+		}
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	}
+	for i, s := range servers {
+		if n := s.Sessions()[0].Tunnel.Connections; n == 0 {
+			t.Fatalf("expected server %d to carry streams", i)
+		}
+	}
+	cancel()
+	client.Wait()
+}
+
+func TestBond(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := availablePort()
+	server := startServer(ctx, t, port)
+	tmpPort := availablePort()
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:        "http://127.0.0.1:" + port,
+		Bond:          2,
+		MaxRetryCount: -1,
+		Remotes:       []string{tmpPort + ":127.0.0.1:" + port},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Debug = debug
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitSessions(t, server, 2)
+	//streams are spread over both connections
+	for i := 0; i < 4; i++ {
+		if _, err := post("http://localhost:"+tmpPort, "foo"); err != nil {
+			t.Fatal(err)
+		}
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	}
+	for i, s := range server.Sessions() {
+		if s.Tunnel.Connections == 0 {
+			t.Fatalf("expected connection %d to carry streams", i)
+		}
+	}
+	cancel()
+	client.Wait()
+}
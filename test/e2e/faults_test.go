@@ -0,0 +1,41 @@
+package e2e_test
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestShortReadsWrites(t *testing.T) {
+	os.Setenv("PENGUIN_FAULTS", "short-read,short-write")
+	defer os.Unsetenv("PENGUIN_FAULTS")
+	tmpPort := availablePort()
+	tmpPort2 := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Reverse: true,
+		},
+		&chclient.Config{
+			Remotes: []string{
+				tmpPort + ":$FILEPORT",
+				"R:" + tmpPort2 + ":$FILEPORT",
+			},
+		})
+	defer teardown()
+	b := make([]byte, 512*1024)
+	rand.Read(b)
+	body := hex.EncodeToString(b)
+	for _, port := range []string{tmpPort, tmpPort2} {
+		result, err := post("http://localhost:"+port, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != body+"!" {
+			t.Fatalf("payload corrupted (got %d bytes, expected %d)", len(result), len(body)+1)
+		}
+	}
+}
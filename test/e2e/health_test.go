@@ -0,0 +1,98 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestHealth(t *testing.T) {
+	tmpPort := availablePort()
+	conf := testLayout{
+		server: &chserver.Config{
+			Auth:        "foo:bar",
+			HealthToken: "hunter2",
+		},
+		client: &chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Auth:    "foo:bar",
+		},
+		fileServer: true,
+	}
+	_, _, teardown := conf.setup(t)
+	defer teardown()
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	health := conf.client.Server + "/health"
+	//plain health checks are unchanged
+	resp, err := http.Get(health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "OK\n" {
+		t.Fatalf("expected OK, got '%s'", b)
+	}
+	resp, err = http.Get(health + "?format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the token to be required, got %s", resp.Status)
+	}
+	req, _ := http.NewRequest("GET", health, nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer hunter2")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	h := &chserver.Health{}
+	if err := json.NewDecoder(resp.Body).Decode(h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Sessions != 1 || h.UserSessions["foo"] != 1 {
+		t.Fatalf("expected one session of foo, got %d, %v", h.Sessions, h.UserSessions)
+	}
+	if h.BytesProxied == 0 {
+		t.Fatal("expected bytes to have been proxied")
+	}
+}
+
+func TestHealthNoToken(t *testing.T) {
+	tmpPort := availablePort()
+	conf := testLayout{
+		server: &chserver.Config{Auth: "foo:bar"},
+		client: &chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Auth:    "foo:bar",
+		},
+		fileServer: true,
+	}
+	_, _, teardown := conf.setup(t)
+	defer teardown()
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(conf.client.Server + "/health?format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	h := &chserver.Health{}
+	if err := json.NewDecoder(resp.Body).Decode(h); err != nil {
+		t.Fatal(err)
+	}
+	//without a token, the usernames stay private
+	if h.Sessions != 1 || h.UserSessions != nil {
+		t.Fatalf("expected one anonymous session, got %d, %v", h.Sessions, h.UserSessions)
+	}
+}
@@ -0,0 +1,44 @@
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestHooks(t *testing.T) {
+	tmpPort := availablePort()
+	connected := make(chan chclient.Session, 1)
+	disconnected := make(chan chclient.Session, 1)
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			OnConnect: func(sess chclient.Session) {
+				connected <- sess
+			},
+			OnDisconnect: func(sess chclient.Session, err error) {
+				disconnected <- sess
+			},
+		})
+	var sess chclient.Session
+	select {
+	case sess = <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected OnConnect to be called")
+	}
+	if sess.RequestID == "" || len(sess.Ports) != 1 || sess.Ports[0] != "0.0.0.0:"+tmpPort+"/tcp" {
+		t.Fatalf("unexpected session %+v", sess)
+	}
+	teardown()
+	select {
+	case d := <-disconnected:
+		if d.RequestID != sess.RequestID {
+			t.Fatalf("expected the same session, got %+v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected OnDisconnect to be called")
+	}
+}
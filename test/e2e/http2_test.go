@@ -0,0 +1,50 @@
+package e2e_test
+
+import (
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestHTTP2(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		transport string
+		tls       bool
+	}{
+		{"h2c", "http2", false},
+		{"h2", "http2", true},
+		{"grpc-h2c", "grpc", false},
+		{"grpc", "grpc", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpPort := availablePort()
+			revPort := availablePort()
+			server := &chserver.Config{Reverse: true}
+			client := &chclient.Config{
+				Remotes: []string{
+					tmpPort + ":$FILEPORT",
+					"R:" + revPort + ":$FILEPORT",
+				},
+				Transport: tc.transport,
+			}
+			if tc.tls {
+				server.TLS.Key = "tls/server-crt/server.key"
+				server.TLS.Cert = "tls/server-crt/server.crt"
+				client.TLS.SkipVerify = true
+			}
+			teardown := simpleSetup(t, server, client)
+			defer teardown()
+			for _, port := range []string{tmpPort, revPort} {
+				result, err := post("http://localhost:"+port, "foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result != "foo!" {
+					t.Fatalf("expected exclamation mark added")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package e2e_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestHTTPProxyRemote(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer ts.Close()
+	echoPort, closer := namedEcho(t, "foo:")
+	defer closer()
+	proxyPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true},
+		&chclient.Config{
+			Remotes: []string{proxyPort + ":httpproxy"},
+		})
+	defer teardown()
+	proxyURL, _ := url.Parse("http://127.0.0.1:" + proxyPort)
+	//plain requests are forwarded
+	hc := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   2 * time.Second,
+	}
+	resp, err := hc.Get(ts.URL + "/world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hello /world" {
+		t.Fatalf("expected hello /world, got %q", b)
+	}
+	//CONNECT requests are tunneled
+	conn, err := net.Dial("tcp", "127.0.0.1:"+proxyPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:%s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\n\r\n", echoPort, echoPort)
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT to succeed, got %s", resp.Status)
+	}
+	conn.Write([]byte("hi"))
+	b = make([]byte, 16)
+	n, err := br.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "foo:hi" {
+		t.Fatalf("expected foo:hi, got %q", b[:n])
+	}
+}
+
+func TestHTTPProxyRemoteNoSocks(t *testing.T) {
+	proxyPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{proxyPort + ":httpproxy"},
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+proxyPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected a bad gateway, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,45 @@
+package e2e_test
+
+import (
+	"strings"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"golang.org/x/net/icmp"
+)
+
+func TestICMP(t *testing.T) {
+	//raw sockets need privileges
+	pc, err := icmp.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("no raw sockets: %s", err)
+	}
+	pc.Close()
+	tmpPort := availablePort()
+	revPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Reverse: true,
+			ICMP:    true,
+		},
+		&chclient.Config{
+			Remotes: []string{
+				tmpPort + ":$FILEPORT",
+				"R:" + revPort + ":$FILEPORT",
+			},
+			Transport: "icmp",
+		})
+	defer teardown()
+	//larger than an echo payload
+	body := strings.Repeat("foo", 1000)
+	for _, port := range []string{tmpPort, revPort} {
+		result, err := post("http://localhost:"+port, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != body+"!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	echoPort, closer := namedEcho(t, "echo:")
+	defer closer()
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":127.0.0.1:" + echoPort + "?idle=1s"},
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	//an active connection stays open
+	for i := 0; i < 6; i++ {
+		conn.Write([]byte("x"))
+		b := make([]byte, len("echo:x"))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	//an idle one is closed
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("expected the connection to be closed within 2s, took %s", d)
+	}
+}
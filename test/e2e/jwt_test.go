@@ -0,0 +1,71 @@
+package e2e_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func signJWT(secret string, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	msg := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(msg))
+	return msg + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func TestJWT(t *testing.T) {
+	exp := time.Now().Add(time.Minute).Unix()
+	valid := signJWT("secret", map[string]interface{}{
+		"sub": "foo", "exp": exp, "remotes": []string{"^127.0.0.1:"},
+	})
+	for _, test := range []struct {
+		name   string
+		auth   string
+		bearer string
+		ok     bool
+	}{
+		{"password", "foo:" + valid, "", true},
+		{"header", "", valid, true},
+		{"wrong secret", "foo:" + signJWT("wrong", map[string]interface{}{
+			"sub": "foo", "exp": exp, "remotes": []string{""},
+		}), "", false},
+		{"expired", "foo:" + signJWT("secret", map[string]interface{}{
+			"sub": "foo", "exp": time.Now().Add(-time.Hour).Unix(), "remotes": []string{""},
+		}), "", false},
+		{"denied remote", "foo:" + signJWT("secret", map[string]interface{}{
+			"sub": "foo", "exp": exp, "remotes": []string{"^10.0.0.1:"},
+		}), "", false},
+	} {
+		tmpPort := availablePort()
+		headers := http.Header{}
+		if test.bearer != "" {
+			headers.Set("Authorization", "Bearer "+test.bearer)
+		}
+		teardown := simpleSetup(t,
+			&chserver.Config{
+				JWT: chserver.JWTConfig{Secret: "secret"},
+			},
+			&chclient.Config{
+				Remotes: []string{tmpPort + ":127.0.0.1:$FILEPORT"},
+				Auth:    test.auth,
+				Headers: headers,
+			})
+		result, err := post("http://localhost:"+tmpPort, "foo")
+		teardown()
+		if test.ok && (err != nil || result != "foo!") {
+			t.Fatalf("%s: expected token to authenticate, got %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("%s: expected token to be rejected", test.name)
+		}
+	}
+}
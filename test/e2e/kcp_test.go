@@ -0,0 +1,37 @@
+package e2e_test
+
+import (
+	"strings"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestKCP(t *testing.T) {
+	tmpPort := availablePort()
+	revPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Reverse: true,
+			KCPPort: availablePort(),
+		},
+		&chclient.Config{
+			Remotes: []string{
+				tmpPort + ":$FILEPORT",
+				"R:" + revPort + ":$FILEPORT",
+			},
+			Transport: "kcp",
+		})
+	defer teardown()
+	body := strings.Repeat("foo", 100000)
+	for _, port := range []string{tmpPort, revPort} {
+		result, err := post("http://localhost:"+port, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != body+"!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/share/cmetrics"
+)
+
+//pingCounter counts the keepalive pings which were replied to
+type pingCounter struct {
+	mut   sync.Mutex
+	pings int
+}
+
+func (p *pingCounter) Counter(string, float64, ...cmetrics.Label) {}
+
+func (p *pingCounter) Gauge(string, float64, ...cmetrics.Label) {}
+
+func (p *pingCounter) Histogram(name string, _ float64, _ ...cmetrics.Label) {
+	if name == "penguin_keepalive_rtt_seconds" {
+		p.mut.Lock()
+		p.pings++
+		p.mut.Unlock()
+	}
+}
+
+func (p *pingCounter) count() int {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.pings
+}
+
+func TestKeepAliveNegotiated(t *testing.T) {
+	serverPings := &pingCounter{}
+	clientPings := &pingCounter{}
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			KeepAlive: 50 * time.Millisecond,
+			Metrics:   serverPings,
+		},
+		&chclient.Config{
+			Remotes:   []string{tmpPort + ":$FILEPORT"},
+			KeepAlive: time.Hour,
+			Metrics:   clientPings,
+		})
+	defer teardown()
+	time.Sleep(500 * time.Millisecond)
+	//the client pings at the server's shorter interval,
+	//and the server sends no pings of its own
+	if n := clientPings.count(); n < 3 {
+		t.Fatalf("expected the client to ping every 50ms, got %d pings", n)
+	}
+	if n := serverPings.count(); n != 0 {
+		t.Fatalf("expected the server not to ping, got %d pings", n)
+	}
+	//the connection is still up
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+//keepAliveSink records the keepalives of a client
+type keepAliveSink struct {
+	mut       sync.Mutex
+	missed    int
+	srtt      float64
+	connected float64
+}
+
+func (k *keepAliveSink) Counter(name string, v float64, _ ...cmetrics.Label) {
+	if name == "penguin_keepalive_missed_total" {
+		k.mut.Lock()
+		k.missed += int(v)
+		k.mut.Unlock()
+	}
+}
+
+func (k *keepAliveSink) Gauge(name string, v float64, _ ...cmetrics.Label) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	switch name {
+	case "penguin_keepalive_srtt_seconds":
+		k.srtt = v
+	case "penguin_client_connected":
+		k.connected = v
+	}
+}
+
+func (k *keepAliveSink) Histogram(string, float64, ...cmetrics.Label) {}
+
+func (k *keepAliveSink) get() (missed int, srtt, connected float64) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	return k.missed, k.srtt, k.connected
+}
+
+//stallingRelay forwards connections to target, until
+//stalled, when it stops forwarding, without closing them
+type stallingRelay struct {
+	stalled int32
+}
+
+func (s *stallingRelay) listen(t *testing.T, port, target string) {
+	l, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			src, err := l.Accept()
+			if err != nil {
+				return
+			}
+			dst, err := net.Dial("tcp", target)
+			if err != nil {
+				src.Close()
+				continue
+			}
+			go s.copy(dst, src)
+			go s.copy(src, dst)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+}
+
+func (s *stallingRelay) copy(dst, src net.Conn) {
+	b := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(b)
+		s.wait()
+		if err != nil {
+			dst.Close()
+			return
+		}
+		if _, err := dst.Write(b[:n]); err != nil {
+			return
+		}
+	}
+}
+
+//wait blocks while the relay is stalled, which
+//also holds back closing the connections
+func (s *stallingRelay) wait() {
+	for atomic.LoadInt32(&s.stalled) == 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepAliveDeadPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := availablePort()
+	startServer(ctx, t, port)
+	relayPort := availablePort()
+	relay := &stallingRelay{}
+	relay.listen(t, relayPort, "127.0.0.1:"+port)
+	sink := &keepAliveSink{}
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:           "http://127.0.0.1:" + relayPort,
+		Remotes:          []string{availablePort() + ":127.0.0.1:1"},
+		KeepAlive:        50 * time.Millisecond,
+		KeepAliveTimeout: 50 * time.Millisecond,
+		KeepAliveMisses:  3,
+		MaxRetryCount:    0,
+		Metrics:          sink,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, srtt, connected := sink.get(); srtt <= 0 || connected != 1 {
+		t.Fatalf("expected a measured RTT while connected, got %f", srtt)
+	}
+	//the server stops replying, but the connection stays open
+	atomic.StoreInt32(&relay.stalled, 1)
+	for i := 0; i < 50; i++ {
+		if _, _, connected := sink.get(); connected == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if missed, _, connected := sink.get(); connected != 0 || missed != 3 {
+		t.Fatalf("expected the server to be declared dead after 3 misses, got %d (connected %f)", missed, connected)
+	}
+}
@@ -0,0 +1,72 @@
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestMASQUE(t *testing.T) {
+	for _, transport := range []string{"quic", "webtransport", "kcp"} {
+		t.Run(transport, func(t *testing.T) {
+			tmpPort := availablePort()
+			quicPort := availablePort()
+			//the server is its own MASQUE relay
+			teardown := simpleSetup(t,
+				&chserver.Config{
+					QUICPort: quicPort,
+					KCPPort:  availablePort(),
+					MASQUE:   true,
+				},
+				&chclient.Config{
+					Remotes:   []string{tmpPort + ":$FILEPORT"},
+					Transport: transport,
+					MASQUE:    "https://127.0.0.1:" + quicPort + "/.well-known/masque/udp/{target_host}/{target_port}/",
+					TLS:       chclient.TLSConfig{SkipVerify: true},
+				})
+			defer teardown()
+			var result string
+			var err error
+			for i := 0; i < 20; i++ {
+				if result, err = post("http://localhost:"+tmpPort, "foo"); err == nil {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != "foo!" {
+				t.Fatalf("expected exclamation mark added")
+			}
+		})
+	}
+}
+
+func TestMASQUEAuth(t *testing.T) {
+	tmpPort := availablePort()
+	quicPort := availablePort()
+	//the relay requires credentials, which the client cannot present
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			QUICPort: quicPort,
+			MASQUE:   true,
+			Auth:     "foo:bar",
+		},
+		&chclient.Config{
+			Remotes:          []string{tmpPort + ":$FILEPORT"},
+			Transport:        "quic",
+			Auth:             "foo:bar",
+			MASQUE:           "https://127.0.0.1:" + quicPort + "/.well-known/masque/udp/{target_host}/{target_port}/",
+			TLS:              chclient.TLSConfig{SkipVerify: true},
+			MaxRetryCount:    1,
+			MaxRetryInterval: time.Millisecond,
+		})
+	defer teardown()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err == nil {
+		t.Fatal("expected the relay to refuse the client")
+	}
+}
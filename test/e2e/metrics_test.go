@@ -0,0 +1,70 @@
+package e2e_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/share/cmetrics"
+)
+
+func TestClientMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "penguin-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "control.sock")
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Control: "unix:" + sock,
+			Metrics: cmetrics.NewPrometheus(),
+		})
+	defer teardown()
+	//close the stream, which counts its bytes
+	c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := c.Post("http://localhost:"+tmpPort, "text/plain", strings.NewReader("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	control := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	metrics := ""
+	for i := 0; i < 20; i++ {
+		resp, err := control.Get("http://control/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if metrics = string(b); strings.Contains(metrics, "penguin_remote_sent_bytes_total") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, expected := range []string{
+		"penguin_client_connected 1\n",
+		"penguin_client_connections_total 1\n",
+		`penguin_remote_sent_bytes_total{remote="`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Fatalf("expected %q in metrics, got:\n%s", expected, metrics)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package e2e_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/share/oidc"
+)
+
+//fakeIdP is an OpenID Connect provider which approves
+//device logins on the second poll
+func fakeIdP(t *testing.T) *httptest.Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	pad := func(n *big.Int) []byte {
+		b := n.Bytes()
+		return append(make([]byte, 32-len(b)), b...)
+	}
+	mux := http.NewServeMux()
+	idp := httptest.NewServer(mux)
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]string{
+			"issuer":                        idp.URL,
+			"device_authorization_endpoint": idp.URL + "/device",
+			"token_endpoint":                idp.URL + "/token",
+			"jwks_uri":                      idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "EC", "kid": "k1", "crv": "P-256", "x": b64(pad(key.X)), "y": b64(pad(key.Y)),
+		}}})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]interface{}{
+			"device_code": "dev", "user_code": "ABCD-EFGH",
+			"verification_uri": idp.URL + "/activate", "expires_in": 60, "interval": 0,
+		})
+	})
+	polls := 0
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if polls++; polls < 2 {
+			writeJSON(w, 400, map[string]string{"error": "authorization_pending"})
+			return
+		}
+		h, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1"})
+		c, _ := json.Marshal(map[string]interface{}{
+			"iss": idp.URL, "sub": "alice", "aud": r.FormValue("client_id"),
+			"exp": time.Now().Add(time.Hour).Unix(), "remotes": []string{""},
+		})
+		msg := b64(h) + "." + b64(c)
+		d := sha256.Sum256([]byte(msg))
+		sr, ss, _ := ecdsa.Sign(rand.Reader, key, d[:])
+		writeJSON(w, 200, map[string]interface{}{
+			"access_token": "access", "id_token": msg + "." + b64(append(pad(sr), pad(ss)...)),
+			"expires_in": 3600,
+		})
+	})
+	return idp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := fakeIdP(t)
+	defer idp.Close()
+	prompted := false
+	login := &oidc.Login{
+		Issuer:   idp.URL,
+		ClientID: "penguin",
+		Scope:    "openid",
+		Prompt:   func(uri, code string) { prompted = true },
+	}
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			JWT: chserver.JWTConfig{OIDCIssuer: idp.URL, Audience: "penguin"},
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Token:   login.Token,
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+	if !prompted {
+		t.Fatal("expected the user to be prompted")
+	}
+}
+
+func TestOIDCNoAudience(t *testing.T) {
+	idp := fakeIdP(t)
+	defer idp.Close()
+	//any ID token of the provider would be accepted
+	_, err := chserver.NewServer(&chserver.Config{
+		JWT: chserver.JWTConfig{OIDCIssuer: idp.URL},
+	})
+	if err == nil {
+		t.Fatal("expected --oidc-issuer without an audience to fail")
+	}
+}
@@ -0,0 +1,36 @@
+package e2e_test
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestPadding(t *testing.T) {
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Padding: 10 * time.Millisecond,
+		})
+	defer teardown()
+	//payloads larger than the largest bucket are split
+	b := make([]byte, 64*1024)
+	rand.Read(b)
+	for _, body := range []string{"foo", hex.EncodeToString(b)} {
+		result, err := post("http://localhost:"+tmpPort, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != body+"!" {
+			t.Fatalf("payload corrupted (got %d bytes, expected %d)", len(result), len(body)+1)
+		}
+		//dummy messages flow in between
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,117 @@
+package e2e_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	chshare "github.com/myzhang1029/penguin/share"
+)
+
+func TestWsPath(t *testing.T) {
+	tmpPort := availablePort()
+	//setup server, client, fileserver
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			WsPath: "/updates/v2",
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			WsPath:  "updates/v2",
+		})
+	defer teardown()
+	//test remote
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestWsPathMismatch(t *testing.T) {
+	tmpPort := availablePort()
+	//setup server, client, fileserver
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			WsPath: "/updates/v2",
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+		})
+	defer teardown()
+	//the client listens, but the tunnel is never established
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err == nil {
+		t.Fatal("expected the upgrade to be refused")
+	}
+}
+
+func TestWsProtocol(t *testing.T) {
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Subprotocols: []string{"graphql-ws"},
+		},
+		&chclient.Config{
+			Remotes:     []string{tmpPort + ":$FILEPORT"},
+			Subprotocol: "graphql-ws",
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestWsProtocolMismatch(t *testing.T) {
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Subprotocols: []string{"graphql-ws"},
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+		})
+	defer teardown()
+	//the penguin subprotocol is no longer accepted
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err == nil {
+		t.Fatal("expected the upgrade to be refused")
+	}
+}
+
+func TestProtocolMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := availablePort()
+	server, err := chserver.NewServer(&chserver.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	//a client of a far newer release
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:        "http://127.0.0.1:" + port,
+		Remotes:       []string{availablePort() + ":127.0.0.1:1"},
+		Subprotocol:   "penguin-v99",
+		MaxRetryCount: 0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//is told which protocols the server supports
+	err = client.Wait()
+	if err == nil || !strings.Contains(err.Error(), "server supports protocols "+chshare.ProtocolVersion) {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package e2e_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestPollFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//fileserver (fake endpoint)
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(append(b, '!'))
+	}))
+	defer files.Close()
+	server, err := chserver.NewServer(&chserver.Config{KeySeed: "poll", Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Debug = debug
+	port := availablePort()
+	if err := server.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	//a middlebox which refuses websockets by dropping the upgrade
+	target, _ := url.Parse("http://127.0.0.1:" + port)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Del("Upgrade")
+		r.Header.Del("Connection")
+	}
+	proxy.FlushInterval = -1
+	middlebox := httptest.NewServer(proxy)
+	defer middlebox.Close()
+	tmpPort := availablePort()
+	revPort := availablePort()
+	fileAddr := strings.TrimPrefix(files.URL, "http://")
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:      middlebox.URL,
+		Fingerprint: server.GetFingerprint(),
+		Remotes: []string{
+			tmpPort + ":" + fileAddr,
+			"R:" + revPort + ":" + fileAddr,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Debug = debug
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitSessions(t, server, 1)
+	for _, port := range []string{tmpPort, revPort} {
+		result, err := post("http://localhost:"+port, strings.Repeat("foo", 100000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != strings.Repeat("foo", 100000)+"!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+	cancel()
+	client.Wait()
+	server.Wait()
+}
@@ -0,0 +1,68 @@
+package e2e_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	headers := make(chan []byte, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		//signature, version and family, length
+		//and the IPv4 addresses and ports
+		b := make([]byte, 16+12)
+		io.ReadFull(conn, b)
+		headers <- b
+		io.Copy(conn, conn)
+	}()
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Reverse: true},
+		&chclient.Config{
+			Remotes: []string{"R:127.0.0.1:" + tmpPort + ":" + backend.Addr().String() + "?proxyproto=true"},
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("hi"))
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hi" {
+		t.Fatalf("expected the data to follow the header, got %q", b)
+	}
+	h := <-headers
+	if !bytes.Equal(h[:12], []byte("\r\n\r\n\x00\r\nQUIT\n")) || h[12] != 0x21 || h[13] != 0x11 {
+		t.Fatalf("expected a PROXY v2 header of TCP over IPv4, got %x", h[:14])
+	}
+	src := conn.LocalAddr().(*net.TCPAddr)
+	if !net.IP(h[16:20]).Equal(src.IP) || int(binary.BigEndian.Uint16(h[24:26])) != src.Port {
+		t.Fatalf("expected the source %s, got %s:%d", src, net.IP(h[16:20]), binary.BigEndian.Uint16(h[24:26]))
+	}
+	if strconv.Itoa(int(binary.BigEndian.Uint16(h[26:28]))) != tmpPort {
+		t.Fatalf("expected the destination port %s", tmpPort)
+	}
+}
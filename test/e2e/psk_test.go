@@ -0,0 +1,167 @@
+package e2e_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestPsk(t *testing.T) {
+	tmpPort := availablePort()
+	//setup server, client, fileserver
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Psk: "secret",
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Psk:     "secret",
+		})
+	defer teardown()
+	//test remote
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestPskIncorrect(t *testing.T) {
+	tmpPort := availablePort()
+	//setup server, client, fileserver
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Psk: "secret",
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Psk:     "guess",
+		})
+	defer teardown()
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err == nil {
+		t.Fatal("expected the upgrade to be refused")
+	}
+}
+
+func TestPskRotation(t *testing.T) {
+	tmpPort := availablePort()
+	//setup server, client, fileserver
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Psks: []string{"old", "new"},
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Psk:     "new",
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestPskFile(t *testing.T) {
+	pskFile, err := ioutil.TempFile("", "psk*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(pskFile.Name())
+	if _, err := pskFile.WriteString("# rotated in\nsecret\n\nold\n"); err != nil {
+		t.Fatal(err)
+	}
+	pskFile.Close()
+	tmpPort := availablePort()
+	//setup server, client, fileserver
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			PskFile: pskFile.Name(),
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Psk:     "secret",
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestPskTransports(t *testing.T) {
+	for _, transport := range []string{"cookie", "query"} {
+		t.Run(transport, func(t *testing.T) {
+			tmpPort := availablePort()
+			//setup server, client, fileserver
+			teardown := simpleSetup(t,
+				&chserver.Config{
+					Psk: "secret",
+				},
+				&chclient.Config{
+					Remotes:      []string{tmpPort + ":$FILEPORT"},
+					Psk:          "secret",
+					PskTransport: transport,
+				})
+			defer teardown()
+			result, err := post("http://localhost:"+tmpPort, "foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != "foo!" {
+				t.Fatalf("expected exclamation mark added")
+			}
+		})
+	}
+}
+
+func TestPskPath(t *testing.T) {
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Psk:     "secret",
+			PskPath: true,
+		},
+		&chclient.Config{
+			Remotes:      []string{tmpPort + ":$FILEPORT"},
+			Psk:          "secret",
+			PskPath:      true,
+			PskTransport: "query",
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestPskPathMissing(t *testing.T) {
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Psk:     "secret",
+			PskPath: true,
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Psk:     "secret",
+		})
+	defer teardown()
+	//the server URL's path is not derived from the PSK
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err == nil {
+		t.Fatal("expected the upgrade to be refused")
+	}
+}
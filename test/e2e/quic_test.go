@@ -0,0 +1,113 @@
+package e2e_test
+
+import (
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestQUIC(t *testing.T) {
+	tmpPort := availablePort()
+	revPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Reverse:  true,
+			QUICPort: availablePort(),
+		},
+		&chclient.Config{
+			Remotes: []string{
+				tmpPort + ":$FILEPORT",
+				"R:" + revPort + ":$FILEPORT",
+			},
+			Transport: "quic",
+		})
+	defer teardown()
+	for _, port := range []string{tmpPort, revPort} {
+		var result string
+		var err error
+		//the reverse remote is bound once connected
+		for i := 0; i < 20; i++ {
+			if result, err = post("http://localhost:"+port, "foo"); err == nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "foo!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+}
+
+func TestQUICReconnect(t *testing.T) {
+	tmpPort := availablePort()
+	conf := testLayout{
+		server: &chserver.Config{
+			QUICPort: availablePort(),
+		},
+		client: &chclient.Config{
+			Remotes:       []string{tmpPort + ":$FILEPORT"},
+			Transport:     "quic",
+			MaxRetryCount: -1,
+		},
+		fileServer: true,
+	}
+	server, _, teardown := conf.setup(t)
+	defer teardown()
+	waitSessions(t, server, 1)
+	//the reconnection resumes the TLS session, in 0-RTT
+	server.KillSession(server.Sessions()[0].ID)
+	var result string
+	var err error
+	for i := 0; i < 50; i++ {
+		sessions := server.Sessions()
+		if len(sessions) == 1 && sessions[0].ID == 2 {
+			result, err = post("http://localhost:"+tmpPort, "foo")
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestQUICProxy(t *testing.T) {
+	_, err := chclient.NewClient(&chclient.Config{
+		Server:    "http://localhost:8443",
+		Proxy:     "http://localhost:3128",
+		Transport: "quic",
+	})
+	if err == nil {
+		t.Fatal("expected an error for QUIC through a proxy")
+	}
+}
+
+func TestWebTransport(t *testing.T) {
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			QUICPort: availablePort(),
+			Psks:     []string{"secret"},
+		},
+		&chclient.Config{
+			Remotes:   []string{tmpPort + ":$FILEPORT"},
+			Psk:       "secret",
+			Transport: "webtransport",
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
@@ -0,0 +1,58 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "penguin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	quotaFile := filepath.Join(dir, "quota.json")
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Auth:      "foo:bar",
+			Quota:     100,
+			QuotaFile: quotaFile,
+		},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Auth:    "foo:bar",
+		})
+	//the first request uses up the quota
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil || result != "foo!" {
+		teardown()
+		t.Fatalf("expected the first request to succeed, got %v", err)
+	}
+	//in a new stream
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err == nil {
+		teardown()
+		t.Fatal("expected the second request to be refused")
+	}
+	teardown()
+	//usage is saved on shutdown
+	var usage map[string]int64
+	for i := 0; i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if b, err := ioutil.ReadFile(quotaFile); err == nil && json.Unmarshal(b, &usage) == nil {
+			break
+		}
+	}
+	if usage["foo"] < 100 {
+		t.Fatalf("expected the usage of foo to be saved, got %v", usage)
+	}
+}
@@ -0,0 +1,85 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestRemoteRate(t *testing.T) {
+	echoPort, closer := namedEcho(t, "")
+	defer closer()
+	tmpPort := availablePort()
+	//500KB/s each way
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":127.0.0.1:" + echoPort + "?rate=4mbps"},
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	const size = 500 * 1000
+	t0 := time.Now()
+	go conn.Write(make([]byte, size))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	//less the burst of a tenth of a second
+	if d := time.Since(t0); d < 800*time.Millisecond {
+		t.Fatalf("expected the transfer to be throttled, took %s", d)
+	}
+}
+
+func TestRemoteMaxConns(t *testing.T) {
+	echoPort, closer := namedEcho(t, "echo:")
+	defer closer()
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Reverse: true},
+		&chclient.Config{
+			Remotes: []string{"R:" + tmpPort + ":127.0.0.1:" + echoPort + "?maxconns=1"},
+		})
+	defer teardown()
+	ping := func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("hi")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, len("echo:hi")))
+		return err
+	}
+	first, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(first); err != nil {
+		t.Fatal(err)
+	}
+	second, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := ping(second); err == nil {
+		t.Fatal("expected the second connection to be refused")
+	}
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	third, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if err := ping(third); err != nil {
+		t.Fatalf("expected a connection once the first closed: %s", err)
+	}
+}
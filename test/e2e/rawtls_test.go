@@ -0,0 +1,50 @@
+package e2e_test
+
+import (
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestRawTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cert bool
+	}{
+		{"self-signed", false},
+		{"cert", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpPort := availablePort()
+			revPort := availablePort()
+			server := &chserver.Config{
+				Reverse:    true,
+				RawTLSPort: availablePort(),
+			}
+			client := &chclient.Config{
+				Remotes: []string{
+					tmpPort + ":$FILEPORT",
+					"R:" + revPort + ":$FILEPORT",
+				},
+				Transport: "tls",
+			}
+			if tc.cert {
+				server.TLS.Key = "tls/server-crt/server.key"
+				server.TLS.Cert = "tls/server-crt/server.crt"
+				client.TLS.SkipVerify = true
+			}
+			teardown := simpleSetup(t, server, client)
+			defer teardown()
+			for _, port := range []string{tmpPort, revPort} {
+				result, err := post("http://localhost:"+port, "foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result != "foo!" {
+					t.Fatalf("expected exclamation mark added")
+				}
+			}
+		})
+	}
+}
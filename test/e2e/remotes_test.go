@@ -0,0 +1,138 @@
+package e2e_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestAddRemotes(t *testing.T) {
+	tmpPort := availablePort()
+	conf := testLayout{
+		server: &chserver.Config{
+			Reverse: true,
+		},
+		client: &chclient.Config{
+			Remotes: []string{"R:" + tmpPort + ":$FILEPORT"},
+		},
+		fileServer: true,
+	}
+	_, client, teardown := conf.setup(t)
+	defer teardown()
+	//occupy a port so that the transaction fails
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, busyPort, _ := net.SplitHostPort(busy.Addr().String())
+	fwdPort := availablePort()
+	revPort := availablePort()
+	err = client.AddRemotes(
+		"127.0.0.1:"+fwdPort+":"+tmpPort,
+		"R:127.0.0.1:"+revPort+":"+tmpPort,
+		"127.0.0.1:"+busyPort+":"+tmpPort,
+	)
+	if err == nil {
+		t.Fatal("expected port conflict")
+	}
+	//nothing should have been bound
+	if _, err := post("http://localhost:"+fwdPort, "foo"); err == nil {
+		t.Fatal("expected forward remote to be rolled back")
+	}
+	if _, err := post("http://localhost:"+revPort, "foo"); err == nil {
+		t.Fatal("expected reverse remote to be rolled back")
+	}
+	if n := len(client.Remotes()); n != 1 {
+		t.Fatalf("expected 1 remote, got %d", n)
+	}
+	//now without the conflict
+	err = client.AddRemotes(
+		"127.0.0.1:"+fwdPort+":"+tmpPort,
+		"R:127.0.0.1:"+revPort+":"+tmpPort,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []string{fwdPort, revPort} {
+		result, err := post("http://localhost:"+port, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "foo!" {
+			t.Fatalf("expected exclamation mark added")
+		}
+	}
+	//and remove them again
+	err = client.RemoveRemotes(
+		"127.0.0.1:"+fwdPort+":"+tmpPort,
+		"R:127.0.0.1:"+revPort+":"+tmpPort,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//existing streams are left open, so don't reuse them
+	http.DefaultClient.CloseIdleConnections()
+	if _, err := post("http://localhost:"+fwdPort, "foo"); err == nil {
+		t.Fatal("expected forward remote to be removed")
+	}
+	if _, err := post("http://localhost:"+revPort, "foo"); err == nil {
+		t.Fatal("expected reverse remote to be removed")
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "penguin-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "control.sock")
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			Control: "unix:" + sock,
+		})
+	defer teardown()
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	fwdPort := availablePort()
+	req, _ := http.NewRequest(http.MethodPost, "http://control/remotes",
+		strings.NewReader(`["127.0.0.1:`+fwdPort+`:`+tmpPort+`"]`))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the remote to be added, got %s", resp.Status)
+	}
+	if result, err := post("http://localhost:"+fwdPort, "foo"); err != nil || result != "foo!" {
+		t.Fatalf("expected the added remote to work, got %v", err)
+	}
+	resp, err = c.Get("http://control/remotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remotes []string
+	json.NewDecoder(resp.Body).Decode(&remotes)
+	resp.Body.Close()
+	if len(remotes) != 2 {
+		t.Fatalf("expected 2 remotes, got %v", remotes)
+	}
+}
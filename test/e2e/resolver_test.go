@@ -0,0 +1,81 @@
+package e2e_test
+
+import (
+	"net"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//dnsServer answers every A query with 127.0.0.1
+func dnsServer(t *testing.T) (addr string, closer func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var m dnsmessage.Message
+			if m.Unpack(b[:n]) != nil || len(m.Questions) != 1 {
+				continue
+			}
+			m.Response = true
+			if q := m.Questions[0]; q.Type == dnsmessage.TypeA {
+				m.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				}}
+			}
+			reply, _ := m.Pack()
+			conn.WriteTo(reply, from)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestDNSServer(t *testing.T) {
+	addr, closer := dnsServer(t)
+	defer closer()
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{DNS: addr},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":penguin.invalid:$FILEPORT"},
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
+
+func TestDNSNone(t *testing.T) {
+	tmpPort1 := availablePort()
+	tmpPort2 := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{DNS: "none"},
+		&chclient.Config{
+			Remotes: []string{
+				tmpPort1 + ":127.0.0.1:$FILEPORT",
+				tmpPort2 + ":localhost:$FILEPORT",
+			},
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort1, "foo")
+	if err != nil || result != "foo!" {
+		t.Fatalf("expected IP addresses to be dialed, got %v", err)
+	}
+	if _, err := post("http://localhost:"+tmpPort2, "foo"); err == nil {
+		t.Fatal("expected hostnames to be refused")
+	}
+}
@@ -0,0 +1,86 @@
+package e2e_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestResume(t *testing.T) {
+	//every connection is cut within a second
+	os.Setenv("PENGUIN_FAULTS", "error-after=1s")
+	defer os.Unsetenv("PENGUIN_FAULTS")
+	echoPort, closer := namedEcho(t, "echo:")
+	defer closer()
+	tmpPort := availablePort()
+	conf := testLayout{
+		server: &chserver.Config{
+			Resume: 10 * time.Second,
+		},
+		client: &chclient.Config{
+			Resume:  10 * time.Second,
+			Remotes: []string{tmpPort + ":127.0.0.1:" + echoPort},
+		},
+	}
+	server, _, teardown := conf.setup(t)
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitSessions(t, server, 1)
+	id := server.Sessions()[0].ID
+	//the forwarded connection outlives several cuts
+	for i := 0; i < 30; i++ {
+		msg := fmt.Sprintf("ping %d", i)
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len("echo:"+msg))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		if string(b) != "echo:"+msg {
+			t.Fatalf("expected '%s', got '%s'", "echo:"+msg, b)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].ID != id {
+		t.Fatalf("expected the session to be resumed")
+	}
+}
+
+func TestResumeDisabled(t *testing.T) {
+	tmpPort := availablePort()
+	//the client falls back to sessions which are not resumed
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Resume:  10 * time.Second,
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+		})
+	defer teardown()
+	var result string
+	var err error
+	for i := 0; i < 20; i++ {
+		if result, err = post("http://localhost:"+tmpPort, "foo"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+}
@@ -0,0 +1,51 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestDialRetries(t *testing.T) {
+	//the target starts listening after
+	//the connection to the remote
+	targetPort := availablePort()
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":127.0.0.1:" + targetPort + "?retries=5"},
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(300 * time.Millisecond)
+	l, err := net.Listen("tcp", "127.0.0.1:"+targetPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("late"))
+	}()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "late" {
+		t.Fatalf("expected late, got %q", b)
+	}
+}
@@ -0,0 +1,71 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"golang.org/x/sys/unix"
+)
+
+//openPty opens a pseudo terminal, whose
+//device stands for a serial device
+func openPty(t *testing.T) (master *os.File, device string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("cannot open pseudo terminals: %s", err)
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master, "/dev/pts/" + strconv.Itoa(n)
+}
+
+func TestSerial(t *testing.T) {
+	master, device := openPty(t)
+	defer master.Close()
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Serial: true},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":serial:" + device + "?baud=115200"},
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//raw mode passes the bytes through unchanged
+	if _, err := conn.Write([]byte("AT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	master.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(master, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "AT\r\n" {
+		t.Fatalf("expected 'AT\\r\\n', got %q", b)
+	}
+	if _, err := master.Write([]byte("OK\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "OK\r\n" {
+		t.Fatalf("expected 'OK\\r\\n', got %q", b)
+	}
+}
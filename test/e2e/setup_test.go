@@ -71,7 +71,20 @@ func (tl *testLayout) setup(t *testing.T) (server *chserver.Server, client *chcl
 	}()
 	//client (with defaults)
 	tl.client.Fingerprint = server.GetFingerprint()
-	if tl.server.TLS.Key != "" {
+	if tl.client.Transport == "quic" || tl.client.Transport == "webtransport" {
+		port = tl.server.QUICPort
+	} else if tl.client.Transport == "tls" {
+		port = tl.server.RawTLSPort
+	} else if tl.client.Transport == "kcp" {
+		port = tl.server.KCPPort
+	}
+	if tl.client.Transport == "icmp" {
+		tl.client.Server = "http://127.0.0.1"
+	} else if tl.client.Transport == "dns" {
+		//the server is the resolver of its own zone
+		tl.client.Server = "http://" + tl.server.DNSZone
+		tl.client.DNSResolver = "127.0.0.1:" + tl.server.DNSPort
+	} else if tl.server.TLS.Key != "" {
 		//the domain name has to be localhost to match the ssl cert
 		tl.client.Server = "https://localhost:" + port
 	} else {
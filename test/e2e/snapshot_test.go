@@ -0,0 +1,205 @@
+package e2e_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	chshare "github.com/myzhang1029/penguin/share"
+)
+
+//restoreSession restores the session of snap, with the
+//test file server as the target of its remotes. It returns
+//the admin API address of the restored server.
+func restoreSession(t *testing.T, snap *chserver.SessionSnapshot) (string, func()) {
+	listen := func(proto string) string {
+		if proto == "udp" {
+			return availableUDPPort()
+		}
+		return availablePort()
+	}
+	server, remotes, err := snap.Restore(listen, func(proto string) string {
+		if proto == "udp" {
+			return "127.0.0.1:" + availableUDPPort()
+		}
+		return "127.0.0.1:$FILEPORT"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Admin = "127.0.0.1:" + availablePort()
+	conf := testLayout{
+		server:     server,
+		client:     &chclient.Config{Remotes: remotes},
+		fileServer: true,
+	}
+	_, _, teardown := conf.setup(t)
+	return conf.server.Admin, teardown
+}
+
+//getSnapshots fetches the sessions from the admin API,
+//waiting a bit for the client to connect
+func getSnapshots(admin string) ([]*chserver.SessionSnapshot, error) {
+	for i := 0; i < 20; i++ {
+		snaps, err := fetchSnapshots(admin)
+		if err != nil || len(snaps) > 0 {
+			return snaps, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, errors.New("no sessions")
+}
+
+func fetchSnapshots(admin string) ([]*chserver.SessionSnapshot, error) {
+	resp, err := http.Get("http://" + admin + "/sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	snaps := []*chserver.SessionSnapshot{}
+	if err := json.NewDecoder(resp.Body).Decode(&snaps); err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	tmpPort := availablePort()
+	admin := "127.0.0.1:" + availablePort()
+	conf := testLayout{
+		server: &chserver.Config{
+			Reverse: true,
+			Admin:   admin,
+		},
+		client: &chclient.Config{
+			Remotes: []string{
+				tmpPort + ":$FILEPORT",
+				"R:" + availablePort() + ":$FILEPORT",
+			},
+		},
+		fileServer: true,
+	}
+	_, _, teardown := conf.setup(t)
+	defer teardown()
+	//generate some traffic
+	if _, err := post("http://localhost:"+tmpPort, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := getSnapshots(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(snaps))
+	}
+	snap := snaps[0]
+	if snap.RequestID == "" {
+		t.Fatalf("expected a request id")
+	}
+	if len(snap.Remotes) != 2 {
+		t.Fatalf("expected 2 remotes, got %v", snap.Remotes)
+	}
+	if snap.Tunnel.Connections == 0 || snap.Tunnel.Sent == 0 || snap.Tunnel.Received == 0 {
+		t.Fatalf("expected traffic counters, got %+v", snap.Tunnel)
+	}
+	//the snapshot survives a JSON round trip
+	b, _ := json.Marshal(snap)
+	restored := &chserver.SessionSnapshot{}
+	if err := json.Unmarshal(b, restored); err != nil {
+		t.Fatal(err)
+	}
+	restoredAdmin, teardown2 := restoreSession(t, restored)
+	defer teardown2()
+	equiv, err := getSnapshots(restoredAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(equiv) != 1 {
+		t.Fatalf("expected 1 restored session, got %d", len(equiv))
+	}
+	if equiv[0].Capabilities != snap.Capabilities {
+		t.Fatalf("expected capabilities %+v, got %+v", snap.Capabilities, equiv[0].Capabilities)
+	}
+	if len(equiv[0].Remotes) != len(snap.Remotes) {
+		t.Fatalf("expected remotes like %v, got %v", snap.Remotes, equiv[0].Remotes)
+	}
+}
+
+func TestSnapshotNegotiated(t *testing.T) {
+	admin := "127.0.0.1:" + availablePort()
+	conf := testLayout{
+		server: &chserver.Config{
+			Admin:     admin,
+			KeepAlive: 25 * time.Second,
+			Compress:  []string{"zstd", "snappy"},
+		},
+		client: &chclient.Config{
+			Remotes:   []string{availablePort() + ":$FILEPORT"},
+			KeepAlive: 5 * time.Second,
+			Compress:  []string{"snappy"},
+		},
+		fileServer: true,
+	}
+	_, _, teardown := conf.setup(t)
+	defer teardown()
+	snaps, err := getSnapshots(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the session reports what the client settled on,
+	//rather than the defaults of the server
+	expected := chserver.SessionCapabilities{
+		Protocol:  chshare.ProtocolVersion,
+		KeepAlive: 5 * time.Second,
+		Compress:  "snappy",
+	}
+	if snaps[0].Capabilities != expected {
+		t.Fatalf("expected capabilities %+v, got %+v", expected, snaps[0].Capabilities)
+	}
+}
+
+func TestKillSession(t *testing.T) {
+	admin := "127.0.0.1:" + availablePort()
+	conf := testLayout{
+		server: &chserver.Config{
+			Admin: admin,
+		},
+		client: &chclient.Config{
+			Remotes:       []string{availablePort() + ":$FILEPORT"},
+			MaxRetryCount: -1,
+		},
+		fileServer: true,
+	}
+	_, _, teardown := conf.setup(t)
+	defer teardown()
+	snaps, err := getSnapshots(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := snaps[0].ID
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s/sessions/%d", admin, id), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the session to be disconnected, got %s", resp.Status)
+	}
+	//the client reconnects as a new session
+	for i := 0; i < 20; i++ {
+		if snaps, err = fetchSnapshots(admin); err == nil && len(snaps) == 1 && snaps[0].ID != id {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("expected session %d to be replaced, got %v", id, snaps)
+}
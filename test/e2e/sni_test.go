@@ -0,0 +1,56 @@
+package e2e_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestSNIRemote(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.TLS.ServerName))
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	sniPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Reverse: true},
+		&chclient.Config{
+			Remotes: []string{"R:127.0.0.1:" + sniPort + ":sni?allow=localhost,*.localhost&port=" + u.Port()},
+		})
+	defer teardown()
+	get := func(serverName string) (string, error) {
+		hc := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			},
+			Timeout: 2 * time.Second,
+		}
+		resp, err := hc.Get("https://127.0.0.1:" + sniPort)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+	//the target is named by the client hello
+	b, err := get("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != "hello localhost" {
+		t.Fatalf("expected hello localhost, got %q", b)
+	}
+	//others are refused
+	if _, err := get("example.com"); err == nil {
+		t.Fatalf("expected hosts which are not allowed to be refused")
+	}
+}
@@ -1,5 +1,373 @@
 package e2e_test
 
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"golang.org/x/net/proxy"
+)
+
 //TODO tests for:
 // - SOCKS-client -> [client -> server SOCKS] -> endpoint
 // - SOCKS-client -> [server -> client SOCKS] -> endpoint
+
+func TestListenerSocksAuth(t *testing.T) {
+	echoPort, closer := namedEcho(t, "foo:")
+	defer closer()
+	socksPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true},
+		&chclient.Config{
+			Remotes:           []string{"127.0.0.1:" + socksPort + ":socks"},
+			ListenerSocksAuth: "user:pass",
+		})
+	defer teardown()
+	dial := func(pass string) (net.Conn, error) {
+		d, err := proxy.SOCKS5("tcp", "127.0.0.1:"+socksPort,
+			&proxy.Auth{User: "user", Password: pass}, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Dial("tcp", "127.0.0.1:"+echoPort)
+	}
+	if _, err := dial("wrong"); err == nil {
+		t.Fatal("expected a wrong password to be refused")
+	}
+	//socks4 has no passwords
+	if reply := socks4Connect(t, socksPort, "127.0.0.1:"+echoPort); reply[1] != 91 {
+		t.Fatalf("expected a socks4 request to be refused, got %v", reply)
+	}
+	conn, err := dial("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "foo:hi" {
+		t.Fatalf("expected foo:hi, got %q", b[:n])
+	}
+}
+
+func TestSocks4(t *testing.T) {
+	echoPort, closer := namedEcho(t, "foo:")
+	defer closer()
+	socksPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true},
+		&chclient.Config{
+			Remotes: []string{"127.0.0.1:" + socksPort + ":socks"},
+		})
+	defer teardown()
+	//socks4 by IP, socks4a by host name
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		t.Run(host, func(t *testing.T) {
+			reply, conn := socks4Dial(t, socksPort, net.JoinHostPort(host, echoPort))
+			defer conn.Close()
+			if reply[1] != 90 {
+				t.Fatalf("expected the request to be granted, got %v", reply)
+			}
+			if _, err := conn.Write([]byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 16)
+			n, err := conn.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b[:n]) != "foo:hi" {
+				t.Fatalf("expected foo:hi, got %q", b[:n])
+			}
+		})
+	}
+}
+
+//socks4Connect sends a SOCKS4(a) connect request for
+//target to the socks port, and returns the reply
+func socks4Connect(t *testing.T, socksPort, target string) []byte {
+	reply, conn := socks4Dial(t, socksPort, target)
+	conn.Close()
+	return reply
+}
+
+func socks4Dial(t *testing.T, socksPort, target string) ([]byte, net.Conn) {
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	req := []byte{4, 1, byte(portNum >> 8), byte(portNum)}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(append(req, ip...), "user\x00"...)
+	} else {
+		req = append(append(req, 0, 0, 0, 1), "user\x00"+host+"\x00"...)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+socksPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply, conn
+}
+
+func TestSocksBind(t *testing.T) {
+	socksPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true, Reverse: true},
+		&chclient.Config{
+			Remotes: []string{"127.0.0.1:" + socksPort + ":socks"},
+		})
+	defer teardown()
+	ctrl, err := net.Dial("tcp", "127.0.0.1:"+socksPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(2 * time.Second))
+	//greeting, then BIND expecting a local peer
+	if _, err := ctrl.Write([]byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0 || reply[5] != 1 {
+		t.Fatalf("expected the bind to succeed, got %v", reply)
+	}
+	bound := &net.TCPAddr{IP: net.IP(reply[6:10]), Port: int(binary.BigEndian.Uint16(reply[10:]))}
+	peer, err := net.DialTCP("tcp", nil, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(2 * time.Second))
+	//the second reply names the peer
+	if _, err := io.ReadFull(ctrl, reply[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0 || binary.BigEndian.Uint16(reply[10:]) != uint16(peer.LocalAddr().(*net.TCPAddr).Port) {
+		t.Fatalf("expected the reply to name %s, got %v", peer.LocalAddr(), reply[2:])
+	}
+	if _, err := peer.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctrl.Write([]byte("ho")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, b); err != nil || string(b) != "hi" {
+		t.Fatalf("expected hi, got %q (%v)", b, err)
+	}
+	if _, err := io.ReadFull(peer, b); err != nil || string(b) != "ho" {
+		t.Fatalf("expected ho, got %q (%v)", b, err)
+	}
+}
+
+func TestSocksBindNoReverse(t *testing.T) {
+	socksPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true},
+		&chclient.Config{
+			Remotes: []string{"127.0.0.1:" + socksPort + ":socks"},
+		})
+	defer teardown()
+	ctrl, err := net.Dial("tcp", "127.0.0.1:"+socksPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(2 * time.Second))
+	//BIND listens on the server, which needs --reverse
+	if _, err := ctrl.Write([]byte{5, 1, 0, 5, 2, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 7 {
+		t.Fatalf("expected the bind to be refused, got %v", reply)
+	}
+}
+
+func TestReverseSocksAuth(t *testing.T) {
+	authfile, err := ioutil.TempFile("", "users*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(authfile.Name())
+	authfile.WriteString(`{"foo:bar": {"addrs": ["R:127.0.0.1:*"], "socksauth": true}}`)
+	authfile.Close()
+	echoPort, closer := namedEcho(t, "foo:")
+	defer closer()
+	socksPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{AuthFile: authfile.Name(), Reverse: true},
+		&chclient.Config{
+			Remotes: []string{"R:127.0.0.1:" + socksPort + ":socks?auth=user:pass"},
+			Auth:    "foo:bar",
+		})
+	defer teardown()
+	dial := func(pass string) (net.Conn, error) {
+		d, err := proxy.SOCKS5("tcp", "127.0.0.1:"+socksPort,
+			&proxy.Auth{User: "user", Password: pass}, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Dial("tcp", "127.0.0.1:"+echoPort)
+	}
+	if _, err := dial("wrong"); err == nil {
+		t.Fatal("expected a wrong password to be refused")
+	}
+	conn, err := dial("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	//the user's reverse socks remotes need credentials
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := availablePort()
+	server, err := chserver.NewServer(&chserver.Config{AuthFile: authfile.Name(), Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:        "http://127.0.0.1:" + port,
+		Remotes:       []string{"R:127.0.0.1:" + availablePort() + ":socks"},
+		Auth:          "foo:bar",
+		MaxRetryCount: -1,
+		RetryOn:       "network-only",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Wait(); !errors.Is(err, chclient.ErrAuth) {
+		t.Fatalf("expected the remote to be rejected, got %v", err)
+	}
+}
+
+func TestListenerAllow(t *testing.T) {
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes:       []string{"127.0.0.1:" + tmpPort + ":localhost:$FILEPORT"},
+			ListenerAllow: "10.0.0.0/8",
+		})
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tmpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be refused, got %v", err)
+	}
+}
+
+func TestSocksUDP(t *testing.T) {
+	//udp server echoing datagrams back duplicated
+	echo, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 128)
+		for {
+			n, a, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(append(b[:n], b[:n]...), a)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	socksPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true},
+		&chclient.Config{
+			Remotes: []string{"127.0.0.1:" + socksPort + ":socks"},
+		})
+	defer teardown()
+	ctrl, err := net.Dial("tcp", "127.0.0.1:"+socksPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(2 * time.Second))
+	//greeting, then UDP ASSOCIATE from any address
+	if _, err := ctrl.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0 || reply[5] != 1 {
+		t.Fatalf("expected the association to succeed, got %v", reply)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(binary.BigEndian.Uint16(reply[10:]))}
+	conn, err := net.DialUDP("udp4", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header := []byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(header[8:], uint16(echoAddr.Port))
+	if _, err := conn.Write(append(header, "bazz"...)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 128)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the reply names the echo server as its source
+	if !bytes.Equal(b[:len(header)], header) {
+		t.Fatalf("expected the header of %s, got %v", echoAddr, b[:len(header)])
+	}
+	if s := string(b[len(header):n]); s != "bazzbazz" {
+		t.Fatalf("expected bazzbazz, got %q", s)
+	}
+	//the association ends with the control connection
+	ctrl.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn.Write(append(header, "bazz"...))
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := conn.Read(b); err == nil {
+		t.Fatal("expected no reply after the association ended")
+	}
+}
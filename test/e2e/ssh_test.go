@@ -0,0 +1,55 @@
+package e2e_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/share/settings"
+)
+
+func TestSSHAlgorithms(t *testing.T) {
+	gcm := settings.SSHAlgorithms{
+		Ciphers:      []string{"aes256-gcm@openssh.com"},
+		KeyExchanges: []string{"curve25519-sha256"},
+	}
+	tmpPort := availablePort()
+	conf := testLayout{
+		server: &chserver.Config{
+			SSH: gcm,
+		},
+		client: &chclient.Config{
+			Remotes: []string{tmpPort + ":$FILEPORT"},
+			SSH:     gcm,
+		},
+		fileServer: true,
+	}
+	_, _, teardown := conf.setup(t)
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+	//a client without any of the allowed ciphers cannot connect
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	other, err := chclient.NewClient(&chclient.Config{
+		Server:  conf.client.Server,
+		Remotes: []string{availablePort() + ":127.0.0.1:1"},
+		SSH:     settings.SSHAlgorithms{Ciphers: []string{"aes128-ctr"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Wait(); err == nil || !strings.Contains(err.Error(), "no common algorithm") {
+		t.Fatalf("expected no common algorithm, got %v", err)
+	}
+}
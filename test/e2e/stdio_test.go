@@ -0,0 +1,114 @@
+package e2e_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+//namedEcho echoes back what it reads, prefixed with name
+func namedEcho(t *testing.T, name string) (port string, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 128)
+				for {
+					n, err := conn.Read(b)
+					if err != nil {
+						return
+					}
+					conn.Write(append([]byte(name), b[:n]...))
+				}
+			}()
+		}
+	}()
+	_, port, _ = net.SplitHostPort(l.Addr().String())
+	return port, func() { l.Close() }
+}
+
+func writeFrame(t *testing.T, w io.Writer, index byte, payload string) {
+	frame := []byte{index, 0, 0}
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	if _, err := w.Write(append(frame, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(t *testing.T, r io.Reader) (byte, string) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0], string(payload)
+}
+
+func TestStdioFramed(t *testing.T) {
+	fooPort, fooCloser := namedEcho(t, "foo:")
+	defer fooCloser()
+	barPort, barCloser := namedEcho(t, "bar:")
+	defer barCloser()
+	//the client frames stdin and stdout
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdinR, stdoutW
+	defer func() {
+		os.Stdin, os.Stdout = stdin, stdout
+		stdinW.Close()
+		stdoutR.Close()
+	}()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{
+				"stdio:127.0.0.1:" + fooPort,
+				"stdio:127.0.0.1:" + barPort,
+			},
+		})
+	defer teardown()
+	os.Stdin, os.Stdout = stdin, stdout
+	stdoutR.SetReadDeadline(time.Now().Add(5 * time.Second))
+	writeFrame(t, stdinW, 1, "hello")
+	if index, payload := readFrame(t, stdoutR); index != 1 || payload != "bar:hello" {
+		t.Fatalf("expected bar:hello on stream 1, got %q on %d", payload, index)
+	}
+	writeFrame(t, stdinW, 0, "world")
+	if index, payload := readFrame(t, stdoutR); index != 0 || payload != "foo:world" {
+		t.Fatalf("expected foo:world on stream 0, got %q on %d", payload, index)
+	}
+	//closing a stream is acknowledged
+	writeFrame(t, stdinW, 1, "")
+	if index, payload := readFrame(t, stdoutR); index != 1 || payload != "" {
+		t.Fatalf("expected stream 1 to close, got %q on %d", payload, index)
+	}
+	//unknown streams are refused
+	writeFrame(t, stdinW, 2, "nobody")
+	if index, payload := readFrame(t, stdoutR); index != 2 || payload != "" {
+		t.Fatalf("expected stream 2 to be refused, got %q on %d", payload, index)
+	}
+}
@@ -0,0 +1,59 @@
+package e2e_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestTLSOrigination(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.TLS.ServerName))
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifiedPort := availablePort()
+	insecurePort := availablePort()
+	untrustedPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Reverse: true},
+		&chclient.Config{
+			Remotes: []string{
+				"R:" + verifiedPort + ":" + u.Host + "?tls=true&servername=example.com&ca=" + ca,
+				insecurePort + ":" + u.Host + "?tls=true&insecure=true",
+				untrustedPort + ":" + u.Host + "?tls=true",
+			},
+		})
+	defer teardown()
+	//plain HTTP reaches the TLS server
+	for port, expected := range map[string]string{
+		verifiedPort: "hello example.com",
+		insecurePort: "hello ",
+	} {
+		resp, err := http.Get("http://127.0.0.1:" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != expected {
+			t.Fatalf("expected %q, got %q", expected, b)
+		}
+	}
+	//its certificate is verified
+	if _, err := http.Get("http://127.0.0.1:" + untrustedPort); err == nil {
+		t.Fatalf("expected an untrusted certificate to be refused")
+	}
+}
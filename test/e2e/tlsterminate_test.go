@@ -0,0 +1,46 @@
+package e2e_test
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestTLSTermination(t *testing.T) {
+	echoPort, closer := namedEcho(t, "echo:")
+	defer closer()
+	tlsPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			Reverse: true,
+			RemoteTLS: chserver.RemoteTLSConfig{
+				Certs: []string{"tls/server-crt/server.crt"},
+				Keys:  []string{"tls/server-crt/server.key"},
+			},
+		},
+		&chclient.Config{
+			Remotes: []string{"R:127.0.0.1:" + tlsPort + ":127.0.0.1:" + echoPort + "?terminate=true"},
+		})
+	defer teardown()
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+tlsPort, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	//the echo server receives the plaintext
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len("echo:hi"))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "echo:hi" {
+		t.Fatalf("expected echo:hi, got %q", b)
+	}
+}
@@ -0,0 +1,36 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+func TestTransparentNotRedirected(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("transparent proxies are only supported on Linux")
+	}
+	proxyPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Socks5: true},
+		&chclient.Config{
+			Remotes: []string{proxyPort + ":tproxy"},
+		})
+	defer teardown()
+	//the destination of a direct connection is the
+	//listener, which must not be dialed in a loop
+	conn, err := net.Dial("tcp", "127.0.0.1:"+proxyPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be refused, got %v", err)
+	}
+}
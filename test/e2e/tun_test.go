@@ -0,0 +1,37 @@
+package e2e_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/share/cnet"
+)
+
+func TestTun(t *testing.T) {
+	dev, err := cnet.OpenTun("pgtest0")
+	if err != nil {
+		t.Skipf("cannot create TUN devices: %s", err)
+	}
+	dev.Close()
+	teardown := simpleSetup(t,
+		&chserver.Config{Tun: true},
+		&chclient.Config{
+			Remotes: []string{"tun:pgtest1:pgtest2"},
+		})
+	for _, name := range []string{"pgtest1", "pgtest2"} {
+		if _, err := net.InterfaceByName(name); err != nil {
+			t.Errorf("expected device %s: %s", name, err)
+		}
+	}
+	teardown()
+	//the devices are removed with the tunnel
+	time.Sleep(100 * time.Millisecond)
+	for _, name := range []string{"pgtest1", "pgtest2"} {
+		if _, err := net.InterfaceByName(name); err == nil {
+			t.Errorf("expected device %s to be removed", name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package e2e_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/tunnelkit"
+)
+
+func TestTunnelkit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//server
+	server, err := chserver.NewServer(&chserver.Config{Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := availablePort()
+	if err := server.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	//endpoint only the server can see (in this test, any local port)
+	endpoint, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(endpoint, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("endpoint"))
+	}))
+	defer endpoint.Close()
+	tun, err := tunnelkit.Connect(ctx, tunnelkit.Config{
+		Server:      "http://127.0.0.1:" + port,
+		Fingerprint: server.GetFingerprint(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	//dial through the tunnel
+	client := &http.Client{Transport: &http.Transport{DialContext: tun.DialContext}}
+	resp, err := client.Get("http://" + endpoint.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "endpoint" {
+		t.Fatalf("unexpected response %q", b)
+	}
+	//listen through the tunnel
+	listenPort := availablePort()
+	l, err := tun.Listen("tcp", "127.0.0.1:"+listenPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(append(b, '!'))
+	}))
+	result, err := post("http://127.0.0.1:"+listenPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+	//closing the listener releases the server port
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	http.DefaultClient.CloseIdleConnections()
+	if _, err := post("http://127.0.0.1:"+listenPort, "foo"); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("expected server port to be released, got %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	chclient "github.com/myzhang1029/penguin/client"
 	chserver "github.com/myzhang1029/penguin/server"
+	"github.com/myzhang1029/penguin/share/tunnel"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -73,6 +74,71 @@ func TestUDP(t *testing.T) {
 	}
 }
 
+func TestUDPMaxFlows(t *testing.T) {
+	echoPort := availableUDPPort()
+	a, _ := net.ResolveUDPAddr("udp", ":"+echoPort)
+	l, err := net.ListenUDP("udp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		b := make([]byte, 128)
+		for {
+			n, a, err := l.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			l.WriteTo(b[:n], a)
+		}
+	}()
+	inboundPort := availableUDPPort()
+	teardown := simpleSetup(t,
+		&chserver.Config{
+			UDP: tunnel.UDPConfig{
+				IdleTimeout: 500 * time.Millisecond,
+				MaxFlows:    1,
+			},
+		},
+		&chclient.Config{
+			Remotes: []string{
+				inboundPort + ":" + echoPort + "/udp",
+			},
+		},
+	)
+	defer teardown()
+	echo := func(conn net.Conn, msg string) bool {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 128)
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, err := conn.Read(b)
+		return err == nil && string(b[:n]) == msg
+	}
+	first, err := net.Dial("udp4", "localhost:"+inboundPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.Dial("udp4", "localhost:"+inboundPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if !echo(first, "foo") {
+		t.Fatal("expected the first flow to be relayed")
+	}
+	if echo(second, "bar") {
+		t.Fatal("expected the second flow to be dropped")
+	}
+	//the first flow is closed once idle
+	time.Sleep(time.Second)
+	if !echo(second, "bar") {
+		t.Fatal("expected the second flow to be relayed")
+	}
+}
+
 func availableUDPPort() string {
 	a, _ := net.ResolveUDPAddr("udp", ":0")
 	l, err := net.ListenUDP("udp", a)
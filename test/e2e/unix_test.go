@@ -0,0 +1,82 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+//unixEcho is namedEcho on the unix socket at path
+func unixEcho(t *testing.T, path, name string) (closer func()) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("cannot listen on unix sockets: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 128)
+				for {
+					n, err := conn.Read(b)
+					if err != nil {
+						return
+					}
+					conn.Write(append([]byte(name), b[:n]...))
+				}
+			}()
+		}
+	}()
+	return func() { l.Close() }
+}
+
+func TestUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.sock")
+	defer unixEcho(t, target, "unix:")()
+	echoPort, closer := namedEcho(t, "tcp:")
+	defer closer()
+	tcpPort := availablePort()
+	listener := filepath.Join(dir, "listener.sock")
+	teardown := simpleSetup(t,
+		&chserver.Config{Unix: true},
+		&chclient.Config{
+			Remotes: []string{
+				tcpPort + ":unix:" + target,
+				"unix:" + listener + ":127.0.0.1:" + echoPort,
+			},
+		})
+	defer teardown()
+	for _, test := range []struct {
+		network, addr, expected string
+	}{
+		{"tcp", "127.0.0.1:" + tcpPort, "unix:ping"},
+		{"unix", listener, "tcp:ping"},
+	} {
+		conn, err := net.Dial(test.network, test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(test.expected))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("%s: %s", test.addr, err)
+		}
+		conn.Close()
+		if string(b) != test.expected {
+			t.Fatalf("expected '%s', got '%s'", test.expected, b)
+		}
+	}
+}
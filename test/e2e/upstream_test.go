@@ -0,0 +1,82 @@
+package e2e_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	chserver "github.com/myzhang1029/penguin/server"
+)
+
+//connectProxy is an HTTP CONNECT proxy
+//which records the addresses it tunnels to
+func connectProxy(t *testing.T) (addr string, targets func() []string, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mut sync.Mutex
+	var seen []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				mut.Lock()
+				seen = append(seen, req.Host)
+				mut.Unlock()
+				dst, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer dst.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(dst, conn)
+				io.Copy(conn, dst)
+			}()
+		}
+	}()
+	targets = func() []string {
+		mut.Lock()
+		defer mut.Unlock()
+		return append([]string(nil), seen...)
+	}
+	return l.Addr().String(), targets, func() { l.Close() }
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	addr, targets, closer := connectProxy(t)
+	defer closer()
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{Upstream: "http://" + addr},
+		&chclient.Config{
+			Remotes: []string{tmpPort + ":localhost:$FILEPORT"},
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added")
+	}
+	//the hostname is left to the proxy
+	seen := targets()
+	if len(seen) != 1 || !strings.HasPrefix(seen[0], "localhost:") {
+		t.Fatalf("expected a CONNECT to localhost, got %v", seen)
+	}
+}
@@ -0,0 +1,134 @@
+//Package tunnelkit lets Go programs use a penguin server
+//without running a penguin client or any local listeners:
+//connections are dialed, and listeners are served, through
+//a client connection which is managed (and reconnected)
+//in the background.
+//
+//	t, err := tunnelkit.Connect(ctx, tunnelkit.Config{
+//		Server:      "https://penguin.example.com",
+//		Auth:        "user:pass",
+//		Fingerprint: "...",
+//	})
+//	...
+//	client := &http.Client{
+//		Transport: &http.Transport{DialContext: t.DialContext},
+//	}
+//	resp, err := client.Get("http://intranet.internal/")
+package tunnelkit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	chclient "github.com/myzhang1029/penguin/client"
+	"github.com/myzhang1029/penguin/share/cio"
+)
+
+//Config of a Tunnel
+type Config struct {
+	//Server is the URL of the penguin server
+	Server string
+	//Auth is the "<user>:<pass>" to authenticate with
+	Auth string
+	//Fingerprint of the server's key, strongly recommended
+	Fingerprint string
+	//Psk is the server's WebSocket pre-shared key
+	Psk string
+	//Headers are sent with every connection attempt
+	Headers http.Header
+	//KeepAlive interval, defaults to 25s. Negative disables it.
+	KeepAlive time.Duration
+	//MaxRetryInterval between reconnects, defaults to 5m
+	MaxRetryInterval time.Duration
+	TLS              TLSConfig
+	//Verbose enables info logging
+	Verbose bool
+	//Logger, if set, receives the logs instead of stderr
+	Logger *cio.Logger
+	//Dial, if set, connects to the server (or its proxy)
+	//instead of net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+//TLSConfig for connecting to a server over https
+type TLSConfig struct {
+	SkipVerify bool
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+}
+
+//Tunnel is a managed connection to a penguin server
+type Tunnel struct {
+	client *chclient.Client
+}
+
+//Connect starts connecting to the server in the background
+//and returns immediately. Dials and listens block until the
+//connection is up. Cancelling ctx closes the tunnel.
+func Connect(ctx context.Context, c Config) (*Tunnel, error) {
+	keepAlive := c.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = 25 * time.Second
+	} else if keepAlive < 0 {
+		keepAlive = 0
+	}
+	client, err := chclient.NewClient(&chclient.Config{
+		Server:           c.Server,
+		Auth:             c.Auth,
+		Fingerprint:      c.Fingerprint,
+		Psk:              c.Psk,
+		Headers:          c.Headers,
+		KeepAlive:        keepAlive,
+		MaxRetryCount:    -1,
+		MaxRetryInterval: c.MaxRetryInterval,
+		TLS: chclient.TLSConfig{
+			SkipVerify: c.TLS.SkipVerify,
+			CA:         c.TLS.CA,
+			Cert:       c.TLS.Cert,
+			Key:        c.TLS.Key,
+			ServerName: c.TLS.ServerName,
+		},
+		Verbose: c.Verbose,
+		Logger:  c.Logger,
+		Dial:    c.Dial,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Start(ctx); err != nil {
+		return nil, err
+	}
+	return &Tunnel{client: client}, nil
+}
+
+//Dial connects to addr through the server, see DialContext
+func (t *Tunnel) Dial(network, addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), network, addr)
+}
+
+//DialContext connects to addr as seen from the server. It has
+//the signature of net.Dialer.DialContext, so it can be used in
+//an http.Transport, for example. Only TCP is supported, and the
+//returned connections do not support deadlines.
+func (t *Tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return t.client.DialContext(ctx, network, addr)
+}
+
+//Listen asks the server to listen on addr (a TCP address on
+//the server) and returns a listener for the connections it
+//receives. The server must allow reverse tunneling, and the
+//address must be allowed for the user.
+func (t *Tunnel) Listen(network, addr string) (net.Listener, error) {
+	return t.client.Listen(network, addr)
+}
+
+//Close disconnects from the server and waits for the
+//background connection to stop
+func (t *Tunnel) Close() error {
+	t.client.Close()
+	return t.client.Wait()
+}